@@ -11,6 +11,16 @@ BUILD_NUMBER=${GITHUB_RUN_NUMBER:-0}
 # Set the ldflags
 LDFLAGS="-X 'github.com/ploycloud/ploy-server-cli/cmd.BuildNumber=${BUILD_NUMBER}'"
 
+# Releases are signed with an ed25519 key in PEM format. Its public key is built into
+# the binary so `ploy update` can verify the checksums of the next release.
+SIGNING_KEY=${PLOY_SIGNING_KEY:-}
+if [ -n "$SIGNING_KEY" ]; then
+    PUBLIC_KEY=$(openssl pkey -in "$SIGNING_KEY" -pubout -outform DER | tail -c 32 | base64)
+    LDFLAGS="${LDFLAGS} -X 'github.com/ploycloud/ploy-server-cli/src/utils.UpdatePublicKey=${PUBLIC_KEY}'"
+else
+    echo "PLOY_SIGNING_KEY is not set, building without update verification: 'ploy update' will be disabled."
+fi
+
 # Create or recreate the build folder
 BUILD_DIR="build"
 rm -rf "$BUILD_DIR"
@@ -59,4 +69,9 @@ else
 fi
 cd ..
 
+# Sign the checksums
+if [ -n "$SIGNING_KEY" ] && [ -f "${BUILD_DIR}/checksums.txt" ]; then
+    openssl pkeyutl -sign -rawin -inkey "$SIGNING_KEY" -in "${BUILD_DIR}/checksums.txt" | base64 -w0 > "${BUILD_DIR}/checksums.txt.sig"
+fi
+
 echo "Build completed successfully. Artifacts are in the '$BUILD_DIR' directory."
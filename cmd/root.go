@@ -2,9 +2,11 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/ploycloud/ploy-server-cli/src/commands"
 	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
 	"github.com/spf13/cobra"
 )
 
@@ -13,18 +15,65 @@ var rootCmd = &cobra.Command{
 	Short:   "Ploy CLI - Manage your cloud deployments",
 	Long:    `Ploy CLI is a powerful tool for managing and deploying your cloud applications. You are using ploy version: ` + common.CurrentCliVersion,
 	Version: common.CurrentCliVersion,
+	// Errors are printed by main, which exits with the code that matches them
+	SilenceErrors: true,
+	SilenceUsage:  true,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		started = true
+		if runner.DryRun {
+			fmt.Fprintln(runner.Out, "Dry run: printing the planned changes, nothing is changed on this server")
+		}
+		notifyUpdate = commands.StartUpdateNotifier(cmd)
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		notifyUpdate()
+	},
 }
 
+// notifyUpdate prints the new version notice once the command is done
+var notifyUpdate = func() {}
+
+// started is set once a command is about to run, after its arguments and flags
+// were accepted
+var started bool
+
+// Execute runs the command line. Errors raised before the command runs, such as
+// unknown commands, flags or a wrong number of arguments, are usage errors.
 func Execute() error {
-	return rootCmd.Execute()
+	started = false
+	cmd, err := rootCmd.ExecuteC()
+	if err != nil && !started {
+		fmt.Fprintf(os.Stderr, "Run '%s --help' for usage.\n", cmd.CommandPath())
+		return commands.UsageError(err)
+	}
+	return err
 }
 
 func init() {
+	rootCmd.PersistentFlags().BoolVar(&runner.DryRun, "dry-run", false,
+		"Print the commands that would run and the files that would be written, without changing anything")
+	rootCmd.PersistentFlags().BoolVar(&runner.Debug, "debug", os.Getenv("PLOY_DEBUG") != "",
+		"Trace every command ploy runs with its exit status and duration (or set PLOY_DEBUG=1)")
+	rootCmd.PersistentFlags().DurationVar(&runner.Timeout, "timeout", runner.Timeout,
+		"Stop commands that change the system, such as docker compose up, after this long")
+
 	rootCmd.AddCommand(commands.DeployCmd)
 	rootCmd.AddCommand(commands.ListCmd)
-	rootCmd.AddCommand(commands.StatusCmd)
+	rootCmd.AddCommand(commands.DoctorCmd)
 	rootCmd.AddCommand(commands.ServicesCmd)
 	rootCmd.AddCommand(commands.SitesCmd)
+	rootCmd.AddCommand(commands.ApplyCmd)
+	rootCmd.AddCommand(commands.CertsCmd)
+	rootCmd.AddCommand(commands.NginxCmd)
+	rootCmd.AddCommand(commands.ProxyCmd)
+	rootCmd.AddCommand(commands.AutoscaleCmd)
+	rootCmd.AddCommand(commands.MonitorCmd)
+	rootCmd.AddCommand(commands.TopCmd)
+	rootCmd.AddCommand(commands.MetricsCmd)
+	rootCmd.AddCommand(commands.AgentCmd)
+	rootCmd.AddCommand(commands.JobsCmd)
+	rootCmd.AddCommand(commands.ServerCmd)
+	rootCmd.AddCommand(commands.FirewallCmd)
 	rootCmd.AddCommand(commands.WpCmd)
 	rootCmd.AddCommand(commands.StartCmd)
 	rootCmd.AddCommand(commands.StopCmd)
@@ -33,6 +82,7 @@ func init() {
 	rootCmd.AddCommand(commands.LogsCmd)
 	rootCmd.AddCommand(commands.UpdateCmd)
 	rootCmd.AddCommand(commands.EchoCmd)
+	rootCmd.AddCommand(commands.RootHelperCmd)
 
 	// Add a custom version command
 	rootCmd.AddCommand(
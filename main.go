@@ -4,14 +4,16 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/fatih/color"
 	"github.com/ploycloud/ploy-server-cli/cmd"
+	"github.com/ploycloud/ploy-server-cli/src/commands"
 )
 
 var osExit = os.Exit
 
 func main() {
 	if err := cmd.Execute(); err != nil {
-		fmt.Println(err)
-		osExit(1)
+		fmt.Fprintln(os.Stderr, color.RedString("Error: %v", err))
+		osExit(commands.ExitCode(err))
 	}
 }
@@ -5,7 +5,6 @@ import (
 	"strings"
 	"testing"
 
-	"github.com/ploycloud/ploy-server-cli/cmd"
 	"github.com/ploycloud/ploy-server-cli/src/commands"
 	"github.com/ploycloud/ploy-server-cli/src/common"
 	"github.com/stretchr/testify/assert"
@@ -51,7 +50,19 @@ func TestMain(t *testing.T) {
 			name:           "Invalid command",
 			args:           []string{"ploy", "invalidcommand"},
 			expectedOutput: "unknown command \"invalidcommand\" for \"ploy\"",
-			expectedExit:   1,
+			expectedExit:   2,
+		},
+		{
+			name:           "Missing argument",
+			args:           []string{"ploy", "echo"},
+			expectedOutput: "Run 'ploy echo --help' for usage.",
+			expectedExit:   2,
+		},
+		{
+			name:           "Unknown site",
+			args:           []string{"ploy", "sites", "health", "missing.example.com"},
+			expectedOutput: "site not found: missing.example.com",
+			expectedExit:   3,
 		},
 	}
 
@@ -68,10 +79,7 @@ func TestMain(t *testing.T) {
 						}
 					}
 				}()
-				err := cmd.Execute()
-				if err != nil {
-					osExit(1)
-				}
+				main()
 			})
 
 			t.Logf("Full output:\n%s", output)
@@ -0,0 +1,320 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/jobs"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBackend records the calls it receives
+type fakeBackend struct {
+	calls []string
+	sites map[string]Site
+	jobs  []jobs.Job
+}
+
+func (b *fakeBackend) find(host string) (Site, error) {
+	site, ok := b.sites[host]
+	if !ok {
+		return Site{}, fmt.Errorf("%s: %w", host, registry.ErrNotFound)
+	}
+	return site, nil
+}
+
+func (b *fakeBackend) Status(ctx context.Context) (Status, error) {
+	return Status{Version: "v1.2.3", Services: map[string]bool{"mysql": true}}, nil
+}
+
+func (b *fakeBackend) Sites(ctx context.Context) ([]Site, error) {
+	var sites []Site
+	for _, s := range b.sites {
+		sites = append(sites, s)
+	}
+	return sites, nil
+}
+
+func (b *fakeBackend) Site(ctx context.Context, host string) (Site, error) { return b.find(host) }
+
+func (b *fakeBackend) CreateSite(ctx context.Context, req SiteRequest) (Site, error) {
+	if req.Domain == "" {
+		return Site{}, fmt.Errorf("%w: domain is required", ErrBadRequest)
+	}
+	b.calls = append(b.calls, "create "+req.Domain)
+	site := Site{Domain: req.Domain, Type: req.Type, Replicas: req.Replicas}
+	b.sites[req.Domain] = site
+	return site, nil
+}
+
+func (b *fakeBackend) DeleteSite(ctx context.Context, host string) error {
+	b.calls = append(b.calls, "delete "+host)
+	_, err := b.find(host)
+	return err
+}
+
+func (b *fakeBackend) StartSite(ctx context.Context, host string) error {
+	b.calls = append(b.calls, "start "+host)
+	return nil
+}
+
+func (b *fakeBackend) StopSite(ctx context.Context, host string) error {
+	b.calls = append(b.calls, "stop "+host)
+	return nil
+}
+
+func (b *fakeBackend) Deploy(ctx context.Context, host string, req DeployRequest) error {
+	b.calls = append(b.calls, "deploy "+host+" "+req.Repo)
+	return nil
+}
+
+func (b *fakeBackend) Backup(ctx context.Context, host string) (Backup, error) {
+	if _, err := b.find(host); err != nil {
+		return Backup{}, err
+	}
+	return Backup{Site: host, Path: "/backups/" + host + ".tar.gz", Size: 42}, nil
+}
+
+func (b *fakeBackend) Jobs(ctx context.Context) ([]jobs.Job, error) { return b.jobs, nil }
+
+func (b *fakeBackend) Job(ctx context.Context, id string) (jobs.Job, error) {
+	for _, job := range b.jobs {
+		if job.ID == id {
+			return job, nil
+		}
+	}
+	return jobs.Job{}, fmt.Errorf("%s: %w", id, jobs.ErrNotFound)
+}
+
+func (b *fakeBackend) Enqueue(ctx context.Context, req JobRequest) (jobs.Job, error) {
+	job := jobs.Job{ID: fmt.Sprintf("job-%d", len(b.jobs)), Type: req.Type, Site: req.Site, State: jobs.Queued, Params: req.Params}
+	b.jobs = append(b.jobs, job)
+	return job, nil
+}
+
+func (b *fakeBackend) CancelJob(ctx context.Context, id string) (jobs.Job, error) {
+	job, err := b.Job(ctx, id)
+	if err != nil {
+		return job, err
+	}
+	if job.State.Done() {
+		return job, fmt.Errorf("%s: %w", id, jobs.ErrFinished)
+	}
+	job.State = jobs.Canceled
+	return job, nil
+}
+
+func (b *fakeBackend) JobLog(ctx context.Context, id string, offset int64) ([]byte, error) {
+	if _, err := b.Job(ctx, id); err != nil {
+		return nil, err
+	}
+	log := []byte("==> dump database\n==> write archive\n")
+	if offset > int64(len(log)) {
+		offset = int64(len(log))
+	}
+	return log[offset:], nil
+}
+
+func newTestAgent(t *testing.T) (*fakeBackend, *Client) {
+	backend := &fakeBackend{sites: map[string]Site{"shop.com": {Domain: "shop.com", Replicas: 2}}}
+	server := httptest.NewServer(NewHandler(backend, "secret"))
+	t.Cleanup(server.Close)
+	return backend, NewClient(server.URL, "secret")
+}
+
+func TestClientServer(t *testing.T) {
+	backend, client := newTestAgent(t)
+	ctx := context.Background()
+
+	status, err := client.Status(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.2.3", status.Version)
+	assert.True(t, status.Services["mysql"])
+
+	site, err := client.CreateSite(ctx, SiteRequest{Type: "wp", Domain: "blog.com", Replicas: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, "blog.com", site.Domain)
+
+	sites, err := client.Sites(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, sites, 2)
+
+	site, err = client.Site(ctx, "shop.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, site.Replicas)
+
+	assert.NoError(t, client.StopSite(ctx, "shop.com"))
+	assert.NoError(t, client.StartSite(ctx, "shop.com"))
+	assert.NoError(t, client.Deploy(ctx, "shop.com", DeployRequest{Repo: "https://example.com/repo.git"}))
+	assert.NoError(t, client.DeleteSite(ctx, "blog.com"))
+
+	backup, err := client.Backup(ctx, "shop.com")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), backup.Size)
+
+	assert.Equal(t, []string{
+		"create blog.com", "stop shop.com", "start shop.com",
+		"deploy shop.com https://example.com/repo.git", "delete blog.com",
+	}, backend.calls)
+}
+
+func TestJobs(t *testing.T) {
+	backend, client := newTestAgent(t)
+	ctx := context.Background()
+
+	job, err := client.Enqueue(ctx, JobRequest{Type: jobs.TypeDeploy, Site: "shop.com", Params: []byte(`{"repo":"https://example.com/repo.git"}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, jobs.Queued, job.State)
+	assert.JSONEq(t, `{"repo":"https://example.com/repo.git"}`, string(job.Params))
+
+	list, err := client.Jobs(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	job, err = client.CancelJob(ctx, job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, jobs.Canceled, job.State)
+
+	log, err := client.JobLog(ctx, job.ID, 18)
+	assert.NoError(t, err)
+	assert.Equal(t, "==> write archive\n", string(log))
+
+	backend.jobs[0].State = jobs.Succeeded
+	_, err = client.CancelJob(ctx, job.ID)
+	if apiErr, ok := err.(*APIError); assert.True(t, ok) {
+		assert.Equal(t, http.StatusConflict, apiErr.StatusCode)
+	}
+	_, err = client.JobLog(ctx, "missing", 0)
+	if apiErr, ok := err.(*APIError); assert.True(t, ok) {
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	_, client := newTestAgent(t)
+	ctx := context.Background()
+
+	_, err := client.Site(ctx, "missing.com")
+	if apiErr, ok := err.(*APIError); assert.True(t, ok) {
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+		assert.Contains(t, apiErr.Message, "site not found")
+	}
+
+	_, err = client.CreateSite(ctx, SiteRequest{Type: "wp"})
+	if apiErr, ok := err.(*APIError); assert.True(t, ok) {
+		assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	}
+
+	client.token = "wrong"
+	_, err = client.Status(ctx)
+	if apiErr, ok := err.(*APIError); assert.True(t, ok) {
+		assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+	}
+}
+
+func TestRejectsMalformedRequests(t *testing.T) {
+	server := httptest.NewServer(NewHandler(&fakeBackend{}, "secret"))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/v1/sites", strings.NewReader(`{"domain": "x.com", "colour": "red"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	req, _ = http.NewRequest(http.MethodGet, server.URL+"/v1/status", nil)
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestUnixSocket(t *testing.T) {
+	// Socket paths are limited in length, so avoid the long default temp dir
+	dir, err := os.MkdirTemp("/tmp", "ploy-agent")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	addr := "unix://" + filepath.Join(dir, "run", "agent.sock")
+
+	l, err := Listen(addr)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- Serve(ctx, l, NewHandler(&fakeBackend{}, "secret")) }()
+
+	info, err := os.Stat(filepath.Join(dir, "run", "agent.sock"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+
+	status, err := NewClient(addr, "secret").Status(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.2.3", status.Version)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not shut down")
+	}
+}
+
+func TestListenRefusesPublicAddresses(t *testing.T) {
+	_, err := Listen("0.0.0.0:7070")
+	assert.Error(t, err)
+	_, err = Listen("203.0.113.10:7070")
+	assert.Error(t, err)
+
+	l, err := Listen("127.0.0.1:0")
+	assert.NoError(t, err)
+	l.Close()
+}
+
+func TestToken(t *testing.T) {
+	oldServicesDir := common.ServicesDir
+	common.SetServicesDir(t.TempDir())
+	defer common.SetServicesDir(oldServicesDir)
+
+	_, err := LoadToken()
+	assert.Error(t, err)
+
+	token, err := LoadOrCreateToken()
+	assert.NoError(t, err)
+	assert.Len(t, token, 64)
+
+	again, err := LoadOrCreateToken()
+	assert.NoError(t, err)
+	assert.Equal(t, token, again)
+
+	info, err := os.Stat(TokenPath())
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	rotated, err := RotateToken()
+	assert.NoError(t, err)
+	assert.NotEqual(t, token, rotated)
+
+	t.Setenv("PLOY_AGENT_TOKEN", "from-env")
+	token, err = LoadToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "from-env", token)
+}
+
+func TestUnit(t *testing.T) {
+	unit, err := Unit("/usr/local/bin/ploy", "ploy", "/home/ploy", DefaultSocket)
+	assert.NoError(t, err)
+	assert.Contains(t, unit, "ExecStart=/usr/local/bin/ploy agent run --listen unix:///run/ploy/agent.sock")
+	assert.Contains(t, unit, "User=ploy")
+	assert.Contains(t, unit, "Environment=HOME=/home/ploy")
+	assert.Contains(t, unit, "WantedBy=multi-user.target")
+}
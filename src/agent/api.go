@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/health"
+)
+
+// SiteRequest creates a site. Fields match the flags of `ploy sites new`.
+type SiteRequest struct {
+	Type        string       `json:"type"`
+	Domain      string       `json:"domain"`
+	Hostname    string       `json:"hostname,omitempty"`
+	SiteID      string       `json:"site_id,omitempty"`
+	PHPVersion  string       `json:"php_version,omitempty"`
+	DBSource    string       `json:"db_source"`
+	DBHost      string       `json:"db_host,omitempty"`
+	DBPort      string       `json:"db_port,omitempty"`
+	DBName      string       `json:"db_name,omitempty"`
+	DBUser      string       `json:"db_user,omitempty"`
+	DBPassword  string       `json:"db_password,omitempty"`
+	ScalingType string       `json:"scaling_type"`
+	Replicas    int          `json:"replicas"`
+	MaxReplicas int          `json:"max_replicas,omitempty"`
+	HealthCheck health.Check `json:"health_check"`
+	TLS         bool         `json:"tls,omitempty"`
+	Webhook     string       `json:"webhook,omitempty"`
+}
+
+// DeployRequest deploys a repository to a site
+type DeployRequest struct {
+	Repo string `json:"repo"`
+}
+
+// JobRequest queues a job. Params holds the job's request, such as a
+// SiteRequest for site.create or a DeployRequest for site.deploy.
+type JobRequest struct {
+	Type   string          `json:"type"`
+	Site   string          `json:"site"`
+	Params json.RawMessage `json:"params,omitempty"`
+	// CommandID makes the request idempotent: a job is queued only once per ID
+	CommandID string `json:"command_id,omitempty"`
+}
+
+// Site is the state of a site as returned by the API. Database credentials are
+// never included.
+type Site struct {
+	Domain      string         `json:"domain"`
+	Hostname    string         `json:"hostname,omitempty"`
+	SiteID      string         `json:"site_id,omitempty"`
+	Type        string         `json:"type"`
+	PHPVersion  string         `json:"php_version"`
+	ScalingType string         `json:"scaling_type"`
+	Replicas    int            `json:"replicas"`
+	Containers  int            `json:"containers"`
+	Health      *health.Result `json:"health,omitempty"`
+	CreatedAt   time.Time      `json:"created_at"`
+	BackedUpAt  *time.Time     `json:"backed_up_at,omitempty"`
+}
+
+// Backup describes a backup archive written on the server
+type Backup struct {
+	Site      string    `json:"site"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Status is the overall state of the server
+type Status struct {
+	Version  string          `json:"version"`
+	Proxy    string          `json:"proxy"`
+	Services map[string]bool `json:"services"`
+	Sites    []Site          `json:"sites"`
+}
+
+// errorResponse is the body of every failed request
+type errorResponse struct {
+	Error string `json:"error"`
+}
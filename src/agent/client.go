@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ploycloud/ploy-server-cli/src/jobs"
+)
+
+// APIError is an error returned by the agent
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("agent: %s", e.Message)
+}
+
+// Client talks to a running agent
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// NewClient returns a client for an agent listening on addr, which is either
+// unix:///path/to/socket, host:port or an http:// URL
+func NewClient(addr, token string) *Client {
+	c := &Client{token: token, http: &http.Client{}}
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		path := strings.TrimPrefix(addr, "unix://")
+		c.baseURL = "http://agent"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+	case strings.HasPrefix(addr, "http://"), strings.HasPrefix(addr, "https://"):
+		c.baseURL = strings.TrimSuffix(addr, "/")
+	default:
+		c.baseURL = "http://" + addr
+	}
+	return c
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// send performs an authenticated request and turns error responses into an APIError
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the agent: %v", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var e errorResponse
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+			e.Error = resp.Status
+		}
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: e.Error}
+	}
+	return resp, nil
+}
+
+func sitePath(host, action string) string {
+	path := "/v1/sites/" + url.PathEscape(host)
+	if action != "" {
+		path += "/" + action
+	}
+	return path
+}
+
+// Status returns the state of the server
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	var status Status
+	err := c.do(ctx, http.MethodGet, "/v1/status", nil, &status)
+	return status, err
+}
+
+// Sites lists every site
+func (c *Client) Sites(ctx context.Context) ([]Site, error) {
+	var sites []Site
+	err := c.do(ctx, http.MethodGet, "/v1/sites", nil, &sites)
+	return sites, err
+}
+
+// Site returns a single site
+func (c *Client) Site(ctx context.Context, host string) (Site, error) {
+	var site Site
+	err := c.do(ctx, http.MethodGet, sitePath(host, ""), nil, &site)
+	return site, err
+}
+
+// CreateSite creates and starts a site
+func (c *Client) CreateSite(ctx context.Context, req SiteRequest) (Site, error) {
+	var site Site
+	err := c.do(ctx, http.MethodPost, "/v1/sites", req, &site)
+	return site, err
+}
+
+// DeleteSite stops a site and removes it
+func (c *Client) DeleteSite(ctx context.Context, host string) error {
+	return c.do(ctx, http.MethodDelete, sitePath(host, ""), nil, nil)
+}
+
+// StartSite starts a site's containers
+func (c *Client) StartSite(ctx context.Context, host string) error {
+	return c.do(ctx, http.MethodPost, sitePath(host, "start"), nil, nil)
+}
+
+// StopSite stops a site's containers
+func (c *Client) StopSite(ctx context.Context, host string) error {
+	return c.do(ctx, http.MethodPost, sitePath(host, "stop"), nil, nil)
+}
+
+// Deploy deploys a repository to a site
+func (c *Client) Deploy(ctx context.Context, host string, req DeployRequest) error {
+	return c.do(ctx, http.MethodPost, sitePath(host, "deploy"), req, nil)
+}
+
+// Backup backs up a site's files and database
+func (c *Client) Backup(ctx context.Context, host string) (Backup, error) {
+	var backup Backup
+	err := c.do(ctx, http.MethodPost, sitePath(host, "backup"), nil, &backup)
+	return backup, err
+}
+
+// Jobs lists every job
+func (c *Client) Jobs(ctx context.Context) ([]jobs.Job, error) {
+	var list []jobs.Job
+	err := c.do(ctx, http.MethodGet, "/v1/jobs", nil, &list)
+	return list, err
+}
+
+// Job returns a single job
+func (c *Client) Job(ctx context.Context, id string) (jobs.Job, error) {
+	var job jobs.Job
+	err := c.do(ctx, http.MethodGet, "/v1/jobs/"+url.PathEscape(id), nil, &job)
+	return job, err
+}
+
+// Enqueue queues a job and returns without waiting for it to run
+func (c *Client) Enqueue(ctx context.Context, req JobRequest) (jobs.Job, error) {
+	var job jobs.Job
+	err := c.do(ctx, http.MethodPost, "/v1/jobs", req, &job)
+	return job, err
+}
+
+// CancelJob asks the agent to stop a job
+func (c *Client) CancelJob(ctx context.Context, id string) (jobs.Job, error) {
+	var job jobs.Job
+	err := c.do(ctx, http.MethodPost, "/v1/jobs/"+url.PathEscape(id)+"/cancel", nil, &job)
+	return job, err
+}
+
+// JobLog returns a job's log from offset onwards
+func (c *Client) JobLog(ctx context.Context, id string, offset int64) ([]byte, error) {
+	path := fmt.Sprintf("%s/v1/jobs/%s/log?offset=%d", c.baseURL, url.PathEscape(id), offset)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
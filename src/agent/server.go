@@ -0,0 +1,229 @@
+package agent
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/jobs"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+)
+
+// DefaultSocket is where the agent listens unless configured otherwise
+const DefaultSocket = "unix:///run/ploy/agent.sock"
+
+// ErrBadRequest marks errors caused by invalid input, answered with 400
+var ErrBadRequest = errors.New("bad request")
+
+// Backend carries out the operations behind the API
+type Backend interface {
+	Status(ctx context.Context) (Status, error)
+	Sites(ctx context.Context) ([]Site, error)
+	Site(ctx context.Context, host string) (Site, error)
+	CreateSite(ctx context.Context, req SiteRequest) (Site, error)
+	DeleteSite(ctx context.Context, host string) error
+	StartSite(ctx context.Context, host string) error
+	StopSite(ctx context.Context, host string) error
+	Deploy(ctx context.Context, host string, req DeployRequest) error
+	Backup(ctx context.Context, host string) (Backup, error)
+	Jobs(ctx context.Context) ([]jobs.Job, error)
+	Job(ctx context.Context, id string) (jobs.Job, error)
+	Enqueue(ctx context.Context, req JobRequest) (jobs.Job, error)
+	CancelJob(ctx context.Context, id string) (jobs.Job, error)
+	JobLog(ctx context.Context, id string, offset int64) ([]byte, error)
+}
+
+// NewHandler returns the versioned API. Every request must carry the token as a
+// bearer token.
+func NewHandler(backend Backend, token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /v1/status", func(w http.ResponseWriter, r *http.Request) {
+		status, err := backend.Status(r.Context())
+		respond(w, status, err)
+	})
+	mux.HandleFunc("GET /v1/sites", func(w http.ResponseWriter, r *http.Request) {
+		sites, err := backend.Sites(r.Context())
+		respond(w, sites, err)
+	})
+	mux.HandleFunc("POST /v1/sites", func(w http.ResponseWriter, r *http.Request) {
+		var req SiteRequest
+		if err := decode(r, &req); err != nil {
+			respond(w, nil, err)
+			return
+		}
+		site, err := backend.CreateSite(r.Context(), req)
+		respondStatus(w, http.StatusCreated, site, err)
+	})
+	mux.HandleFunc("GET /v1/sites/{host}", func(w http.ResponseWriter, r *http.Request) {
+		site, err := backend.Site(r.Context(), r.PathValue("host"))
+		respond(w, site, err)
+	})
+	mux.HandleFunc("DELETE /v1/sites/{host}", func(w http.ResponseWriter, r *http.Request) {
+		respondStatus(w, http.StatusNoContent, nil, backend.DeleteSite(r.Context(), r.PathValue("host")))
+	})
+	mux.HandleFunc("POST /v1/sites/{host}/start", func(w http.ResponseWriter, r *http.Request) {
+		respondStatus(w, http.StatusNoContent, nil, backend.StartSite(r.Context(), r.PathValue("host")))
+	})
+	mux.HandleFunc("POST /v1/sites/{host}/stop", func(w http.ResponseWriter, r *http.Request) {
+		respondStatus(w, http.StatusNoContent, nil, backend.StopSite(r.Context(), r.PathValue("host")))
+	})
+	mux.HandleFunc("POST /v1/sites/{host}/deploy", func(w http.ResponseWriter, r *http.Request) {
+		var req DeployRequest
+		if err := decode(r, &req); err != nil {
+			respond(w, nil, err)
+			return
+		}
+		respondStatus(w, http.StatusNoContent, nil, backend.Deploy(r.Context(), r.PathValue("host"), req))
+	})
+	mux.HandleFunc("POST /v1/sites/{host}/backup", func(w http.ResponseWriter, r *http.Request) {
+		backup, err := backend.Backup(r.Context(), r.PathValue("host"))
+		respondStatus(w, http.StatusCreated, backup, err)
+	})
+
+	mux.HandleFunc("GET /v1/jobs", func(w http.ResponseWriter, r *http.Request) {
+		list, err := backend.Jobs(r.Context())
+		respond(w, list, err)
+	})
+	mux.HandleFunc("POST /v1/jobs", func(w http.ResponseWriter, r *http.Request) {
+		var req JobRequest
+		if err := decode(r, &req); err != nil {
+			respond(w, nil, err)
+			return
+		}
+		job, err := backend.Enqueue(r.Context(), req)
+		respondStatus(w, http.StatusAccepted, job, err)
+	})
+	mux.HandleFunc("GET /v1/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		job, err := backend.Job(r.Context(), r.PathValue("id"))
+		respond(w, job, err)
+	})
+	mux.HandleFunc("POST /v1/jobs/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		job, err := backend.CancelJob(r.Context(), r.PathValue("id"))
+		respond(w, job, err)
+	})
+	mux.HandleFunc("GET /v1/jobs/{id}/log", func(w http.ResponseWriter, r *http.Request) {
+		var offset int64
+		if value := r.URL.Query().Get("offset"); value != "" {
+			var err error
+			if offset, err = strconv.ParseInt(value, 10, 64); err != nil || offset < 0 {
+				respond(w, nil, fmt.Errorf("%w: invalid offset %q", ErrBadRequest, value))
+				return
+			}
+		}
+		data, err := backend.JobLog(r.Context(), r.PathValue("id"), offset)
+		if err != nil {
+			respond(w, nil, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(data)
+	})
+
+	return authenticate(token, mux)
+}
+
+func authenticate(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ploy"`)
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "invalid or missing token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func decode(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: invalid request body: %v", ErrBadRequest, err)
+	}
+	return nil
+}
+
+func respond(w http.ResponseWriter, v interface{}, err error) {
+	respondStatus(w, http.StatusOK, v, err)
+}
+
+func respondStatus(w http.ResponseWriter, status int, v interface{}, err error) {
+	switch {
+	case errors.Is(err, registry.ErrNotFound), errors.Is(err, jobs.ErrNotFound):
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: err.Error()})
+	case errors.Is(err, ErrBadRequest):
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+	case errors.Is(err, jobs.ErrFinished):
+		writeJSON(w, http.StatusConflict, errorResponse{Error: err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+	case status == http.StatusNoContent:
+		w.WriteHeader(status)
+	default:
+		writeJSON(w, status, v)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Listen opens the agent's listener. Addresses are either unix:///path/to/socket
+// or a loopback host:port; the API is never exposed on public interfaces.
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		// Remove the socket left behind by a previous run
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0660); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("refusing to listen on %s: use a loopback address or a unix socket", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Serve runs the API on l until ctx is cancelled
+func Serve(ctx context.Context, l net.Listener, handler http.Handler) error {
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
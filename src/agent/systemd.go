@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// UnitPath is where the systemd unit of the agent is installed
+const UnitPath = "/etc/systemd/system/ploy-agent.service"
+
+// UnitName is the systemd service name of the agent
+const UnitName = "ploy-agent"
+
+var unitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=Ploy agent
+After=network-online.target docker.service
+Wants=network-online.target
+Requires=docker.service
+
+[Service]
+Type=simple
+User={{ .User }}
+Environment=HOME={{ .Home }}
+ExecStart={{ .Binary }} agent run --listen {{ .Listen }}
+Restart=on-failure
+RestartSec=5
+RuntimeDirectory=ploy
+RuntimeDirectoryPreserve=yes
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// Unit renders the systemd unit running binary as user with the given HOME
+func Unit(binary, user, home, listen string) (string, error) {
+	var buf bytes.Buffer
+	err := unitTemplate.Execute(&buf, struct{ Binary, User, Home, Listen string }{binary, user, home, listen})
+	return buf.String(), err
+}
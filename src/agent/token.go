@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+)
+
+// TokenPath returns the file holding the API token
+func TokenPath() string {
+	return filepath.Join(common.ServicesDir, "agent.token")
+}
+
+// LoadToken returns the API token from $PLOY_AGENT_TOKEN or the token file
+func LoadToken() (string, error) {
+	if token := os.Getenv("PLOY_AGENT_TOKEN"); token != "" {
+		return token, nil
+	}
+	data, err := os.ReadFile(TokenPath())
+	if err != nil {
+		return "", fmt.Errorf("failed to read agent token: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("agent token in %s is empty", TokenPath())
+	}
+	return token, nil
+}
+
+// LoadOrCreateToken returns the API token, generating and storing one on first use
+func LoadOrCreateToken() (string, error) {
+	if token, err := LoadToken(); err == nil {
+		return token, nil
+	} else if _, statErr := os.Stat(TokenPath()); !os.IsNotExist(statErr) {
+		return "", err
+	}
+	return RotateToken()
+}
+
+// RotateToken replaces the API token with a new random one
+func RotateToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	if err := runner.MkdirAll(filepath.Dir(TokenPath()), 0755); err != nil {
+		return "", err
+	}
+	if err := runner.WriteFile(TokenPath(), []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write agent token: %v", err)
+	}
+	return token, nil
+}
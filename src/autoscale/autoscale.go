@@ -0,0 +1,134 @@
+package autoscale
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy holds the thresholds the autoscaler compares container usage against.
+// CPU and memory are percentages as reported by `docker stats`.
+type Policy struct {
+	CPUHigh           float64
+	CPULow            float64
+	MemoryHigh        float64
+	MemoryLow         float64
+	ScaleUpCooldown   time.Duration
+	ScaleDownCooldown time.Duration
+}
+
+// DefaultPolicy returns the thresholds used when none are given
+func DefaultPolicy() Policy {
+	return Policy{
+		CPUHigh:           75,
+		CPULow:            25,
+		MemoryHigh:        80,
+		MemoryLow:         40,
+		ScaleUpCooldown:   3 * time.Minute,
+		ScaleDownCooldown: 10 * time.Minute,
+	}
+}
+
+// Validate checks that the low thresholds sit below the high ones
+func (p Policy) Validate() error {
+	if p.CPULow >= p.CPUHigh {
+		return fmt.Errorf("cpu low threshold (%.0f%%) must be below the high threshold (%.0f%%)", p.CPULow, p.CPUHigh)
+	}
+	if p.MemoryLow >= p.MemoryHigh {
+		return fmt.Errorf("memory low threshold (%.0f%%) must be below the high threshold (%.0f%%)", p.MemoryLow, p.MemoryHigh)
+	}
+	if p.ScaleUpCooldown < 0 || p.ScaleDownCooldown < 0 {
+		return fmt.Errorf("cooldowns must not be negative")
+	}
+	return nil
+}
+
+// Usage is the resource usage of one container, or the average over a site's replicas
+type Usage struct {
+	CPU    float64
+	Memory float64
+}
+
+// ParseStats parses `docker stats --no-stream --format "{{.ID}}\t{{.CPUPerc}}\t{{.MemPerc}}"`
+// output into the usage of each container
+func ParseStats(output string) ([]Usage, error) {
+	var usages []Usage
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected docker stats line %q", line)
+		}
+
+		cpu, err := parsePercent(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		memory, err := parsePercent(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, Usage{CPU: cpu, Memory: memory})
+	}
+	return usages, nil
+}
+
+func parsePercent(value string) (float64, error) {
+	value = strings.TrimSuffix(strings.TrimSpace(value), "%")
+	if value == "" || value == "--" {
+		return 0, nil
+	}
+	percent, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid percentage %q", value)
+	}
+	return percent, nil
+}
+
+// Average returns the mean usage over a site's containers
+func Average(usages []Usage) Usage {
+	var total Usage
+	if len(usages) == 0 {
+		return total
+	}
+	for _, u := range usages {
+		total.CPU += u.CPU
+		total.Memory += u.Memory
+	}
+	n := float64(len(usages))
+	return Usage{CPU: total.CPU / n, Memory: total.Memory / n}
+}
+
+// Decide returns the replica count a site should run, one step away from current
+// at most. A site scales up when CPU or memory is above its high threshold and
+// down when both are below their low thresholds, unless the last scaling happened
+// within the cooldown. A count outside [min, max] is always brought back in range.
+func Decide(p Policy, current, min, max int, usage Usage, lastScaled, now time.Time) int {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	if current < min {
+		return min
+	}
+	if current > max {
+		return max
+	}
+
+	switch {
+	case usage.CPU >= p.CPUHigh || usage.Memory >= p.MemoryHigh:
+		if current < max && now.Sub(lastScaled) >= p.ScaleUpCooldown {
+			return current + 1
+		}
+	case usage.CPU <= p.CPULow && usage.Memory <= p.MemoryLow:
+		if current > min && now.Sub(lastScaled) >= p.ScaleDownCooldown {
+			return current - 1
+		}
+	}
+	return current
+}
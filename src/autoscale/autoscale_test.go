@@ -0,0 +1,74 @@
+package autoscale
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStats(t *testing.T) {
+	output := "abc123\t87.50%\t40.10%\ndef456\t12.50%\t20.90%\nghi789\t--\t--\n"
+
+	usages, err := ParseStats(output)
+	assert.NoError(t, err)
+	assert.Equal(t, []Usage{{CPU: 87.5, Memory: 40.1}, {CPU: 12.5, Memory: 20.9}, {}}, usages)
+
+	avg := Average(usages[:2])
+	assert.InDelta(t, 50.0, avg.CPU, 0.001)
+	assert.InDelta(t, 30.5, avg.Memory, 0.001)
+	assert.Equal(t, Usage{}, Average(nil))
+
+	_, err = ParseStats("abc123 87%")
+	assert.Error(t, err)
+	_, err = ParseStats("abc123\tlots\t1%")
+	assert.Error(t, err)
+
+	usages, err = ParseStats("")
+	assert.NoError(t, err)
+	assert.Empty(t, usages)
+}
+
+func TestDecide(t *testing.T) {
+	p := DefaultPolicy()
+	now := time.Now()
+	longAgo := now.Add(-time.Hour)
+
+	tests := []struct {
+		name       string
+		current    int
+		usage      Usage
+		lastScaled time.Time
+		expected   int
+	}{
+		{"High CPU scales up", 2, Usage{CPU: 90, Memory: 10}, longAgo, 3},
+		{"High memory scales up", 2, Usage{CPU: 10, Memory: 95}, longAgo, 3},
+		{"Scale up capped at max", 4, Usage{CPU: 90}, longAgo, 4},
+		{"Scale up within cooldown", 2, Usage{CPU: 90}, now.Add(-time.Minute), 2},
+		{"Low usage scales down", 3, Usage{CPU: 5, Memory: 10}, longAgo, 2},
+		{"Scale down needs both low", 3, Usage{CPU: 5, Memory: 60}, longAgo, 3},
+		{"Scale down within cooldown", 3, Usage{CPU: 5, Memory: 10}, now.Add(-5 * time.Minute), 3},
+		{"Scale down stops at min", 1, Usage{CPU: 5, Memory: 10}, longAgo, 1},
+		{"Below min is raised", 0, Usage{CPU: 5}, now, 1},
+		{"Above max is lowered", 6, Usage{CPU: 90}, now, 4},
+		{"Steady usage keeps count", 2, Usage{CPU: 50, Memory: 50}, longAgo, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, Decide(p, tt.current, 1, 4, tt.usage, tt.lastScaled, now))
+		})
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	assert.NoError(t, DefaultPolicy().Validate())
+
+	p := DefaultPolicy()
+	p.CPULow = 80
+	assert.Error(t, p.Validate())
+
+	p = DefaultPolicy()
+	p.MemoryHigh = 10
+	assert.Error(t, p.Validate())
+}
@@ -0,0 +1,182 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Names of the entries in a backup archive
+const (
+	FilesPrefix  = "files/"
+	DatabaseFile = "database.sql"
+)
+
+// FileName returns the archive name for a backup of site taken at t
+func FileName(site string, t time.Time) string {
+	return fmt.Sprintf("%s-%s.tar.gz", site, t.UTC().Format("20060102T150405Z"))
+}
+
+// Prune removes all but the newest keep backups of site from dir and returns the
+// paths it removed. Files not named by FileName are left alone.
+func Prune(dir, site string, keep int) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type archive struct {
+		path string
+		at   time.Time
+	}
+	var archives []archive
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(entry.Name(), site+"-")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		at, err := time.Parse("20060102T150405Z.tar.gz", stamp)
+		if err != nil {
+			continue
+		}
+		archives = append(archives, archive{filepath.Join(dir, entry.Name()), at})
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].at.After(archives[j].at) })
+
+	var removed []string
+	for i := keep; i < len(archives); i++ {
+		if err := os.Remove(archives[i].path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, archives[i].path)
+	}
+	return removed, nil
+}
+
+// Create writes a gzipped tarball with the contents of siteDir under files/ and,
+// if given, the database dump read from the file at databasePath as database.sql.
+// The dump is streamed, so it never has to fit in memory. The archive is written
+// to a temporary file first so a failed backup never leaves a partial archive
+// behind. It returns the size of the archive.
+func Create(path, siteDir, databasePath string) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".backup-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp, siteDir, databasePath); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func write(w io.Writer, siteDir, databasePath string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.WalkDir(siteDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(siteDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			// Sockets, pipes and devices cannot be restored meaningfully
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = FilesPrefix + filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %v", siteDir, err)
+	}
+
+	if databasePath != "" {
+		if err := writeDatabase(tw, databasePath); err != nil {
+			return fmt.Errorf("failed to archive the database dump: %v", err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeDatabase(tw *tar.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := &tar.Header{Name: DatabaseFile, Mode: 0600, Size: info.Size(), ModTime: time.Now()}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,102 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readArchive(t *testing.T, path string) map[string]string {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.NoError(t, err)
+
+	entries := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		content, _ := io.ReadAll(tr)
+		entries[header.Name] = string(content)
+	}
+	return entries
+}
+
+func TestCreate(t *testing.T) {
+	siteDir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(siteDir, "wp-content", "uploads"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(siteDir, "site.yml"), []byte("domain: shop.com\n"), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(siteDir, "wp-content", "uploads", "a.jpg"), []byte("jpeg"), 0644))
+	assert.NoError(t, os.Symlink("uploads/a.jpg", filepath.Join(siteDir, "wp-content", "latest.jpg")))
+
+	path := filepath.Join(t.TempDir(), "backups", FileName("shop.com", time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)))
+	assert.Equal(t, "shop.com-20261001T120000Z.tar.gz", filepath.Base(path))
+
+	dump := filepath.Join(t.TempDir(), "dump.sql")
+	assert.NoError(t, os.WriteFile(dump, []byte("CREATE TABLE wp_posts;"), 0600))
+	size, err := Create(path, siteDir, dump)
+	assert.NoError(t, err)
+	assert.NotZero(t, size)
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	entries := readArchive(t, path)
+	assert.Equal(t, "domain: shop.com\n", entries["files/site.yml"])
+	assert.Equal(t, "jpeg", entries["files/wp-content/uploads/a.jpg"])
+	assert.Contains(t, entries, "files/wp-content/uploads/")
+	assert.Contains(t, entries, "files/wp-content/latest.jpg")
+	assert.Equal(t, "CREATE TABLE wp_posts;", entries[DatabaseFile])
+
+	// Only the finished archive is left in the backup directory
+	files, _ := os.ReadDir(filepath.Dir(path))
+	assert.Len(t, files, 1)
+}
+
+func TestCreateFailureLeavesNothing(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Create(filepath.Join(dir, "x.tar.gz"), filepath.Join(dir, "missing"), "")
+	assert.Error(t, err)
+
+	files, _ := os.ReadDir(dir)
+	assert.Empty(t, files)
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2026, 10, 1, 3, 0, 0, 0, time.UTC)
+	for day := 0; day < 4; day++ {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, FileName("shop.com", start.AddDate(0, 0, day))), nil, 0600))
+	}
+	// Backups of other sites and other files are kept
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, FileName("shop.com.au", start)), nil, 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "shop.com-notes.txt"), nil, 0600))
+
+	removed, err := Prune(dir, "shop.com", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "shop.com-20261002T030000Z.tar.gz"),
+		filepath.Join(dir, "shop.com-20261001T030000Z.tar.gz"),
+	}, removed)
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"shop.com-20261003T030000Z.tar.gz", "shop.com-20261004T030000Z.tar.gz",
+		"shop.com-notes.txt", "shop.com.au-20261001T030000Z.tar.gz"}, names)
+}
@@ -0,0 +1,217 @@
+package bootstrap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Step is one idempotent part of preparing a server. Steps can be run on their
+// own and run again at any time.
+type Step struct {
+	Name        string
+	Description string
+	// Done reports whether the step has nothing left to do
+	Done func() (bool, error)
+	// Apply carries out the step
+	Apply func() error
+}
+
+// Outcome is what happened to a step
+type Outcome string
+
+const (
+	// Unchanged steps were already done
+	Unchanged Outcome = "ok"
+	// Applied steps were carried out
+	Applied Outcome = "applied"
+	// Pending steps would be carried out, in check mode
+	Pending Outcome = "pending"
+	// Failed steps could not be checked or carried out
+	Failed Outcome = "failed"
+)
+
+// ErrPending is returned in check mode when a step is not done
+var ErrPending = errors.New("the server is not fully set up")
+
+// Run carries out the steps in order and reports progress to w. It stops at the
+// first step that fails. In check mode nothing is changed, every step is checked
+// and ErrPending is returned when a step is not done.
+func Run(w io.Writer, steps []Step, check bool) error {
+	pending := 0
+	for i, step := range steps {
+		prefix := fmt.Sprintf("[%d/%d] %s", i+1, len(steps), step.Name)
+		outcome, err := runStep(step, check)
+		switch outcome {
+		case Failed:
+			fmt.Fprintf(w, "%s: %s: %v\n", prefix, outcome, err)
+			return fmt.Errorf("step %s failed: %w", step.Name, err)
+		case Pending:
+			pending++
+			fmt.Fprintf(w, "%s: %s, would %s\n", prefix, outcome, step.Description)
+		default:
+			fmt.Fprintf(w, "%s: %s\n", prefix, outcome)
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("%w: %d step(s) pending", ErrPending, pending)
+	}
+	return nil
+}
+
+func runStep(step Step, check bool) (Outcome, error) {
+	done, err := step.Done()
+	if err != nil {
+		return Failed, err
+	}
+	if done {
+		return Unchanged, nil
+	}
+	if check {
+		return Pending, nil
+	}
+	if err := step.Apply(); err != nil {
+		return Failed, err
+	}
+	return Applied, nil
+}
+
+// Select returns the named steps in their original order, or all steps when no
+// names are given
+func Select(steps []Step, names []string) ([]Step, error) {
+	if len(names) == 0 {
+		return steps, nil
+	}
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+	var selected []Step
+	for _, step := range steps {
+		if wanted[step.Name] {
+			selected = append(selected, step)
+			delete(wanted, step.Name)
+		}
+	}
+	if len(wanted) > 0 {
+		var unknown []string
+		for _, name := range names {
+			if wanted[name] {
+				unknown = append(unknown, name)
+			}
+		}
+		return nil, fmt.Errorf("unknown step %s (steps: %s)", strings.Join(unknown, ", "), strings.Join(Names(steps), ", "))
+	}
+	return selected, nil
+}
+
+// Names returns the names of the steps
+func Names(steps []Step) []string {
+	names := make([]string, len(steps))
+	for i, step := range steps {
+		names[i] = step.Name
+	}
+	return names
+}
+
+var upgradedPattern = regexp.MustCompile(`(?m)^(\d+) upgraded`)
+
+// PendingUpgrades returns the number of packages `apt-get -s upgrade` would upgrade
+func PendingUpgrades(output string) int {
+	match := upgradedPattern.FindStringSubmatch(output)
+	if match == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(match[1])
+	return n
+}
+
+// Swap
+const (
+	SwapFile   = "/swapfile"
+	FstabEntry = SwapFile + " none swap sw 0 0"
+)
+
+// Files written by `ploy server init`
+const (
+	SysctlPath             = "/etc/sysctl.d/60-ploy.conf"
+	SudoersPath            = "/etc/sudoers.d/ploy"
+	UnattendedUpgradesPath = "/etc/apt/apt.conf.d/52ploy-unattended-upgrades"
+	AutoUpgradesPath       = "/etc/apt/apt.conf.d/20auto-upgrades"
+)
+
+// DistroUnattendedUpgradesPath is the configuration the unattended-upgrades
+// package ships. Older versions of server init replaced it with their own.
+const DistroUnattendedUpgradesPath = "/etc/apt/apt.conf.d/50unattended-upgrades"
+
+// managedHeader starts the apt configuration files written by `ploy server init`
+const managedHeader = "// Managed by ploy server init"
+
+// ManagedByPloy reports whether an apt configuration file was written by server init
+func ManagedByPloy(content string) bool {
+	return strings.HasPrefix(content, managedHeader)
+}
+
+// Sysctl keeps the kernel from swapping until memory is nearly exhausted
+const Sysctl = `# Managed by ploy server init
+vm.swappiness = 10
+`
+
+// UnattendedUpgrades adds the release and security pockets to the origins unattended-upgrades
+// installs from; apt appends it to the list of the distribution's configuration
+const UnattendedUpgrades = `// Managed by ploy server init
+Unattended-Upgrade::Allowed-Origins {
+	"${distro_id}:${distro_codename}";
+	"${distro_id}:${distro_codename}-security";
+};
+`
+
+const AutoUpgrades = `// Managed by ploy server init
+APT::Periodic::Update-Package-Lists "1";
+APT::Periodic::Unattended-Upgrade "1";
+`
+
+// WithLine returns content with line appended, unless it already has it
+func WithLine(content, line string) string {
+	for _, l := range strings.Split(content, "\n") {
+		if strings.TrimSpace(l) == line {
+			return content
+		}
+	}
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content + line + "\n"
+}
+
+// WithoutLines returns content without the lines matching drop
+func WithoutLines(content string, drop func(line string) bool) string {
+	lines := strings.SplitAfter(content, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !drop(strings.TrimSpace(line)) {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "")
+}
+
+// IsSwappinessTypo matches the misspelt setting older setup scripts appended to /etc/sysctl.conf
+func IsSwappinessTypo(line string) bool {
+	return strings.HasPrefix(line, "vm.sappiness")
+}
+
+// IsBlanketSudo matches a rule that gives user every command without a password
+func IsBlanketSudo(user string) func(line string) bool {
+	return func(line string) bool {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != user {
+			return false
+		}
+		rule := strings.Join(fields[1:], "")
+		return rule == "ALL=(ALL)NOPASSWD:ALL" || rule == "ALL=(ALL:ALL)NOPASSWD:ALL"
+	}
+}
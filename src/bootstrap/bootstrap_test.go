@@ -0,0 +1,114 @@
+package bootstrap
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStep is a step that is done once it has been applied
+func fakeStep(name string, done bool, applyErr error) Step {
+	return Step{
+		Name:        name,
+		Description: "set up " + name,
+		Done:        func() (bool, error) { return done, nil },
+		Apply: func() error {
+			if applyErr == nil {
+				done = true
+			}
+			return applyErr
+		},
+	}
+}
+
+func TestRun(t *testing.T) {
+	steps := []Step{fakeStep("docker", true, nil), fakeStep("swap", false, nil)}
+
+	var out bytes.Buffer
+	assert.NoError(t, Run(&out, steps, false))
+	assert.Equal(t, "[1/2] docker: ok\n[2/2] swap: applied\n", out.String())
+
+	// Running again changes nothing
+	out.Reset()
+	assert.NoError(t, Run(&out, steps, false))
+	assert.Equal(t, "[1/2] docker: ok\n[2/2] swap: ok\n", out.String())
+}
+
+func TestRunCheck(t *testing.T) {
+	steps := []Step{fakeStep("docker", false, nil), fakeStep("swap", true, nil), fakeStep("user", false, nil)}
+
+	var out bytes.Buffer
+	err := Run(&out, steps, true)
+	assert.True(t, errors.Is(err, ErrPending))
+	assert.EqualError(t, err, "the server is not fully set up: 2 step(s) pending")
+	assert.Equal(t, "[1/3] docker: pending, would set up docker\n[2/3] swap: ok\n[3/3] user: pending, would set up user\n", out.String())
+
+	// Check mode never applies anything
+	assert.Error(t, Run(&out, steps, true))
+}
+
+func TestRunStopsAtFailure(t *testing.T) {
+	steps := []Step{fakeStep("docker", false, errors.New("apt-get failed")), fakeStep("swap", false, nil)}
+
+	var out bytes.Buffer
+	assert.EqualError(t, Run(&out, steps, false), "step docker failed: apt-get failed")
+	assert.Equal(t, "[1/2] docker: failed: apt-get failed\n", out.String())
+}
+
+func TestSelect(t *testing.T) {
+	steps := []Step{fakeStep("docker", true, nil), fakeStep("swap", true, nil), fakeStep("user", true, nil)}
+
+	selected, err := Select(steps, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docker", "swap", "user"}, Names(selected))
+
+	selected, err = Select(steps, []string{"user", "docker"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docker", "user"}, Names(selected))
+
+	_, err = Select(steps, []string{"user", "firewall"})
+	assert.EqualError(t, err, "unknown step firewall (steps: docker, swap, user)")
+}
+
+func TestPendingUpgrades(t *testing.T) {
+	output := "Reading package lists...\nThe following packages will be upgraded:\n  curl libcurl4\n2 upgraded, 0 newly installed, 0 to remove and 0 not upgraded.\n"
+	assert.Equal(t, 2, PendingUpgrades(output))
+	assert.Equal(t, 0, PendingUpgrades("0 upgraded, 0 newly installed, 0 to remove and 0 not upgraded.\n"))
+	assert.Equal(t, 0, PendingUpgrades(""))
+}
+
+func TestWithLine(t *testing.T) {
+	assert.Equal(t, FstabEntry+"\n", WithLine("", FstabEntry))
+	assert.Equal(t, "LABEL=root / ext4 defaults 0 1\n"+FstabEntry+"\n", WithLine("LABEL=root / ext4 defaults 0 1", FstabEntry))
+
+	content := "LABEL=root / ext4 defaults 0 1\n" + FstabEntry + "\n"
+	assert.Equal(t, content, WithLine(content, FstabEntry))
+}
+
+func TestWithoutLines(t *testing.T) {
+	sysctl := "net.ipv4.ip_forward=1\nvm.sappiness=10\n"
+	assert.Equal(t, "net.ipv4.ip_forward=1\n", WithoutLines(sysctl, IsSwappinessTypo))
+
+	sudoers := "root\tALL=(ALL:ALL) ALL\nploy ALL=(ALL) NOPASSWD:ALL\nploy2 ALL=(ALL) NOPASSWD:ALL\n@includedir /etc/sudoers.d\n"
+	assert.Equal(t, "root\tALL=(ALL:ALL) ALL\nploy2 ALL=(ALL) NOPASSWD:ALL\n@includedir /etc/sudoers.d\n",
+		WithoutLines(sudoers, IsBlanketSudo("ploy")))
+	assert.True(t, IsBlanketSudo("ploy")("ploy ALL=(ALL:ALL) NOPASSWD: ALL"))
+	assert.False(t, IsBlanketSudo("ploy")("ploy ALL=(root) NOPASSWD: PLOY_CHECK"))
+}
+
+func TestSudoers(t *testing.T) {
+	sudoers := Sudoers(SudoersConfig{User: "ploy", Ploy: "/usr/local/bin/ploy"})
+
+	assert.Contains(t, sudoers, "Cmnd_Alias PLOY_HELPER = /usr/local/bin/ploy root-helper *\n")
+	assert.Contains(t, sudoers, "/usr/sbin/nginx -t")
+	// Nothing installs, links or removes files the caller names
+	for _, command := range []string{"/usr/bin/install", "/usr/bin/ln", "/usr/bin/rm", "/usr/bin/mkdir", "/usr/bin/chmod", "/etc/cron.d"} {
+		assert.NotContains(t, sudoers, command)
+	}
+	assert.True(t, strings.HasSuffix(sudoers,
+		"ploy ALL=(root) NOPASSWD: PLOY_CHECK, PLOY_NGINX, PLOY_HELPER, PLOY_SERVICES, PLOY_DISK\n"))
+	assert.False(t, IsBlanketSudo("ploy")(strings.TrimSpace(sudoers[strings.LastIndex(strings.TrimSpace(sudoers), "\n"):])))
+}
@@ -0,0 +1,39 @@
+package bootstrap
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// sudoersTemplate allows exactly the commands ploy runs with `sudo -n`. Wildcards
+// in sudoers arguments also match spaces and extra arguments, so no rule hands
+// paths or file contents to a system command: vhosts, cron files and the agent
+// unit are installed by the root helper of the ploy binary, which renders them
+// itself and validates every name it is given.
+var sudoersTemplate = template.Must(template.New("sudoers").Parse(`# Managed by ploy server init; changes are overwritten.
+# Commands the ploy CLI runs with sudo -n as {{.User}}.
+Cmnd_Alias PLOY_CHECK = /usr/bin/true
+Cmnd_Alias PLOY_NGINX = /usr/sbin/nginx -t, \
+	/usr/bin/systemctl reload nginx, /usr/bin/systemctl start nginx, /usr/bin/systemctl enable nginx, \
+	/usr/bin/apt-get update, /usr/bin/apt-get install -y nginx
+Cmnd_Alias PLOY_HELPER = {{.Ploy}} root-helper *
+Cmnd_Alias PLOY_SERVICES = /usr/bin/systemctl daemon-reload, /usr/bin/systemctl enable --now ploy-agent, \
+	/usr/bin/systemctl restart ploy-agent
+Cmnd_Alias PLOY_DISK = /usr/bin/du -sbc /var/lib/docker/volumes/*
+{{.User}} ALL=(root) NOPASSWD: PLOY_CHECK, PLOY_NGINX, PLOY_HELPER, PLOY_SERVICES, PLOY_DISK
+`))
+
+// SudoersConfig is what the sudoers rules are rendered from
+type SudoersConfig struct {
+	User string
+	// Ploy is the path of the ploy binary, which must be owned and only writable
+	// by root since the user may run its root helper
+	Ploy string
+}
+
+// Sudoers renders the sudoers rules for the user ploy runs as
+func Sudoers(config SudoersConfig) string {
+	var buf bytes.Buffer
+	sudoersTemplate.Execute(&buf, config)
+	return buf.String()
+}
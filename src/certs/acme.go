@@ -0,0 +1,255 @@
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"golang.org/x/crypto/acme"
+)
+
+// DefaultDirectoryURL is the ACME directory used when none is configured
+const DefaultDirectoryURL = acme.LetsEncryptURL
+
+// Issuer obtains and revokes certificates from an ACME server using the HTTP-01
+// challenge. Challenge responses are written to Webroot, which nginx serves under
+// /.well-known/acme-challenge/.
+type Issuer struct {
+	DirectoryURL string
+	Email        string
+	Insecure     bool
+	Webroot      string
+	HTTPClient   *http.Client
+}
+
+// NewIssuer returns an Issuer for the given directory. insecure disables TLS
+// verification of the ACME server, which is only meant for local test servers
+// such as Pebble.
+func NewIssuer(directoryURL, email string, insecure bool) *Issuer {
+	if directoryURL == "" {
+		directoryURL = DefaultDirectoryURL
+	}
+
+	client := http.DefaultClient
+	if insecure {
+		client = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		}
+	}
+
+	return &Issuer{
+		DirectoryURL: directoryURL,
+		Email:        email,
+		Insecure:     insecure,
+		Webroot:      common.AcmeWebroot,
+		HTTPClient:   client,
+	}
+}
+
+// Obtain issues a certificate covering the given domains and stores it under the
+// first domain
+func (i *Issuer) Obtain(ctx context.Context, domains ...string) error {
+	if len(domains) == 0 {
+		return errors.New("at least one domain is required")
+	}
+
+	client, err := i.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		return fmt.Errorf("failed to create order: %v", err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := i.authorize(ctx, client, authzURL); err != nil {
+			return err
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("order was not ready: %v", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, certKey)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate request: %v", err)
+	}
+
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("failed to finalize order: %v", err)
+	}
+
+	var chain []byte
+	for _, b := range der {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := Save(domains[0], chain, keyPEM, SourceACME); err != nil {
+		return err
+	}
+	return SaveACMEAccount(domains[0], i.Account())
+}
+
+// Account returns the ACME server and account the issuer uses
+func (i *Issuer) Account() ACMEAccount {
+	return ACMEAccount{DirectoryURL: i.DirectoryURL, Email: i.Email, Insecure: i.Insecure}
+}
+
+// Revoke revokes the stored certificate for a domain with the ACME server
+func (i *Issuer) Revoke(ctx context.Context, domain string) error {
+	certPath, _ := Paths(domain)
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("no PEM certificate found in %s", certPath)
+	}
+
+	client, err := i.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := client.RevokeCert(ctx, nil, block.Bytes, acme.CRLReasonUnspecified); err != nil {
+		return fmt.Errorf("failed to revoke certificate: %v", err)
+	}
+	return nil
+}
+
+func (i *Issuer) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch authorization: %v", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no http-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	response, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+
+	challengePath := filepath.Join(i.Webroot, filepath.FromSlash(client.HTTP01ChallengePath(chal.Token)))
+	if err := os.MkdirAll(filepath.Dir(challengePath), 0755); err != nil {
+		if os.IsPermission(err) {
+			return fmt.Errorf("failed to create challenge directory, create %s with 'sudo ploy server init user': %v", i.Webroot, err)
+		}
+		return fmt.Errorf("failed to create challenge directory: %v", err)
+	}
+	if err := os.WriteFile(challengePath, []byte(response), 0644); err != nil {
+		return fmt.Errorf("failed to write challenge response: %v", err)
+	}
+	defer os.Remove(challengePath)
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("failed to accept challenge: %v", err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorization failed for %s: %v", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+func (i *Issuer) client(ctx context.Context) (*acme.Client, error) {
+	key, err := loadAccountKey()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: i.DirectoryURL,
+		HTTPClient:   i.HTTPClient,
+		UserAgent:    "ploy/" + common.CurrentCliVersion,
+	}
+
+	account := &acme.Account{}
+	if i.Email != "" {
+		account.Contact = []string{"mailto:" + i.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register ACME account: %v", err)
+	}
+
+	return client, nil
+}
+
+// loadAccountKey returns the ACME account key, creating it on first use
+func loadAccountKey() (crypto.Signer, error) {
+	path := filepath.Join(common.CertsDir, "account.key")
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid account key in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(common.CertsDir, 0700); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write account key: %v", err)
+	}
+	return key, nil
+}
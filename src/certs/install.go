@@ -0,0 +1,77 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+)
+
+// Validate checks that a PEM certificate chain belongs to the private key, that
+// every certificate in the chain is signed by the next one, that the leaf is
+// currently valid and that it covers all of the given domains.
+func Validate(certPEM, keyPEM []byte, domains ...string) error {
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return fmt.Errorf("certificate does not match private key: %v", err)
+	}
+
+	chain, err := parseChain(certPEM)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i+1 < len(chain); i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return fmt.Errorf("certificate %d in chain is not signed by certificate %d: %v", i+1, i+2, err)
+		}
+	}
+
+	leaf := chain[0]
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate is not valid before %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	for _, domain := range domains {
+		if err := leaf.VerifyHostname(domain); err != nil {
+			return fmt.Errorf("certificate does not cover %s", domain)
+		}
+	}
+	return nil
+}
+
+// Install validates a customer supplied certificate and stores it for a domain
+func Install(domain string, certPEM, keyPEM []byte) error {
+	if err := Validate(certPEM, keyPEM, domain); err != nil {
+		return err
+	}
+	return Save(domain, certPEM, keyPEM, SourceCustom)
+}
+
+func parseChain(chainPEM []byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for rest := chainPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %v", err)
+		}
+		chain = append(chain, cert)
+	}
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	return chain, nil
+}
@@ -0,0 +1,108 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// issuedByCA returns a leaf chain (leaf + CA) and the leaf key, plus a chain whose
+// intermediate did not sign the leaf
+func issuedByCA(t *testing.T, domain string) ([]byte, []byte, []byte) {
+	newCA := func() (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(2),
+			Subject:               pkix.Name{CommonName: "Test CA"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		assert.NoError(t, err)
+		cert, err := x509.ParseCertificate(der)
+		assert.NoError(t, err)
+		return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+
+	ca, caKey, caPEM := newCA()
+	_, _, otherCAPEM := newCA()
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}, ca, &leafKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	leafPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+
+	keyDER, err := x509.MarshalECPrivateKey(leafKey)
+	assert.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return append(leafPEM, caPEM...), keyPEM, append(leafPEM, otherCAPEM...)
+}
+
+func TestValidate(t *testing.T) {
+	chainPEM, keyPEM, brokenChainPEM := issuedByCA(t, "shop.example.com")
+	_, otherKeyPEM := selfSigned(t, "shop.example.com", time.Now().Add(time.Hour))
+	expiredPEM, expiredKeyPEM := selfSigned(t, "shop.example.com", time.Now().Add(-time.Minute))
+
+	tests := []struct {
+		name          string
+		certPEM       []byte
+		keyPEM        []byte
+		domain        string
+		expectedError string
+	}{
+		{"Valid chain", chainPEM, keyPEM, "shop.example.com", ""},
+		{"Key mismatch", chainPEM, otherKeyPEM, "shop.example.com", "does not match private key"},
+		{"Wrong domain", chainPEM, keyPEM, "blog.example.com", "does not cover blog.example.com"},
+		{"Broken chain", brokenChainPEM, keyPEM, "shop.example.com", "is not signed by certificate 2"},
+		{"Expired", expiredPEM, expiredKeyPEM, "shop.example.com", "certificate expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.certPEM, tt.keyPEM, tt.domain)
+			if tt.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expectedError)
+			}
+		})
+	}
+}
+
+func TestInstallRecordsCustomSource(t *testing.T) {
+	oldCertsDir := common.CertsDir
+	common.SetCertsDir(t.TempDir())
+	defer common.SetCertsDir(oldCertsDir)
+
+	chainPEM, keyPEM, _ := issuedByCA(t, "shop.example.com")
+	assert.NoError(t, Install("shop.example.com", chainPEM, keyPEM))
+
+	cert, err := Load("shop.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, SourceCustom, cert.Source)
+
+	assert.Error(t, Install("blog.example.com", chainPEM, keyPEM))
+	assert.False(t, Exists("blog.example.com"))
+}
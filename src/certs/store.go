@@ -0,0 +1,227 @@
+package certs
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+)
+
+const (
+	certFileName   = "fullchain.pem"
+	keyFileName    = "privkey.pem"
+	sourceFileName = "source"
+	acmeFileName   = "acme.json"
+)
+
+// Certificate sources
+const (
+	SourceACME   = "acme"
+	SourceCustom = "custom"
+)
+
+// RenewBefore is how long before expiry a certificate is considered due for renewal
+var RenewBefore = 30 * 24 * time.Hour
+
+// ACMEAccount is the ACME server and account a certificate was issued with, so it
+// is renewed by the same CA
+type ACMEAccount struct {
+	DirectoryURL string `json:"directory_url"`
+	Email        string `json:"email,omitempty"`
+	Insecure     bool   `json:"insecure,omitempty"`
+}
+
+// Certificate describes a certificate stored for a site domain
+type Certificate struct {
+	Domain string
+	Source string
+	// ACME is nil for custom certificates and those issued before it was recorded
+	ACME     *ACMEAccount
+	Names    []string
+	CertPath string
+	KeyPath  string
+	NotAfter time.Time
+}
+
+// DaysLeft returns the number of whole days until the certificate expires
+func (c *Certificate) DaysLeft() int {
+	return int(time.Until(c.NotAfter).Hours() / 24)
+}
+
+// NeedsRenewal reports whether the certificate expires within RenewBefore
+func (c *Certificate) NeedsRenewal() bool {
+	return time.Until(c.NotAfter) < RenewBefore
+}
+
+// Dir returns the directory holding the certificate files for a domain
+func Dir(domain string) string {
+	return filepath.Join(common.CertsDir, domain)
+}
+
+// Paths returns the certificate chain and private key paths for a domain
+func Paths(domain string) (string, string) {
+	return filepath.Join(Dir(domain), certFileName), filepath.Join(Dir(domain), keyFileName)
+}
+
+// Exists reports whether both certificate and key are stored for a domain
+func Exists(domain string) bool {
+	certPath, keyPath := Paths(domain)
+	if _, err := os.Stat(certPath); err != nil {
+		return false
+	}
+	if _, err := os.Stat(keyPath); err != nil {
+		return false
+	}
+	return true
+}
+
+// Load reads the stored certificate for a domain
+func Load(domain string) (*Certificate, error) {
+	certPath, keyPath := Paths(domain)
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := parseLeaf(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate for %s: %v", domain, err)
+	}
+
+	source := SourceACME
+	if data, err := os.ReadFile(filepath.Join(Dir(domain), sourceFileName)); err == nil {
+		source = strings.TrimSpace(string(data))
+	}
+
+	var account *ACMEAccount
+	if data, err := os.ReadFile(filepath.Join(Dir(domain), acmeFileName)); err == nil {
+		account = &ACMEAccount{}
+		if err := json.Unmarshal(data, account); err != nil {
+			return nil, fmt.Errorf("failed to parse the ACME account of %s: %v", domain, err)
+		}
+	}
+
+	return &Certificate{
+		Domain:   domain,
+		Source:   source,
+		ACME:     account,
+		Names:    leaf.DNSNames,
+		CertPath: certPath,
+		KeyPath:  keyPath,
+		NotAfter: leaf.NotAfter,
+	}, nil
+}
+
+// List returns every stored certificate sorted by domain
+func List() ([]*Certificate, error) {
+	entries, err := os.ReadDir(common.CertsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Certificate
+	for _, entry := range entries {
+		if !entry.IsDir() || !Exists(entry.Name()) {
+			continue
+		}
+		cert, err := Load(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, cert)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Domain < result[j].Domain })
+	return result, nil
+}
+
+// Save stores a PEM encoded certificate chain and private key for a domain,
+// recording where the certificate came from. The key is only readable by the owner.
+func Save(domain string, certPEM, keyPEM []byte, source string) error {
+	dir := Dir(domain)
+	if runner.DryRun {
+		// Never print the private key
+		runner.Plan("store the %s certificate and private key for %s in %s", source, domain, dir)
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create certificate directory: %v", err)
+	}
+
+	certPath, keyPath := Paths(domain)
+	if err := writeFileAtomic(keyPath, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write private key: %v", err)
+	}
+	if err := writeFileAtomic(certPath, certPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %v", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, sourceFileName), []byte(source+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to record certificate source: %v", err)
+	}
+	if source != SourceACME {
+		// A custom certificate replacing an ACME one is not renewed with its account
+		os.Remove(filepath.Join(dir, acmeFileName))
+	}
+	return nil
+}
+
+// SaveACMEAccount records the ACME server and account a domain's certificate was
+// issued with
+func SaveACMEAccount(domain string, account ACMEAccount) error {
+	if runner.DryRun {
+		return nil
+	}
+	data, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(Dir(domain), acmeFileName), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to record ACME account: %v", err)
+	}
+	return nil
+}
+
+// Remove deletes the stored certificate files for a domain
+func Remove(domain string) error {
+	return runner.RemoveAll(Dir(domain))
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func parseLeaf(chainPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(chainPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
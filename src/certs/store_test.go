@@ -0,0 +1,109 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func selfSigned(t *testing.T, domain string, notAfter time.Time) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestSaveLoadList(t *testing.T) {
+	oldCertsDir := common.CertsDir
+	common.SetCertsDir(t.TempDir())
+	defer common.SetCertsDir(oldCertsDir)
+
+	expiry := time.Now().Add(60 * 24 * time.Hour).Truncate(time.Second)
+	certPEM, keyPEM := selfSigned(t, "example.com", expiry)
+	assert.NoError(t, Save("example.com", certPEM, keyPEM, SourceACME))
+
+	soonPEM, soonKey := selfSigned(t, "a.example.com", time.Now().Add(10*24*time.Hour))
+	assert.NoError(t, Save("a.example.com", soonPEM, soonKey, SourceACME))
+
+	assert.True(t, Exists("example.com"))
+	assert.False(t, Exists("missing.com"))
+
+	_, keyPath := Paths("example.com")
+	info, err := os.Stat(keyPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	cert, err := Load("example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, cert.Names)
+	assert.True(t, expiry.Equal(cert.NotAfter))
+	assert.False(t, cert.NeedsRenewal())
+	assert.InDelta(t, 59, cert.DaysLeft(), 1)
+
+	list, err := List()
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+	assert.Equal(t, "a.example.com", list[0].Domain)
+	assert.True(t, list[0].NeedsRenewal())
+
+	assert.NoError(t, Remove("example.com"))
+	assert.False(t, Exists("example.com"))
+}
+
+func TestListWithoutCertsDir(t *testing.T) {
+	oldCertsDir := common.CertsDir
+	common.SetCertsDir("/nonexistent/ploy/certs")
+	defer common.SetCertsDir(oldCertsDir)
+
+	list, err := List()
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+}
+
+func TestACMEAccount(t *testing.T) {
+	oldCertsDir := common.CertsDir
+	common.SetCertsDir(t.TempDir())
+	defer common.SetCertsDir(oldCertsDir)
+
+	certPEM, keyPEM := selfSigned(t, "example.com", time.Now().Add(60*24*time.Hour))
+	assert.NoError(t, Save("example.com", certPEM, keyPEM, SourceACME))
+	cert, err := Load("example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, cert.ACME)
+
+	account := NewIssuer("https://pebble:14000/dir", "ops@example.com", true).Account()
+	assert.NoError(t, SaveACMEAccount("example.com", account))
+	cert, err = Load("example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, &account, cert.ACME)
+
+	// A custom certificate is not renewed with the ACME account
+	assert.NoError(t, Save("example.com", certPEM, keyPEM, SourceCustom))
+	cert, err = Load("example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, cert.ACME)
+}
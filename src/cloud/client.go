@@ -0,0 +1,113 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// APIError is an error response from the PloyCloud API
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("PloyCloud API: %s", e.Message)
+}
+
+// Client talks to the PloyCloud API. Registration authenticates with the
+// account's API key, everything after it with the server token.
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// NewClient returns a client for the API at baseURL
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the PloyCloud API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e) != nil || e.Error == "" {
+			e.Error = resp.Status
+		}
+		return &APIError{StatusCode: resp.StatusCode, Message: e.Error}
+	}
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func serverPath(serverID string, parts ...string) string {
+	path := "/v1/servers/" + url.PathEscape(serverID)
+	for _, part := range parts {
+		path += "/" + url.PathEscape(part)
+	}
+	return path
+}
+
+// Register exchanges the client's API key for a server identity
+func (c *Client) Register(ctx context.Context, req RegisterRequest) (*Identity, error) {
+	var identity Identity
+	if err := c.do(ctx, http.MethodPost, "/v1/servers/register", req, &identity); err != nil {
+		return nil, err
+	}
+	if identity.ServerID == "" || identity.Token == "" {
+		return nil, fmt.Errorf("PloyCloud API returned an incomplete server identity")
+	}
+	return &identity, nil
+}
+
+// Heartbeat reports the state of the server and returns pending commands
+func (c *Client) Heartbeat(ctx context.Context, serverID string, heartbeat Heartbeat) (HeartbeatResponse, error) {
+	var resp HeartbeatResponse
+	err := c.do(ctx, http.MethodPost, serverPath(serverID, "heartbeat"), heartbeat, &resp)
+	return resp, err
+}
+
+// Ack reports whether a command was accepted
+func (c *Client) Ack(ctx context.Context, serverID, commandID string, ack Ack) error {
+	return c.do(ctx, http.MethodPost, serverPath(serverID, "commands", commandID, "ack"), ack, nil)
+}
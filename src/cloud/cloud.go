@@ -0,0 +1,138 @@
+package cloud
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/agent"
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/jobs"
+)
+
+// DefaultInterval is the time between heartbeats unless the API asks for another
+const DefaultInterval = 30 * time.Second
+
+// ErrNotRegistered is returned when the server has no identity yet
+var ErrNotRegistered = errors.New("server is not registered, run `ploy server register` first")
+
+// Identity is what the API hands out when a server registers. The token
+// authenticates heartbeats, so the API key itself is not needed afterwards.
+type Identity struct {
+	ServerID        string     `json:"server_id"`
+	Token           string     `json:"token"`
+	APIURL          string     `json:"api_url"`
+	Region          string     `json:"region,omitempty"`
+	RegisteredAt    time.Time  `json:"registered_at"`
+	LastHeartbeatAt *time.Time `json:"last_heartbeat_at,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+}
+
+// RegisterRequest introduces a server to the API
+type RegisterRequest struct {
+	Hostname string `json:"hostname"`
+	Region   string `json:"region"`
+	Version  string `json:"version"`
+	Facts    Facts  `json:"facts"`
+}
+
+// Heartbeat reports the state of the server
+type Heartbeat struct {
+	Version  string          `json:"version"`
+	Facts    Facts           `json:"facts"`
+	Proxy    string          `json:"proxy"`
+	Services map[string]bool `json:"services"`
+	Sites    []agent.Site    `json:"sites"`
+	Jobs     []JobSummary    `json:"jobs"`
+}
+
+// JobSummary reports a recent job, so the API can follow commands it sent
+type JobSummary struct {
+	ID         string     `json:"id"`
+	CommandID  string     `json:"command_id,omitempty"`
+	Type       string     `json:"type"`
+	Site       string     `json:"site,omitempty"`
+	State      jobs.State `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Command is an operation the API wants carried out on the server. Types and
+// params are those of jobs.
+type Command struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Site   string          `json:"site,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// HeartbeatResponse carries pending commands and the interval until the next heartbeat
+type HeartbeatResponse struct {
+	Commands        []Command `json:"commands"`
+	IntervalSeconds int       `json:"interval_seconds,omitempty"`
+}
+
+// Interval returns the time until the next heartbeat
+func (r HeartbeatResponse) Interval() time.Duration {
+	if r.IntervalSeconds <= 0 {
+		return DefaultInterval
+	}
+	return time.Duration(r.IntervalSeconds) * time.Second
+}
+
+// Ack tells the API whether a command was accepted, and which job runs it
+type Ack struct {
+	JobID string `json:"job_id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// IdentityPath returns where the server identity is kept
+func IdentityPath() string {
+	return filepath.Join(common.ServicesDir, "server.json")
+}
+
+// LoadIdentity returns the identity saved by `ploy server register`
+func LoadIdentity() (*Identity, error) {
+	data, err := os.ReadFile(IdentityPath())
+	if os.IsNotExist(err) {
+		return nil, ErrNotRegistered
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var identity Identity
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, fmt.Errorf("invalid server identity in %s: %v", IdentityPath(), err)
+	}
+	return &identity, nil
+}
+
+// SaveIdentity writes the identity. It holds the server token, so it is only
+// readable by the owner.
+func SaveIdentity(identity *Identity) error {
+	data, err := json.MarshalIndent(identity, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(common.ServicesDir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(common.ServicesDir, ".server-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), IdentityPath())
+}
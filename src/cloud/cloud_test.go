@@ -0,0 +1,190 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/agent"
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// standIn is a minimal PloyCloud API
+type standIn struct {
+	mu         sync.Mutex
+	heartbeats []Heartbeat
+	acks       map[string]Ack
+	pending    []Command
+}
+
+func newStandIn(t *testing.T) (*standIn, *httptest.Server) {
+	api := &standIn{acks: make(map[string]Ack)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/servers/register", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer account-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid API key"})
+			return
+		}
+		var req RegisterRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(Identity{ServerID: "srv-" + req.Hostname, Token: "server-token"})
+	})
+	mux.HandleFunc("POST /v1/servers/{id}/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer server-token" || r.PathValue("id") != "srv-web1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var heartbeat Heartbeat
+		json.NewDecoder(r.Body).Decode(&heartbeat)
+
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		api.heartbeats = append(api.heartbeats, heartbeat)
+		json.NewEncoder(w).Encode(HeartbeatResponse{Commands: api.pending, IntervalSeconds: 1})
+		api.pending = nil
+	})
+	mux.HandleFunc("POST /v1/servers/{id}/commands/{command}/ack", func(w http.ResponseWriter, r *http.Request) {
+		var ack Ack
+		json.NewDecoder(r.Body).Decode(&ack)
+		api.mu.Lock()
+		api.acks[r.PathValue("command")] = ack
+		api.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return api, server
+}
+
+// fakeReporter queues commands by remembering them
+type fakeReporter struct {
+	accepted []Command
+}
+
+func (r *fakeReporter) Heartbeat(ctx context.Context) (Heartbeat, error) {
+	return Heartbeat{
+		Version:  "1.0.0",
+		Services: map[string]bool{"mysql": true},
+		Sites:    []agent.Site{{Domain: "shop.com", Replicas: 2}},
+	}, nil
+}
+
+func (r *fakeReporter) Accept(ctx context.Context, command Command) (string, error) {
+	if command.Type == "site.explode" {
+		return "", errors.New("unknown job type")
+	}
+	r.accepted = append(r.accepted, command)
+	return "job-" + command.ID, nil
+}
+
+func TestRegister(t *testing.T) {
+	_, server := newStandIn(t)
+
+	identity, err := NewClient(server.URL+"/", "account-key").Register(context.Background(), RegisterRequest{Hostname: "web1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "srv-web1", identity.ServerID)
+	assert.Equal(t, "server-token", identity.Token)
+
+	_, err = NewClient(server.URL, "wrong-key").Register(context.Background(), RegisterRequest{Hostname: "web1"})
+	var apiErr *APIError
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+		assert.Equal(t, "invalid API key", apiErr.Message)
+	}
+}
+
+func TestBeat(t *testing.T) {
+	api, server := newStandIn(t)
+	api.pending = []Command{
+		{ID: "c1", Type: "site.backup", Site: "shop.com"},
+		{ID: "c2", Type: "site.explode", Site: "shop.com"},
+	}
+
+	identity := &Identity{ServerID: "srv-web1", Token: "server-token"}
+	reporter := &fakeReporter{}
+	interval, err := Beat(context.Background(), NewClient(server.URL, identity.Token), identity, reporter)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, interval)
+	assert.NotNil(t, identity.LastHeartbeatAt)
+
+	if assert.Len(t, api.heartbeats, 1) {
+		assert.Equal(t, "1.0.0", api.heartbeats[0].Version)
+		assert.Equal(t, "shop.com", api.heartbeats[0].Sites[0].Domain)
+	}
+	if assert.Len(t, reporter.accepted, 1) {
+		assert.Equal(t, "c1", reporter.accepted[0].ID)
+	}
+	assert.Equal(t, Ack{JobID: "job-c1"}, api.acks["c1"])
+	assert.Equal(t, Ack{Error: "unknown job type"}, api.acks["c2"])
+
+	identity.Token = "revoked"
+	_, err = Beat(context.Background(), NewClient(server.URL, identity.Token), identity, reporter)
+	assert.Error(t, err)
+}
+
+func TestRun(t *testing.T) {
+	oldServicesDir := common.ServicesDir
+	common.ServicesDir = t.TempDir()
+	defer func() { common.ServicesDir = oldServicesDir }()
+
+	api, server := newStandIn(t)
+	identity := &Identity{ServerID: "srv-web1", Token: "server-token", APIURL: server.URL}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Run(ctx, NewClient(server.URL, identity.Token), identity, &fakeReporter{}, t.Logf)
+	}()
+	assert.Eventually(t, func() bool {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		return len(api.heartbeats) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	assert.NoError(t, <-done)
+
+	saved, err := LoadIdentity()
+	assert.NoError(t, err)
+	assert.Equal(t, "srv-web1", saved.ServerID)
+	assert.NotNil(t, saved.LastHeartbeatAt)
+	info, err := os.Stat(IdentityPath())
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestLoadIdentityNotRegistered(t *testing.T) {
+	oldServicesDir := common.ServicesDir
+	common.ServicesDir = t.TempDir()
+	defer func() { common.ServicesDir = oldServicesDir }()
+
+	_, err := LoadIdentity()
+	assert.ErrorIs(t, err, ErrNotRegistered)
+}
+
+func TestCollectFacts(t *testing.T) {
+	oldProcDir := procDir
+	procDir = t.TempDir()
+	defer func() { procDir = oldProcDir }()
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(procDir, "sys", "kernel"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(procDir, "sys", "kernel", "osrelease"), []byte("6.8.0-1012-aws\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(procDir, "meminfo"), []byte("MemTotal:        4028180 kB\nMemFree:          123456 kB\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(procDir, "uptime"), []byte("3600.52 7000.10\n"), 0644))
+
+	facts := CollectFacts(t.TempDir())
+	assert.Equal(t, "6.8.0-1012-aws", facts.Kernel)
+	assert.Equal(t, uint64(4028180*1024), facts.MemoryBytes)
+	assert.Equal(t, int64(3600), facts.UptimeSeconds)
+	assert.NotZero(t, facts.CPUs)
+	assert.NotZero(t, facts.DiskBytes)
+}
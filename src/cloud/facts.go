@@ -0,0 +1,86 @@
+package cloud
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// procDir is read for memory, kernel and uptime; swapped out in tests
+var procDir = "/proc"
+
+// Facts describe the machine. Values that cannot be read are left empty.
+type Facts struct {
+	Hostname      string   `json:"hostname"`
+	OS            string   `json:"os"`
+	Arch          string   `json:"arch"`
+	Kernel        string   `json:"kernel,omitempty"`
+	CPUs          int      `json:"cpus"`
+	MemoryBytes   uint64   `json:"memory_bytes,omitempty"`
+	DiskBytes     uint64   `json:"disk_bytes,omitempty"`
+	DiskFreeBytes uint64   `json:"disk_free_bytes,omitempty"`
+	UptimeSeconds int64    `json:"uptime_seconds,omitempty"`
+	Addresses     []string `json:"addresses,omitempty"`
+	DockerVersion string   `json:"docker_version,omitempty"`
+}
+
+// CollectFacts gathers facts about this machine. Disk figures are those of the
+// filesystem holding diskPath.
+func CollectFacts(diskPath string) Facts {
+	facts := Facts{OS: runtime.GOOS, Arch: runtime.GOARCH, CPUs: runtime.NumCPU()}
+	facts.Hostname, _ = os.Hostname()
+
+	if data, err := os.ReadFile(filepath.Join(procDir, "sys", "kernel", "osrelease")); err == nil {
+		facts.Kernel = strings.TrimSpace(string(data))
+	}
+	facts.MemoryBytes = memTotal()
+	if data, err := os.ReadFile(filepath.Join(procDir, "uptime")); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 0 {
+			if uptime, err := strconv.ParseFloat(fields[0], 64); err == nil {
+				facts.UptimeSeconds = int64(uptime)
+			}
+		}
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(diskPath, &fs); err == nil {
+		facts.DiskBytes = fs.Blocks * uint64(fs.Bsize)
+		facts.DiskFreeBytes = fs.Bavail * uint64(fs.Bsize)
+	}
+
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+				facts.Addresses = append(facts.Addresses, ipnet.IP.String())
+			}
+		}
+	}
+	return facts
+}
+
+// memTotal returns MemTotal from /proc/meminfo in bytes
+func memTotal() uint64 {
+	f, err := os.Open(filepath.Join(procDir, "meminfo"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb * 1024
+		}
+	}
+	return 0
+}
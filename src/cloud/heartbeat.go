@@ -0,0 +1,70 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Reporter gathers the state reported in heartbeats and accepts the commands
+// the API sends back
+type Reporter interface {
+	Heartbeat(ctx context.Context) (Heartbeat, error)
+	// Accept queues a command and returns the ID of the job carrying it out
+	Accept(ctx context.Context, command Command) (string, error)
+}
+
+// Beat sends a single heartbeat, hands pending commands to the reporter and
+// acknowledges them. It returns the time until the next heartbeat.
+func Beat(ctx context.Context, client *Client, identity *Identity, reporter Reporter) (time.Duration, error) {
+	heartbeat, err := reporter.Heartbeat(ctx)
+	if err != nil {
+		return DefaultInterval, fmt.Errorf("failed to collect server state: %v", err)
+	}
+	resp, err := client.Heartbeat(ctx, identity.ServerID, heartbeat)
+	if err != nil {
+		return DefaultInterval, err
+	}
+
+	now := time.Now().UTC()
+	identity.LastHeartbeatAt = &now
+
+	for _, command := range resp.Commands {
+		var ack Ack
+		jobID, err := reporter.Accept(ctx, command)
+		if err != nil {
+			ack.Error = err.Error()
+		}
+		ack.JobID = jobID
+		if err := client.Ack(ctx, identity.ServerID, command.ID, ack); err != nil {
+			return resp.Interval(), fmt.Errorf("failed to acknowledge command %s: %v", command.ID, err)
+		}
+	}
+	return resp.Interval(), nil
+}
+
+// Run sends heartbeats until ctx is cancelled. Failures are logged and retried
+// at the next interval; the outcome of each heartbeat is saved with the identity.
+func Run(ctx context.Context, client *Client, identity *Identity, reporter Reporter, logf func(format string, args ...interface{})) error {
+	for {
+		interval, err := Beat(ctx, client, identity, reporter)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			identity.LastError = err.Error()
+			logf("Heartbeat failed: %v", err)
+		} else {
+			identity.LastError = ""
+		}
+		if err := SaveIdentity(identity); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
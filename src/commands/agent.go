@@ -0,0 +1,364 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"os/user"
+	"sync"
+	"syscall"
+
+	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/agent"
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/config"
+	"github.com/ploycloud/ploy-server-cli/src/health"
+	"github.com/ploycloud/ploy-server-cli/src/jobs"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/spf13/cobra"
+)
+
+var AgentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Run the ploy agent that serves the local HTTP API",
+	Long:  `The agent is a long-running service exposing site operations over an authenticated HTTP API on a unix socket or a loopback port. Set "agent:" in ~/.ploy/config.yaml to make the CLI send site commands to it.`,
+}
+
+func init() {
+	AgentCmd.AddCommand(agentRunCmd)
+	AgentCmd.AddCommand(agentInstallCmd)
+	AgentCmd.AddCommand(agentTokenCmd)
+	AgentCmd.AddCommand(agentStatusCmd)
+
+	agentRunCmd.Flags().String("listen", "", "unix:///path/to/socket or a loopback host:port (default: agent address from the configuration, or "+agent.DefaultSocket+")")
+	agentInstallCmd.Flags().String("listen", agent.DefaultSocket, "Address the agent listens on")
+	agentInstallCmd.Flags().String("user", "", "User the agent runs as (default: the current user)")
+	agentTokenCmd.Flags().Bool("rotate", false, "Replace the token with a new one")
+	agentStatusCmd.Flags().Bool("json", false, "Print the status as JSON")
+}
+
+var agentRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Serve the agent API in the foreground",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		listen, _ := cmd.Flags().GetString("listen")
+		if listen == "" {
+			listen = agentAddress()
+		}
+
+		token, err := agent.LoadOrCreateToken()
+		if err != nil {
+			return fmt.Errorf("loading agent token: %w", err)
+		}
+		l, err := agent.Listen(listen)
+		if err != nil {
+			return fmt.Errorf("listening on %s: %w", listen, err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		// Jobs queued through the API or with --async run next to the API
+		worker := jobs.NewWorker(runJobProcess)
+		workerDone := make(chan error, 1)
+		go func() {
+			err := worker.Run(ctx)
+			if errors.Is(err, jobs.ErrWorkerRunning) {
+				// `ploy jobs worker` runs the queued jobs instead
+				color.Yellow("Another job worker is running, queued jobs are left to it")
+				err = nil
+			}
+			workerDone <- err
+		}()
+
+		fmt.Printf("ploy agent %s listening on %s\n", common.CurrentCliVersion, listen)
+		backend := &agentBackend{issuer: newCertIssuer(cmd), worker: worker}
+		startHeartbeat(ctx, backend)
+		if err := agent.Serve(ctx, l, agent.NewHandler(backend, token)); err != nil {
+			return fmt.Errorf("serving agent API: %w", err)
+		}
+		if err := <-workerDone; err != nil {
+			return fmt.Errorf("running jobs: %w", err)
+		}
+		return nil
+	},
+}
+
+var agentInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install and start the agent as a systemd service",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		listen, _ := cmd.Flags().GetString("listen")
+		username, _ := cmd.Flags().GetString("user")
+		if username == "" {
+			current, err := user.Current()
+			if err != nil {
+				return fmt.Errorf("determining the current user: %w", err)
+			}
+			username = current.Username
+		}
+
+		if _, err := agent.LoadOrCreateToken(); err != nil {
+			return fmt.Errorf("creating agent token: %w", err)
+		}
+		if err := installAgentUnit(listen, username); err != nil {
+			return fmt.Errorf("installing agent: %w", err)
+		}
+		color.Green("ploy agent is running on %s", listen)
+		fmt.Printf("Set \"agent: %s\" in %s to send site commands to it.\n", listen, config.Path())
+		return nil
+	},
+}
+
+var agentTokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Print the API token",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rotate, _ := cmd.Flags().GetBool("rotate")
+		var token string
+		var err error
+		if rotate {
+			token, err = agent.RotateToken()
+		} else {
+			token, err = agent.LoadOrCreateToken()
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		return nil
+	},
+}
+
+var agentStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Ask the agent for the state of the server",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		token, err := agent.LoadToken()
+		if err != nil {
+			return err
+		}
+		status, err := agent.NewClient(agentAddress(), token).Status(context.Background())
+		if err != nil {
+			return err
+		}
+
+		if asJSON {
+			data, _ := json.MarshalIndent(status, "", "  ")
+			fmt.Println(string(data))
+			return nil
+		}
+		fmt.Printf("Version: %s\nProxy:   %s\n", status.Version, status.Proxy)
+		for service, running := range status.Services {
+			state := "not running"
+			if running {
+				state = "running"
+			}
+			fmt.Printf("%s is %s\n", service, state)
+		}
+		var results []health.Result
+		for _, site := range status.Sites {
+			if site.Health != nil {
+				results = append(results, *site.Health)
+			}
+		}
+		if len(results) > 0 {
+			fmt.Println()
+			printHealthResults(results)
+		}
+		return nil
+	},
+}
+
+// installAgentUnit has the root helper write the systemd unit and enables the service
+func installAgentUnit(listen, username string) error {
+	if err := runRootHelper("agent-unit", listen, username); err != nil {
+		return err
+	}
+	if err := runner.Run(execSudo("systemctl", "daemon-reload")); err != nil {
+		return fmt.Errorf("failed to reload systemd: %w", err)
+	}
+	if err := runner.Run(execSudo("systemctl", "enable", "--now", agent.UnitName)); err != nil {
+		return fmt.Errorf("failed to start %s: %w", agent.UnitName, err)
+	}
+	// Pick up a new binary or unit when the agent was already running
+	if err := runner.Run(execSudo("systemctl", "restart", agent.UnitName)); err != nil {
+		return fmt.Errorf("failed to restart %s: %w", agent.UnitName, err)
+	}
+	return nil
+}
+
+// agentAddress returns the configured agent address, or the default socket
+func agentAddress() string {
+	if cfg, err := config.LoadConfig(); err == nil && cfg.Agent != "" {
+		return cfg.Agent
+	}
+	return agent.DefaultSocket
+}
+
+// agentClient returns a client for the configured agent, or nil when the CLI
+// should carry out operations itself. Dry runs are always planned locally, since
+// the agent would carry the operation out.
+func agentClient() (*agent.Client, error) {
+	if runner.DryRun {
+		return nil, nil
+	}
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Agent == "" {
+		return nil, nil
+	}
+	token, err := agent.LoadToken()
+	if err != nil {
+		return nil, err
+	}
+	return agent.NewClient(cfg.Agent, token), nil
+}
+
+// agentBackend carries out API requests with the same functions the CLI uses
+type agentBackend struct {
+	issuer certIssuer
+	worker *jobs.Worker
+
+	// Site operations change shared files such as the proxy configuration, so
+	// they run one at a time
+	mu sync.Mutex
+}
+
+func (b *agentBackend) Status(ctx context.Context) (agent.Status, error) {
+	status := agent.Status{Version: common.CurrentCliVersion, Services: make(map[string]bool)}
+	if p, err := loadProxy(); err == nil {
+		status.Proxy = p.Name()
+	}
+	for _, service := range monitoredServices() {
+		status.Services[service], _ = serviceRunning(service)
+	}
+
+	sites, err := b.Sites(ctx)
+	if err != nil {
+		return status, err
+	}
+	status.Sites = sites
+	return status, nil
+}
+
+func (b *agentBackend) Sites(ctx context.Context) ([]agent.Site, error) {
+	sites, err := registry.List()
+	if err != nil {
+		return nil, err
+	}
+
+	// Probe all sites at once so a few slow sites do not hold up the response
+	result := make([]agent.Site, len(sites))
+	var wg sync.WaitGroup
+	for i, site := range sites {
+		wg.Add(1)
+		go func(i int, site *registry.Site) {
+			defer wg.Done()
+			result[i] = apiSite(ctx, site)
+		}(i, site)
+	}
+	wg.Wait()
+	return result, nil
+}
+
+func (b *agentBackend) Site(ctx context.Context, host string) (agent.Site, error) {
+	site, err := registry.Load(host)
+	if err != nil {
+		return agent.Site{}, err
+	}
+	return apiSite(ctx, site), nil
+}
+
+func (b *agentBackend) CreateSite(ctx context.Context, req agent.SiteRequest) (agent.Site, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if req.Domain == "" {
+		return agent.Site{}, fmt.Errorf("%w: domain is required", agent.ErrBadRequest)
+	}
+	if req.PHPVersion == "" {
+		req.PHPVersion = "8.3"
+	}
+	if req.Replicas == 0 {
+		req.Replicas = 1
+	}
+	if err := createSite(req, b.issuer); err != nil {
+		return agent.Site{}, err
+	}
+	return b.Site(ctx, req.Domain)
+}
+
+func (b *agentBackend) DeleteSite(ctx context.Context, host string) error {
+	return b.withSite(host, deleteSite)
+}
+
+func (b *agentBackend) StartSite(ctx context.Context, host string) error {
+	return b.withSite(host, startSite)
+}
+
+func (b *agentBackend) StopSite(ctx context.Context, host string) error {
+	return b.withSite(host, stopSite)
+}
+
+func (b *agentBackend) Deploy(ctx context.Context, host string, req agent.DeployRequest) error {
+	if req.Repo == "" {
+		return fmt.Errorf("%w: repo is required", agent.ErrBadRequest)
+	}
+	return b.withSite(host, func(site *registry.Site) error {
+		return deploySite(site, req.Repo)
+	})
+}
+
+func (b *agentBackend) Backup(ctx context.Context, host string) (agent.Backup, error) {
+	var result agent.Backup
+	err := b.withSite(host, func(site *registry.Site) error {
+		var err error
+		result, err = backupSite(site)
+		return err
+	})
+	return result, err
+}
+
+func (b *agentBackend) withSite(host string, op func(*registry.Site) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	site, err := registry.Load(host)
+	if err != nil {
+		return err
+	}
+	return op(site)
+}
+
+// apiSite describes a site for the API, leaving out its database credentials
+func apiSite(ctx context.Context, site *registry.Site) agent.Site {
+	s := agent.Site{
+		Domain:      site.Domain,
+		Hostname:    site.Hostname,
+		SiteID:      site.SiteID,
+		Type:        site.Type,
+		PHPVersion:  site.PHPVersion,
+		ScalingType: site.ScalingType,
+		Replicas:    site.Replicas,
+		CreatedAt:   site.CreatedAt,
+	}
+	if ids, err := siteContainerIDs(site); err == nil {
+		s.Containers = len(ids)
+	}
+	result := checkSiteHealth(ctx, site)
+	s.Health = &result
+	if !site.BackedUpAt.IsZero() {
+		backedUpAt := site.BackedUpAt
+		s.BackedUpAt = &backedUpAt
+	}
+	return s
+}
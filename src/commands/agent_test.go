@@ -0,0 +1,100 @@
+package commands
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ploycloud/ploy-server-cli/src/agent"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupAgentTest(t *testing.T) *agent.Client {
+	setupStatsTest(t)
+	t.Setenv("PLOY_PROXY", "nginx")
+
+	sites := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "shop.com" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	oldHealthBaseURL := healthBaseURL
+	healthBaseURL = func(domain string) string { return sites.URL }
+
+	api := httptest.NewServer(agent.NewHandler(&agentBackend{}, "secret"))
+	t.Cleanup(func() {
+		api.Close()
+		sites.Close()
+		healthBaseURL = oldHealthBaseURL
+	})
+	return agent.NewClient(api.URL, "secret")
+}
+
+func TestAgentBackendStatus(t *testing.T) {
+	client := setupAgentTest(t)
+
+	status, err := client.Status(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "nginx", status.Proxy)
+	assert.Contains(t, status.Services, "mysql")
+	if assert.Len(t, status.Sites, 2) {
+		for _, site := range status.Sites {
+			switch site.Domain {
+			case "shop.com":
+				assert.Equal(t, 2, site.Containers)
+				assert.True(t, site.Health.Healthy)
+			case "blog.com":
+				assert.Equal(t, 1, site.Containers)
+				assert.False(t, site.Health.Healthy)
+			}
+		}
+	}
+
+	_, err = client.Site(context.Background(), "missing.com")
+	var apiErr *agent.APIError
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	}
+}
+
+func TestAgentBackendSiteOperations(t *testing.T) {
+	client := setupAgentTest(t)
+
+	var composeArgs [][]string
+	oldMockRunCompose := mockRunCompose
+	mockRunCompose = func(composePath string, args ...string) error {
+		composeArgs = append(composeArgs, args)
+		return nil
+	}
+	defer func() { mockRunCompose = oldMockRunCompose }()
+
+	assert.NoError(t, client.StopSite(context.Background(), "blog.com"))
+	assert.Equal(t, [][]string{{"down"}}, composeArgs)
+
+	err := client.Deploy(context.Background(), "blog.com", agent.DeployRequest{})
+	var apiErr *agent.APIError
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	}
+
+	result, err := client.Backup(context.Background(), "shop.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "shop.com", result.Site)
+	info, err := os.Stat(result.Path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, result.Size, info.Size())
+	}
+	shop, err := registry.Load("shop.com")
+	assert.NoError(t, err)
+	assert.False(t, shop.BackedUpAt.IsZero())
+
+	assert.NoError(t, client.DeleteSite(context.Background(), "blog.com"))
+	assert.Equal(t, []string{"down", "--volumes"}, composeArgs[1])
+	_, err = registry.Load("blog.com")
+	assert.ErrorIs(t, err, registry.ErrNotFound)
+}
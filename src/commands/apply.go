@@ -0,0 +1,534 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/agent"
+	"github.com/ploycloud/ploy-server-cli/src/certs"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/ploycloud/ploy-server-cli/src/sitespec"
+	"github.com/spf13/cobra"
+)
+
+var ApplyCmd = &cobra.Command{
+	Use:   "apply -f site.yaml",
+	Short: "Create or update sites from site.yaml specs",
+	Long: `Bring sites in line with their site.yaml specs. The spec is compared with the
+site registry and with the site's compose file, proxy configuration, cron jobs and
+certificate on this server; the differences are shown as a plan and applied once confirmed. Sites that
+do not exist yet are created. Sites without a spec are left alone.
+
+Database passwords and env values can refer to environment variables as ${NAME},
+so the spec can be kept in git without secrets.`,
+	Args: cobra.NoArgs,
+	RunE: runApply,
+}
+
+func init() {
+	ApplyCmd.Flags().StringArrayP("file", "f", nil, "Site spec to apply; repeat for several sites")
+	ApplyCmd.Flags().BoolP("yes", "y", false, "Apply the plan without asking for confirmation")
+	ApplyCmd.MarkFlagRequired("file")
+}
+
+// sitePlan is what `ploy apply` changes to bring a site in line with its spec
+type sitePlan struct {
+	spec *sitespec.Spec
+	// current is the recorded site, nil when the site is created
+	current *registry.Site
+	desired *registry.Site
+	changes []sitespec.Change
+	// compose is set when the compose file is rewritten and the containers updated
+	compose bool
+	// ports is the size of the port block to reserve in place of a too small one
+	ports int
+	// proxy is set when the site's proxy configuration is regenerated
+	proxy       bool
+	crontab     bool
+	certificate bool
+}
+
+func runApply(cmd *cobra.Command, args []string) error {
+	files, _ := cmd.Flags().GetStringArray("file")
+	yes, _ := cmd.Flags().GetBool("yes")
+
+	var specs []*sitespec.Spec
+	seen := map[string]string{}
+	for _, file := range files {
+		spec, err := sitespec.Load(file)
+		if errors.Is(err, os.ErrNotExist) {
+			return errNotFound("site spec %s does not exist", file)
+		}
+		if err != nil {
+			return errUsage("%s: %v", file, err)
+		}
+		for _, domain := range spec.Domains {
+			if other, ok := seen[domain]; ok {
+				return errUsage("%s: domain %s is also in %s", file, domain, other)
+			}
+			seen[domain] = file
+		}
+		specs = append(specs, spec)
+	}
+
+	siteProxy, err := loadProxy()
+	if err != nil {
+		return fmt.Errorf("failed to load proxy configuration: %w", err)
+	}
+
+	var plans []*sitePlan
+	pending := 0
+	for _, spec := range specs {
+		plan, err := planSite(spec, siteProxy)
+		if err != nil {
+			return err
+		}
+		printSitePlan(plan)
+		if plan.current == nil || len(plan.changes) > 0 {
+			plans = append(plans, plan)
+			pending++
+		}
+	}
+	if pending == 0 {
+		color.Green("Everything is up to date.")
+		return nil
+	}
+
+	if !yes && !runner.DryRun {
+		fmt.Print("Apply these changes? (y/n): ")
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Apply cancelled.")
+			return nil
+		}
+	}
+
+	issuer := newCertIssuer(cmd)
+	failed := 0
+	for _, plan := range plans {
+		color.Yellow("Applying %s...", plan.desired.Domain)
+		if err := applyLocked(plan, siteProxy, issuer); err != nil {
+			color.Red("%s: %v", plan.desired.Domain, err)
+			failed++
+			continue
+		}
+		color.Green("%s is up to date", plan.desired.Domain)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d site(s) could not be applied", failed)
+	}
+	return nil
+}
+
+// planSite compares a spec with the recorded site and the files on this server
+func planSite(spec *sitespec.Spec, siteProxy proxyProvider) (*sitePlan, error) {
+	domain := spec.Domain()
+	if len(spec.Domains) > 1 && siteProxy.Name() == "traefik" {
+		return nil, errUsage("%s: aliases are not supported with the traefik proxy", domain)
+	}
+
+	current, err := registry.Load(domain)
+	if errors.Is(err, registry.ErrNotFound) {
+		current = nil
+	} else if err != nil {
+		return nil, fmt.Errorf("loading site %s: %w", domain, err)
+	}
+	if current != nil && current.Domain != domain {
+		return nil, errUsage("%s is the hostname of site %s", domain, current.Domain)
+	}
+	if current != nil && current.Hostname != spec.Hostname {
+		return nil, errUsage("%s: the hostname cannot be changed from %q to %q, it names the site directory",
+			domain, current.Hostname, spec.Hostname)
+	}
+
+	plan := &sitePlan{spec: spec, current: current, desired: spec.Site(current)}
+	if current == nil {
+		return plan, nil
+	}
+	desired := plan.desired
+	plan.changes = sitespec.Diff(current, desired)
+
+	// Hand edits on the server are overwritten, show them in the plan
+	onDisk, readErr := os.ReadFile(current.ComposePath())
+	recorded, err := renderSiteCompose(current)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case readErr != nil:
+		plan.changes = append(plan.changes, sitespec.Change{Field: "compose file", From: "missing", To: "written"})
+	case string(onDisk) != recorded:
+		plan.changes = append(plan.changes, sitespec.Change{Field: "compose file", From: "modified", To: "rewritten"})
+	}
+	rendered, err := renderSiteCompose(desired)
+	if err != nil {
+		return nil, err
+	}
+	plan.compose = readErr != nil || string(onDisk) != rendered || desired.ComposeFile != current.ComposeFile
+
+	// A site that outgrows its ports gets a new block when the plan is applied
+	if needed := max(desired.Replicas, desired.MaxReplicas); needed > len(desired.Ports()) {
+		plan.ports = needed
+		plan.compose = true
+		plan.changes = append(plan.changes, sitespec.Change{Field: "ports",
+			From: fmt.Sprintf("%d-%d", desired.HostPort, desired.LastPort()), To: fmt.Sprintf("a new block of %d", needed)})
+	}
+
+	// The installed proxy configuration is compared with what the record renders,
+	// so a retry still updates it after an apply that failed before doing so
+	state, err := proxyConfigDrift(siteProxy, domain)
+	if err != nil {
+		return nil, err
+	}
+	if state != "" {
+		plan.changes = append(plan.changes, sitespec.Change{Field: siteProxy.Name() + " config", From: state, To: "regenerated"})
+	}
+	plan.proxy = state != "" || plan.compose || strings.Join(current.Aliases, " ") != strings.Join(desired.Aliases, " ")
+
+	installed, readErr := os.ReadFile(siteCronPath(current))
+	switch {
+	case readErr != nil && siteCrontab(current, cronUser()) != "":
+		plan.changes = append(plan.changes, sitespec.Change{Field: "cron file", From: "missing", To: "installed"})
+	case readErr == nil && string(installed) != siteCrontab(current, cronUser()):
+		plan.changes = append(plan.changes, sitespec.Change{Field: "cron file", From: "modified", To: "installed"})
+	}
+	plan.crontab = string(installed) != siteCrontab(desired, cronUser())
+
+	if desired.TLS && !siteProxy.IssuesCertificates() {
+		if covered := certificateNames(domain); !coversAll(covered, desired.Domains()) {
+			plan.certificate = true
+			from := "missing"
+			if len(covered) > 0 {
+				from = strings.Join(covered, ", ")
+			}
+			plan.changes = append(plan.changes, sitespec.Change{Field: "certificate", From: from,
+				To: strings.Join(desired.Domains(), ", ")})
+		}
+	}
+	return plan, nil
+}
+
+// proxyConfigDrift compares the proxy configuration installed for a site with
+// what its record renders now. It returns "missing" or "modified", or "" when
+// they match or the proxy keeps no configuration file per site.
+func proxyConfigDrift(siteProxy proxyProvider, domain string) (string, error) {
+	var rendered, path string
+	var err error
+	switch p := siteProxy.(type) {
+	case *nginxProxy:
+		rendered, err = nginxSiteConfig(domain)
+		path = filepath.Join(nginxBasePath, "sites-available", domain+".conf")
+	case *caddyProxy:
+		rendered, err = caddySiteConfig(domain)
+		path = p.SitePath(domain)
+	default:
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("rendering %s configuration: %w", siteProxy.Name(), err)
+	}
+
+	installed, err := os.ReadFile(path)
+	switch {
+	case err != nil:
+		return "missing", nil
+	case string(installed) != rendered:
+		return "modified", nil
+	}
+	return "", nil
+}
+
+func printSitePlan(plan *sitePlan) {
+	switch {
+	case plan.current == nil:
+		color.Green("+ %s (create)", plan.desired.Domain)
+	case len(plan.changes) == 0:
+		fmt.Printf("= %s (up to date)\n", plan.desired.Domain)
+	default:
+		color.Yellow("~ %s", plan.desired.Domain)
+		for _, change := range plan.changes {
+			fmt.Printf("    %s\n", change)
+		}
+	}
+}
+
+// applyLocked applies the plan of a site while holding the site's lock. The plan
+// of an existing site is made again from the record read under the lock, so that
+// what was saved since it was shown, such as the replicas the autoscaler chose,
+// is kept.
+func applyLocked(plan *sitePlan, siteProxy proxyProvider, issuer certIssuer) error {
+	if plan.current == nil {
+		return applySitePlan(plan, siteProxy, issuer)
+	}
+	_, unlock, err := registry.Lock(plan.current.Domain)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	plan, err = planSite(plan.spec, siteProxy)
+	if err != nil {
+		return err
+	}
+	return applySitePlan(plan, siteProxy, issuer)
+}
+
+// applySitePlan creates the site or changes it into the state of its spec
+func applySitePlan(plan *sitePlan, siteProxy proxyProvider, issuer certIssuer) error {
+	if plan.current == nil {
+		return createSiteFromSpec(plan, siteProxy, issuer)
+	}
+	current, desired := plan.current, plan.desired
+
+	if plan.ports > 0 {
+		if _, err := registry.ReservePorts(desired, plan.ports); err != nil {
+			return fmt.Errorf("failed to reserve ports for %d replicas: %w", plan.ports, err)
+		}
+	}
+
+	// A site that moves to the internal database gets the credentials of the MySQL service
+	if desired.Database.Source == "internal" && desired.Database.Host == "" {
+		database, err := internalDatabase()
+		if err != nil {
+			return err
+		}
+		desired.Database = database
+	}
+
+	if plan.compose && desired.ComposeFile != current.ComposeFile && os.Getenv("PLOY_TEST_ENV") != "true" {
+		// The containers of the previous PHP version are replaced by those of the new compose file
+		if err := runner.Run(composeCommand(current.ComposePath(), "down")); err != nil {
+			return fmt.Errorf("failed to stop containers: %w", err)
+		}
+	}
+
+	if err := registry.Save(desired); err != nil {
+		return fmt.Errorf("failed to record site: %w", err)
+	}
+	if plan.compose {
+		// A stopped site stays stopped, `sites start` brings it up with the new file
+		write := writeSiteCompose
+		if desired.Stopped {
+			write = writeComposeFile
+		}
+		if err := write(desired); err != nil {
+			return err
+		}
+		if desired.ComposeFile != current.ComposeFile {
+			runner.Remove(current.ComposePath())
+		}
+	}
+	if plan.proxy {
+		if err := refreshSiteUpstream(desired, ""); err != nil {
+			return fmt.Errorf("failed to update proxy configuration: %w", err)
+		}
+	}
+	if plan.certificate {
+		if err := issueCertificate(issuer, desired.Domain, ""); err != nil {
+			return fmt.Errorf("failed to issue TLS certificate: %w", err)
+		}
+	}
+	if plan.crontab {
+		if err := installSiteCrontab(desired); err != nil {
+			return err
+		}
+	}
+	if plan.compose && !desired.Stopped {
+		if err := waitForSiteReady(desired, ""); err != nil {
+			return err
+		}
+	}
+
+	createSiteLog(desired.Name(), "Site spec applied")
+	return nil
+}
+
+// createSiteFromSpec creates a site the way `ploy sites new` does, then adds what
+// only a spec describes: aliases, env, cron jobs and backups. The certificate is
+// issued last so it covers the aliases.
+func createSiteFromSpec(plan *sitePlan, siteProxy proxyProvider, issuer certIssuer) error {
+	spec, desired := plan.spec, plan.desired
+	req := agent.SiteRequest{
+		Type:        spec.Type,
+		Domain:      desired.Domain,
+		Hostname:    spec.Hostname,
+		SiteID:      spec.SiteID,
+		PHPVersion:  spec.PHPVersion,
+		DBSource:    spec.Database.Source,
+		DBHost:      spec.Database.Host,
+		DBPort:      spec.Database.Port,
+		DBName:      spec.Database.Name,
+		DBUser:      spec.Database.User,
+		DBPassword:  spec.Database.Password,
+		ScalingType: spec.Scaling.Type,
+		Replicas:    spec.Scaling.Replicas,
+		MaxReplicas: spec.Scaling.MaxReplicas,
+		HealthCheck: spec.HealthCheck,
+	}
+	if err := createSite(req, issuer); err != nil {
+		return err
+	}
+
+	site, err := registry.Load(desired.Domain)
+	if err != nil {
+		return err
+	}
+	site.Aliases, site.Env, site.Cron, site.Backup, site.TLS = desired.Aliases, desired.Env, desired.Cron, desired.Backup, desired.TLS
+	if err := registry.Save(site); err != nil {
+		return fmt.Errorf("failed to record site: %w", err)
+	}
+
+	if len(site.Env) > 0 {
+		if err := writeSiteCompose(site); err != nil {
+			return err
+		}
+	}
+	if len(site.Aliases) > 0 {
+		if err := configureSiteProxy(site.Domain, ""); err != nil {
+			return fmt.Errorf("failed to create proxy configuration: %w", err)
+		}
+	}
+	if site.TLS && !siteProxy.IssuesCertificates() {
+		if err := issueCertificate(issuer, site.Domain, ""); err != nil {
+			return fmt.Errorf("failed to issue TLS certificate: %w", err)
+		}
+	}
+	if err := installSiteCrontab(site); err != nil {
+		return err
+	}
+
+	createSiteLog(site.Name(), "Site spec applied")
+	return nil
+}
+
+// internalDatabase sets up the internal MySQL service if needed and returns its
+// connection settings
+func internalDatabase() (registry.Database, error) {
+	if err := setupInternalMySQL(); err != nil {
+		return registry.Database{}, fmt.Errorf("failed to set up internal MySQL: %w", err)
+	}
+	details, err := getServiceDetails("mysql")
+	if err != nil {
+		return registry.Database{}, err
+	}
+	return registry.Database{
+		Source:   "internal",
+		Host:     details["Host"],
+		Port:     details["Port"],
+		Name:     details["Database"],
+		User:     details["User"],
+		Password: details["Password"],
+	}, nil
+}
+
+// writeSiteCompose renders the site's compose file and updates its containers
+func writeSiteCompose(site *registry.Site) error {
+	if err := writeComposeFile(site); err != nil {
+		return err
+	}
+
+	if os.Getenv("PLOY_TEST_ENV") != "true" {
+		cmd := composeCommand(site.ComposePath(), "up", "-d", "--remove-orphans")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := runner.Run(cmd); err != nil {
+			return fmt.Errorf("failed to update containers: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeComposeFile writes a site's compose file without touching its containers
+func writeComposeFile(site *registry.Site) error {
+	content, err := renderSiteCompose(site)
+	if err != nil {
+		return err
+	}
+	if err := runner.WriteFile(site.ComposePath(), []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write docker-compose file: %w", err)
+	}
+	return nil
+}
+
+// certificateNames returns the names the stored certificate of a domain covers
+func certificateNames(domain string) []string {
+	cert, err := certs.Load(domain)
+	if err != nil {
+		return nil
+	}
+	return cert.Names
+}
+
+func coversAll(names, domains []string) bool {
+	covered := map[string]bool{}
+	for _, name := range names {
+		covered[name] = true
+	}
+	for _, domain := range domains {
+		if !covered[domain] {
+			return false
+		}
+	}
+	return true
+}
+
+// cronFileNamePattern matches what cron does not accept in the name of a file in
+// /etc/cron.d, such as the dots of a domain
+var cronFileNamePattern = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// siteCronPath returns the cron.d file with the scheduled jobs of a site
+func siteCronPath(site *registry.Site) string {
+	return filepath.Join(cronBasePath, "ploy-site-"+cronFileNamePattern.ReplaceAllString(site.Name(), "-"))
+}
+
+// siteCrontab renders the cron.d file of a site: its cron jobs, which run as user
+// in the web container, and its backup schedule. It is empty for a site without
+// either.
+func siteCrontab(site *registry.Site, user string) string {
+	if len(site.Cron) == 0 && site.Backup.Schedule == "" {
+		return ""
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		exe = "ploy"
+	}
+	logDir := filepath.Join(logBasePath, "sites", site.Name())
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Managed by ploy: scheduled jobs of %s\n", site.Domain)
+	for _, job := range site.Cron {
+		fmt.Fprintf(&b, "%s %s docker compose -f %s exec -T wordpress sh -c %s >> %s 2>&1\n",
+			job.Schedule, user, shellQuote(site.ComposePath()), cronEscape(shellQuote(job.Command)),
+			filepath.Join(logDir, "cron.log"))
+	}
+	if site.Backup.Schedule != "" {
+		fmt.Fprintf(&b, "%s %s %s sites backup %s >> %s 2>&1\n",
+			site.Backup.Schedule, user, exe, site.Domain, filepath.Join(logDir, "backup.log"))
+	}
+	return b.String()
+}
+
+// installSiteCrontab has the root helper install the cron.d file of a site from
+// its saved record, or remove it when the site has no scheduled jobs
+func installSiteCrontab(site *registry.Site) error {
+	if err := runRootHelper("site-cron", site.Domain); err != nil {
+		return fmt.Errorf("failed to install cron jobs: %w", err)
+	}
+	return nil
+}
+
+// shellQuote quotes a word for sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// cronEscape escapes percent signs, which cron turns into newlines
+func cronEscape(s string) string {
+	return strings.ReplaceAll(s, "%", `\%`)
+}
@@ -0,0 +1,213 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ploycloud/ploy-server-cli/src/docker"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/sitespec"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupApplyTest(t *testing.T) (string, *registry.Site) {
+	tempDir, site := setupScaleTest(t)
+
+	oldCronBasePath := cronBasePath
+	cronBasePath = filepath.Join(tempDir, "cron.d")
+	t.Cleanup(func() { cronBasePath = oldCronBasePath })
+	assert.NoError(t, os.MkdirAll(cronBasePath, 0755))
+
+	site.Type, site.PHPVersion = "wp", "8.3"
+	site.Database = registry.Database{Source: "external", Host: "db.example.com", Port: "3306",
+		Name: "shop", User: "shop", Password: "secret"}
+	assert.NoError(t, registry.Save(site))
+	assert.NoError(t, writeSiteCompose(site))
+	assert.NoError(t, configureSiteProxy(site.Domain, ""))
+	return tempDir, site
+}
+
+const applyTestSpec = `domains: [shop.com, www.shop.com]
+php_version: "8.3"
+database:
+  source: external
+  host: db.example.com
+  port: "3306"
+  name: shop
+  user: shop
+  password: secret
+scaling:
+  type: dynamic
+  replicas: 1
+  max_replicas: 3
+env:
+  WP_ENV: production
+cron:
+  - schedule: "*/5 * * * *"
+    command: wp cron event run --due-now
+backups:
+  schedule: "@daily"
+  keep: 7
+`
+
+func TestApplySitePlan(t *testing.T) {
+	tempDir, _ := setupApplyTest(t)
+	siteProxy, err := loadProxy()
+	assert.NoError(t, err)
+
+	spec, err := sitespec.Parse([]byte(applyTestSpec))
+	assert.NoError(t, err)
+	plan, err := planSite(spec, siteProxy)
+	assert.NoError(t, err)
+	assert.True(t, plan.compose)
+	assert.True(t, plan.crontab)
+	assert.False(t, plan.certificate)
+	var fields []string
+	for _, change := range plan.changes {
+		fields = append(fields, change.Field)
+	}
+	assert.Equal(t, []string{"aliases", "env.WP_ENV", "cron", "backups.schedule", "backups.keep"}, fields)
+
+	assert.NoError(t, applySitePlan(plan, siteProxy, &fakeIssuer{}))
+
+	recorded, err := registry.Load("shop.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"www.shop.com"}, recorded.Aliases)
+	assert.Equal(t, 7, recorded.Backup.Keep)
+
+	compose, err := os.ReadFile(recorded.ComposePath())
+	assert.NoError(t, err)
+	assert.Contains(t, string(compose), "WP_ENV: production")
+
+	vhost, err := os.ReadFile(filepath.Join(tempDir, "sites-available", "shop.com.conf"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(vhost), "server_name shop.com www.shop.com;")
+
+	crontab, err := os.ReadFile(filepath.Join(cronBasePath, "ploy-site-shop-com"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(crontab), "exec -T wordpress sh -c 'wp cron event run --due-now'")
+	assert.Contains(t, string(crontab), "@daily ")
+	assert.Contains(t, string(crontab), " sites backup shop.com >> ")
+
+	// Applying the same spec again changes nothing
+	plan, err = planSite(spec, siteProxy)
+	assert.NoError(t, err)
+	assert.Empty(t, plan.changes)
+	assert.False(t, plan.compose)
+	assert.False(t, plan.crontab)
+
+	// Hand edits are shown and overwritten
+	assert.NoError(t, os.WriteFile(recorded.ComposePath(), []byte("services: {}\n"), 0644))
+	plan, err = planSite(spec, siteProxy)
+	assert.NoError(t, err)
+	assert.Equal(t, []sitespec.Change{{Field: "compose file", From: "modified", To: "rewritten"}}, plan.changes)
+	assert.True(t, plan.compose)
+}
+
+func TestApplyRetryRegeneratesProxyConfig(t *testing.T) {
+	tempDir, site := setupApplyTest(t)
+	siteProxy, err := loadProxy()
+	assert.NoError(t, err)
+
+	// An earlier apply recorded the aliases but failed before updating the vhost
+	site.Aliases = []string{"www.shop.com"}
+	assert.NoError(t, registry.Save(site))
+
+	spec, err := sitespec.Parse([]byte("domains: [shop.com, www.shop.com]\nphp_version: \"8.3\"\n" +
+		"database:\n  source: external\n  host: db.example.com\n  port: \"3306\"\n  name: shop\n  user: shop\n  password: secret\n" +
+		"scaling:\n  type: dynamic\n  replicas: 1\n  max_replicas: 3\n"))
+	assert.NoError(t, err)
+	plan, err := planSite(spec, siteProxy)
+	assert.NoError(t, err)
+	assert.Equal(t, []sitespec.Change{{Field: "nginx config", From: "modified", To: "regenerated"}}, plan.changes)
+	assert.True(t, plan.proxy)
+
+	assert.NoError(t, applySitePlan(plan, siteProxy, &fakeIssuer{}))
+	vhost, err := os.ReadFile(filepath.Join(tempDir, "sites-available", "shop.com.conf"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(vhost), "server_name shop.com www.shop.com;")
+}
+
+func TestApplyKeepsStoppedSiteStopped(t *testing.T) {
+	_, site := setupApplyTest(t)
+	t.Setenv("PLOY_TEST_ENV", "")
+	site.Stopped = true
+	assert.NoError(t, registry.Save(site))
+	siteProxy, err := loadProxy()
+	assert.NoError(t, err)
+
+	var composeCalls []string
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		if name == "docker" && len(arg) > 0 && arg[0] == "compose" {
+			composeCalls = append(composeCalls, strings.Join(arg[3:], " "))
+		}
+		return exec.Command("false")
+	}
+
+	spec, err := sitespec.Parse([]byte(applyTestSpec))
+	assert.NoError(t, err)
+	plan, err := planSite(spec, siteProxy)
+	assert.NoError(t, err)
+	assert.True(t, plan.compose)
+	assert.NoError(t, applySitePlan(plan, siteProxy, &fakeIssuer{}))
+
+	// The compose file is updated, but no container is started or waited for
+	recorded, err := registry.Load("shop.com")
+	assert.NoError(t, err)
+	assert.True(t, recorded.Stopped)
+	compose, err := os.ReadFile(recorded.ComposePath())
+	assert.NoError(t, err)
+	assert.Contains(t, string(compose), "WP_ENV: production")
+	for _, call := range composeCalls {
+		assert.False(t, strings.HasPrefix(call, "up"), call)
+	}
+}
+
+func TestApplyReservesMorePorts(t *testing.T) {
+	setupApplyTest(t)
+	getDockerComposeTemplate = docker.GetDockerComposeTemplate
+	siteProxy, err := loadProxy()
+	assert.NoError(t, err)
+
+	spec, err := sitespec.Parse([]byte(strings.Replace(applyTestSpec, "max_replicas: 3", "max_replicas: 5", 1)))
+	assert.NoError(t, err)
+	plan, err := planSite(spec, siteProxy)
+	assert.NoError(t, err)
+	assert.Contains(t, plan.changes, sitespec.Change{Field: "ports", From: "20010-20012", To: "a new block of 5"})
+	assert.True(t, plan.compose)
+
+	assert.NoError(t, applySitePlan(plan, siteProxy, &fakeIssuer{}))
+	recorded, err := registry.Load("shop.com")
+	assert.NoError(t, err)
+	assert.Len(t, recorded.Ports(), 5)
+	compose, err := os.ReadFile(recorded.ComposePath())
+	assert.NoError(t, err)
+	assert.Contains(t, string(compose), fmt.Sprintf("127.0.0.1:%d-%d:80", recorded.HostPort, recorded.LastPort()))
+}
+
+func TestPlanSiteErrors(t *testing.T) {
+	setupApplyTest(t)
+	siteProxy, err := loadProxy()
+	assert.NoError(t, err)
+
+	spec, err := sitespec.Parse([]byte(applyTestSpec + "hostname: shop\n"))
+	assert.NoError(t, err)
+	_, err = planSite(spec, siteProxy)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "hostname cannot be changed")
+}
+
+func TestSiteCrontab(t *testing.T) {
+	site := &registry.Site{Domain: "shop.com", ComposeFile: "docker-compose-wp-php8.3.yml"}
+	assert.Equal(t, "", siteCrontab(site, "ploy"))
+
+	site.Cron = []registry.CronJob{{Schedule: "0 3 * * *", Command: "echo 'done' $(date +%F)"}}
+	crontab := siteCrontab(site, "ploy")
+	assert.True(t, strings.HasPrefix(crontab, "# Managed by ploy: scheduled jobs of shop.com\n"))
+	assert.Contains(t, crontab, `sh -c 'echo '\''done'\'' $(date +\%F)'`)
+	assert.Equal(t, filepath.Join(cronBasePath, "ploy-site-shop-com"), siteCronPath(site))
+}
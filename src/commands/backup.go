@@ -0,0 +1,136 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/agent"
+	"github.com/ploycloud/ploy-server-cli/src/backup"
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/jobs"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	SitesCmd.AddCommand(sitesBackupCmd)
+
+	sitesBackupCmd.Flags().Bool("async", false, "Queue the backup as a background job")
+}
+
+var sitesBackupCmd = &cobra.Command{
+	Use:   "backup [host]",
+	Short: "Back up a site's files and database",
+	Long:  `Write the site directory and a dump of the site's database to a tar.gz archive in ~/.ploy/backups/<site>/.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if queued, err := queueJob(cmd, jobs.TypeBackup, args[0], nil); queued || err != nil {
+			return err
+		}
+		fmt.Printf("Backing up %s...\n", args[0])
+
+		client, err := agentClient()
+		if err != nil {
+			return err
+		}
+
+		var result agent.Backup
+		if client != nil {
+			result, err = client.Backup(context.Background(), args[0])
+		} else {
+			var site *registry.Site
+			if site, err = registry.Load(args[0]); err == nil {
+				result, err = backupSite(site)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("backing up site: %w", err)
+		}
+		color.Green("Backup written to %s (%d bytes)", result.Path, result.Size)
+		return nil
+	},
+}
+
+// backupTimeout bounds the database dump of a backup, which can take far longer
+// than other commands on large sites
+var backupTimeout = 2 * time.Hour
+
+// backupDir returns the directory holding a site's backups
+func backupDir(site *registry.Site) string {
+	return filepath.Join(common.ServicesDir, "backups", site.Name())
+}
+
+// backupSite archives the site directory together with a dump of its database and
+// records the time of the backup
+func backupSite(site *registry.Site) (agent.Backup, error) {
+	cmd, err := siteMySQLCommand(site, "mysqldump", "--single-transaction", "--routines", "--triggers", site.Database.Name)
+	if err != nil {
+		return agent.Backup{}, err
+	}
+	reportStep("dump database")
+	now := time.Now().UTC()
+	path := filepath.Join(backupDir(site), backup.FileName(site.Name(), now))
+	if runner.DryRun {
+		runner.RunWithin(cmd, backupTimeout)
+		runner.Plan("write backup archive %s of %s and the database dump", path, site.Dir())
+		return agent.Backup{Site: site.Domain, Path: path, CreatedAt: now}, nil
+	}
+	dump, err := dumpDatabase(site, cmd)
+	if err != nil {
+		return agent.Backup{}, err
+	}
+	defer os.Remove(dump)
+
+	reportStep("write archive")
+	size, err := backup.Create(path, site.Dir(), dump)
+	if err != nil {
+		return agent.Backup{}, fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	site.BackedUpAt = now
+	if err := registry.Save(site); err != nil {
+		os.Remove(path)
+		return agent.Backup{}, fmt.Errorf("failed to record backup: %w", err)
+	}
+	createSiteLog(site.Name(), fmt.Sprintf("Backup written to %s", path))
+
+	if site.Backup.Keep > 0 {
+		removed, err := backup.Prune(backupDir(site), site.Name(), site.Backup.Keep)
+		if err != nil {
+			color.Yellow("Failed to remove old backups: %v", err)
+		}
+		for _, old := range removed {
+			createSiteLog(site.Name(), fmt.Sprintf("Removed old backup %s", old))
+		}
+	}
+
+	return agent.Backup{Site: site.Domain, Path: path, Size: size, CreatedAt: now}, nil
+}
+
+// dumpDatabase streams the output of the mysqldump command to a temporary file
+// next to the site's backups and returns its path
+func dumpDatabase(site *registry.Site, cmd *exec.Cmd) (string, error) {
+	if err := os.MkdirAll(backupDir(site), 0700); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(backupDir(site), ".dump-*.sql")
+	if err != nil {
+		return "", err
+	}
+	cmd.Stdout = f
+	err = runner.RunWithin(cmd, backupTimeout)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to dump database %s: %w", site.Database.Name, err)
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,326 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/certs"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/spf13/cobra"
+)
+
+var CertsCmd = &cobra.Command{
+	Use:   "certs",
+	Short: "Manage TLS certificates for sites",
+	Long:  `Issue, list, renew and revoke TLS certificates for site domains using ACME (HTTP-01), or install your own.`,
+}
+
+var cronBasePath = "/etc/cron.d"
+
+// newCertIssuer is swapped out in tests to avoid talking to a real ACME server
+var newCertIssuer = func(cmd *cobra.Command) certIssuer {
+	directory, _ := cmd.Flags().GetString("directory")
+	email, _ := cmd.Flags().GetString("email")
+	insecure, _ := cmd.Flags().GetBool("insecure")
+	if directory == "" {
+		directory = os.Getenv("PLOY_ACME_DIRECTORY")
+	}
+	if email == "" {
+		email = os.Getenv("PLOY_ACME_EMAIL")
+	}
+	return certs.NewIssuer(directory, email, insecure)
+}
+
+// newACMEIssuer returns an issuer for the ACME account a certificate was issued with
+var newACMEIssuer = func(account certs.ACMEAccount) certIssuer {
+	return certs.NewIssuer(account.DirectoryURL, account.Email, account.Insecure)
+}
+
+// certIssuerFor returns the issuer to renew or revoke a certificate with: the ACME
+// server and account it was issued with, unless the ACME flags name another
+func certIssuerFor(cmd *cobra.Command, c *certs.Certificate) certIssuer {
+	flags := cmd.Flags()
+	if c.ACME == nil || flags.Changed("directory") || flags.Changed("email") || flags.Changed("insecure") {
+		return newCertIssuer(cmd)
+	}
+	return newACMEIssuer(*c.ACME)
+}
+
+type certIssuer interface {
+	Obtain(ctx context.Context, domains ...string) error
+	Revoke(ctx context.Context, domain string) error
+}
+
+func init() {
+	CertsCmd.AddCommand(certsIssueCmd)
+	CertsCmd.AddCommand(certsListCmd)
+	CertsCmd.AddCommand(certsRenewCmd)
+	CertsCmd.AddCommand(certsRevokeCmd)
+	CertsCmd.AddCommand(certsInstallCmd)
+
+	for _, c := range []*cobra.Command{certsIssueCmd, certsRenewCmd, certsRevokeCmd} {
+		c.Flags().String("directory", "", "ACME directory URL (default: Let's Encrypt, or $PLOY_ACME_DIRECTORY)")
+		c.Flags().String("email", "", "Contact email for the ACME account (or $PLOY_ACME_EMAIL)")
+		c.Flags().Bool("insecure", false, "Skip TLS verification of the ACME server (local test servers only)")
+	}
+	certsRenewCmd.Flags().Bool("force", false, "Renew even if the certificate is not close to expiry")
+
+	certsInstallCmd.Flags().String("site", "", "Site domain the certificate is for")
+	certsInstallCmd.Flags().String("cert", "", "Path to the PEM certificate chain (leaf first)")
+	certsInstallCmd.Flags().String("key", "", "Path to the PEM private key")
+	certsInstallCmd.MarkFlagRequired("site")
+	certsInstallCmd.MarkFlagRequired("cert")
+	certsInstallCmd.MarkFlagRequired("key")
+}
+
+var certsIssueCmd = &cobra.Command{
+	Use:   "issue [domain]",
+	Short: "Issue a certificate for a site domain",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domain := args[0]
+		fmt.Printf("Issuing certificate for %s...\n", domain)
+		if err := issueCertificate(newCertIssuer(cmd), domain, ""); err != nil {
+			return fmt.Errorf("issuing certificate: %w", err)
+		}
+		color.Green("Certificate issued for %s", domain)
+		return nil
+	},
+}
+
+var certsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List certificates and their expiry",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		list, err := certs.List()
+		if err != nil {
+			return fmt.Errorf("listing certificates: %w", err)
+		}
+		if len(list) == 0 {
+			fmt.Println("No certificates found.")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DOMAIN\tSOURCE\tEXPIRES\tDAYS LEFT")
+		for _, c := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", c.Domain, c.Source, c.NotAfter.Format("2006-01-02"), c.DaysLeft())
+		}
+		w.Flush()
+		return nil
+	},
+}
+
+var certsRenewCmd = &cobra.Command{
+	Use:   "renew [domain]",
+	Short: "Renew certificates that are close to expiry",
+	Long:  `Renew certificates expiring within 30 days with the ACME server and account they were issued with. Run without a domain to check every certificate; this is what the renewal schedule runs.`,
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		force, _ := cmd.Flags().GetBool("force")
+
+		var list []*certs.Certificate
+		if len(args) == 1 {
+			c, err := certs.Load(args[0])
+			if err != nil {
+				return fmt.Errorf("loading certificate for %s: %w", args[0], err)
+			}
+			list = append(list, c)
+		} else {
+			var err error
+			if list, err = certs.List(); err != nil {
+				return fmt.Errorf("listing certificates: %w", err)
+			}
+		}
+
+		failed := 0
+		for _, c := range list {
+			if c.Source == certs.SourceCustom {
+				if c.NeedsRenewal() {
+					color.Yellow("%s: custom certificate expires in %d days, install a new one with 'ploy certs install'", c.Domain, c.DaysLeft())
+				}
+				continue
+			}
+			if !force && !c.NeedsRenewal() {
+				fmt.Printf("%s: valid for %d more days, skipping\n", c.Domain, c.DaysLeft())
+				continue
+			}
+			fmt.Printf("Renewing certificate for %s...\n", c.Domain)
+			if err := issueCertificate(certIssuerFor(cmd, c), c.Domain, ""); err != nil {
+				color.Red("Error renewing certificate for %s: %v", c.Domain, err)
+				failed++
+				continue
+			}
+			color.Green("Certificate renewed for %s", c.Domain)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d certificate(s) could not be renewed", failed)
+		}
+		return nil
+	},
+}
+
+var certsRevokeCmd = &cobra.Command{
+	Use:   "revoke [domain]",
+	Short: "Revoke and remove the certificate for a domain",
+	Long:  `Revoke an ACME certificate and remove it. Custom certificates are only removed; revoke them with their issuer.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domain := args[0]
+		c, err := certs.Load(domain)
+		if err != nil {
+			return errNotFound("no certificate found for %s", domain)
+		}
+
+		if c.Source == certs.SourceACME && runner.DryRun {
+			runner.Plan("revoke the certificate for %s with the ACME server", domain)
+		} else if c.Source == certs.SourceACME {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			defer cancel()
+			if err := certIssuerFor(cmd, c).Revoke(ctx, domain); err != nil {
+				return fmt.Errorf("revoking certificate: %w", err)
+			}
+		}
+		if err := certs.Remove(domain); err != nil {
+			return fmt.Errorf("removing certificate files: %w", err)
+		}
+
+		// Switch the vhost back to plain HTTP
+		if err := certificateChanged(domain); err != nil {
+			return fmt.Errorf("updating proxy configuration: %w", err)
+		}
+		color.Green("Certificate revoked for %s", domain)
+		return nil
+	},
+}
+
+var certsInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install your own certificate for a site",
+	Long:  `Install a certificate chain and private key supplied by you. The chain must match the key and cover the site domain.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domain, _ := cmd.Flags().GetString("site")
+		certFile, _ := cmd.Flags().GetString("cert")
+		keyFile, _ := cmd.Flags().GetString("key")
+
+		if err := installCustomCertificate(domain, certFile, keyFile); err != nil {
+			return fmt.Errorf("installing certificate: %w", err)
+		}
+		color.Green("Certificate installed for %s", domain)
+		return nil
+	},
+}
+
+func installCustomCertificate(domain, certFile, keyFile string) error {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	if err := certs.Install(domain, certPEM, keyPEM); err != nil {
+		return err
+	}
+
+	return certificateChanged(domain)
+}
+
+// certificateChanged lets the configured proxy pick up a stored or removed certificate
+func certificateChanged(domain string) error {
+	p, err := loadProxy()
+	if err != nil {
+		return err
+	}
+	return p.CertificateChanged(domain)
+}
+
+// issueCertificate obtains a certificate for a domain and switches its vhost to TLS.
+// The vhost is written first so that nginx serves the HTTP-01 challenge. Proxies
+// that run their own ACME client are left to it.
+func issueCertificate(issuer certIssuer, domain, webhook string) error {
+	p, err := loadProxy()
+	if err != nil {
+		return err
+	}
+	if p.IssuesCertificates() {
+		return fmt.Errorf("%s obtains certificates for %s itself", p.Name(), domain)
+	}
+
+	if !certs.Exists(domain) {
+		if err := createNginxConfig(domain, webhook); err != nil {
+			return fmt.Errorf("failed to prepare nginx for the ACME challenge: %w", err)
+		}
+	}
+
+	if runner.DryRun {
+		runner.Plan("obtain a certificate for %s from the ACME server and switch its vhost to TLS", domain)
+		return installRenewalSchedule()
+	}
+
+	sendWebhook(webhook, fmt.Sprintf("Requesting certificate for %s...", domain))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	if err := issuer.Obtain(ctx, siteDomains(domain)...); err != nil {
+		return err
+	}
+
+	if err := createNginxConfig(domain, webhook); err != nil {
+		return err
+	}
+
+	return installRenewalSchedule()
+}
+
+// siteDomains returns the domains a certificate for domain covers: the domain and
+// the aliases of its site
+func siteDomains(domain string) []string {
+	if site, err := registry.Load(domain); err == nil {
+		return site.Domains()
+	}
+	return []string{domain}
+}
+
+// installRenewalSchedule installs a cron entry that runs `ploy certs renew` twice a day
+func installRenewalSchedule() error {
+	if os.Getenv("PLOY_TEST_ENV") == "true" {
+		return nil
+	}
+
+	schedulePath := filepath.Join(cronBasePath, "ploy-certs")
+	if _, err := os.Stat(schedulePath); err == nil {
+		return nil
+	}
+
+	if err := runRootHelper("certs-cron"); err != nil {
+		return fmt.Errorf("failed to install renewal schedule: %w", err)
+	}
+	return nil
+}
+
+// renewalCrontab renders the cron.d file that runs `ploy certs renew` as user
+func renewalCrontab(user string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("# Managed by ploy: renew TLS certificates\n17 3,15 * * * %s %s certs renew >> %s 2>&1\n",
+		user, exe, filepath.Join(logBasePath, "ploy-certs.log")), nil
+}
+
+// cronUser returns the user cron runs ploy's scheduled commands as: the user the
+// root helper acts for
+func cronUser() string {
+	if u, err := helperUser(); err == nil {
+		return u.Username
+	}
+	return "root"
+}
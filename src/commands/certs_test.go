@@ -0,0 +1,210 @@
+package commands
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/certs"
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeIssuer struct {
+	obtained []string
+	revoked  []string
+}
+
+func (f *fakeIssuer) Obtain(ctx context.Context, domains ...string) error {
+	f.obtained = append(f.obtained, domains...)
+	certPEM, keyPEM := testCertificate(domains[0], time.Now().Add(90*24*time.Hour))
+	return certs.Save(domains[0], certPEM, keyPEM, certs.SourceACME)
+}
+
+func (f *fakeIssuer) Revoke(ctx context.Context, domain string) error {
+	f.revoked = append(f.revoked, domain)
+	return nil
+}
+
+func testCertificate(domain string, notAfter time.Time) ([]byte, []byte) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func setupCertsTest(t *testing.T) string {
+	tempDir := t.TempDir()
+
+	oldNginxBasePath := nginxBasePath
+	oldCertsDir := common.CertsDir
+	oldSitesDir := common.SitesDir
+	oldServicesDir := common.ServicesDir
+	nginxBasePath = tempDir
+	common.SetCertsDir(filepath.Join(tempDir, "certs"))
+	common.SitesDir = filepath.Join(tempDir, "sites")
+	common.SetServicesDir(tempDir)
+
+	oldExecSudo := execSudo
+	execSudo = mockExecSudo(t, tempDir)
+
+	os.Setenv("PLOY_TEST_ENV", "true")
+	t.Cleanup(func() {
+		nginxBasePath = oldNginxBasePath
+		common.SetCertsDir(oldCertsDir)
+		common.SitesDir = oldSitesDir
+		common.SetServicesDir(oldServicesDir)
+		execSudo = oldExecSudo
+		os.Unsetenv("PLOY_TEST_ENV")
+	})
+
+	return tempDir
+}
+
+func TestNginxSiteConfigWithoutCertificate(t *testing.T) {
+	setupCertsTest(t)
+
+	config, err := nginxSiteConfig("test.com")
+	assert.NoError(t, err)
+	assert.Contains(t, config, "listen 80;")
+	assert.Contains(t, config, "location ^~ /.well-known/acme-challenge/")
+	assert.NotContains(t, config, "listen 443")
+}
+
+func TestIssueCertificateSwitchesVhostToTLS(t *testing.T) {
+	tempDir := setupCertsTest(t)
+
+	issuer := &fakeIssuer{}
+	err := issueCertificate(issuer, "test.com", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test.com"}, issuer.obtained)
+
+	content, err := os.ReadFile(filepath.Join(tempDir, "sites-available", "test.com.conf"))
+	assert.NoError(t, err)
+	config := string(content)
+
+	certPath, keyPath := certs.Paths("test.com")
+	assert.Contains(t, config, "listen 443 ssl")
+	assert.Contains(t, config, "ssl_certificate "+certPath+";")
+	assert.Contains(t, config, "ssl_certificate_key "+keyPath+";")
+	assert.Contains(t, config, "return 301 https://$host$request_uri;")
+	assert.Contains(t, config, "location ^~ /.well-known/acme-challenge/")
+}
+
+func TestCertsListCmd(t *testing.T) {
+	setupCertsTest(t)
+
+	certPEM, keyPEM := testCertificate("test.com", time.Now().Add(45*24*time.Hour))
+	assert.NoError(t, certs.Save("test.com", certPEM, keyPEM, certs.SourceACME))
+
+	output := CaptureOutput(func() {
+		assert.NoError(t, certsListCmd.RunE(certsListCmd, []string{}))
+	})
+
+	assert.Contains(t, output, "DOMAIN")
+	assert.Contains(t, output, "test.com")
+	assert.Contains(t, output, time.Now().Add(45*24*time.Hour).Format("2006-01-02"))
+}
+
+func TestCertsRenewSkipsValidCertificates(t *testing.T) {
+	setupCertsTest(t)
+
+	certPEM, keyPEM := testCertificate("valid.com", time.Now().Add(80*24*time.Hour))
+	assert.NoError(t, certs.Save("valid.com", certPEM, keyPEM, certs.SourceACME))
+	certPEM, keyPEM = testCertificate("expiring.com", time.Now().Add(5*24*time.Hour))
+	assert.NoError(t, certs.Save("expiring.com", certPEM, keyPEM, certs.SourceACME))
+
+	issuer := &fakeIssuer{}
+	oldNewCertIssuer := newCertIssuer
+	newCertIssuer = func(_ *cobra.Command) certIssuer { return issuer }
+	defer func() { newCertIssuer = oldNewCertIssuer }()
+
+	output := CaptureOutput(func() {
+		assert.NoError(t, certsRenewCmd.RunE(certsRenewCmd, []string{}))
+	})
+
+	assert.Contains(t, output, "valid.com: valid for")
+	assert.Contains(t, output, "Renewing certificate for expiring.com")
+	assert.Equal(t, []string{"expiring.com"}, issuer.obtained)
+}
+
+func TestCertsRenewUsesRecordedAccount(t *testing.T) {
+	setupCertsTest(t)
+
+	certPEM, keyPEM := testCertificate("pebble.com", time.Now().Add(5*24*time.Hour))
+	assert.NoError(t, certs.Save("pebble.com", certPEM, keyPEM, certs.SourceACME))
+	account := certs.ACMEAccount{DirectoryURL: "https://pebble:14000/dir", Email: "ops@pebble.com", Insecure: true}
+	assert.NoError(t, certs.SaveACMEAccount("pebble.com", account))
+
+	flagIssuer, accountIssuer := &fakeIssuer{}, &fakeIssuer{}
+	var used []certs.ACMEAccount
+	oldNewCertIssuer, oldNewACMEIssuer := newCertIssuer, newACMEIssuer
+	newCertIssuer = func(_ *cobra.Command) certIssuer { return flagIssuer }
+	newACMEIssuer = func(account certs.ACMEAccount) certIssuer {
+		used = append(used, account)
+		return accountIssuer
+	}
+	defer func() { newCertIssuer, newACMEIssuer = oldNewCertIssuer, oldNewACMEIssuer }()
+
+	CaptureOutput(func() {
+		assert.NoError(t, certsRenewCmd.RunE(certsRenewCmd, []string{"pebble.com"}))
+	})
+	assert.Equal(t, []certs.ACMEAccount{account}, used)
+	assert.Equal(t, []string{"pebble.com"}, accountIssuer.obtained)
+	assert.Empty(t, flagIssuer.obtained)
+
+	// --directory overrides the recorded account
+	certsRenewCmd.Flags().Set("directory", "https://acme.example.com/dir")
+	defer func() {
+		certsRenewCmd.Flags().Set("directory", "")
+		certsRenewCmd.Flags().Lookup("directory").Changed = false
+	}()
+	certsRenewCmd.Flags().Set("force", "true")
+	defer certsRenewCmd.Flags().Set("force", "false")
+	CaptureOutput(func() {
+		assert.NoError(t, certsRenewCmd.RunE(certsRenewCmd, []string{"pebble.com"}))
+	})
+	assert.Equal(t, []string{"pebble.com"}, flagIssuer.obtained)
+}
+
+func TestInstallCustomCertificate(t *testing.T) {
+	tempDir := setupCertsTest(t)
+
+	certPEM, keyPEM := testCertificate("shop.com", time.Now().Add(200*24*time.Hour))
+	certFile := filepath.Join(tempDir, "fullchain.pem")
+	keyFile := filepath.Join(tempDir, "key.pem")
+	assert.NoError(t, os.WriteFile(certFile, certPEM, 0644))
+	assert.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+
+	assert.NoError(t, installCustomCertificate("shop.com", certFile, keyFile))
+
+	c, err := certs.Load("shop.com")
+	assert.NoError(t, err)
+	assert.Equal(t, certs.SourceCustom, c.Source)
+
+	content, err := os.ReadFile(filepath.Join(tempDir, "sites-available", "shop.com.conf"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "ssl_certificate "+c.CertPath+";")
+
+	err = installCustomCertificate("other.com", certFile, keyFile)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not cover other.com")
+}
@@ -1,8 +1,13 @@
 package commands
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/ploycloud/ploy-server-cli/src/agent"
+	"github.com/ploycloud/ploy-server-cli/src/jobs"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
 	"github.com/ploycloud/ploy-server-cli/src/utils"
 	"github.com/spf13/cobra"
 )
@@ -11,16 +16,79 @@ var DeployCmd = &cobra.Command{
 	Use:   "deploy [repo]",
 	Short: "Deploy a repository to PloyCloud server",
 	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		repo := args[0]
 		fmt.Printf("Deploying repository: %s\n", repo)
+		host, _ := cmd.Flags().GetString("site")
+		if async, _ := cmd.Flags().GetBool("async"); async && host == "" {
+			return errUsage("--async requires --site")
+		}
+		if host != "" {
+			if queued, err := queueJob(cmd, jobs.TypeDeploy, host, agent.DeployRequest{Repo: repo}); queued || err != nil {
+				return err
+			}
+		}
+
+		// Deploys to a site go through the agent when one is configured
+		if host != "" {
+			client, err := agentClient()
+			if err != nil {
+				return err
+			}
+			if client != nil {
+				if err := client.Deploy(context.Background(), host, agent.DeployRequest{Repo: repo}); err != nil {
+					return fmt.Errorf("deploying: %w", err)
+				}
+				fmt.Println("Deployment successful!")
+				return nil
+			}
+		}
 
-		if err := utils.CloneRepo(repo); err != nil {
-			fmt.Printf("Error cloning repository: %v\n", err)
-			return
+		if err := cloneRepo(repo); err != nil {
+			return fmt.Errorf("cloning repository: %w", err)
 		}
 
 		// Add your deployment logic here
+
+		// Wait for the site serving this repository to answer before reporting success
+		if host != "" {
+			site, err := registry.Load(host)
+			if err != nil {
+				return fmt.Errorf("loading site: %w", err)
+			}
+			if err := waitForSiteReady(site, ""); err != nil {
+				return fmt.Errorf("deployment finished but the site is not healthy: %w", err)
+			}
+		}
+
 		fmt.Println("Deployment successful!")
+		return nil
 	},
 }
+
+func init() {
+	DeployCmd.Flags().String("site", "", "Site to health check after deploying (optional)")
+	DeployCmd.Flags().Bool("async", false, "Queue the deployment as a background job (requires --site)")
+}
+
+// deploySite deploys a repository to a site and waits for the site to be healthy
+func deploySite(site *registry.Site, repo string) error {
+	reportStep("clone repository")
+	if err := cloneRepo(repo); err != nil {
+		return err
+	}
+	reportStep("wait for health check")
+	if err := waitForSiteReady(site, ""); err != nil {
+		return fmt.Errorf("deployment finished but the site is not healthy: %w", err)
+	}
+	return nil
+}
+
+// cloneRepo clones the repository that is deployed
+func cloneRepo(repo string) error {
+	if runner.DryRun {
+		runner.Plan("clone %s into ./temp", repo)
+		return nil
+	}
+	return utils.CloneRepo(repo)
+}
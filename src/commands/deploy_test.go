@@ -29,6 +29,7 @@ func TestDeployCmd(t *testing.T) {
 		repo        string
 		mockClone   func(string) error
 		expectedOut string
+		expectedErr string
 	}{
 		{
 			name: "Successful deployment",
@@ -44,7 +45,8 @@ func TestDeployCmd(t *testing.T) {
 			mockClone: func(repo string) error {
 				return assert.AnError
 			},
-			expectedOut: "Deploying repository: https://github.com/example/fail-repo.git\nError cloning repository: assert.AnError general error for testing\n",
+			expectedOut: "Deploying repository: https://github.com/example/fail-repo.git\n",
+			expectedErr: "cloning repository: assert.AnError general error for testing",
 		},
 	}
 
@@ -52,11 +54,17 @@ func TestDeployCmd(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mockCloneRepo = tt.mockClone
 
+			var err error
 			output := CaptureOutput(func() {
-				DeployCmd.Run(DeployCmd, []string{tt.repo})
+				err = DeployCmd.RunE(DeployCmd, []string{tt.repo})
 			})
 
 			assert.Equal(t, tt.expectedOut, output)
+			if tt.expectedErr != "" {
+				assert.EqualError(t, err, tt.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
 		})
 	}
 }
@@ -0,0 +1,334 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/config"
+	"github.com/ploycloud/ploy-server-cli/src/docker"
+	"github.com/ploycloud/ploy-server-cli/src/doctor"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/spf13/cobra"
+)
+
+// Oldest Docker and Compose plugin versions ploy's compose files are tested with
+const (
+	minDockerVersion  = "20.10"
+	minComposeVersion = "2.0"
+)
+
+// Swapped out in tests
+var (
+	lookupHost    = net.DefaultResolver.LookupHost
+	inDockerGroup = userInDockerGroup
+	doctorDisks   = func() []string { return []string{common.ServicesDir, "/var/lib/docker"} }
+	listening     = doctor.Listening
+)
+
+var DoctorCmd = &cobra.Command{
+	Use:     "doctor",
+	Aliases: []string{"status"},
+	Short:   "Check that the server is set up to run sites",
+	Long: `Check Docker, sudo, the proxy, ports 80 and 443, MySQL, the DNS of every site, disk space, the clock and
+the permissions of ploy's directories. Each check passes, warns or fails with a hint on how to fix it. Exits
+non-zero when a check fails.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		results := runDoctorChecks()
+		if asJSON {
+			data, _ := json.MarshalIndent(results, "", "  ")
+			fmt.Println(string(data))
+		} else {
+			doctor.Print(os.Stdout, results)
+		}
+
+		if failed := doctor.Failed(results); failed > 0 {
+			return fmt.Errorf("%d check(s) failed", failed)
+		}
+		return nil
+	},
+}
+
+func init() {
+	DoctorCmd.Flags().Bool("json", false, "Print the results as JSON")
+}
+
+func runDoctorChecks() []doctor.Result {
+	var results []doctor.Result
+	results = append(results, checkDirectories()...)
+	results = append(results, checkDocker()...)
+	results = append(results, checkDockerGroup(), checkSudo())
+	proxyRunning, proxyResults := checkProxy()
+	results = append(results, proxyResults...)
+	results = append(results, checkPort(80, proxyRunning), checkPort(443, proxyRunning))
+	results = append(results, checkMySQL())
+	results = append(results, checkDNS()...)
+	for _, path := range doctorDisks() {
+		if _, err := os.Stat(path); err == nil {
+			results = append(results, doctor.Disk(path)...)
+		}
+	}
+	results = append(results, checkClock())
+	return results
+}
+
+// checkDirectories checks that ploy's directory exists and belongs to the user
+// running ploy. Only its direct entries are checked: site files and databases
+// belong to container users.
+func checkDirectories() []doctor.Result {
+	dir := common.ServicesDir
+	info, err := os.Stat(dir)
+	if err != nil {
+		return []doctor.Result{doctor.Failure("directories", fmt.Sprintf("%s does not exist", dir),
+			"Install ploy with the install script, or create it: mkdir -p "+dir)}
+	}
+	if !info.IsDir() || syscall.Access(dir, 2) != nil {
+		return []doctor.Result{doctor.Failure("directories", fmt.Sprintf("%s is not writable", dir),
+			"sudo chown -R $USER: "+dir)}
+	}
+
+	var results []doctor.Result
+	entries, _ := os.ReadDir(dir)
+	var foreign []string
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Geteuid() {
+			foreign = append(foreign, entry.Name())
+		}
+	}
+	if len(foreign) > 0 {
+		results = append(results, doctor.Warning("directories",
+			fmt.Sprintf("%s belong to another user: %s", dir, strings.Join(foreign, ", ")),
+			"sudo chown $USER: "+filepath.Join(dir, foreign[0])))
+	} else {
+		results = append(results, doctor.Passed("directories", fmt.Sprintf("%s is writable", dir)))
+	}
+
+	if info, err := os.Stat(common.CertsDir); err == nil && info.Mode().Perm()&0077 != 0 {
+		results = append(results, doctor.Warning("certificates",
+			fmt.Sprintf("%s is readable by other users (%04o)", common.CertsDir, info.Mode().Perm()),
+			"chmod 700 "+common.CertsDir))
+	}
+	return results
+}
+
+func checkDocker() []doctor.Result {
+	version, err := getDockerVersion()
+	if err != nil || version == "" {
+		return []doctor.Result{doctor.Failure("docker", "the Docker daemon is not reachable",
+			"Install Docker and start it: sudo systemctl enable --now docker")}
+	}
+	results := []doctor.Result{versionResult("docker", "Docker", version, minDockerVersion,
+		"Upgrade Docker: https://docs.docker.com/engine/install/")}
+
+	// The plugin every compose command of ploy runs, as installed by `ploy server init`
+	output, err := runner.Query(execCommand("docker", docker.ComposeVersionArgs()...))
+	if compose := strings.TrimSpace(string(output)); err != nil || compose == "" {
+		results = append(results, doctor.Failure("compose", "the Docker Compose plugin (docker compose) is not installed",
+			"sudo apt-get install docker-compose-v2 (docker-compose-plugin with Docker's own apt repository)"))
+	} else {
+		results = append(results, versionResult("compose", "Docker Compose", compose, minComposeVersion,
+			"sudo apt-get install --only-upgrade docker-compose-v2 (or docker-compose-plugin)"))
+	}
+	return results
+}
+
+func versionResult(check, name, version, min, hint string) doctor.Result {
+	if !doctor.VersionAtLeast(version, min) {
+		return doctor.Warning(check, fmt.Sprintf("%s %s is older than %s", name, version, min), hint)
+	}
+	return doctor.Passed(check, fmt.Sprintf("%s %s", name, version))
+}
+
+func checkDockerGroup() doctor.Result {
+	member, err := inDockerGroup()
+	switch {
+	case err != nil:
+		return doctor.Warning("docker group", fmt.Sprintf("cannot read group membership: %v", err), "")
+	case !member:
+		return doctor.Failure("docker group", "this user is not in the docker group",
+			"sudo usermod -aG docker $USER, then log in again")
+	}
+	return doctor.Passed("docker group", "this user can use Docker")
+}
+
+// userInDockerGroup reports whether the current user is root or in the docker group
+func userInDockerGroup() (bool, error) {
+	if os.Geteuid() == 0 {
+		return true, nil
+	}
+	current, err := user.Current()
+	if err != nil {
+		return false, err
+	}
+	group, err := user.LookupGroup("docker")
+	if err != nil {
+		var unknown user.UnknownGroupError
+		if errors.As(err, &unknown) {
+			return false, nil
+		}
+		return false, err
+	}
+	ids, err := current.GroupIds()
+	if err != nil {
+		return false, err
+	}
+	for _, id := range ids {
+		if id == group.Gid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkSudo checks that sudo works without a password, as ploy runs it with -n
+func checkSudo() doctor.Result {
+	if _, err := runner.Query(execSudo("true")); err != nil {
+		return doctor.Failure("sudo", "sudo asks for a password",
+			"Allow passwordless sudo for this user with a NOPASSWD rule in /etc/sudoers.d")
+	}
+	return doctor.Passed("sudo", "passwordless sudo works")
+}
+
+// checkProxy checks the configured proxy and reports whether it is running
+func checkProxy() (bool, []doctor.Result) {
+	p, err := loadProxy()
+	if err != nil {
+		return false, []doctor.Result{doctor.Failure("proxy", err.Error(), "Fix \"proxy:\" in "+config.Path())}
+	}
+	if p.Name() != config.ProxyNginx {
+		if running, _ := serviceRunning(p.Name()); !running {
+			return false, []doctor.Result{doctor.Failure("proxy", p.Name()+" is not running", "ploy proxy setup")}
+		}
+		results := []doctor.Result{doctor.Passed("proxy", p.Name()+" is running")}
+		if err := p.Validate(); err != nil {
+			return true, append(results, doctor.Failure(p.Name()+" config", err.Error(), "ploy proxy setup"))
+		}
+		return true, append(results, doctor.Passed(p.Name()+" config", "the "+p.Name()+" configuration is valid"))
+	}
+
+	if _, err := runner.Query(execCommand("nginx", "-v")); err != nil {
+		return false, []doctor.Result{doctor.Failure("nginx", "nginx is not installed", "ploy services install nginx-proxy")}
+	}
+	results := []doctor.Result{doctor.Passed("nginx", "nginx is installed")}
+
+	if _, err := runner.Query(execSudo("nginx", "-t")); err != nil {
+		message := "the nginx configuration is invalid"
+		var runErr *runner.Error
+		if errors.As(err, &runErr) && runErr.Stderr != "" {
+			lines := strings.Split(runErr.Stderr, "\n")
+			message += ": " + lines[0]
+		}
+		results = append(results, doctor.Failure("nginx config", message, "sudo nginx -t"))
+	} else {
+		results = append(results, doctor.Passed("nginx config", "the nginx configuration is valid"))
+	}
+
+	running, _ := serviceRunning("nginx-proxy")
+	if !running {
+		results = append(results, doctor.Failure("nginx service", "nginx is not active", "sudo systemctl enable --now nginx"))
+	} else {
+		results = append(results, doctor.Passed("nginx service", "nginx is active"))
+	}
+	return running, results
+}
+
+// checkPort checks that a web port is served by the proxy, or free for it
+func checkPort(port int, proxyRunning bool) doctor.Result {
+	check := "port " + strconv.Itoa(port)
+	inUse := listening(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	switch {
+	case inUse && !proxyRunning:
+		return doctor.Failure(check, fmt.Sprintf("port %d is taken by another program", port),
+			fmt.Sprintf("Find it with: sudo ss -ltnp 'sport = :%d'", port))
+	case !inUse && proxyRunning:
+		return doctor.Warning(check, fmt.Sprintf("the proxy is running but nothing listens on port %d", port),
+			"Check the listen directives of the proxy")
+	case inUse:
+		return doctor.Passed(check, fmt.Sprintf("port %d is served by the proxy", port))
+	}
+	return doctor.Passed(check, fmt.Sprintf("port %d is free", port))
+}
+
+// checkMySQL checks that the global MySQL container runs and answers, on servers
+// that use it
+func checkMySQL() doctor.Result {
+	if !mysqlInUse() {
+		return doctor.Passed("mysql", "MySQL is not installed and no site uses it")
+	}
+	name, err := queryMySQLContainer("{{.Names}}", false)
+	if err != nil || name == "" {
+		return doctor.Failure("mysql", "MySQL is not running", "ploy services start")
+	}
+	if _, err := runner.Query(execCommand("docker", "exec", name, "mysqladmin", "ping", "--silent")); err != nil {
+		return doctor.Failure("mysql", fmt.Sprintf("MySQL in %s does not answer", name), "docker logs "+name)
+	}
+	return doctor.Passed("mysql", fmt.Sprintf("MySQL in %s is reachable", name))
+}
+
+// checkDNS checks that every site domain resolves
+func checkDNS() []doctor.Result {
+	sites, err := registry.List()
+	if err != nil {
+		return []doctor.Result{doctor.Warning("dns", fmt.Sprintf("cannot list sites: %v", err), "")}
+	}
+
+	var results []doctor.Result
+	for _, site := range sites {
+		if strings.HasSuffix(site.Domain, ".localhost") {
+			continue
+		}
+		check := "dns " + site.Domain
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		addrs, err := lookupHost(ctx, site.Domain)
+		cancel()
+		if err != nil || len(addrs) == 0 {
+			results = append(results, doctor.Failure(check, fmt.Sprintf("%s does not resolve", site.Domain),
+				fmt.Sprintf("Point an A record for %s at this server", site.Domain)))
+			continue
+		}
+		results = append(results, doctor.Passed(check, fmt.Sprintf("%s resolves to %s", site.Domain, strings.Join(addrs, ", "))))
+	}
+	return results
+}
+
+// checkClock compares the clock with the PloyCloud API
+func checkClock() doctor.Result {
+	apiURL := config.DefaultAPIURL
+	if cfg, err := config.LoadConfig(); err == nil {
+		apiURL = cfg.APIURL
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	skew, err := doctor.ClockSkew(ctx, apiURL)
+	if err != nil {
+		return doctor.Warning("clock", fmt.Sprintf("cannot compare the clock with %s: %v", apiURL, err), "")
+	}
+	return doctor.Clock(skew)
+}
+
+func getDockerVersion() (string, error) {
+	cmd := execCommand("docker", "version", "--format", "{{.Server.Version}}")
+	output, err := runner.Query(cmd)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,181 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/doctor"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+// doctorServer describes the server the doctor checks see
+type doctorServer struct {
+	sudo       bool
+	nginxValid bool
+	nginxUp    bool
+	mysqlUp    bool
+	portsInUse bool
+	resolves   map[string][]string
+}
+
+func setupDoctorTest(t *testing.T, server *doctorServer) {
+	tempDir := setupCertsTest(t)
+
+	oldExecCommand, oldExecSudo := execCommand, execSudo
+	oldLookupHost, oldInDockerGroup, oldDoctorDisks, oldListening := lookupHost, inDockerGroup, doctorDisks, listening
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		args := strings.Join(arg, " ")
+		switch {
+		case name == "docker" && strings.HasPrefix(args, "version"):
+			return exec.Command("echo", "24.0.7")
+		case name == "docker" && strings.HasPrefix(args, "compose version"):
+			return exec.Command("echo", "2.24.5")
+		case name == "docker" && strings.HasPrefix(args, "ps") && server.mysqlUp:
+			return exec.Command("echo", "mysql")
+		case name == "docker" && strings.HasPrefix(args, "exec mysql mysqladmin"):
+			return exec.Command("echo", "mysqld is alive")
+		case name == "nginx":
+			return exec.Command("true")
+		case name == "systemctl" && server.nginxUp:
+			return exec.Command("echo", "active")
+		}
+		return exec.Command("false")
+	}
+	execSudo = func(name string, arg ...string) *exec.Cmd {
+		switch {
+		case !server.sudo:
+			return exec.Command("sh", "-c", "echo 'sudo: a password is required' >&2; exit 1")
+		case name == "nginx" && !server.nginxValid:
+			return exec.Command("sh", "-c", "echo 'nginx: [emerg] unknown directive \"proxy_pas\"' >&2; exit 1")
+		}
+		return exec.Command("true")
+	}
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if addrs, ok := server.resolves[host]; ok {
+			return addrs, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	inDockerGroup = func() (bool, error) { return true, nil }
+	doctorDisks = func() []string { return []string{tempDir} }
+	listening = func(addr string) bool { return server.portsInUse }
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}))
+	t.Setenv("PLOY_API_URL", api.URL)
+	t.Cleanup(func() {
+		api.Close()
+		execCommand, execSudo = oldExecCommand, oldExecSudo
+		lookupHost, inDockerGroup, doctorDisks, listening = oldLookupHost, oldInDockerGroup, oldDoctorDisks, oldListening
+	})
+
+	assert.NoError(t, registry.Save(&registry.Site{Domain: "shop.com", HostPort: 20010}))
+	assert.NoError(t, registry.Save(&registry.Site{Domain: "blog.com", HostPort: 20011}))
+	assert.NoError(t, registry.Save(&registry.Site{Domain: "dev.localhost", HostPort: 20012}))
+}
+
+func TestDoctorCmd(t *testing.T) {
+	setupDoctorTest(t, &doctorServer{sudo: true, nginxValid: true, nginxUp: true, mysqlUp: true, portsInUse: true,
+		resolves: map[string][]string{"shop.com": {"203.0.113.10"}, "blog.com": {"203.0.113.10"}}})
+
+	var err error
+	output := CaptureOutput(func() {
+		err = DoctorCmd.RunE(DoctorCmd, []string{})
+	})
+
+	assert.NoError(t, err)
+	assert.NotContains(t, output, "FAIL")
+	assert.Contains(t, output, "Docker 24.0.7")
+	assert.Contains(t, output, "Docker Compose 2.24.5")
+	assert.Contains(t, output, "passwordless sudo works")
+	assert.Contains(t, output, "the nginx configuration is valid")
+	assert.Contains(t, output, "port 443 is served by the proxy")
+	assert.Contains(t, output, "MySQL in mysql is reachable")
+	assert.Contains(t, output, "shop.com resolves to 203.0.113.10")
+	assert.NotContains(t, output, "dev.localhost")
+	assert.Contains(t, output, "clock is in sync")
+}
+
+func TestDoctorCmdFailures(t *testing.T) {
+	setupDoctorTest(t, &doctorServer{sudo: true, portsInUse: true,
+		resolves: map[string][]string{"shop.com": {"203.0.113.10"}}})
+
+	cmd := DoctorCmd
+	cmd.Flags().Set("json", "true")
+	defer cmd.Flags().Set("json", "false")
+
+	var err error
+	output := CaptureOutput(func() {
+		err = cmd.RunE(cmd, []string{})
+	})
+
+	var results []doctor.Result
+	assert.NoError(t, json.Unmarshal([]byte(output), &results))
+	byCheck := make(map[string]doctor.Result)
+	for _, r := range results {
+		byCheck[r.Check] = r
+	}
+
+	assert.Equal(t, doctor.Fail, byCheck["nginx config"].Status)
+	assert.Contains(t, byCheck["nginx config"].Message, `unknown directive "proxy_pas"`)
+	assert.Equal(t, doctor.Fail, byCheck["nginx service"].Status)
+	assert.Equal(t, doctor.Failure("port 80", "port 80 is taken by another program",
+		"Find it with: sudo ss -ltnp 'sport = :80'"), byCheck["port 80"])
+	assert.Equal(t, doctor.Fail, byCheck["mysql"].Status)
+	assert.Equal(t, doctor.Pass, byCheck["dns shop.com"].Status)
+	assert.Equal(t, doctor.Fail, byCheck["dns blog.com"].Status)
+	assert.Equal(t, "Point an A record for blog.com at this server", byCheck["dns blog.com"].Hint)
+	assert.EqualError(t, err, "6 check(s) failed")
+}
+
+func TestDoctorCmdWithoutSudo(t *testing.T) {
+	setupDoctorTest(t, &doctorServer{nginxUp: true, mysqlUp: true, portsInUse: true})
+
+	assert.Equal(t, doctor.Failure("sudo", "sudo asks for a password",
+		"Allow passwordless sudo for this user with a NOPASSWD rule in /etc/sudoers.d"), checkSudo())
+}
+
+func TestDoctorCheckMySQLWithExternalDatabases(t *testing.T) {
+	setupDoctorTest(t, &doctorServer{})
+	for _, domain := range []string{"shop.com", "blog.com", "dev.localhost"} {
+		site, err := registry.Load(domain)
+		assert.NoError(t, err)
+		site.Database = registry.Database{Source: "external", Host: "db.example.com", Port: "3306", Name: "wp"}
+		assert.NoError(t, registry.Save(site))
+	}
+
+	assert.Equal(t, doctor.Passed("mysql", "MySQL is not installed and no site uses it"), checkMySQL())
+	assert.NotContains(t, monitoredServices(), "mysql")
+
+	// A site on the internal database needs it running
+	assert.NoError(t, registry.Save(&registry.Site{Domain: "new.com", HostPort: 20013,
+		Database: registry.Database{Source: "internal"}}))
+	assert.Equal(t, doctor.Fail, checkMySQL().Status)
+	assert.Contains(t, monitoredServices(), "mysql")
+}
+
+func TestDoctorCheckDockerWithoutComposePlugin(t *testing.T) {
+	setupDoctorTest(t, &doctorServer{})
+	mockExec := execCommand
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		if name == "docker" && arg[0] == "compose" {
+			return exec.Command("false")
+		}
+		return mockExec(name, arg...)
+	}
+
+	results := checkDocker()
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, doctor.Fail, results[1].Status)
+		assert.Contains(t, results[1].Hint, "docker-compose-v2")
+	}
+}
@@ -0,0 +1,267 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/docker"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/ploycloud/ploy-server-cli/src/sitespec"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	SitesCmd.AddCommand(sitesDriftCmd)
+
+	sitesDriftCmd.Flags().Bool("all", false, "Check all sites")
+	sitesDriftCmd.Flags().Bool("fix", false, "Bring drifted sites back in line with their records")
+}
+
+var sitesDriftCmd = &cobra.Command{
+	Use:   "drift [host]",
+	Short: "Compare sites with their recorded configuration",
+	Long: `Compare each site's recorded configuration with this server: the compose file
+and nginx vhost with what ploy would render now, and the running containers' image,
+replica count and PHP version. Sites stopped with 'ploy sites stop' are only
+compared by their files and stay stopped. Exits with status 1 if any site has
+drifted, unless --fix rewrites the files and updates the containers.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		all, _ := cmd.Flags().GetBool("all")
+		fix, _ := cmd.Flags().GetBool("fix")
+
+		var sites []*registry.Site
+		switch {
+		case len(args) == 1 && all:
+			return errUsage("specify a host or --all, not both")
+		case len(args) == 1:
+			site, err := registry.Load(args[0])
+			if err != nil {
+				return fmt.Errorf("loading site: %w", err)
+			}
+			sites = append(sites, site)
+		case all:
+			var err error
+			if sites, err = registry.List(); err != nil {
+				return fmt.Errorf("listing sites: %w", err)
+			}
+		default:
+			return errUsage("specify a host or --all")
+		}
+		if len(sites) == 0 {
+			fmt.Println("No sites found.")
+			return nil
+		}
+
+		siteProxy, err := loadProxy()
+		if err != nil {
+			return fmt.Errorf("failed to load proxy configuration: %w", err)
+		}
+
+		drifted, failed := 0, 0
+		for _, site := range sites {
+			drift, err := detectDrift(site, siteProxy)
+			if err != nil {
+				color.Red("! %s: %v", site.Domain, err)
+				failed++
+				continue
+			}
+			printDrift(drift)
+			if len(drift.changes) == 0 {
+				continue
+			}
+			drifted++
+
+			if fix {
+				if err := fixDrift(drift); err != nil {
+					color.Red("%s: %v", site.Domain, err)
+					failed++
+					continue
+				}
+				color.Green("%s is back in line with its record", site.Domain)
+			}
+		}
+
+		switch {
+		case failed > 0 && fix:
+			return fmt.Errorf("%d site(s) could not be checked or fixed", failed)
+		case failed > 0:
+			return fmt.Errorf("%d site(s) could not be checked", failed)
+		case drifted > 0 && !fix:
+			return errors.New("some sites have drifted, run with --fix to correct them")
+		case drifted == 0:
+			color.Green("No drift found.")
+		}
+		return nil
+	},
+}
+
+// siteDrift is how a site on this server differs from its record
+type siteDrift struct {
+	site    *registry.Site
+	changes []sitespec.Change
+	// compose is set when the compose file is rewritten and the containers updated
+	compose bool
+	// pull is set when the containers run another PHP version than their image tag says
+	pull  bool
+	vhost bool
+}
+
+// detectDrift compares a site's compose file, vhost and running containers with
+// what its record produces. Each change goes from what is on the server to what
+// the record says.
+func detectDrift(site *registry.Site, siteProxy proxyProvider) (*siteDrift, error) {
+	drift := &siteDrift{site: site}
+	add := func(field, actual, recorded string) {
+		drift.changes = append(drift.changes, sitespec.Change{Field: field, From: actual, To: recorded})
+	}
+
+	rendered, err := renderSiteCompose(site)
+	if err != nil {
+		return nil, err
+	}
+	onDisk, err := os.ReadFile(site.ComposePath())
+	switch {
+	case err != nil:
+		add("compose file", "missing", "written")
+		drift.compose = true
+	case string(onDisk) != rendered:
+		add("compose file", "modified", "rewritten")
+		drift.compose = true
+	}
+
+	if siteProxy.Name() == "nginx" {
+		vhost, err := nginxSiteConfig(site.Domain)
+		if err != nil {
+			return nil, fmt.Errorf("rendering nginx configuration: %w", err)
+		}
+		installed, err := os.ReadFile(filepath.Join(nginxBasePath, "sites-available", site.Domain+".conf"))
+		switch {
+		case err != nil:
+			add("nginx vhost", "missing", "written")
+			drift.vhost = true
+		case string(installed) != vhost:
+			add("nginx vhost", "modified", "regenerated")
+			drift.vhost = true
+		}
+	}
+
+	// Without a compose file there are no containers of the site to inspect, and a
+	// stopped site is meant to have none
+	if onDisk == nil || site.Stopped {
+		return drift, nil
+	}
+	output, err := runner.Query(composeCommand(site.ComposePath(), "ps", "-q", "wordpress"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	ids := strings.Fields(string(output))
+	if len(ids) != site.Replicas {
+		add("replicas", strconv.Itoa(len(ids)), strconv.Itoa(site.Replicas))
+		drift.compose = true
+	}
+	if len(ids) == 0 {
+		return drift, nil
+	}
+
+	image, err := docker.ServiceImage(rendered, "wordpress")
+	if err != nil {
+		return nil, err
+	}
+	images, err := containerImages(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, running := range images {
+		if running != image {
+			add("image", running, image)
+			drift.compose = true
+		}
+	}
+
+	version, err := containerPHPVersion(ids[0])
+	if err != nil {
+		return nil, err
+	}
+	if version != site.PHPVersion {
+		add("php_version", version, site.PHPVersion)
+		drift.compose, drift.pull = true, true
+	}
+	return drift, nil
+}
+
+// containerImages returns the distinct images the containers were created from
+func containerImages(ids []string) ([]string, error) {
+	args := append([]string{"inspect", "--format", "{{.Config.Image}}"}, ids...)
+	output, err := runner.Query(execCommand("docker", args...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect containers: %w", err)
+	}
+	seen := map[string]bool{}
+	var images []string
+	for _, image := range strings.Fields(string(output)) {
+		if !seen[image] {
+			seen[image] = true
+			images = append(images, image)
+		}
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// containerPHPVersion returns the major and minor PHP version a container runs
+func containerPHPVersion(id string) (string, error) {
+	output, err := runner.Query(execCommand("docker", "exec", id, "php", "-r",
+		`echo PHP_MAJOR_VERSION . "." . PHP_MINOR_VERSION;`))
+	if err != nil {
+		return "", fmt.Errorf("failed to read the PHP version: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func printDrift(drift *siteDrift) {
+	if len(drift.changes) == 0 {
+		fmt.Printf("= %s (no drift)\n", drift.site.Domain)
+		return
+	}
+	color.Yellow("~ %s", drift.site.Domain)
+	for _, change := range drift.changes {
+		fmt.Printf("    %s\n", change)
+	}
+}
+
+// fixDrift rewrites the drifted files of a site and updates its containers
+func fixDrift(drift *siteDrift) error {
+	site := drift.site
+	if drift.pull && os.Getenv("PLOY_TEST_ENV") != "true" {
+		// The image tag is unchanged, so compose only recreates the containers after a pull
+		if err := runner.Run(composeCommand(site.ComposePath(), "pull", "wordpress")); err != nil {
+			return fmt.Errorf("failed to pull image: %w", err)
+		}
+	}
+	if drift.compose {
+		write := writeSiteCompose
+		if site.Stopped {
+			// The site stays stopped until `ploy sites start`
+			write = writeComposeFile
+		}
+		if err := write(site); err != nil {
+			return err
+		}
+	}
+	if drift.vhost {
+		if err := configureSiteProxy(site.Domain, ""); err != nil {
+			return fmt.Errorf("failed to update proxy configuration: %w", err)
+		}
+	}
+
+	createSiteLog(site.Name(), "Drift fixed")
+	return nil
+}
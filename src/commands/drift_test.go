@@ -0,0 +1,111 @@
+package commands
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/sitespec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSiteDrift(t *testing.T) {
+	tempDir, site := setupScaleTest(t)
+	site.PHPVersion = "8.3"
+	assert.NoError(t, registry.Save(site))
+
+	getDockerComposeTemplate = func(filename string) ([]byte, error) {
+		return []byte("services:\n  wordpress:\n    image: wordpress:php${PHP_VERSION}-apache\n" +
+			"    deploy:\n      replicas: ${REPLICAS}\n"), nil
+	}
+	running := "abc123"
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		args := strings.Join(arg, " ")
+		switch {
+		case name == "docker" && strings.Contains(args, " ps -q wordpress"):
+			return exec.Command("echo", running)
+		case name == "docker" && arg[0] == "inspect":
+			return exec.Command("printf", "wordpress:php8.2-apache\\n")
+		case name == "docker" && arg[0] == "exec":
+			return exec.Command("echo", "8.2")
+		}
+		return exec.Command("false")
+	}
+	siteProxy, err := loadProxy()
+	assert.NoError(t, err)
+
+	drift, err := detectDrift(site, siteProxy)
+	assert.NoError(t, err)
+	assert.Equal(t, []sitespec.Change{
+		{Field: "compose file", From: "missing", To: "written"},
+		{Field: "nginx vhost", From: "missing", To: "written"},
+	}, drift.changes)
+
+	assert.NoError(t, fixDrift(drift))
+	compose, err := os.ReadFile(site.ComposePath())
+	assert.NoError(t, err)
+	assert.Contains(t, string(compose), "image: wordpress:php8.3-apache")
+	_, err = os.Stat(filepath.Join(tempDir, "sites-available", "shop.com.conf"))
+	assert.NoError(t, err)
+
+	// The containers are still those of the previous PHP version
+	drift, err = detectDrift(site, siteProxy)
+	assert.NoError(t, err)
+	assert.Equal(t, []sitespec.Change{
+		{Field: "image", From: "wordpress:php8.2-apache", To: "wordpress:php8.3-apache"},
+		{Field: "php_version", From: "8.2", To: "8.3"},
+	}, drift.changes)
+	assert.True(t, drift.compose)
+	assert.True(t, drift.pull)
+	assert.False(t, drift.vhost)
+
+	// A hand edited vhost and a missing replica
+	running = ""
+	assert.NoError(t, os.WriteFile(filepath.Join(tempDir, "sites-available", "shop.com.conf"), []byte("server {}\n"), 0644))
+	drift, err = detectDrift(site, siteProxy)
+	assert.NoError(t, err)
+	assert.Equal(t, []sitespec.Change{
+		{Field: "nginx vhost", From: "modified", To: "regenerated"},
+		{Field: "replicas", From: "0", To: "1"},
+	}, drift.changes)
+
+	// A stopped site has no containers to compare
+	site.Stopped = true
+	drift, err = detectDrift(site, siteProxy)
+	assert.NoError(t, err)
+	assert.Equal(t, []sitespec.Change{{Field: "nginx vhost", From: "modified", To: "regenerated"}}, drift.changes)
+	assert.False(t, drift.compose)
+}
+
+func TestStopSiteIsRecorded(t *testing.T) {
+	setupScaleTest(t)
+	setupTest()
+
+	site, err := registry.Load("shop.com")
+	assert.NoError(t, err)
+	assert.NoError(t, stopSite(site))
+	site, err = registry.Load("shop.com")
+	assert.NoError(t, err)
+	assert.True(t, site.Stopped)
+
+	assert.NoError(t, startSite(site))
+	site, err = registry.Load("shop.com")
+	assert.NoError(t, err)
+	assert.False(t, site.Stopped)
+}
+
+func TestSitesDriftCmdUsage(t *testing.T) {
+	setupScaleTest(t)
+
+	sitesDriftCmd.Flags().Set("all", "true")
+	t.Cleanup(func() { sitesDriftCmd.Flags().Set("all", "false") })
+	err := sitesDriftCmd.RunE(sitesDriftCmd, []string{"shop.com"})
+	assert.Equal(t, ExitUsage, ExitCode(err))
+
+	sitesDriftCmd.Flags().Set("all", "false")
+	err = sitesDriftCmd.RunE(sitesDriftCmd, nil)
+	assert.Equal(t, ExitUsage, ExitCode(err))
+}
@@ -0,0 +1,109 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/ploycloud/ploy-server-cli/src/agent"
+	"github.com/ploycloud/ploy-server-cli/src/cloud"
+	"github.com/ploycloud/ploy-server-cli/src/jobs"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+)
+
+// Exit codes of ploy. They are documented in the README; scripts depend on them.
+const (
+	ExitFailure     = 1   // any other failure
+	ExitUsage       = 2   // invalid arguments or flags
+	ExitNotFound    = 3   // the site, job, certificate or file does not exist
+	ExitDependency  = 4   // a required program or service is missing
+	ExitDocker      = 5   // a docker or docker compose command failed
+	ExitPermission  = 6   // ploy lacks the permissions it needs
+	ExitInterrupted = 130 // interrupted by Ctrl-C or SIGTERM
+)
+
+// Error is a failure with the exit code ploy should end with
+type Error struct {
+	Code int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(code int, format string, args ...interface{}) error {
+	return &Error{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// UsageError marks an error as caused by invalid arguments or flags
+func UsageError(err error) error {
+	return &Error{Code: ExitUsage, Err: err}
+}
+
+func errUsage(format string, args ...interface{}) error {
+	return newError(ExitUsage, format, args...)
+}
+
+func errNotFound(format string, args ...interface{}) error {
+	return newError(ExitNotFound, format, args...)
+}
+
+func errDependency(format string, args ...interface{}) error {
+	return newError(ExitDependency, format, args...)
+}
+
+func errDocker(format string, args ...interface{}) error {
+	return newError(ExitDocker, format, args...)
+}
+
+func errPermission(format string, args ...interface{}) error {
+	return newError(ExitPermission, format, args...)
+}
+
+// ExitCode returns the exit code for an error returned by a command. Errors
+// that were not marked with a code are classified by their cause.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if errors.Is(err, runner.ErrInterrupted) {
+		return ExitInterrupted
+	}
+	var codeErr *Error
+	if errors.As(err, &codeErr) {
+		return codeErr.Code
+	}
+
+	switch {
+	case errors.Is(err, agent.ErrBadRequest):
+		return ExitUsage
+	case errors.Is(err, registry.ErrNotFound), errors.Is(err, jobs.ErrNotFound),
+		errors.Is(err, cloud.ErrNotRegistered), errors.Is(err, os.ErrNotExist):
+		return ExitNotFound
+	case errors.Is(err, exec.ErrNotFound):
+		return ExitDependency
+	case errors.Is(err, os.ErrPermission):
+		return ExitPermission
+	}
+
+	var runErr *runner.Error
+	if errors.As(err, &runErr) {
+		stderr := strings.ToLower(runErr.Stderr)
+		switch {
+		case strings.Contains(stderr, "permission denied"), strings.Contains(stderr, "password is required"):
+			return ExitPermission
+		case runErr.Program == "docker":
+			return ExitDocker
+		}
+	}
+	return ExitFailure
+}
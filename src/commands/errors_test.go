@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/ploycloud/ploy-server-cli/src/agent"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"no error", nil, 0},
+		{"plain error", errors.New("boom"), ExitFailure},
+		{"usage", errUsage("specify --site or --all"), ExitUsage},
+		{"invalid site request", fmt.Errorf("%w: invalid site type", agent.ErrBadRequest), ExitUsage},
+		{"missing site", fmt.Errorf("loading site: %w", registry.ErrNotFound), ExitNotFound},
+		{"missing file", &os.PathError{Op: "open", Path: "/etc/ploy/cert.pem", Err: os.ErrNotExist}, ExitNotFound},
+		{"missing program", &runner.Error{Cmdline: "certbot", ExitCode: -1, Err: exec.ErrNotFound}, ExitDependency},
+		{"docker", fmt.Errorf("starting site: %w", &runner.Error{Cmdline: "docker compose up -d", Program: "docker", ExitCode: 1, Err: errors.New("exit status 1")}), ExitDocker},
+		{"docker with sudo", &runner.Error{Cmdline: "cd /srv && sudo -n docker ps", Program: "docker", ExitCode: 1, Err: errors.New("exit status 1")}, ExitDocker},
+		{"not docker", &runner.Error{Cmdline: "dockerd-rootless-setuptool.sh install", Program: "dockerd-rootless-setuptool.sh", ExitCode: 1, Err: errors.New("exit status 1")}, ExitFailure},
+		{"sudo", &runner.Error{Cmdline: "sudo nginx -t", Program: "nginx", ExitCode: 1, Stderr: "sudo: a password is required", Err: errors.New("exit status 1")}, ExitPermission},
+		{"docker socket", &runner.Error{Cmdline: "docker ps", Program: "docker", ExitCode: 1, Stderr: "permission denied while trying to connect to the Docker daemon socket", Err: errors.New("exit status 1")}, ExitPermission},
+		{"interrupted", fmt.Errorf("backup: %w", &runner.Error{Cmdline: "mysqldump", ExitCode: -1, Err: runner.ErrInterrupted}), ExitInterrupted},
+		{"marked code wins", errDocker("starting containers: %w", registry.ErrNotFound), ExitDocker},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.code, ExitCode(tt.err))
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/bootstrap"
+	"github.com/ploycloud/ploy-server-cli/src/firewall"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/spf13/cobra"
+)
+
+var FirewallCmd = &cobra.Command{
+	Use:   "firewall",
+	Short: "Manage the firewall of this server",
+	Long: `Manage the firewall of this server with ufw, or nftables when ufw is not installed.
+
+The rules are kept in a ploy-owned ruleset in /etc/ploy/firewall.json. By default SSH,
+on the ports sshd listens on, HTTP and HTTPS are allowed and the port MySQL is published on is closed, including to
+containers Docker publishes, which bypass ufw's own rules.`,
+}
+
+func init() {
+	FirewallCmd.AddCommand(firewallStatusCmd)
+	FirewallCmd.AddCommand(firewallAllowCmd)
+	FirewallCmd.AddCommand(firewallDenyCmd)
+	FirewallCmd.AddCommand(firewallResetCmd)
+
+	firewallAllowCmd.Flags().String("from", "", "Only allow traffic from this address or network")
+	firewallDenyCmd.Flags().String("from", "", "Only deny traffic from this address or network")
+	firewallResetCmd.Flags().Int("ssh-port", 0, "Port to allow SSH on, when it cannot be found from the sshd configuration")
+}
+
+var firewallStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the firewall rules and whether they are applied",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rs, exists, err := loadFirewallRuleset(0)
+		if errors.Is(err, errSSHPortUnknown) {
+			// sshd only shows its configuration to root
+			port, _ := publishedMySQLPort()
+			rs, err = firewall.Default(nil, port), nil
+			color.Yellow("The SSH port could not be found, run the command with sudo to see it in the default rules")
+		}
+		if err != nil {
+			return err
+		}
+
+		backend := rs.Backend
+		if backend == "" {
+			backend, _ = detectFirewall()
+		}
+		if backend == "" {
+			fmt.Println("Backend: none, install ufw or nftables")
+		} else {
+			fmt.Printf("Backend: %s (%s)\n", backend, firewallState(backend))
+		}
+
+		fmt.Println("Rules:")
+		for _, rule := range rs.Ordered() {
+			fmt.Printf("  %-5s  %-9s  from %s\n", strings.ToUpper(string(rule.Action)), fmt.Sprintf("%d/%s", rule.Port, rule.Proto), rule.From)
+		}
+
+		switch {
+		case !exists:
+			color.Yellow("These are the default rules; apply them with 'sudo ploy firewall reset'")
+		case !rs.InSync():
+			color.Yellow("The ruleset changed since it was applied; apply it with 'sudo ploy server init firewall'")
+		}
+		if port, published := publishedMySQLPort(); published && !rs.Denies(port, "tcp") {
+			color.Red("MySQL is published on port %d and reachable from anywhere; close it with 'sudo ploy firewall deny %d'", port, port)
+		}
+		return nil
+	},
+}
+
+var firewallAllowCmd = &cobra.Command{
+	Use:   "allow <port>[/tcp|/udp]",
+	Short: "Allow incoming traffic to a port",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from, _ := cmd.Flags().GetString("from")
+		return setFirewallRule(firewall.Allow, args[0], from)
+	},
+}
+
+var firewallDenyCmd = &cobra.Command{
+	Use:   "deny <port>[/tcp|/udp]",
+	Short: "Deny incoming traffic to a port",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from, _ := cmd.Flags().GetString("from")
+		return setFirewallRule(firewall.Deny, args[0], from)
+	},
+}
+
+var firewallResetCmd = &cobra.Command{
+	Use:   "reset",
+	Short: "Replace the firewall rules with the defaults",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireFirewallRoot(); err != nil {
+			return err
+		}
+		sshPort, _ := cmd.Flags().GetInt("ssh-port")
+		rs, err := defaultFirewallRuleset(sshPort)
+		if err != nil {
+			return err
+		}
+
+		// The rules applied before are kept so they are removed from the backend
+		current, err := firewall.Load(initPath(firewall.RulesetPath))
+		if err == nil {
+			rs.Backend, rs.Applied = current.Backend, current.Applied
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := applyFirewall(rs); err != nil {
+			return err
+		}
+		color.Green("Firewall reset to the default rules")
+		return nil
+	},
+}
+
+func setFirewallRule(action firewall.Action, spec, from string) error {
+	rule, err := firewall.ParseRule(action, spec, from)
+	if err != nil {
+		return errUsage("%v", err)
+	}
+	if err := requireFirewallRoot(); err != nil {
+		return err
+	}
+	rs, _, err := loadFirewallRuleset(0)
+	if err != nil {
+		return err
+	}
+
+	rs.Set(rule)
+	if err := applyFirewall(rs); err != nil {
+		return err
+	}
+	color.Green("Firewall rule applied: %s", rule)
+	return nil
+}
+
+func requireFirewallRoot() error {
+	if !runner.DryRun && geteuid() != 0 {
+		return errPermission("the firewall can only be changed by root, run the command with sudo")
+	}
+	return nil
+}
+
+// errSSHPortUnknown is returned instead of default rules that would not allow SSH
+var errSSHPortUnknown = errUsage("could not find the port sshd listens on, give it with --ssh-port to " +
+	"'ploy firewall reset' or 'ploy server init firewall'")
+
+// loadFirewallRuleset loads the ploy ruleset, or returns the default rules, with
+// SSH allowed on sshPort or the ports sshd listens on, and false when there is
+// none yet
+func loadFirewallRuleset(sshPort int) (*firewall.Ruleset, bool, error) {
+	rs, err := firewall.Load(initPath(firewall.RulesetPath))
+	if errors.Is(err, os.ErrNotExist) {
+		rs, err := defaultFirewallRuleset(sshPort)
+		return rs, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return rs, true, nil
+}
+
+// defaultFirewallRuleset returns the default rules, with SSH allowed on sshPort or,
+// when it is 0, on the ports sshd listens on
+func defaultFirewallRuleset(sshPort int) (*firewall.Ruleset, error) {
+	var ports []int
+	switch {
+	case sshPort < 0 || sshPort > 65535:
+		return nil, errUsage("invalid SSH port %d", sshPort)
+	case sshPort > 0:
+		ports = []int{sshPort}
+	default:
+		ports = detectSSHPorts()
+	}
+	if len(ports) == 0 {
+		return nil, errSSHPortUnknown
+	}
+	port, _ := publishedMySQLPort()
+	return firewall.Default(ports, port), nil
+}
+
+// detectSSHPorts returns the ports of the sshd configuration, or those an sshd
+// process listens on when the configuration cannot be read. Both only work as root.
+func detectSSHPorts() []int {
+	if output, err := runner.Query(execCommand("sshd", "-T")); err == nil {
+		if ports := firewall.SSHDPorts(string(output)); len(ports) > 0 {
+			return ports
+		}
+	}
+	output, err := runner.Query(execCommand("ss", "-Hltnp"))
+	if err != nil {
+		return nil
+	}
+	return firewall.ListeningPorts(string(output), "sshd")
+}
+
+// applyFirewall reconciles the backend with the ruleset and records what was applied.
+// It refuses rules that would lock out SSH on a port sshd listens on.
+func applyFirewall(rs *firewall.Ruleset) error {
+	for _, port := range detectSSHPorts() {
+		if !rs.Allows(port, "tcp") {
+			return errUsage("sshd listens on port %d, which the firewall rules do not allow; "+
+				"allow it with 'sudo ploy firewall allow %d'", port, port)
+		}
+	}
+	if rs.Backend == "" {
+		backend, err := detectFirewall()
+		if err != nil {
+			return err
+		}
+		rs.Backend = backend
+	}
+
+	switch rs.Backend {
+	case firewall.Ufw:
+		afterRules, err := readInitFile(firewall.UfwAfterRules)
+		if err != nil {
+			return err
+		}
+		content := firewall.WithDockerUserRules(afterRules, firewall.DockerUserRules(rs))
+		if err := runner.WriteFile(initPath(firewall.UfwAfterRules), []byte(content), 0640); err != nil {
+			return err
+		}
+		if err := runInitCommands(firewall.UfwCommands(rs)...); err != nil {
+			return fmt.Errorf("applying ufw rules: %w", err)
+		}
+	case firewall.Nftables:
+		if err := runner.MkdirAll(filepath.Dir(initPath(firewall.NftPath)), 0755); err != nil {
+			return err
+		}
+		if err := runner.WriteFile(initPath(firewall.NftPath), []byte(firewall.NftTable(rs)), 0644); err != nil {
+			return err
+		}
+		if err := runInitCommands([]string{"nft", "-f", firewall.NftPath}); err != nil {
+			return fmt.Errorf("applying nftables rules: %w", err)
+		}
+		conf, err := readInitFile(firewall.NftConf)
+		if err != nil {
+			return err
+		}
+		if withInclude := bootstrap.WithLine(conf, firewall.NftInclude(firewall.NftPath)); withInclude != conf {
+			if err := runner.WriteFile(initPath(firewall.NftConf), []byte(withInclude), 0755); err != nil {
+				return err
+			}
+		}
+		if err := runInitCommands([]string{"systemctl", "enable", "nftables"}); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown firewall backend %q in %s", rs.Backend, firewall.RulesetPath)
+	}
+
+	rs.Applied = rs.Ordered()
+	return firewall.Save(initPath(firewall.RulesetPath), rs)
+}
+
+// firewallApplied reports whether the backend enforces the ruleset as it is
+func firewallApplied(rs *firewall.Ruleset) bool {
+	if !rs.InSync() {
+		return false
+	}
+	switch rs.Backend {
+	case firewall.Ufw:
+		afterRules, err := readInitFile(firewall.UfwAfterRules)
+		return err == nil && strings.Contains(afterRules, firewall.DockerUserRules(rs)) && firewallState(rs.Backend) == "active"
+	case firewall.Nftables:
+		table, err := readInitFile(firewall.NftPath)
+		return err == nil && table == firewall.NftTable(rs) && firewallState(rs.Backend) == "active"
+	}
+	return false
+}
+
+// detectFirewall returns the backend to use, preferring ufw
+func detectFirewall() (string, error) {
+	switch {
+	case queriesSucceed([]string{"ufw", "version"}):
+		return firewall.Ufw, nil
+	case queriesSucceed([]string{"nft", "--version"}):
+		return firewall.Nftables, nil
+	}
+	return "", errDependency("neither ufw nor nftables is installed, install ufw with 'apt-get install -y ufw'")
+}
+
+// firewallState returns whether the backend is active, inactive, or unknown when
+// it cannot be asked, as ufw only answers root
+func firewallState(backend string) string {
+	switch backend {
+	case firewall.Ufw:
+		output, err := runner.Query(execCommand("ufw", "status"))
+		if err != nil {
+			return "state unknown"
+		}
+		if strings.Contains(string(output), "Status: active") {
+			return "active"
+		}
+	case firewall.Nftables:
+		if queriesSucceed([]string{"nft", "list", "table", "inet", "ploy"}) {
+			return "active"
+		}
+	}
+	return "inactive"
+}
+
+// publishedMySQLPort returns the host port the global MySQL container is
+// published on, or the default port and false when it is not running
+func publishedMySQLPort() (int, bool) {
+	name, err := queryMySQLContainer("{{.Names}}", false)
+	if err != nil || name == "" {
+		return firewall.MySQLPort, false
+	}
+	output, err := runner.Query(execCommand("docker", "inspect", "--format", mysqlHostPortFormat, name))
+	if err != nil {
+		return firewall.MySQLPort, false
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		return firewall.MySQLPort, false
+	}
+	return port, true
+}
@@ -0,0 +1,140 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/firewall"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureColorOutput captures the output of f including the colored messages,
+// which are written to color.Output
+func captureColorOutput(f func()) string {
+	return CaptureOutput(func() {
+		oldOutput := color.Output
+		color.Output = os.Stdout
+		defer func() { color.Output = oldOutput }()
+		f()
+	})
+}
+
+func TestFirewallAllowDeny(t *testing.T) {
+	server := setupServerInitTest(t)
+	server.mysqlPort = "3307"
+
+	cmd := firewallAllowCmd
+	cmd.Flags().Set("from", "10.0.0.0/8")
+	defer cmd.Flags().Set("from", "")
+
+	var err error
+	output := captureColorOutput(func() {
+		err = cmd.RunE(cmd, []string{"3307"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, output, "Firewall rule applied: allow 3307/tcp from 10.0.0.0/8")
+
+	// The defaults close the published MySQL port and the new rule comes first
+	rs, err := firewall.Load(filepath.Join(server.root, firewall.RulesetPath))
+	assert.NoError(t, err)
+	assert.Equal(t, firewall.Ufw, rs.Backend)
+	assert.True(t, rs.InSync())
+	assert.Equal(t, "allow 3307/tcp from 10.0.0.0/8", rs.Applied[0].String())
+	assert.True(t, rs.Denies(3307, "tcp"))
+	assert.Contains(t, server.commands, "ufw allow proto tcp from 10.0.0.0/8 to any port 3307 comment ploy")
+	assert.Contains(t, server.read(t, firewall.UfwAfterRules), "--ctorigdstport 3307 -s 10.0.0.0/8 -j RETURN\n"+
+		"-A DOCKER-USER -p tcp -m conntrack --ctstate DNAT --ctorigdstport 3307 -j DROP\n")
+
+	// A changed ruleset is applied again from the top, so the order holds
+	server.commands = nil
+	CaptureOutput(func() {
+		err = firewallDenyCmd.RunE(firewallDenyCmd, []string{"8080"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, server.commands, "ufw delete allow proto tcp from 10.0.0.0/8 to any port 3307")
+	assert.Contains(t, server.commands, "ufw deny proto tcp from any to any port 8080 comment ploy")
+}
+
+func TestFirewallStatus(t *testing.T) {
+	server := setupServerInitTest(t)
+	server.mysqlPort = "3306"
+
+	output := captureColorOutput(func() {
+		assert.NoError(t, firewallStatusCmd.RunE(firewallStatusCmd, []string{}))
+	})
+	assert.Contains(t, output, "Backend: ufw (inactive)")
+	assert.Contains(t, output, "  DENY   3306/tcp   from any")
+	assert.Contains(t, output, "These are the default rules")
+
+	// A ruleset that leaves the published MySQL port open is flagged
+	rs := firewall.Default([]int{22}, 3306)
+	rs.Set(firewall.Rule{Action: firewall.Allow, Port: 3306, Proto: "tcp", From: firewall.Anywhere})
+	assert.NoError(t, firewall.Save(filepath.Join(server.root, firewall.RulesetPath), rs))
+
+	output = captureColorOutput(func() {
+		assert.NoError(t, firewallStatusCmd.RunE(firewallStatusCmd, []string{}))
+	})
+	assert.Contains(t, output, "The ruleset changed since it was applied")
+	assert.Contains(t, output, "MySQL is published on port 3306 and reachable from anywhere")
+}
+
+func TestFirewallErrors(t *testing.T) {
+	setupServerInitTest(t)
+
+	err := firewallAllowCmd.RunE(firewallAllowCmd, []string{"mysql"})
+	assert.Equal(t, ExitUsage, ExitCode(err))
+
+	geteuid = func() int { return 1000 }
+	err = firewallResetCmd.RunE(firewallResetCmd, []string{})
+	assert.Equal(t, ExitPermission, ExitCode(err))
+}
+
+func TestFirewallSSHPort(t *testing.T) {
+	server := setupServerInitTest(t)
+
+	// Without the port sshd listens on the firewall is not enabled
+	server.sshdConfig = ""
+	var err error
+	CaptureOutput(func() {
+		err = serverInitCmd.RunE(serverInitCmd, []string{"firewall"})
+	})
+	assert.Equal(t, ExitUsage, ExitCode(err))
+	assert.ErrorContains(t, err, "--ssh-port")
+	assert.NotContains(t, server.commands, "ufw --force enable")
+	assert.NoFileExists(t, filepath.Join(server.root, firewall.RulesetPath))
+
+	output := captureColorOutput(func() {
+		assert.NoError(t, firewallStatusCmd.RunE(firewallStatusCmd, []string{}))
+	})
+	assert.Contains(t, output, "The SSH port could not be found")
+
+	// The port can be given instead
+	serverInitCmd.Flags().Set("ssh-port", "2222")
+	defer serverInitCmd.Flags().Set("ssh-port", "0")
+	CaptureOutput(func() {
+		err = serverInitCmd.RunE(serverInitCmd, []string{"firewall"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, server.commands, "ufw allow proto tcp from any to any port 2222 comment ploy")
+	assert.NotContains(t, server.commands, "ufw allow proto tcp from any to any port 22 comment ploy")
+
+	// The defaults allow the ports sshd listens on
+	server.sshdConfig = "port 2200\nport 2222\n"
+	server.commands = nil
+	captureColorOutput(func() {
+		err = firewallResetCmd.RunE(firewallResetCmd, []string{})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, server.commands, "ufw allow proto tcp from any to any port 2200 comment ploy")
+	assert.Contains(t, server.commands, "ufw allow proto tcp from any to any port 2222 comment ploy")
+
+	// Rules that leave out a port sshd listens on are refused
+	server.sshdConfig = "port 2022\n"
+	server.commands = nil
+	err = firewallDenyCmd.RunE(firewallDenyCmd, []string{"8080"})
+	assert.Equal(t, ExitUsage, ExitCode(err))
+	assert.ErrorContains(t, err, "sshd listens on port 2022")
+	assert.NotContains(t, server.commands, "ufw deny proto tcp from any to any port 8080 comment ploy")
+}
@@ -0,0 +1,136 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/certs"
+	"github.com/ploycloud/ploy-server-cli/src/health"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/spf13/cobra"
+)
+
+// How long `sites new`, deploy and restart wait for a site to pass its health check
+var (
+	siteReadyTimeout  = 2 * time.Minute
+	siteReadyInterval = 2 * time.Second
+)
+
+// healthBaseURL returns the proxy address health checks are sent to. Sites served
+// over HTTPS are checked over HTTPS, since their HTTP vhost only redirects.
+var healthBaseURL = func(domain string) string {
+	if certs.Exists(domain) {
+		return "https://127.0.0.1:443"
+	}
+	if p, err := loadProxy(); err == nil && p.IssuesCertificates() {
+		return "https://127.0.0.1:443"
+	}
+	return "http://127.0.0.1:80"
+}
+
+func init() {
+	SitesCmd.AddCommand(sitesHealthCmd)
+	sitesHealthCmd.Flags().Bool("all", false, "Check every site")
+	sitesHealthCmd.Flags().Bool("json", false, "Print the results as JSON")
+}
+
+var sitesHealthCmd = &cobra.Command{
+	Use:   "health [host]",
+	Short: "Check that sites respond through the proxy",
+	Long:  `Request each site's health check path through the proxy with the site's Host header. Exits with status 1 if any site is unhealthy.`,
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		all, _ := cmd.Flags().GetBool("all")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		var sites []*registry.Site
+		switch {
+		case len(args) == 1:
+			site, err := registry.Load(args[0])
+			if err != nil {
+				return fmt.Errorf("loading site: %w", err)
+			}
+			sites = append(sites, site)
+		case all:
+			var err error
+			if sites, err = registry.List(); err != nil {
+				return fmt.Errorf("listing sites: %w", err)
+			}
+		default:
+			return errUsage("specify a host or --all")
+		}
+
+		results := make([]health.Result, 0, len(sites))
+		healthy := true
+		for _, site := range sites {
+			result := checkSiteHealth(context.Background(), site)
+			healthy = healthy && result.Healthy
+			results = append(results, result)
+		}
+
+		if asJSON {
+			data, _ := json.MarshalIndent(results, "", "  ")
+			fmt.Println(string(data))
+		} else if len(results) == 0 {
+			fmt.Println("No sites found.")
+		} else {
+			printHealthResults(results)
+		}
+
+		if !healthy {
+			return errors.New("some sites are unhealthy")
+		}
+		return nil
+	},
+}
+
+func printHealthResults(results []health.Result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SITE\tSTATE\tSTATUS\tLATENCY\tERROR")
+	for _, r := range results {
+		state := "up"
+		if !r.Healthy {
+			state = "down"
+		}
+		status := "-"
+		if r.Status != 0 {
+			status = fmt.Sprint(r.Status)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%dms\t%s\n", r.Site, state, status, r.LatencyMS, r.Error)
+	}
+	w.Flush()
+}
+
+// checkSiteHealth probes a site once through the proxy
+func checkSiteHealth(ctx context.Context, site *registry.Site) health.Result {
+	return health.Probe(ctx, healthBaseURL(site.Domain), site.Domain, site.HealthCheck)
+}
+
+// waitForSiteReady blocks until a site passes its health check, or fails once
+// siteReadyTimeout has passed
+func waitForSiteReady(site *registry.Site, webhook string) error {
+	if os.Getenv("PLOY_TEST_ENV") == "true" {
+		return nil
+	}
+	if runner.DryRun {
+		runner.Plan("wait for %s to pass its health check", site.Domain)
+		return nil
+	}
+
+	sendWebhook(webhook, fmt.Sprintf("Waiting for %s to become healthy...", site.Domain))
+	result, err := health.WaitReady(context.Background(), healthBaseURL(site.Domain), site.Domain,
+		site.HealthCheck, siteReadyTimeout, siteReadyInterval)
+	if err != nil {
+		sendWebhook(webhook, fmt.Sprintf("%s failed its health check: %v", site.Domain, err))
+		return err
+	}
+
+	sendWebhook(webhook, fmt.Sprintf("%s is healthy (HTTP %d in %dms)", site.Domain, result.Status, result.LatencyMS))
+	return nil
+}
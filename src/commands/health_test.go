@@ -0,0 +1,88 @@
+package commands
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/health"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupHealthTest(t *testing.T) {
+	setupNginxTest(t)
+
+	// Stands in for the proxy: shop.com is up, blog.com is down
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "shop.com" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	oldHealthBaseURL := healthBaseURL
+	healthBaseURL = func(domain string) string { return server.URL }
+	t.Cleanup(func() {
+		server.Close()
+		healthBaseURL = oldHealthBaseURL
+	})
+
+	assert.NoError(t, registry.Save(&registry.Site{Domain: "shop.com", HostPort: 20010}))
+	assert.NoError(t, registry.Save(&registry.Site{Domain: "blog.com", HostPort: 20011}))
+}
+
+func TestSitesHealthCmd(t *testing.T) {
+	setupHealthTest(t)
+	cmd := sitesHealthCmd
+
+	var err error
+	output := CaptureOutput(func() {
+		err = cmd.RunE(cmd, []string{"shop.com"})
+	})
+	assert.Contains(t, output, "SITE")
+	assert.Contains(t, output, "shop.com")
+	assert.Contains(t, output, "up")
+	assert.NoError(t, err)
+
+	cmd.Flags().Set("all", "true")
+	cmd.Flags().Set("json", "true")
+	defer cmd.Flags().Set("all", "false")
+	defer cmd.Flags().Set("json", "false")
+
+	output = CaptureOutput(func() {
+		err = cmd.RunE(cmd, []string{})
+	})
+	var results []health.Result
+	assert.NoError(t, json.Unmarshal([]byte(output), &results))
+	assert.Len(t, results, 2)
+	assert.Equal(t, "blog.com", results[0].Site)
+	assert.False(t, results[0].Healthy)
+	assert.Equal(t, http.StatusBadGateway, results[0].Status)
+	assert.True(t, results[1].Healthy)
+	assert.EqualError(t, err, "some sites are unhealthy")
+}
+
+func TestWaitForSiteReady(t *testing.T) {
+	setupHealthTest(t)
+	os.Unsetenv("PLOY_TEST_ENV")
+	defer os.Setenv("PLOY_TEST_ENV", "true")
+
+	oldTimeout, oldInterval := siteReadyTimeout, siteReadyInterval
+	siteReadyTimeout, siteReadyInterval = 100*time.Millisecond, 10*time.Millisecond
+	defer func() { siteReadyTimeout, siteReadyInterval = oldTimeout, oldInterval }()
+
+	shop, err := registry.Load("shop.com")
+	assert.NoError(t, err)
+	assert.NoError(t, waitForSiteReady(shop, ""))
+
+	blog, err := registry.Load("blog.com")
+	assert.NoError(t, err)
+	err = waitForSiteReady(blog, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "blog.com did not become healthy")
+}
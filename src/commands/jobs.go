@@ -0,0 +1,504 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/agent"
+	"github.com/ploycloud/ploy-server-cli/src/jobs"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/spf13/cobra"
+)
+
+// maxJobLogChunk caps how much of a job log is returned at once
+const maxJobLogChunk = 1 << 20
+
+// jobLogPoll is how often `jobs logs -f` checks for new output
+var jobLogPoll = time.Second
+
+// reportStep marks the start of a stage of a long operation. Jobs record steps
+// so their progress shows up in `ploy jobs show`.
+var reportStep = func(name string) {}
+
+var JobsCmd = &cobra.Command{
+	Use:   "jobs",
+	Short: "List, follow and cancel background jobs",
+	Long:  `Long operations started with --async run as jobs in the background, one at a time per site. Jobs are run by the ploy agent, or by "ploy jobs worker" when no agent is configured.`,
+}
+
+func init() {
+	JobsCmd.AddCommand(jobsListCmd)
+	JobsCmd.AddCommand(jobsShowCmd)
+	JobsCmd.AddCommand(jobsLogsCmd)
+	JobsCmd.AddCommand(jobsCancelCmd)
+	JobsCmd.AddCommand(jobsWorkerCmd)
+	JobsCmd.AddCommand(jobsExecCmd)
+
+	jobsListCmd.Flags().String("site", "", "Only list jobs of this site")
+	jobsListCmd.Flags().Int("limit", 20, "Number of most recent jobs to list (0 for all)")
+	jobsListCmd.Flags().Bool("json", false, "Print jobs as JSON")
+	jobsShowCmd.Flags().Bool("json", false, "Print the job as JSON")
+	jobsLogsCmd.Flags().BoolP("follow", "f", false, "Keep printing output until the job finishes")
+}
+
+var jobsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List jobs",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		site, _ := cmd.Flags().GetString("site")
+		limit, _ := cmd.Flags().GetInt("limit")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		api, _, err := jobsAPI()
+		if err != nil {
+			return err
+		}
+		list, err := api.Jobs(context.Background())
+		if err != nil {
+			return fmt.Errorf("listing jobs: %w", err)
+		}
+
+		var selected []jobs.Job
+		for _, job := range list {
+			if site == "" || job.Site == site {
+				selected = append(selected, job)
+			}
+		}
+		if limit > 0 && len(selected) > limit {
+			selected = selected[len(selected)-limit:]
+		}
+
+		if asJSON {
+			data, _ := json.MarshalIndent(selected, "", "  ")
+			fmt.Println(string(data))
+			return nil
+		}
+		if len(selected) == 0 {
+			fmt.Println("No jobs found.")
+			return nil
+		}
+		now := time.Now()
+		fmt.Printf("%-24s %-12s %-24s %-10s %-20s %s\n", "ID", "TYPE", "SITE", "STATE", "CREATED", "DURATION")
+		for _, job := range selected {
+			fmt.Printf("%-24s %-12s %-24s %-10s %-20s %s\n", job.ID, job.Type, job.Site, job.State,
+				job.CreatedAt.Local().Format("2006-01-02 15:04:05"), job.Duration(now).Round(time.Second))
+		}
+		return nil
+	},
+}
+
+var jobsShowCmd = &cobra.Command{
+	Use:   "show [id]",
+	Short: "Show a job and its steps",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		api, _, err := jobsAPI()
+		if err != nil {
+			return err
+		}
+		job, err := api.Job(context.Background(), args[0])
+		if err != nil {
+			return err
+		}
+
+		if asJSON {
+			data, _ := json.MarshalIndent(job, "", "  ")
+			fmt.Println(string(data))
+			return nil
+		}
+		printJob(job, time.Now())
+		return nil
+	},
+}
+
+var jobsLogsCmd = &cobra.Command{
+	Use:   "logs [id]",
+	Short: "Print the output of a job",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		follow, _ := cmd.Flags().GetBool("follow")
+
+		api, _, err := jobsAPI()
+		if err != nil {
+			return err
+		}
+		return printJobLog(api, args[0], follow)
+	},
+}
+
+var jobsCancelCmd = &cobra.Command{
+	Use:   "cancel [id]",
+	Short: "Cancel a queued or running job",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		api, _, err := jobsAPI()
+		if err != nil {
+			return err
+		}
+		job, err := api.CancelJob(context.Background(), args[0])
+		if err != nil {
+			return fmt.Errorf("cancelling job: %w", err)
+		}
+		if job.State == jobs.Canceled {
+			color.Green("Job %s cancelled", job.ID)
+			return nil
+		}
+		color.Green("Job %s is being stopped", job.ID)
+		return nil
+	},
+}
+
+var jobsWorkerCmd = &cobra.Command{
+	Use:   "worker",
+	Short: "Run queued jobs in the foreground",
+	Long:  `Run queued jobs until interrupted. The ploy agent runs the same worker, so this is only needed on servers without an agent.`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		fmt.Println("Waiting for jobs...")
+		if err := jobs.NewWorker(runJobProcess).Run(ctx); err != nil {
+			return fmt.Errorf("running jobs: %w", err)
+		}
+		return nil
+	},
+}
+
+// jobsExecCmd runs a single job. The worker starts it as a child process so a
+// cancelled job can be stopped together with everything it started.
+var jobsExecCmd = &cobra.Command{
+	Use:    "exec [id]",
+	Short:  "Run a single job",
+	Hidden: true,
+	Args:   cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		job, err := jobs.Load(args[0])
+		if err != nil {
+			return err
+		}
+
+		reportStep = func(name string) {
+			fmt.Printf("==> %s\n", name)
+			if err := job.StartStep(name); err != nil {
+				color.Red("Error recording step: %v", err)
+			}
+		}
+		if err := runJob(job, newCertIssuer(cmd)); err != nil {
+			job.Error = err.Error()
+			job.Save()
+			return err
+		}
+		return nil
+	},
+}
+
+// jobAPI is implemented by the agent client and, for servers without an agent,
+// by agentBackend reading the local job directory
+type jobAPI interface {
+	Jobs(ctx context.Context) ([]jobs.Job, error)
+	Job(ctx context.Context, id string) (jobs.Job, error)
+	Enqueue(ctx context.Context, req agent.JobRequest) (jobs.Job, error)
+	CancelJob(ctx context.Context, id string) (jobs.Job, error)
+	JobLog(ctx context.Context, id string, offset int64) ([]byte, error)
+}
+
+// jobsAPI returns where jobs are queued and read, and whether that is the agent
+func jobsAPI() (jobAPI, bool, error) {
+	client, err := agentClient()
+	if err != nil {
+		return nil, false, err
+	}
+	if client != nil {
+		return client, true, nil
+	}
+	return &agentBackend{}, false, nil
+}
+
+// queueJob queues the command as a job instead of running it when --async is set.
+// It returns false when the command should run in the foreground.
+func queueJob(cmd *cobra.Command, jobType, site string, params interface{}) (bool, error) {
+	if async, _ := cmd.Flags().GetBool("async"); !async {
+		return false, nil
+	}
+	if runner.DryRun {
+		runner.Plan("queue a %s job; this is what it would do:", jobType)
+		return false, nil
+	}
+
+	req := agent.JobRequest{Type: jobType, Site: site}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return true, err
+		}
+		req.Params = data
+	}
+
+	api, viaAgent, err := jobsAPI()
+	if err != nil {
+		return true, err
+	}
+	job, err := api.Enqueue(context.Background(), req)
+	if err != nil {
+		return true, fmt.Errorf("queueing job: %w", err)
+	}
+
+	color.Green("Queued job %s", job.ID)
+	if !viaAgent {
+		fmt.Println("No agent is configured: the job runs once `ploy jobs worker` is running.")
+	}
+	fmt.Printf("Follow it with `ploy jobs logs -f %s`\n", job.ID)
+	return true, nil
+}
+
+// newJob validates a job request and queues it
+func newJob(req agent.JobRequest) (*jobs.Job, error) {
+	switch req.Type {
+	case jobs.TypeCreateSite:
+		var site agent.SiteRequest
+		if err := decodeJobParams(req.Params, &site); err != nil {
+			return nil, err
+		}
+		if site.Domain == "" {
+			return nil, fmt.Errorf("%w: domain is required", agent.ErrBadRequest)
+		}
+		req.Site = site.Domain
+	case jobs.TypeDeploy:
+		var deploy agent.DeployRequest
+		if err := decodeJobParams(req.Params, &deploy); err != nil {
+			return nil, err
+		}
+		if deploy.Repo == "" {
+			return nil, fmt.Errorf("%w: repo is required", agent.ErrBadRequest)
+		}
+	case jobs.TypeDeleteSite, jobs.TypeStartSite, jobs.TypeStopSite, jobs.TypeBackup:
+	default:
+		return nil, fmt.Errorf("%w: unknown job type %q", agent.ErrBadRequest, req.Type)
+	}
+
+	if req.Type != jobs.TypeCreateSite {
+		if _, err := registry.Load(req.Site); err != nil {
+			return nil, err
+		}
+	}
+
+	spec := jobs.Spec{Type: req.Type, Site: req.Site, CommandID: req.CommandID}
+	if len(req.Params) > 0 {
+		spec.Params = req.Params
+	}
+	return jobs.New(spec)
+}
+
+func decodeJobParams(data json.RawMessage, v interface{}) error {
+	if len(data) == 0 {
+		return fmt.Errorf("%w: params are required", agent.ErrBadRequest)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: invalid params: %w", agent.ErrBadRequest, err)
+	}
+	return nil
+}
+
+// runJob carries out a job with the same functions the commands use
+func runJob(job *jobs.Job, issuer certIssuer) error {
+	if job.Type == jobs.TypeCreateSite {
+		var req agent.SiteRequest
+		if err := decodeJobParams(job.Params, &req); err != nil {
+			return err
+		}
+		return createSite(req, issuer)
+	}
+
+	site, err := registry.Load(job.Site)
+	if err != nil {
+		return err
+	}
+	switch job.Type {
+	case jobs.TypeDeleteSite:
+		return deleteSite(site)
+	case jobs.TypeStartSite:
+		return startSite(site)
+	case jobs.TypeStopSite:
+		return stopSite(site)
+	case jobs.TypeDeploy:
+		var req agent.DeployRequest
+		if err := decodeJobParams(job.Params, &req); err != nil {
+			return err
+		}
+		return deploySite(site, req.Repo)
+	case jobs.TypeBackup:
+		result, err := backupSite(site)
+		if err == nil {
+			fmt.Printf("Backup written to %s (%d bytes)\n", result.Path, result.Size)
+		}
+		return err
+	}
+	return fmt.Errorf("unknown job type %q", job.Type)
+}
+
+// runJobProcess runs a job in a `ploy jobs exec` child process with its own
+// process group, so cancelling the job also stops the docker and git commands it
+// started
+func runJobProcess(ctx context.Context, job *jobs.Job, log io.Writer) error {
+	binary, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, binary, "jobs", "exec", job.ID)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 30 * time.Second
+	return cmd.Run()
+}
+
+// readJobLog returns a job's log from offset onwards, at most maxJobLogChunk bytes
+func readJobLog(job *jobs.Job, offset int64) ([]byte, error) {
+	f, err := os.Open(job.LogPath)
+	if os.IsNotExist(err) {
+		// The job has not started yet
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(f, maxJobLogChunk))
+}
+
+// printJobLog prints a job's log. With follow it keeps printing new output until
+// the job finishes.
+func printJobLog(api jobAPI, id string, follow bool) error {
+	ctx := context.Background()
+	var offset int64
+	for {
+		// Check the state before reading, so output written just before the job
+		// finished is not missed
+		job, err := api.Job(ctx, id)
+		if err != nil {
+			return err
+		}
+		data, err := api.JobLog(ctx, id, offset)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(data))
+		offset += int64(len(data))
+
+		if len(data) == maxJobLogChunk {
+			continue
+		}
+		if !follow || job.State.Done() {
+			if follow && job.State != jobs.Succeeded {
+				return fmt.Errorf("job %s", job.State)
+			}
+			return nil
+		}
+		time.Sleep(jobLogPoll)
+	}
+}
+
+func printJob(job jobs.Job, now time.Time) {
+	fmt.Printf("ID:       %s\n", job.ID)
+	fmt.Printf("Type:     %s\n", job.Type)
+	if job.Site != "" {
+		fmt.Printf("Site:     %s\n", job.Site)
+	}
+	fmt.Printf("State:    %s\n", job.State)
+	fmt.Printf("Created:  %s\n", job.CreatedAt.Local().Format(time.RFC3339))
+	if job.StartedAt != nil {
+		fmt.Printf("Started:  %s\n", job.StartedAt.Local().Format(time.RFC3339))
+	}
+	if job.FinishedAt != nil {
+		fmt.Printf("Finished: %s\n", job.FinishedAt.Local().Format(time.RFC3339))
+	}
+	if job.StartedAt != nil {
+		fmt.Printf("Duration: %s\n", job.Duration(now).Round(time.Second))
+	}
+	if job.Error != "" {
+		fmt.Printf("Error:    %s\n", job.Error)
+	}
+	fmt.Printf("Log:      %s\n", job.LogPath)
+
+	if len(job.Steps) > 0 {
+		fmt.Println("\nSteps:")
+		for _, step := range job.Steps {
+			end := now
+			if step.FinishedAt != nil {
+				end = *step.FinishedAt
+			}
+			fmt.Printf("  %-10s %-30s %s\n", step.State, step.Name, end.Sub(step.StartedAt).Round(time.Second))
+		}
+	}
+}
+
+// Job operations of agentBackend. Without an agent the commands use them
+// directly on the local job directory.
+
+func (b *agentBackend) Jobs(ctx context.Context) ([]jobs.Job, error) {
+	list, err := jobs.List()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]jobs.Job, len(list))
+	for i, job := range list {
+		result[i] = *job
+	}
+	return result, nil
+}
+
+func (b *agentBackend) Job(ctx context.Context, id string) (jobs.Job, error) {
+	job, err := jobs.Load(id)
+	if err != nil {
+		return jobs.Job{}, err
+	}
+	return *job, nil
+}
+
+func (b *agentBackend) Enqueue(ctx context.Context, req agent.JobRequest) (jobs.Job, error) {
+	job, err := newJob(req)
+	if err != nil {
+		return jobs.Job{}, err
+	}
+	if b.worker != nil {
+		b.worker.Wake()
+	}
+	return *job, nil
+}
+
+func (b *agentBackend) CancelJob(ctx context.Context, id string) (jobs.Job, error) {
+	job, err := jobs.Cancel(id)
+	if job == nil {
+		return jobs.Job{}, err
+	}
+	return *job, err
+}
+
+func (b *agentBackend) JobLog(ctx context.Context, id string, offset int64) ([]byte, error) {
+	job, err := jobs.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	return readJobLog(job, offset)
+}
@@ -0,0 +1,117 @@
+package commands
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/agent"
+	"github.com/ploycloud/ploy-server-cli/src/jobs"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSitesBackupAsync(t *testing.T) {
+	setupStatsTest(t)
+
+	cmd := sitesBackupCmd
+	cmd.Flags().Set("async", "true")
+	defer cmd.Flags().Set("async", "false")
+
+	output := CaptureOutput(func() { assert.NoError(t, cmd.RunE(cmd, []string{"shop.com"})) })
+	list, err := jobs.List()
+	assert.NoError(t, err)
+	if !assert.Len(t, list, 1) {
+		return
+	}
+	job := list[0]
+	assert.Contains(t, output, "ploy jobs logs -f "+job.ID)
+	assert.Contains(t, output, "ploy jobs worker")
+	assert.Equal(t, jobs.TypeBackup, job.Type)
+	assert.Equal(t, "shop.com", job.Site)
+
+	// The worker runs the job through `ploy jobs exec`
+	oldReportStep := reportStep
+	defer func() { reportStep = oldReportStep }()
+	output = CaptureOutput(func() { assert.NoError(t, jobsExecCmd.RunE(jobsExecCmd, []string{job.ID})) })
+	assert.Contains(t, output, "==> dump database\n==> write archive\n")
+	assert.Contains(t, output, "Backup written to ")
+
+	job, err = jobs.Load(job.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, job.Steps, 2) {
+		assert.Equal(t, "dump database", job.Steps[0].Name)
+		assert.Equal(t, jobs.Succeeded, job.Steps[0].State)
+		assert.Equal(t, jobs.Running, job.Steps[1].State)
+	}
+	site, err := registry.Load("shop.com")
+	assert.NoError(t, err)
+	assert.False(t, site.BackedUpAt.IsZero())
+}
+
+func TestNewJobValidation(t *testing.T) {
+	setupStatsTest(t)
+
+	_, err := newJob(agent.JobRequest{Type: jobs.TypeBackup, Site: "missing.com"})
+	assert.ErrorIs(t, err, registry.ErrNotFound)
+
+	_, err = newJob(agent.JobRequest{Type: jobs.TypeDeploy, Site: "shop.com", Params: []byte(`{}`)})
+	assert.ErrorIs(t, err, agent.ErrBadRequest)
+
+	_, err = newJob(agent.JobRequest{Type: "site.explode", Site: "shop.com"})
+	assert.ErrorIs(t, err, agent.ErrBadRequest)
+
+	job, err := newJob(agent.JobRequest{Type: jobs.TypeCreateSite, Params: []byte(`{"type":"wp","domain":"new.com"}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, "new.com", job.Site)
+}
+
+func TestJobsListAndCancel(t *testing.T) {
+	setupStatsTest(t)
+
+	job, err := newJob(agent.JobRequest{Type: jobs.TypeStopSite, Site: "blog.com"})
+	assert.NoError(t, err)
+
+	CaptureOutput(func() { assert.NoError(t, jobsCancelCmd.RunE(jobsCancelCmd, []string{job.ID})) })
+	assert.True(t, jobs.CancelRequested(job.ID))
+
+	output := CaptureOutput(func() { assert.NoError(t, jobsListCmd.RunE(jobsListCmd, nil)) })
+	assert.Contains(t, output, job.ID)
+	assert.Contains(t, output, "site.stop")
+	assert.Contains(t, output, "canceled")
+
+	output = CaptureOutput(func() { assert.NoError(t, jobsShowCmd.RunE(jobsShowCmd, []string{job.ID})) })
+	assert.Contains(t, output, "State:    canceled\n")
+	assert.Contains(t, output, "Site:     blog.com\n")
+
+	// A finished job cannot be cancelled again
+	err = jobsCancelCmd.RunE(jobsCancelCmd, []string{job.ID})
+	assert.Error(t, err)
+}
+
+func TestFollowJobLog(t *testing.T) {
+	setupStatsTest(t)
+	oldJobLogPoll := jobLogPoll
+	jobLogPoll = 10 * time.Millisecond
+	defer func() { jobLogPoll = oldJobLogPoll }()
+
+	job, err := newJob(agent.JobRequest{Type: jobs.TypeBackup, Site: "shop.com"})
+	assert.NoError(t, err)
+	job.State = jobs.Running
+	assert.NoError(t, job.Save())
+	assert.NoError(t, os.WriteFile(job.LogPath, []byte("==> dump database\n"), 0600))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f, _ := os.OpenFile(job.LogPath, os.O_WRONLY|os.O_APPEND, 0600)
+		f.WriteString("==> write archive\n")
+		f.Close()
+		job.Finish(jobs.Succeeded, nil)
+		job.Save()
+	}()
+
+	var followErr error
+	output := CaptureOutput(func() { followErr = printJobLog(&agentBackend{}, job.ID, true) })
+	assert.NoError(t, followErr)
+	assert.Equal(t, "==> dump database\n==> write archive\n", output)
+}
@@ -5,23 +5,22 @@ import (
 	"github.com/ploycloud/ploy-server-cli/src/docker"
 	"github.com/ploycloud/ploy-server-cli/src/utils"
 	"github.com/spf13/cobra"
-	"os"
 )
 
 var StartCmd = &cobra.Command{
 	Use:   "start",
 	Short: "Start the site in the current directory",
 	Long:  "Start the Docker container for the site in the current directory",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		composePath := utils.FindComposeFile()
 		if composePath == "" {
-			color.Red("No docker-compose.yml file found.")
-			return
+			return errNotFound("no docker-compose.yml file found")
 		}
 
 		if err := docker.RunCompose(composePath, "up", "-d"); err != nil {
-			color.Red("Error starting container:", err)
+			return errDocker("starting containers: %w", err)
 		}
+		return nil
 	},
 }
 
@@ -29,16 +28,16 @@ var StopCmd = &cobra.Command{
 	Use:   "stop",
 	Short: "Stop the site in the current directory",
 	Long:  "Stop the Docker container for the site in the current directory",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		composePath := utils.FindComposeFile()
 		if composePath == "" {
-			color.Red("No docker-compose.yml file found.")
-			return
+			return errNotFound("no docker-compose.yml file found")
 		}
 
 		if err := docker.RunCompose(composePath, "down"); err != nil {
-			color.Red("Error stopping container:", err)
+			return errDocker("stopping containers: %w", err)
 		}
+		return nil
 	},
 }
 
@@ -46,34 +45,33 @@ var RestartCmd = &cobra.Command{
 	Use:   "restart",
 	Short: "Restart the site in the current directory",
 	Long:  "Restart the Docker containers for the site in the current directory.",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		composePath := utils.FindComposeFile()
 		if composePath == "" {
-			color.Red("No docker-compose.yml file found")
-			return
+			return errNotFound("no docker-compose.yml file found")
 		}
 
 		if err := docker.RunCompose(composePath, "restart"); err != nil {
-			color.Red("Error restarting site using Docker Compose setup:", err)
+			return errDocker("restarting containers: %w", err)
 		}
 
 		color.Green("Site restarted successfully")
+		return nil
 	},
 }
 
 var ExecCmd = &cobra.Command{
 	Use:   "exec",
 	Short: "Execute a command in the Docker container",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		composePath := utils.FindComposeFile()
 		if composePath == "" {
-			color.Red("No docker-compose.yml file found")
-			return
+			return errNotFound("no docker-compose.yml file found")
 		}
 
 		if len(args) == 0 {
 			color.Yellow("No command provided")
-			return
+			return nil
 		}
 
 		// if the next argument is "php", "nginx" or "litespeed", use it as the service name
@@ -89,8 +87,9 @@ var ExecCmd = &cobra.Command{
 		composeArgs = append(composeArgs, args...)
 
 		if err := docker.RunCompose(composePath, composeArgs...); err != nil {
-			color.Red("Error executing command: %v\n", err)
+			return errDocker("executing command: %w", err)
 		}
+		return nil
 	},
 }
 
@@ -99,11 +98,10 @@ var LogsCmd = &cobra.Command{
 	Short: "Show logs of the site in the current directory",
 	Long:  `Show logs of the Docker container for the site in the current directory.`,
 	Args:  cobra.MaximumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		composePath := utils.FindComposeFile()
 		if composePath == "" {
-			color.Red("No docker-compose.yml file found")
-			os.Exit(1)
+			return errNotFound("no docker-compose.yml file found")
 		}
 
 		composeArgs := []string{"logs"}
@@ -112,8 +110,8 @@ var LogsCmd = &cobra.Command{
 		}
 
 		if err := docker.RunCompose(composePath, composeArgs...); err != nil {
-			color.Red("Error showing logs: %v\n", err)
-			os.Exit(1)
+			return errDocker("showing logs: %w", err)
 		}
+		return nil
 	},
 }
@@ -35,10 +35,18 @@ func TestStartCmd(t *testing.T) {
 
 	// Run the command
 	output := CaptureOutput(func() {
-		StartCmd.Run(StartCmd, []string{})
+		assert.NoError(t, StartCmd.RunE(StartCmd, []string{}))
 	})
 
 	assert.Empty(t, output)
+
+	// A failing docker compose ends ploy with the docker exit code
+	docker.RunCompose = func(composePath string, args ...string) error {
+		return assert.AnError
+	}
+	err = StartCmd.RunE(StartCmd, []string{})
+	assert.EqualError(t, err, "starting containers: "+assert.AnError.Error())
+	assert.Equal(t, ExitDocker, ExitCode(err))
 }
 
 func TestStopCmd(t *testing.T) {
@@ -63,7 +71,7 @@ func TestStopCmd(t *testing.T) {
 	defer func() { docker.RunCompose = oldRunCompose }()
 
 	output := CaptureOutput(func() {
-		StopCmd.Run(StopCmd, []string{})
+		assert.NoError(t, StopCmd.RunE(StopCmd, []string{}))
 	})
 
 	assert.Empty(t, output)
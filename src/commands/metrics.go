@@ -0,0 +1,186 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/certs"
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/health"
+	"github.com/ploycloud/ploy-server-cli/src/metrics"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/stats"
+	"github.com/spf13/cobra"
+)
+
+var MetricsCmd = &cobra.Command{
+	Use:   "metrics",
+	Short: "Export server and site metrics to Prometheus",
+}
+
+func init() {
+	MetricsCmd.AddCommand(metricsServeCmd)
+	metricsServeCmd.Flags().String("listen", "127.0.0.1:9469", "Address the metrics endpoint listens on")
+	metricsServeCmd.Flags().Duration("disk_interval", 5*time.Minute, "How often disk usage is measured")
+}
+
+var metricsServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve metrics on /metrics",
+	Long:  `Serve per-site container counts, health, certificate expiry, backup age and disk usage, and the state of MySQL and the proxy, in the Prometheus text format on /metrics.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		listen, _ := cmd.Flags().GetString("listen")
+		diskInterval, _ := cmd.Flags().GetDuration("disk_interval")
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", newMetricsHandler(diskInterval))
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintln(w, "ploy metrics exporter - see /metrics")
+		})
+
+		fmt.Printf("Serving metrics on http://%s/metrics\n", listen)
+		server := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		if err := server.ListenAndServe(); err != nil {
+			return fmt.Errorf("serving metrics: %w", err)
+		}
+		return nil
+	},
+}
+
+// metricsHandler collects metrics on every scrape. Disk usage is cached, since
+// walking site directories on each scrape would be too slow.
+type metricsHandler struct {
+	diskInterval time.Duration
+
+	mu         sync.Mutex
+	disks      map[string]stats.Disk
+	measuredAt time.Time
+}
+
+func newMetricsHandler(diskInterval time.Duration) *metricsHandler {
+	return &metricsHandler{diskInterval: diskInterval, disks: make(map[string]stats.Disk)}
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metrics.ContentType)
+	if err := metrics.Write(w, h.collect(r.Context(), time.Now())); err != nil {
+		color.Yellow("Error writing metrics: %v", err)
+	}
+}
+
+// siteDisks returns the cached disk usage, measuring again once diskInterval passed
+func (h *metricsHandler) siteDisks(sites []*registry.Site, now time.Time) map[string]stats.Disk {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if now.Sub(h.measuredAt) >= h.diskInterval || len(h.disks) != len(sites) {
+		disks := make(map[string]stats.Disk, len(sites))
+		for _, site := range sites {
+			disks[site.Domain] = siteDiskUsage(site)
+		}
+		h.disks, h.measuredAt = disks, now
+	}
+	return h.disks
+}
+
+func (h *metricsHandler) collect(ctx context.Context, now time.Time) []*metrics.Metric {
+	start := time.Now()
+
+	buildInfo := metrics.NewGauge("ploy_build_info", "Version of the ploy CLI serving these metrics")
+	buildInfo.Add(1, "version", common.CurrentCliVersion)
+
+	serviceUp := metrics.NewGauge("ploy_service_up", "Whether a global service is running")
+	for _, service := range monitoredServices() {
+		running, _ := serviceRunning(service)
+		serviceUp.Add(metrics.Bool(running), "service", service)
+	}
+
+	sitesTotal := metrics.NewGauge("ploy_sites", "Number of sites registered on this server")
+	siteInfo := metrics.NewGauge("ploy_site_info", "Static information about a site")
+	replicas := metrics.NewGauge("ploy_site_replicas", "Number of replicas a site should run")
+	containers := metrics.NewGauge("ploy_site_containers", "Number of containers running for a site")
+	up := metrics.NewGauge("ploy_site_up", "Whether a site passes its health check through the proxy")
+	statusCode := metrics.NewGauge("ploy_site_health_status_code", "HTTP status returned by the last health check")
+	latency := metrics.NewGauge("ploy_site_health_latency_seconds", "Duration of the last health check")
+	certExpiry := metrics.NewGauge("ploy_certificate_expiry_timestamp_seconds", "Unix time the site's certificate expires")
+	backupTime := metrics.NewGauge("ploy_site_last_backup_timestamp_seconds", "Unix time of the last backup of a site, 0 if never backed up")
+	backupAge := metrics.NewGauge("ploy_site_last_backup_age_seconds", "Time since the last backup of a site")
+	disk := metrics.NewGauge("ploy_site_disk_bytes", "Disk space used by a site's files, volumes and database")
+	scrapeErrors := metrics.NewGauge("ploy_scrape_errors", "Number of sources that could not be read during this scrape")
+	duration := metrics.NewGauge("ploy_scrape_duration_seconds", "Time taken to collect these metrics")
+
+	all := []*metrics.Metric{buildInfo, serviceUp, sitesTotal, siteInfo, replicas, containers, up, statusCode,
+		latency, certExpiry, backupTime, backupAge, disk, scrapeErrors, duration}
+
+	failures := 0
+	sites, err := registry.List()
+	if err != nil {
+		failures++
+	}
+	sitesTotal.Add(float64(len(sites)))
+
+	// Probe all sites at once so a few slow sites do not hold up the scrape
+	results := make([]health.Result, len(sites))
+	var wg sync.WaitGroup
+	for i, site := range sites {
+		wg.Add(1)
+		go func(i int, site *registry.Site) {
+			defer wg.Done()
+			results[i] = checkSiteHealth(ctx, site)
+		}(i, site)
+	}
+	wg.Wait()
+
+	disks := h.siteDisks(sites, now)
+	for i, site := range sites {
+		siteInfo.Add(1, "site", site.Domain, "type", site.Type, "php_version", site.PHPVersion, "scaling_type", site.ScalingType)
+		replicas.Add(float64(site.Replicas), "site", site.Domain)
+
+		if ids, err := siteContainerIDs(site); err == nil {
+			containers.Add(float64(len(ids)), "site", site.Domain)
+		} else {
+			failures++
+		}
+
+		result := results[i]
+		up.Add(metrics.Bool(result.Healthy), "site", site.Domain)
+		if result.Status != 0 {
+			statusCode.Add(float64(result.Status), "site", site.Domain)
+		}
+		latency.Add(result.Latency.Seconds(), "site", site.Domain)
+
+		if certs.Exists(site.Domain) {
+			if cert, err := certs.Load(site.Domain); err == nil {
+				certExpiry.Add(float64(cert.NotAfter.Unix()), "site", site.Domain, "source", cert.Source)
+			} else {
+				failures++
+			}
+		}
+
+		if site.BackedUpAt.IsZero() {
+			backupTime.Add(0, "site", site.Domain)
+		} else {
+			backupTime.Add(float64(site.BackedUpAt.Unix()), "site", site.Domain)
+			backupAge.Add(now.Sub(site.BackedUpAt).Seconds(), "site", site.Domain)
+		}
+
+		usage := disks[site.Domain]
+		for kind, bytes := range map[string]int64{"files": usage.SiteDir, "volumes": usage.Volumes, "database": usage.Database} {
+			if bytes >= 0 {
+				disk.Add(float64(bytes), "site", site.Domain, "kind", kind)
+			}
+		}
+	}
+
+	scrapeErrors.Add(float64(failures))
+	duration.Add(time.Since(start).Seconds())
+	return all
+}
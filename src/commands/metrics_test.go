@@ -0,0 +1,69 @@
+package commands
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/certs"
+	"github.com/ploycloud/ploy-server-cli/src/metrics"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	setupStatsTest(t)
+	t.Setenv("PLOY_PROXY", "nginx")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "shop.com" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	oldHealthBaseURL := healthBaseURL
+	healthBaseURL = func(domain string) string { return server.URL }
+	defer func() {
+		server.Close()
+		healthBaseURL = oldHealthBaseURL
+	}()
+
+	shop, err := registry.Load("shop.com")
+	assert.NoError(t, err)
+	backedUp := time.Now().Add(-2 * time.Hour).UTC().Truncate(time.Second)
+	shop.BackedUpAt = backedUp
+	assert.NoError(t, registry.Save(shop))
+
+	expiry := time.Now().Add(60 * 24 * time.Hour).UTC().Truncate(time.Second)
+	certPEM, keyPEM := testCertificate("shop.com", expiry)
+	assert.NoError(t, certs.Save("shop.com", certPEM, keyPEM, certs.SourceACME))
+
+	handler := newMetricsHandler(time.Hour)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, metrics.ContentType, recorder.Header().Get("Content-Type"))
+	body := recorder.Body.String()
+	assert.Contains(t, body, "# TYPE ploy_site_up gauge")
+	assert.Contains(t, body, `ploy_service_up{service="mysql"} 0`)
+	assert.Contains(t, body, `ploy_service_up{service="nginx-proxy"} 0`)
+	assert.Contains(t, body, "ploy_sites 2")
+	assert.Contains(t, body, `ploy_site_containers{site="shop.com"} 2`)
+	assert.Contains(t, body, `ploy_site_containers{site="blog.com"} 1`)
+	assert.Contains(t, body, `ploy_site_up{site="shop.com"} 1`)
+	assert.Contains(t, body, `ploy_site_up{site="blog.com"} 0`)
+	assert.Contains(t, body, `ploy_site_health_status_code{site="blog.com"} 502`)
+	assert.Contains(t, body, `ploy_certificate_expiry_timestamp_seconds{site="shop.com",source="acme"} `+
+		strconv.FormatInt(expiry.Unix(), 10))
+	assert.Contains(t, body, `ploy_site_last_backup_timestamp_seconds{site="shop.com"} `+
+		strconv.FormatInt(backedUp.Unix(), 10))
+	assert.Contains(t, body, `ploy_site_last_backup_timestamp_seconds{site="blog.com"} 0`)
+	assert.Contains(t, body, `ploy_site_last_backup_age_seconds{site="shop.com"} 72`)
+	assert.NotContains(t, body, `ploy_site_last_backup_age_seconds{site="blog.com"}`)
+	assert.Contains(t, body, `ploy_site_disk_bytes{kind="database",site="shop.com"} 1048576`)
+	assert.Contains(t, body, `ploy_site_disk_bytes{kind="volumes",site="shop.com"} 2048`)
+	assert.NotContains(t, body, `ploy_site_disk_bytes{kind="database",site="blog.com"}`)
+}
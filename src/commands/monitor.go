@@ -0,0 +1,203 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/monitor"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/spf13/cobra"
+)
+
+var MonitorCmd = &cobra.Command{
+	Use:   "monitor",
+	Short: "Watch sites and services and send alerts when they go down",
+	Long:  `Check every site and the global services at an interval and alert the channels in ~/.ploy/monitor.yaml when one goes down or recovers.`,
+}
+
+func init() {
+	MonitorCmd.AddCommand(monitorRunCmd)
+	MonitorCmd.AddCommand(monitorStatusCmd)
+	MonitorCmd.AddCommand(monitorMaintenanceCmd)
+
+	monitorRunCmd.Flags().Bool("once", false, "Check every target once and exit (for cron)")
+	monitorMaintenanceCmd.Flags().Duration("duration", time.Hour, "How long alerts are silenced")
+}
+
+var monitorRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Run the monitor loop",
+	Long:  `Check every site through the proxy, plus MySQL and the proxy itself. A target is reported down after failure_threshold consecutive failed checks and up again after recovery_threshold successful ones.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		once, _ := cmd.Flags().GetBool("once")
+
+		config, err := monitor.LoadConfig()
+		if err != nil {
+			return fmt.Errorf("loading monitor configuration: %w", err)
+		}
+		tracker, err := monitor.LoadTracker(config)
+		if err != nil {
+			return fmt.Errorf("loading monitor state: %w", err)
+		}
+		interval, _ := time.ParseDuration(config.Interval)
+
+		for {
+			monitorOnce(config, tracker, time.Now())
+			if once {
+				return nil
+			}
+			time.Sleep(interval)
+
+			// Pick up new channels and maintenance windows without a restart
+			if reloaded, err := monitor.LoadConfig(); err == nil {
+				config = reloaded
+				tracker.FailureThreshold = config.FailureThreshold
+				tracker.RecoveryThreshold = config.RecoveryThreshold
+			}
+		}
+	},
+}
+
+var monitorStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the state of every monitored target",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := monitor.LoadConfig()
+		if err != nil {
+			return fmt.Errorf("loading monitor configuration: %w", err)
+		}
+		tracker, err := monitor.LoadTracker(config)
+		if err != nil {
+			return fmt.Errorf("loading monitor state: %w", err)
+		}
+
+		names := tracker.Names()
+		if len(names) == 0 {
+			fmt.Println("No targets checked yet. Start the monitor with `ploy monitor run`.")
+			return nil
+		}
+
+		now := time.Now()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TARGET\tSTATE\tSINCE\tLAST CHECK\tERROR")
+		for _, name := range names {
+			s := tracker.Targets[name]
+			state := string(s.State)
+			if config.InMaintenance(name, now) {
+				state += " (maintenance)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, state,
+				s.Since.Local().Format("2006-01-02 15:04:05"), s.LastChecked.Local().Format("15:04:05"), s.LastError)
+		}
+		w.Flush()
+		return nil
+	},
+}
+
+var monitorMaintenanceCmd = &cobra.Command{
+	Use:   "maintenance [target|all]",
+	Short: "Silence alerts for a target during maintenance",
+	Long:  `Silence alerts for a site, a service such as service:mysql, or every target with "all", starting now. State changes are still recorded.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		duration, _ := cmd.Flags().GetDuration("duration")
+		if duration <= 0 {
+			return errUsage("duration must be positive")
+		}
+
+		config, err := monitor.LoadConfig()
+		if err != nil {
+			return fmt.Errorf("loading monitor configuration: %w", err)
+		}
+
+		target := args[0]
+		if target == "all" {
+			target = ""
+		}
+		now := time.Now().UTC()
+		config.PruneMaintenance(now)
+		config.Maintenance = append(config.Maintenance, monitor.Maintenance{Target: target, Start: now, End: now.Add(duration)})
+		if err := monitor.SaveConfig(config); err != nil {
+			return fmt.Errorf("saving monitor configuration: %w", err)
+		}
+		color.Green("Alerts for %s are silenced until %s", args[0], now.Add(duration).Local().Format("2006-01-02 15:04:05"))
+		return nil
+	},
+}
+
+// monitorCheck is the result of checking one target
+type monitorCheck struct {
+	target  string
+	healthy bool
+	detail  string
+}
+
+// monitorTargets checks every registered site and the global services. Sites
+// stopped with `ploy sites stop` are left out, so they are not reported DOWN.
+func monitorTargets() []monitorCheck {
+	var checks []monitorCheck
+
+	sites, err := registry.List()
+	if err != nil {
+		color.Red("Error listing sites: %v", err)
+	}
+	for _, site := range sites {
+		if site.Stopped {
+			continue
+		}
+		result := checkSiteHealth(context.Background(), site)
+		checks = append(checks, monitorCheck{target: site.Domain, healthy: result.Healthy, detail: result.Error})
+	}
+
+	for _, service := range monitoredServices() {
+		running, _ := serviceRunning(service)
+		check := monitorCheck{target: "service:" + service, healthy: running}
+		if !running {
+			check.detail = "not running"
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// monitorOnce checks every target, alerts on confirmed state changes outside
+// maintenance windows and stores the new state
+func monitorOnce(config monitor.Config, tracker *monitor.Tracker, now time.Time) {
+	checks := monitorTargets()
+	notifiers := config.Channels.Notifiers()
+
+	names := make([]string, 0, len(checks))
+	for _, check := range checks {
+		names = append(names, check.target)
+		event := tracker.Observe(check.target, check.healthy, check.detail, now)
+		if event == nil {
+			continue
+		}
+
+		event.Suppressed = config.InMaintenance(check.target, now)
+		if event.Suppressed {
+			fmt.Printf("%s (in maintenance, not alerting)\n", event.Message())
+		} else {
+			fmt.Println(event.Message())
+			for _, n := range notifiers {
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				if err := n.Notify(ctx, *event); err != nil {
+					color.Yellow("Failed to alert %s: %v", n.Name(), err)
+				}
+				cancel()
+			}
+		}
+		if err := monitor.RecordEvent(*event); err != nil {
+			color.Yellow("Failed to record event: %v", err)
+		}
+	}
+
+	tracker.Forget(names)
+	if err := tracker.Save(); err != nil {
+		color.Red("Error saving monitor state: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package commands
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/monitor"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupMonitorTest serves shop.com as up and blog.com as down, with MySQL and
+// nginx running
+func setupMonitorTest(t *testing.T) {
+	setupHealthTest(t)
+	t.Setenv("PLOY_PROXY", "nginx")
+
+	oldExecCommand := execCommand
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		if name == "systemctl" {
+			return exec.Command("echo", "active")
+		}
+		return exec.Command("echo", "Up 2 hours")
+	}
+	t.Cleanup(func() { execCommand = oldExecCommand })
+}
+
+func TestMonitorOnce(t *testing.T) {
+	setupMonitorTest(t)
+
+	var alerts []map[string]interface{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		alerts = append(alerts, payload)
+	}))
+	defer receiver.Close()
+
+	config := monitor.DefaultConfig()
+	config.FailureThreshold = 2
+	config.Channels.Webhooks = []string{receiver.URL}
+	tracker := monitor.NewTracker(config)
+	now := time.Now()
+
+	output := CaptureOutput(func() {
+		monitorOnce(config, tracker, now)
+	})
+	assert.Empty(t, output)
+	assert.Empty(t, alerts)
+	assert.Equal(t, []string{"blog.com", "service:mysql", "service:nginx-proxy", "shop.com"}, tracker.Names())
+	assert.Equal(t, monitor.StateUp, tracker.Targets["service:mysql"].State)
+
+	output = CaptureOutput(func() {
+		monitorOnce(config, tracker, now.Add(time.Minute))
+	})
+	assert.Contains(t, output, "[ploy] blog.com is DOWN: unexpected status 502")
+	if assert.Len(t, alerts, 1) {
+		assert.Equal(t, "blog.com", alerts[0]["target"])
+	}
+
+	events, err := os.ReadFile(monitor.Dir() + "/events.log")
+	assert.NoError(t, err)
+	assert.Contains(t, string(events), `"target":"blog.com"`)
+
+	restored, err := monitor.LoadTracker(config)
+	assert.NoError(t, err)
+	assert.Equal(t, monitor.StateDown, restored.Targets["blog.com"].State)
+}
+
+func TestMonitorMaintenance(t *testing.T) {
+	setupMonitorTest(t)
+
+	cmd := monitorMaintenanceCmd
+	cmd.Flags().Set("duration", "2h")
+	defer cmd.Flags().Set("duration", "1h")
+	assert.NoError(t, cmd.RunE(cmd, []string{"blog.com"}))
+
+	config, err := monitor.LoadConfig()
+	assert.NoError(t, err)
+	assert.Len(t, config.Maintenance, 1)
+	assert.True(t, config.InMaintenance("blog.com", time.Now().Add(time.Hour)))
+	assert.False(t, config.InMaintenance("shop.com", time.Now()))
+
+	alerted := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alerted = true
+	}))
+	defer receiver.Close()
+	config.FailureThreshold = 1
+	config.Channels.Slack = []string{receiver.URL}
+
+	tracker := monitor.NewTracker(config)
+	output := CaptureOutput(func() {
+		monitorOnce(config, tracker, time.Now())
+	})
+	assert.Contains(t, output, "blog.com is DOWN")
+	assert.Contains(t, output, "in maintenance")
+	assert.False(t, alerted)
+	assert.Equal(t, monitor.StateDown, tracker.Targets["blog.com"].State)
+}
+
+func TestMonitorSkipsStoppedSites(t *testing.T) {
+	setupMonitorTest(t)
+
+	site, err := registry.Load("blog.com")
+	assert.NoError(t, err)
+	site.Stopped = true
+	assert.NoError(t, registry.Save(site))
+
+	config := monitor.DefaultConfig()
+	config.FailureThreshold = 1
+	tracker := monitor.NewTracker(config)
+	output := CaptureOutput(func() {
+		monitorOnce(config, tracker, time.Now())
+	})
+	assert.NotContains(t, output, "blog.com")
+	assert.Equal(t, []string{"service:mysql", "service:nginx-proxy", "shop.com"}, tracker.Names())
+}
@@ -0,0 +1,349 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/certs"
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/nginx"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/spf13/cobra"
+)
+
+var NginxCmd = &cobra.Command{
+	Use:   "nginx",
+	Short: "Manage nginx vhosts for sites",
+	Long:  `Render, configure and regenerate the nginx vhosts ploy manages for sites.`,
+}
+
+func init() {
+	NginxCmd.AddCommand(nginxRenderCmd)
+	NginxCmd.AddCommand(nginxRegenerateCmd)
+	NginxCmd.AddCommand(nginxConfigureCmd)
+
+	nginxRenderCmd.Flags().String("site", "", "Site domain to render the vhost for")
+	nginxRenderCmd.MarkFlagRequired("site")
+
+	nginxRegenerateCmd.Flags().String("site", "", "Site domain to regenerate the vhost for")
+	nginxRegenerateCmd.Flags().Bool("all", false, "Regenerate the vhosts of all ploy managed sites")
+
+	defaults := nginx.DefaultOptions()
+	nginxConfigureCmd.Flags().String("site", "", "Site domain to configure")
+	nginxConfigureCmd.Flags().String("client_max_body_size", defaults.ClientMaxBodySize, "Maximum request body size")
+	nginxConfigureCmd.Flags().String("proxy_connect_timeout", defaults.ProxyConnectTimeout, "Timeout for connecting to the site")
+	nginxConfigureCmd.Flags().String("proxy_timeout", defaults.ProxyTimeout, "Read/send timeout for requests to the site")
+	nginxConfigureCmd.Flags().Bool("gzip", defaults.Gzip, "Enable gzip compression")
+	nginxConfigureCmd.Flags().Bool("brotli", defaults.Brotli, "Enable brotli compression (requires the nginx brotli module)")
+	nginxConfigureCmd.Flags().Bool("security_headers", defaults.SecurityHeaders, "Send common security headers")
+	nginxConfigureCmd.Flags().String("static_cache", defaults.StaticCache, "Browser cache lifetime for static assets (empty to disable)")
+	nginxConfigureCmd.Flags().Bool("http2", defaults.HTTP2, "Enable HTTP/2 when TLS is on")
+	nginxConfigureCmd.Flags().String("load_balancing", defaults.LoadBalancing, "How requests are spread over replicas: least_conn, ip_hash or round_robin")
+	nginxConfigureCmd.Flags().Int("max_fails", defaults.MaxFails, "Failed requests before a replica is taken out of rotation")
+	nginxConfigureCmd.Flags().String("fail_timeout", defaults.FailTimeout, "How long a failing replica stays out of rotation")
+	nginxConfigureCmd.MarkFlagRequired("site")
+}
+
+var nginxRenderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "Print the vhost ploy would generate for a site",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domain, _ := cmd.Flags().GetString("site")
+		content, err := nginxSiteConfig(domain)
+		if err != nil {
+			return fmt.Errorf("rendering nginx configuration: %w", err)
+		}
+		fmt.Println(content)
+		return nil
+	},
+}
+
+var nginxRegenerateCmd = &cobra.Command{
+	Use:   "regenerate",
+	Short: "Rewrite site vhosts from the current template",
+	Long:  `Rewrite site vhosts from the current template so existing sites pick up template improvements. Custom snippets in custom.d are left untouched.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domain, _ := cmd.Flags().GetString("site")
+		all, _ := cmd.Flags().GetBool("all")
+
+		var domains []string
+		switch {
+		case all:
+			var err error
+			if domains, err = managedNginxSites(); err != nil {
+				return fmt.Errorf("listing nginx sites: %w", err)
+			}
+		case domain != "":
+			domains = []string{domain}
+		default:
+			return errUsage("specify --site or --all")
+		}
+
+		if len(domains) == 0 {
+			fmt.Println("No ploy managed vhosts found.")
+			return nil
+		}
+
+		failed := 0
+		for _, d := range domains {
+			fmt.Printf("Regenerating vhost for %s...\n", d)
+			if err := createNginxConfig(d, ""); err != nil {
+				color.Red("Error regenerating vhost for %s: %v", d, err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d vhost(s) could not be regenerated", failed)
+		}
+		return nil
+	},
+}
+
+var nginxConfigureCmd = &cobra.Command{
+	Use:   "configure",
+	Short: "Change vhost options for a site",
+	Long:  `Change vhost options for a site. Only the flags you pass are changed; the vhost is regenerated afterwards.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domain, _ := cmd.Flags().GetString("site")
+
+		options, err := nginx.LoadOptions(domain)
+		if err != nil {
+			return fmt.Errorf("loading nginx options: %w", err)
+		}
+
+		flags := cmd.Flags()
+		if flags.Changed("client_max_body_size") {
+			options.ClientMaxBodySize, _ = flags.GetString("client_max_body_size")
+		}
+		if flags.Changed("proxy_connect_timeout") {
+			options.ProxyConnectTimeout, _ = flags.GetString("proxy_connect_timeout")
+		}
+		if flags.Changed("proxy_timeout") {
+			options.ProxyTimeout, _ = flags.GetString("proxy_timeout")
+		}
+		if flags.Changed("gzip") {
+			options.Gzip, _ = flags.GetBool("gzip")
+		}
+		if flags.Changed("brotli") {
+			options.Brotli, _ = flags.GetBool("brotli")
+		}
+		if flags.Changed("security_headers") {
+			options.SecurityHeaders, _ = flags.GetBool("security_headers")
+		}
+		if flags.Changed("static_cache") {
+			options.StaticCache, _ = flags.GetString("static_cache")
+		}
+		if flags.Changed("http2") {
+			options.HTTP2, _ = flags.GetBool("http2")
+		}
+		if flags.Changed("load_balancing") {
+			options.LoadBalancing, _ = flags.GetString("load_balancing")
+		}
+		if flags.Changed("max_fails") {
+			options.MaxFails, _ = flags.GetInt("max_fails")
+		}
+		if flags.Changed("fail_timeout") {
+			options.FailTimeout, _ = flags.GetString("fail_timeout")
+		}
+		if err := options.Validate(); err != nil {
+			return fmt.Errorf("invalid nginx options: %w", err)
+		}
+
+		if err := nginx.SaveOptions(domain, options); err != nil {
+			return fmt.Errorf("saving nginx options: %w", err)
+		}
+		if err := createNginxConfig(domain, ""); err != nil {
+			return fmt.Errorf("regenerating vhost for %s: %w", domain, err)
+		}
+		color.Green("Nginx options updated for %s", domain)
+		return nil
+	},
+}
+
+var nginxBasePath = "/etc/nginx"
+
+// createNginxConfig has the root helper install and enable the vhost of a domain,
+// then reloads nginx
+func createNginxConfig(domain string, webhook string) error {
+	sendWebhook(webhook, "Creating nginx configuration...")
+
+	if err := runRootHelper("vhost", domain); err != nil {
+		sendWebhook(webhook, err.Error())
+		return err
+	}
+	if err := reloadNginx(); err != nil {
+		return err
+	}
+
+	sendWebhook(webhook, "Nginx configuration created and enabled")
+	return nil
+}
+
+// removeNginxConfig disables and deletes the vhost of a domain
+func removeNginxConfig(domain string) error {
+	if err := runRootHelper("remove-vhost", domain); err != nil {
+		return err
+	}
+	if err := validateNginxConfig(); err != nil {
+		return fmt.Errorf("nginx configuration test failed after removing %s: %w", domain, err)
+	}
+	return reloadNginx()
+}
+
+// reloadNginx reloads the host nginx, except in the test environment
+func reloadNginx() error {
+	if os.Getenv("PLOY_TEST_ENV") == "true" {
+		return nil
+	}
+	if err := runner.Run(execSudo("systemctl", "reload", "nginx")); err != nil {
+		return fmt.Errorf("failed to reload nginx: %w", err)
+	}
+	return nil
+}
+
+// validateNginxConfig runs `nginx -t` and returns nginx's own error output on failure
+func validateNginxConfig() error {
+	output, err := runner.CombinedOutput(execSudo("nginx", "-t"))
+	if err != nil {
+		if msg := strings.TrimSpace(string(output)); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// nginxSiteConfig renders the vhost for a domain from the template. The ACME
+// challenge location is always served over plain HTTP; once a certificate is
+// stored for the domain, all other HTTP traffic is redirected to HTTPS.
+func nginxSiteConfig(domain string) (string, error) {
+	options, err := nginx.LoadOptions(domain)
+	if err != nil {
+		return "", err
+	}
+	if err := options.Validate(); err != nil {
+		return "", fmt.Errorf("invalid nginx options for %s: %w", domain, err)
+	}
+
+	servers, err := siteUpstreamServers(domain)
+	if err != nil {
+		return "", err
+	}
+
+	vhost := nginx.Vhost{
+		Domain:      domain,
+		Upstream:    nginx.Upstream{Name: nginx.UpstreamName(domain), Servers: servers},
+		AcmeWebroot: common.AcmeWebroot,
+		CustomDir:   nginxCustomDir(domain),
+		Options:     options,
+	}
+	if site, err := registry.Load(domain); err == nil {
+		vhost.Aliases = site.Aliases
+	}
+	if certs.Exists(domain) {
+		certPath, keyPath := certs.Paths(domain)
+		vhost.TLS = &nginx.TLS{CertPath: certPath, KeyPath: keyPath}
+	}
+
+	return nginx.Render(vhost)
+}
+
+// siteUpstreamServers returns the endpoints a proxy should balance a domain over
+func siteUpstreamServers(domain string) ([]string, error) {
+	site, err := registry.Load(domain)
+	if errors.Is(err, registry.ErrNotFound) {
+		// Sites created before the registry existed are still proxied by container name
+		return []string{fmt.Sprintf("%s:80", strings.ReplaceAll(domain, ".", "-"))}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return siteEndpoints(site), nil
+}
+
+// siteEndpoints returns the loopback address of every running replica of a site,
+// as published by Docker. When the containers are not up yet, the endpoints are
+// taken from the site's reserved port block instead.
+func siteEndpoints(site *registry.Site) []string {
+	var endpoints []string
+	for i := 1; i <= site.Replicas; i++ {
+		output, err := runner.Query(composeCommand(site.ComposePath(),
+			"port", "--index", strconv.Itoa(i), "wordpress", "80"))
+		if err != nil {
+			break
+		}
+		if endpoint := parsePublishedPort(string(output)); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	if len(endpoints) == 0 {
+		return site.Endpoints()
+	}
+	return endpoints
+}
+
+// parsePublishedPort turns `docker compose port` output into a loopback address
+func parsePublishedPort(output string) string {
+	host, port, err := net.SplitHostPort(strings.TrimSpace(output))
+	if err != nil {
+		return ""
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return ""
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// refreshSiteUpstream rewrites a site's vhost so the upstream matches the replicas
+// that are currently running. It is called whenever containers are started or scaled.
+func refreshSiteUpstream(site *registry.Site, webhook string) error {
+	createSiteLog(site.Name(), fmt.Sprintf("Updating proxy upstream for %d replica(s)...", site.Replicas))
+	return configureSiteProxy(site.Domain, webhook)
+}
+
+// nginxCustomDir is the per-site include directory for hand written snippets
+func nginxCustomDir(domain string) string {
+	return filepath.Join(nginxBasePath, "ploy", domain, "custom.d")
+}
+
+// managedNginxSites returns the domains of all vhosts in sites-available that were
+// written by ploy, including those generated before the template existed
+func managedNginxSites() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(nginxBasePath, "sites-available"))
+	if err != nil {
+		return nil, err
+	}
+
+	var domains []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".conf") {
+			continue
+		}
+		domain := strings.TrimSuffix(entry.Name(), ".conf")
+
+		content, err := os.ReadFile(filepath.Join(nginxBasePath, "sites-available", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		legacyUpstream := fmt.Sprintf("proxy_pass http://%s:80;", strings.ReplaceAll(domain, ".", "-"))
+		if _, ok := nginx.ManagedVersion(string(content)); ok || strings.Contains(string(content), legacyUpstream) {
+			domains = append(domains, domain)
+		}
+	}
+
+	sort.Strings(domains)
+	return domains, nil
+}
@@ -0,0 +1,133 @@
+package commands
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/nginx"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupNginxTest(t *testing.T) string {
+	tempDir := setupCertsTest(t)
+
+	oldNginxDir := common.NginxDir
+	oldLogBasePath := logBasePath
+	common.SetNginxDir(filepath.Join(tempDir, "ploy-nginx"))
+	logBasePath = tempDir
+	t.Cleanup(func() {
+		common.SetNginxDir(oldNginxDir)
+		logBasePath = oldLogBasePath
+	})
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(tempDir, "sites-available"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(tempDir, "sites-enabled"), 0755))
+	return tempDir
+}
+
+func TestManagedNginxSites(t *testing.T) {
+	tempDir := setupNginxTest(t)
+	available := filepath.Join(tempDir, "sites-available")
+
+	rendered, err := nginxSiteConfig("new.com")
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(available, "new.com.conf"), []byte(rendered), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(available, "legacy.com.conf"),
+		[]byte("server {\n\tlocation / {\n\t\tproxy_pass http://legacy-com:80;\n\t}\n}"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(available, "default"), []byte("server {}"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(available, "hand.com.conf"), []byte("server {}"), 0644))
+
+	domains, err := managedNginxSites()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"legacy.com", "new.com"}, domains)
+}
+
+func TestNginxRegenerateAll(t *testing.T) {
+	tempDir := setupNginxTest(t)
+	legacyPath := filepath.Join(tempDir, "sites-available", "legacy.com.conf")
+	assert.NoError(t, os.WriteFile(legacyPath,
+		[]byte("server {\n\tlocation / {\n\t\tproxy_pass http://legacy-com:80;\n\t}\n}"), 0644))
+
+	cmd := nginxRegenerateCmd
+	cmd.Flags().Set("all", "true")
+	defer cmd.Flags().Set("all", "false")
+
+	output := CaptureOutput(func() {
+		assert.NoError(t, cmd.RunE(cmd, []string{}))
+	})
+	assert.Contains(t, output, "Regenerating vhost for legacy.com")
+
+	content, err := os.ReadFile(legacyPath)
+	assert.NoError(t, err)
+	version, ok := nginx.ManagedVersion(string(content))
+	assert.True(t, ok)
+	assert.Equal(t, nginx.TemplateVersion, version)
+	assert.DirExists(t, filepath.Join(tempDir, "ploy", "legacy.com", "custom.d"))
+}
+
+func TestNginxConfigureCmd(t *testing.T) {
+	tempDir := setupNginxTest(t)
+
+	cmd := nginxConfigureCmd
+	cmd.Flags().Set("site", "shop.com")
+	cmd.Flags().Set("client_max_body_size", "256m")
+	cmd.Flags().Set("gzip", "false")
+
+	assert.NoError(t, cmd.RunE(cmd, []string{}))
+
+	options, err := nginx.LoadOptions("shop.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "256m", options.ClientMaxBodySize)
+	assert.False(t, options.Gzip)
+	assert.True(t, options.SecurityHeaders)
+
+	content, err := os.ReadFile(filepath.Join(tempDir, "sites-available", "shop.com.conf"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "client_max_body_size 256m;")
+	assert.NotContains(t, string(content), "gzip on;")
+}
+
+func TestSiteUpstreamTracksReplicas(t *testing.T) {
+	tempDir := setupNginxTest(t)
+
+	site := &registry.Site{Domain: "shop.com", HostPort: 20010, PortCount: 4, Replicas: 3, ComposeFile: "docker-compose.yml"}
+	assert.NoError(t, registry.Save(site))
+
+	// Containers not running: fall back to the reserved port block
+	oldExecCommand := execCommand
+	defer func() { execCommand = oldExecCommand }()
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		return exec.Command("false")
+	}
+	assert.Equal(t, []string{"127.0.0.1:20010", "127.0.0.1:20011", "127.0.0.1:20012"}, siteEndpoints(site))
+
+	// Running replicas are looked up from Docker
+	published := map[string]string{"1": "127.0.0.1:20012", "2": "127.0.0.1:20010"}
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		if name == "docker" && len(arg) > 5 && arg[0] == "compose" && arg[3] == "port" {
+			if port, ok := published[arg[5]]; ok {
+				return exec.Command("echo", port)
+			}
+		}
+		return exec.Command("false")
+	}
+	site.Replicas = 2
+	assert.NoError(t, refreshSiteUpstream(site, ""))
+
+	content, err := os.ReadFile(filepath.Join(tempDir, "sites-available", "shop.com.conf"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "server 127.0.0.1:20012 max_fails=3")
+	assert.Contains(t, string(content), "server 127.0.0.1:20010 max_fails=3")
+	assert.NotContains(t, string(content), "127.0.0.1:20011")
+}
+
+func TestParsePublishedPort(t *testing.T) {
+	assert.Equal(t, "127.0.0.1:20001", parsePublishedPort("127.0.0.1:20001\n"))
+	assert.Equal(t, "127.0.0.1:20001", parsePublishedPort("0.0.0.0:20001"))
+	assert.Equal(t, "", parsePublishedPort(""))
+	assert.Equal(t, "", parsePublishedPort("no such service"))
+}
@@ -0,0 +1,369 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/certs"
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/config"
+	"github.com/ploycloud/ploy-server-cli/src/nginx"
+	"github.com/ploycloud/ploy-server-cli/src/proxy"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/spf13/cobra"
+)
+
+var ProxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "Manage the reverse proxy that routes traffic to sites",
+	Long:  `Set up the reverse proxy chosen with "proxy:" in ~/.ploy/config.yaml (nginx, traefik or caddy) and route every site through it.`,
+}
+
+func init() {
+	ProxyCmd.AddCommand(proxySetupCmd)
+}
+
+var proxySetupCmd = &cobra.Command{
+	Use:   "setup",
+	Short: "Install the configured proxy and route all sites through it",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		p, err := loadProxy()
+		if err != nil {
+			return fmt.Errorf("loading proxy configuration: %w", err)
+		}
+
+		fmt.Printf("Setting up %s...\n", p.Name())
+		if err := p.Setup(""); err != nil {
+			return fmt.Errorf("setting up %s: %w", p.Name(), err)
+		}
+
+		sites, err := registry.List()
+		if err != nil {
+			return fmt.Errorf("listing sites: %w", err)
+		}
+		failed := 0
+		for _, site := range sites {
+			fmt.Printf("Routing %s...\n", site.Domain)
+			if err := p.CreateVhost(site.Domain, ""); err != nil {
+				color.Red("Error routing %s: %v", site.Domain, err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d site(s) could not be routed", failed)
+		}
+		color.Green("%s is routing %d site(s)", p.Name(), len(sites))
+		return nil
+	},
+}
+
+// proxyProvider routes traffic for site domains to the site containers
+type proxyProvider interface {
+	Name() string
+	// Setup installs and starts the proxy if it is not running yet
+	Setup(webhook string) error
+	// CreateVhost creates or updates the routing for a domain
+	CreateVhost(domain, webhook string) error
+	// RemoveVhost removes the routing for a domain
+	RemoveVhost(domain string) error
+	// Validate checks the complete proxy configuration. nginx and Caddy test it
+	// themselves; Traefik has no such test, so only its files and the references
+	// between them are checked.
+	Validate() error
+	// Reload makes the proxy pick up configuration changes
+	Reload() error
+	// IssuesCertificates reports whether the proxy obtains ACME certificates itself
+	IssuesCertificates() bool
+	// CertificateChanged is called after a certificate for the domain was stored or removed
+	CertificateChanged(domain string) error
+}
+
+// loadProxy returns the provider selected in the configuration
+var loadProxy = func() (proxyProvider, error) {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	email := os.Getenv("PLOY_ACME_EMAIL")
+	switch cfg.Proxy {
+	case config.ProxyTraefik:
+		return &traefikProxy{proxy.Traefik{Dir: filepath.Join(common.ProxyDir, "traefik"), CertsDir: common.CertsDir, Email: email}}, nil
+	case config.ProxyCaddy:
+		return &caddyProxy{proxy.Caddy{Dir: filepath.Join(common.ProxyDir, "caddy"), CertsDir: common.CertsDir, Email: email}}, nil
+	}
+	return &nginxProxy{}, nil
+}
+
+// configureSiteProxy creates or updates the routing for a domain in the configured proxy
+func configureSiteProxy(domain, webhook string) error {
+	p, err := loadProxy()
+	if err != nil {
+		return err
+	}
+	return p.CreateVhost(domain, webhook)
+}
+
+// nginxProxy is nginx installed on the host, configured through vhost files
+type nginxProxy struct{}
+
+func (p *nginxProxy) Name() string               { return "nginx" }
+func (p *nginxProxy) Setup(webhook string) error { return setupNginxProxy(webhook) }
+func (p *nginxProxy) CreateVhost(domain, webhook string) error {
+	return createNginxConfig(domain, webhook)
+}
+func (p *nginxProxy) RemoveVhost(domain string) error { return removeNginxConfig(domain) }
+func (p *nginxProxy) Validate() error                 { return validateNginxConfig() }
+func (p *nginxProxy) Reload() error                   { return reloadNginx() }
+func (p *nginxProxy) IssuesCertificates() bool        { return false }
+
+func (p *nginxProxy) CertificateChanged(domain string) error {
+	return createNginxConfig(domain, "")
+}
+
+// traefikProxy is a Traefik container that routes sites from their compose labels
+// and obtains certificates through its own ACME resolver
+type traefikProxy struct {
+	proxy.Traefik
+}
+
+func (p *traefikProxy) Name() string { return "traefik" }
+
+func (p *traefikProxy) Setup(webhook string) error {
+	sendWebhook(webhook, "Setting up Traefik...")
+	for _, dir := range []string{p.DynamicDir(), filepath.Join(p.Dir, "letsencrypt")} {
+		if err := runner.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+
+	config, err := p.RenderConfig()
+	if err != nil {
+		return err
+	}
+	compose, err := p.RenderCompose()
+	if err != nil {
+		return err
+	}
+	if err := runner.WriteFile(p.ConfigPath(), []byte(config), 0644); err != nil {
+		return fmt.Errorf("failed to write Traefik configuration: %w", err)
+	}
+	if err := runner.WriteFile(p.ComposePath(), []byte(compose), 0644); err != nil {
+		return fmt.Errorf("failed to write Traefik compose file: %w", err)
+	}
+
+	return startProxyContainer(p.ComposePath(), "Traefik", webhook)
+}
+
+// CreateVhost only has to take care of custom certificates: routers and services
+// come from the labels in the site's compose file
+func (p *traefikProxy) CreateVhost(domain, webhook string) error {
+	sendWebhook(webhook, fmt.Sprintf("Traefik routes %s from the container labels", domain))
+	return p.CertificateChanged(domain)
+}
+
+func (p *traefikProxy) RemoveVhost(domain string) error {
+	err := runner.Remove(p.CertificatePath(domain))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (p *traefikProxy) Validate() error {
+	static, err := os.ReadFile(p.ConfigPath())
+	if err != nil {
+		return fmt.Errorf("reading Traefik configuration: %w", err)
+	}
+
+	dynamic := map[string][]byte{}
+	entries, err := os.ReadDir(p.DynamicDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !(strings.HasSuffix(entry.Name(), ".yml") || strings.HasSuffix(entry.Name(), ".yaml")) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(p.DynamicDir(), entry.Name()))
+		if err != nil {
+			return err
+		}
+		dynamic[entry.Name()] = content
+	}
+	return proxy.ValidateTraefik(static, dynamic)
+}
+
+// Reload is a no-op: Traefik watches the dynamic directory and the Docker socket
+func (p *traefikProxy) Reload() error { return nil }
+
+func (p *traefikProxy) IssuesCertificates() bool { return true }
+
+// CertificateChanged points Traefik at a customer supplied certificate, or removes
+// it so that the ACME resolver takes over again
+func (p *traefikProxy) CertificateChanged(domain string) error {
+	if !certs.Exists(domain) {
+		return p.RemoveVhost(domain)
+	}
+
+	certPath, keyPath := certs.Paths(domain)
+	content, err := proxy.RenderCertificate(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+	if err := runner.MkdirAll(p.DynamicDir(), 0755); err != nil {
+		return err
+	}
+	return runner.WriteFile(p.CertificatePath(domain), []byte(content), 0644)
+}
+
+// caddyProxy is a Caddy container with one site block per domain, proxying to the
+// site's loopback ports. Caddy obtains certificates on its own.
+type caddyProxy struct {
+	proxy.Caddy
+}
+
+func (p *caddyProxy) Name() string { return "caddy" }
+
+func (p *caddyProxy) Setup(webhook string) error {
+	sendWebhook(webhook, "Setting up Caddy...")
+	for _, dir := range []string{p.SitesDir(), filepath.Join(p.Dir, "data")} {
+		if err := runner.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+
+	config, err := p.RenderConfig()
+	if err != nil {
+		return err
+	}
+	compose, err := p.RenderCompose()
+	if err != nil {
+		return err
+	}
+	if err := runner.WriteFile(p.ConfigPath(), []byte(config), 0644); err != nil {
+		return fmt.Errorf("failed to write Caddyfile: %w", err)
+	}
+	if err := runner.WriteFile(p.ComposePath(), []byte(compose), 0644); err != nil {
+		return fmt.Errorf("failed to write Caddy compose file: %w", err)
+	}
+
+	return startProxyContainer(p.ComposePath(), "Caddy", webhook)
+}
+
+func (p *caddyProxy) CreateVhost(domain, webhook string) error {
+	sendWebhook(webhook, "Creating Caddy site configuration...")
+
+	content, err := caddySiteConfig(domain)
+	if err != nil {
+		return err
+	}
+
+	if err := runner.MkdirAll(p.SitesDir(), 0755); err != nil {
+		return err
+	}
+	sitePath := p.SitePath(domain)
+	previous, readErr := os.ReadFile(sitePath)
+	if err := runner.WriteFile(sitePath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write Caddy site configuration: %w", err)
+	}
+
+	// Roll back to the previous site block if Caddy rejects the new one
+	if err := p.Validate(); err != nil {
+		if readErr == nil {
+			runner.WriteFile(sitePath, previous, 0644)
+		} else {
+			runner.Remove(sitePath)
+		}
+		message := fmt.Sprintf("Caddy configuration test failed for %s, changes rolled back: %v", domain, err)
+		sendWebhook(webhook, message)
+		return errors.New(message)
+	}
+
+	if err := p.Reload(); err != nil {
+		return err
+	}
+	sendWebhook(webhook, "Caddy site configuration created")
+	return nil
+}
+
+// caddySiteConfig renders the Caddy site block of a domain
+func caddySiteConfig(domain string) (string, error) {
+	options, err := nginx.LoadOptions(domain)
+	if err != nil {
+		return "", err
+	}
+	servers, err := siteUpstreamServers(domain)
+	if err != nil {
+		return "", err
+	}
+
+	site := proxy.CaddySite{Domain: domain, Servers: servers, Options: options}
+	if record, err := registry.Load(domain); err == nil {
+		site.Aliases = record.Aliases
+	}
+	if certs.Exists(domain) {
+		certPath, keyPath := certs.Paths(domain)
+		site.TLS = &nginx.TLS{CertPath: certPath, KeyPath: keyPath}
+	}
+	return proxy.RenderCaddySite(site)
+}
+
+func (p *caddyProxy) RemoveVhost(domain string) error {
+	err := runner.Remove(p.SitePath(domain))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return p.Reload()
+}
+
+func (p *caddyProxy) Validate() error {
+	output, err := runner.CombinedOutput(execCommand("docker", "exec", proxy.CaddyContainer,
+		"caddy", "validate", "--config", p.ConfigPath(), "--adapter", "caddyfile"))
+	if err != nil {
+		if msg := strings.TrimSpace(string(output)); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+	return nil
+}
+
+func (p *caddyProxy) Reload() error {
+	if os.Getenv("PLOY_TEST_ENV") == "true" {
+		return nil
+	}
+	cmd := execCommand("docker", "exec", proxy.CaddyContainer,
+		"caddy", "reload", "--config", p.ConfigPath(), "--adapter", "caddyfile")
+	if err := runner.Run(cmd); err != nil {
+		return fmt.Errorf("failed to reload Caddy: %w", err)
+	}
+	return nil
+}
+
+func (p *caddyProxy) IssuesCertificates() bool { return true }
+
+func (p *caddyProxy) CertificateChanged(domain string) error {
+	return p.CreateVhost(domain, "")
+}
+
+// startProxyContainer brings up a proxy's compose project
+func startProxyContainer(composePath, name, webhook string) error {
+	if os.Getenv("PLOY_TEST_ENV") == "true" {
+		return nil
+	}
+
+	cmd := composeCommand(composePath, "up", "-d")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := runner.Run(cmd); err != nil {
+		return fmt.Errorf("failed to start %s: %w", name, err)
+	}
+	sendWebhook(webhook, fmt.Sprintf("%s is running", name))
+	return nil
+}
@@ -0,0 +1,123 @@
+package commands
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/certs"
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupProxyTest(t *testing.T, provider string) string {
+	tempDir := setupNginxTest(t)
+
+	oldProxyDir := common.ProxyDir
+	common.SetProxyDir(filepath.Join(tempDir, "proxy"))
+	t.Setenv("PLOY_PROXY", provider)
+	t.Cleanup(func() { common.SetProxyDir(oldProxyDir) })
+	return tempDir
+}
+
+func TestLoadProxy(t *testing.T) {
+	for _, name := range []string{"nginx", "traefik", "caddy"} {
+		setupProxyTest(t, name)
+		p, err := loadProxy()
+		assert.NoError(t, err)
+		assert.Equal(t, name, p.Name())
+		assert.Equal(t, name != "nginx", p.IssuesCertificates())
+	}
+
+	setupProxyTest(t, "haproxy")
+	_, err := loadProxy()
+	assert.Error(t, err)
+}
+
+func TestTraefikProxyCertificates(t *testing.T) {
+	tempDir := setupProxyTest(t, "traefik")
+
+	p, err := loadProxy()
+	assert.NoError(t, err)
+	assert.NoError(t, p.Setup(""))
+	assert.FileExists(t, filepath.Join(tempDir, "proxy", "traefik", "traefik.yml"))
+	assert.FileExists(t, filepath.Join(tempDir, "proxy", "traefik", "docker-compose.yml"))
+
+	// Without a custom certificate Traefik's resolver is used
+	assert.NoError(t, p.CreateVhost("shop.com", ""))
+	certFile := filepath.Join(tempDir, "proxy", "traefik", "dynamic", "shop.com.yml")
+	assert.NoFileExists(t, certFile)
+
+	certPEM, keyPEM := testCertificate("shop.com", time.Now().Add(90*24*time.Hour))
+	assert.NoError(t, certs.Save("shop.com", certPEM, keyPEM, certs.SourceCustom))
+	assert.NoError(t, p.CertificateChanged("shop.com"))
+	assert.FileExists(t, certFile)
+	assert.NoError(t, p.Validate())
+
+	// Routers added by hand must use services that exist
+	customFile := filepath.Join(tempDir, "proxy", "traefik", "dynamic", "custom.yml")
+	assert.NoError(t, os.WriteFile(customFile, []byte("http:\n  routers:\n    blog:\n      rule: Host(`blog.shop.com`)\n      service: blog\n"), 0644))
+	assert.ErrorContains(t, p.Validate(), "custom.yml: router blog uses service blog, which is not defined")
+	assert.NoError(t, os.Remove(customFile))
+
+	assert.NoError(t, certs.Remove("shop.com"))
+	assert.NoError(t, p.CertificateChanged("shop.com"))
+	assert.NoFileExists(t, certFile)
+
+	// Certificates are not issued through ploy's ACME client
+	err = issueCertificate(&fakeIssuer{}, "shop.com", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "traefik obtains certificates")
+}
+
+func TestCaddyProxyVhost(t *testing.T) {
+	tempDir := setupProxyTest(t, "caddy")
+	assert.NoError(t, registry.Save(&registry.Site{Domain: "shop.com", HostPort: 20010, PortCount: 2, Replicas: 2}))
+
+	valid := true
+	oldExecCommand := execCommand
+	defer func() { execCommand = oldExecCommand }()
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		if name == "docker" && len(arg) > 3 && arg[0] == "exec" && arg[3] == "validate" {
+			if valid {
+				return exec.Command("true")
+			}
+			return exec.Command("sh", "-c", "echo 'Error: adapting config' && exit 1")
+		}
+		return exec.Command("false")
+	}
+
+	p, err := loadProxy()
+	assert.NoError(t, err)
+	assert.NoError(t, p.CreateVhost("shop.com", ""))
+
+	sitePath := filepath.Join(tempDir, "proxy", "caddy", "sites", "shop.com.caddy")
+	content, err := os.ReadFile(sitePath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "reverse_proxy 127.0.0.1:20010 127.0.0.1:20011 {")
+
+	// A rejected configuration is rolled back
+	valid = false
+	assert.NoError(t, registry.Save(&registry.Site{Domain: "shop.com", HostPort: 20010, PortCount: 2, Replicas: 1}))
+	err = p.CreateVhost("shop.com", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "adapting config")
+
+	rolledBack, err := os.ReadFile(sitePath)
+	assert.NoError(t, err)
+	assert.Equal(t, string(content), string(rolledBack))
+
+	valid = true
+	assert.NoError(t, p.RemoveVhost("shop.com"))
+	assert.NoFileExists(t, sitePath)
+
+	// No nginx vhost is written when Caddy is the proxy
+	entries, _ := os.ReadDir(filepath.Join(tempDir, "sites-available"))
+	for _, entry := range entries {
+		assert.False(t, strings.HasPrefix(entry.Name(), "shop.com"))
+	}
+}
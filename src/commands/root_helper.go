@@ -0,0 +1,360 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ploycloud/ploy-server-cli/src/agent"
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/ploycloud/ploy-server-cli/src/sitespec"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootHelperCmd.AddCommand(rootHelperVhostCmd)
+	RootHelperCmd.AddCommand(rootHelperRemoveVhostCmd)
+	RootHelperCmd.AddCommand(rootHelperSiteCronCmd)
+	RootHelperCmd.AddCommand(rootHelperCertsCronCmd)
+	RootHelperCmd.AddCommand(rootHelperAgentUnitCmd)
+}
+
+// RootHelperCmd makes the changes ploy needs root for. The sudoers rules written
+// by `ploy server init` allow the ploy user to run it and no other ploy command as
+// root, so it never takes file contents or paths: it renders what it installs
+// from the records of the user that ran sudo, and checks every name it is given
+// and every value it reads from those records.
+var RootHelperCmd = &cobra.Command{
+	Use:    "root-helper",
+	Short:  "Install the vhosts, cron files and agent unit of ploy as root",
+	Hidden: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if geteuid() != 0 {
+			return errPermission("the root helper must be run with sudo")
+		}
+		invoker, err := helperUser()
+		if err != nil {
+			return fmt.Errorf("looking up the user that ran sudo: %w", err)
+		}
+		// sudo resets HOME, the records are in the home of the user that ran it
+		common.SetHomeDir(invoker.HomeDir)
+		return nil
+	},
+}
+
+var rootHelperVhostCmd = &cobra.Command{
+	Use:   "vhost <domain>",
+	Short: "Install and enable the nginx vhost of a domain",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return installVhost(args[0])
+	},
+}
+
+var rootHelperRemoveVhostCmd = &cobra.Command{
+	Use:   "remove-vhost <domain>",
+	Short: "Disable and delete the nginx vhost of a domain",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return removeVhost(args[0])
+	},
+}
+
+var rootHelperSiteCronCmd = &cobra.Command{
+	Use:   "site-cron <domain>",
+	Short: "Install the cron file of a site, or remove it when the site has no scheduled jobs",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return installSiteCron(args[0])
+	},
+}
+
+var rootHelperCertsCronCmd = &cobra.Command{
+	Use:   "certs-cron",
+	Short: "Install the cron file that renews certificates",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return installCertsCron()
+	},
+}
+
+var rootHelperAgentUnitCmd = &cobra.Command{
+	Use:   "agent-unit <listen> [user]",
+	Short: "Install the systemd unit of the agent",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		username := ""
+		if len(args) == 2 {
+			username = args[1]
+		}
+		return installAgentUnitFile(args[0], username)
+	},
+}
+
+// runRootHelper runs a root helper command with sudo. In dry-run mode it runs in
+// this process instead, where it only prints the changes it would make.
+var runRootHelper = func(arg ...string) error {
+	if runner.DryRun {
+		return callRootHelper(arg...)
+	}
+	binary, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locating the ploy binary: %w", err)
+	}
+	return runner.Run(execSudo(binary, append([]string{"root-helper"}, arg...)...))
+}
+
+// callRootHelper runs a root helper command in this process
+func callRootHelper(arg ...string) error {
+	cmd, args, err := RootHelperCmd.Find(arg)
+	if err != nil {
+		return err
+	}
+	if cmd.RunE == nil {
+		return errUsage("unknown root helper command %q", strings.Join(arg, " "))
+	}
+	return cmd.RunE(cmd, args)
+}
+
+// helperUser returns the user the root helper acts for: the one that ran sudo,
+// or the current user when the helper runs in-process
+func helperUser() (*user.User, error) {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return user.Lookup(name)
+	}
+	return user.Current()
+}
+
+// checkHelperDomain rejects anything but a plain domain, which is all the helper
+// puts into file names
+func checkHelperDomain(domain string) error {
+	if !sitespec.ValidDomain(domain) {
+		return errUsage("invalid domain %q", domain)
+	}
+	return nil
+}
+
+// checkHelperSite checks the values of a site record that end up in the files
+// the helper installs, since the record can be edited by its owner
+func checkHelperSite(site *registry.Site) error {
+	for _, domain := range site.Domains() {
+		if !sitespec.ValidDomain(domain) {
+			return fmt.Errorf("invalid domain %q in the record of %s", domain, site.Domain)
+		}
+	}
+	if site.Hostname != "" && !sitespec.ValidDomain(site.Hostname) {
+		return fmt.Errorf("invalid hostname %q in the record of %s", site.Hostname, site.Domain)
+	}
+	if site.ComposeFile != filepath.Base(site.ComposeFile) || strings.ContainsAny(site.ComposeFile, "\n\r") {
+		return fmt.Errorf("invalid compose file %q in the record of %s", site.ComposeFile, site.Domain)
+	}
+	for _, job := range site.Cron {
+		if err := sitespec.ValidateSchedule(job.Schedule); err != nil {
+			return err
+		}
+		if strings.ContainsAny(job.Command, "\n\r") {
+			return fmt.Errorf("cron job %q of %s is not on a single line", job.Schedule, site.Domain)
+		}
+	}
+	if site.Backup.Schedule != "" {
+		if err := sitespec.ValidateSchedule(site.Backup.Schedule); err != nil {
+			return fmt.Errorf("backups: %w", err)
+		}
+	}
+	return nil
+}
+
+// installVhost renders the vhost of a domain into sites-available, enables it and
+// checks the complete nginx configuration. When the check fails, the previous
+// vhost is restored, or the new one removed.
+func installVhost(domain string) error {
+	if err := checkHelperDomain(domain); err != nil {
+		return err
+	}
+	site, err := registry.Load(domain)
+	if err == nil {
+		err = checkHelperSite(site)
+	}
+	if err != nil && !errors.Is(err, registry.ErrNotFound) {
+		return err
+	}
+
+	content, err := nginxSiteConfig(domain)
+	if err != nil {
+		return err
+	}
+
+	// The per-site custom.d directory is created empty and never written to by ploy
+	sitesDir := filepath.Join(nginxBasePath, "sites-available")
+	enabledDir := filepath.Join(nginxBasePath, "sites-enabled")
+	for _, dir := range []string{sitesDir, enabledDir, nginxCustomDir(domain)} {
+		if err := runner.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create nginx directories: %w", err)
+		}
+	}
+
+	configPath := filepath.Join(sitesDir, domain+".conf")
+	enabledPath := filepath.Join(enabledDir, domain+".conf")
+
+	// Keep the current vhost so it can be restored if the new one fails validation
+	previousContent, readErr := os.ReadFile(configPath)
+	hadPrevious := readErr == nil
+
+	if err := writeRootFile(configPath, content); err != nil {
+		return err
+	}
+	if err := runner.Symlink(configPath, enabledPath); err != nil {
+		return fmt.Errorf("failed to enable nginx configuration: %w", err)
+	}
+
+	if err := validateNginxConfig(); err != nil {
+		var rollbackErr error
+		if hadPrevious {
+			rollbackErr = writeRootFile(configPath, string(previousContent))
+		} else {
+			rollbackErr = errors.Join(removeRootFile(enabledPath), removeRootFile(configPath))
+		}
+		if rollbackErr != nil {
+			return fmt.Errorf("nginx configuration test failed for %s and rollback failed (%v): %v", domain, rollbackErr, err)
+		}
+		return fmt.Errorf("nginx configuration test failed for %s, changes rolled back: %v", domain, err)
+	}
+	return nil
+}
+
+// removeVhost disables and deletes the vhost of a domain
+func removeVhost(domain string) error {
+	if err := checkHelperDomain(domain); err != nil {
+		return err
+	}
+	enabledPath := filepath.Join(nginxBasePath, "sites-enabled", domain+".conf")
+	configPath := filepath.Join(nginxBasePath, "sites-available", domain+".conf")
+	if err := errors.Join(removeRootFile(enabledPath), removeRootFile(configPath)); err != nil {
+		return fmt.Errorf("failed to remove nginx configuration: %w", err)
+	}
+	return nil
+}
+
+// installSiteCron installs the cron.d file of a site from its record, or removes
+// it when the site has no scheduled jobs or no longer exists
+func installSiteCron(domain string) error {
+	if err := checkHelperDomain(domain); err != nil {
+		return err
+	}
+	invoker, err := helperUser()
+	if err != nil {
+		return err
+	}
+
+	site, err := registry.Load(domain)
+	if errors.Is(err, registry.ErrNotFound) {
+		return removeRootFile(siteCronPath(&registry.Site{Domain: domain}))
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkHelperSite(site); err != nil {
+		return err
+	}
+
+	content := siteCrontab(site, invoker.Username)
+	if content == "" {
+		return removeRootFile(siteCronPath(site))
+	}
+	return writeRootFile(siteCronPath(site), content)
+}
+
+// installCertsCron installs the cron.d file that runs `ploy certs renew`
+func installCertsCron() error {
+	invoker, err := helperUser()
+	if err != nil {
+		return err
+	}
+	content, err := renewalCrontab(invoker.Username)
+	if err != nil {
+		return err
+	}
+	return writeRootFile(filepath.Join(cronBasePath, "ploy-certs"), content)
+}
+
+// installAgentUnitFile installs the systemd unit running the agent as username,
+// which defaults to the user that ran sudo. Only root may name another user.
+func installAgentUnitFile(listen, username string) error {
+	invoker, err := helperUser()
+	if err != nil {
+		return err
+	}
+	if username == "" {
+		username = invoker.Username
+	}
+	if username != invoker.Username && invoker.Uid != "0" {
+		return errPermission("only root can install the agent for another user")
+	}
+	target, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+
+	host, port, err := net.SplitHostPort(listen)
+	if err == nil {
+		_, err = strconv.ParseUint(port, 10, 16)
+	}
+	if err != nil || strings.ContainsAny(host, " \t\n\r") {
+		return errUsage("invalid listen address %q", listen)
+	}
+
+	binary, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	unit, err := agent.Unit(binary, target.Username, target.HomeDir, listen)
+	if err != nil {
+		return err
+	}
+	return writeRootFile(agent.UnitPath, unit)
+}
+
+// writeRootFile replaces a file through a temporary file in the same directory,
+// so that cron, nginx and systemd never read it half written
+func writeRootFile(path, content string) error {
+	if runner.DryRun {
+		runner.PlanFile(path, 0644, []byte(content))
+		return nil
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(path), ".ploy-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.WriteString(content); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Chmod(tempFile.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		return fmt.Errorf("failed to install %s: %w", path, err)
+	}
+	return nil
+}
+
+// removeRootFile removes a file the helper manages, if it exists
+func removeRootFile(path string) error {
+	if err := runner.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package commands
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRootHelperNeedsRoot(t *testing.T) {
+	oldGeteuid := geteuid
+	geteuid = func() int { return 1000 }
+	defer func() { geteuid = oldGeteuid }()
+
+	err := RootHelperCmd.PersistentPreRunE(rootHelperSiteCronCmd, []string{"shop.com"})
+	assert.Error(t, err)
+	assert.Equal(t, ExitPermission, ExitCode(err))
+}
+
+func TestRootHelperSiteCron(t *testing.T) {
+	_, site := setupApplyTest(t)
+	current, err := user.Current()
+	assert.NoError(t, err)
+	t.Setenv("SUDO_USER", current.Username)
+	cronPath := filepath.Join(cronBasePath, "ploy-site-shop-com")
+
+	// The file is rendered from the record, and runs as the user that ran sudo
+	site.Cron = []registry.CronJob{{Schedule: "*/5 * * * *", Command: "wp cron event run --due-now"}}
+	assert.NoError(t, registry.Save(site))
+	assert.NoError(t, callRootHelper("site-cron", "shop.com"))
+	installed, err := os.ReadFile(cronPath)
+	assert.NoError(t, err)
+	assert.Equal(t, siteCrontab(site, current.Username), string(installed))
+	assert.Contains(t, string(installed), "*/5 * * * * "+current.Username+" docker compose")
+
+	// A record edited to add a line of its own is refused
+	site.Cron[0].Command = "true\n* * * * * root sh /tmp/evil"
+	assert.NoError(t, registry.Save(site))
+	assert.ErrorContains(t, callRootHelper("site-cron", "shop.com"), "single line")
+	site.Cron[0] = registry.CronJob{Schedule: "* * * * * root", Command: "true"}
+	assert.NoError(t, registry.Save(site))
+	assert.ErrorContains(t, callRootHelper("site-cron", "shop.com"), "invalid cron schedule")
+	content, err := os.ReadFile(cronPath)
+	assert.NoError(t, err)
+	assert.Equal(t, string(installed), string(content))
+
+	// Without jobs the file is removed
+	site.Cron = nil
+	assert.NoError(t, registry.Save(site))
+	assert.NoError(t, callRootHelper("site-cron", "shop.com"))
+	assert.NoFileExists(t, cronPath)
+}
+
+func TestRootHelperRejectsNames(t *testing.T) {
+	setupApplyTest(t)
+
+	for _, domain := range []string{"../../etc/cron.d/x", "shop.com /etc/shadow", "-t", ""} {
+		assert.Equal(t, ExitUsage, ExitCode(callRootHelper("vhost", domain)), domain)
+		assert.Equal(t, ExitUsage, ExitCode(callRootHelper("site-cron", domain)), domain)
+		assert.Equal(t, ExitUsage, ExitCode(callRootHelper("remove-vhost", domain)), domain)
+	}
+	assert.Equal(t, ExitUsage, ExitCode(callRootHelper("agent-unit", "127.0.0.1:8080\nExecStartPre=/bin/sh")))
+	assert.Error(t, callRootHelper("install", "/tmp/file", "/etc/cron.d/file"))
+}
+
+func TestCheckRootOwned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ploy")
+	assert.NoError(t, os.WriteFile(path, []byte("binary"), 0755))
+	assert.NoError(t, os.Chmod(path, 0777))
+
+	err := checkRootOwned(path)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), path+" must be owned by root")
+}
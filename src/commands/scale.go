@@ -0,0 +1,225 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/autoscale"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/spf13/cobra"
+)
+
+var AutoscaleCmd = &cobra.Command{
+	Use:   "autoscale",
+	Short: "Scale dynamic sites based on container usage",
+	Long:  `Scale sites with scaling_type=dynamic between their replicas and max_replicas based on container CPU and memory usage.`,
+}
+
+func init() {
+	SitesCmd.AddCommand(sitesScaleCmd)
+	sitesScaleCmd.Flags().Int("replicas", 0, "Number of replicas to run")
+	sitesScaleCmd.MarkFlagRequired("replicas")
+
+	AutoscaleCmd.AddCommand(autoscaleRunCmd)
+	defaults := autoscale.DefaultPolicy()
+	autoscaleRunCmd.Flags().Float64("cpu_high", defaults.CPUHigh, "Average CPU percentage above which a site is scaled up")
+	autoscaleRunCmd.Flags().Float64("cpu_low", defaults.CPULow, "Average CPU percentage below which a site may be scaled down")
+	autoscaleRunCmd.Flags().Float64("memory_high", defaults.MemoryHigh, "Average memory percentage above which a site is scaled up")
+	autoscaleRunCmd.Flags().Float64("memory_low", defaults.MemoryLow, "Average memory percentage below which a site may be scaled down")
+	autoscaleRunCmd.Flags().Duration("scale_up_cooldown", defaults.ScaleUpCooldown, "Minimum time between a scaling action and the next scale up")
+	autoscaleRunCmd.Flags().Duration("scale_down_cooldown", defaults.ScaleDownCooldown, "Minimum time between a scaling action and the next scale down")
+	autoscaleRunCmd.Flags().Duration("interval", 30*time.Second, "How often container usage is checked")
+	autoscaleRunCmd.Flags().Bool("once", false, "Check every site once and exit (for cron)")
+}
+
+var sitesScaleCmd = &cobra.Command{
+	Use:   "scale [host]",
+	Short: "Change the number of replicas of a site",
+	Long:  `Change the number of replicas of a site, within max_replicas for dynamic sites. A site that outgrows its reserved ports gets a larger block, which recreates its containers.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		replicas, _ := cmd.Flags().GetInt("replicas")
+
+		site, unlock, err := registry.Lock(args[0])
+		if err != nil {
+			return fmt.Errorf("loading site: %w", err)
+		}
+		defer unlock()
+
+		fmt.Printf("Scaling %s from %d to %d replicas...\n", site.Domain, site.Replicas, replicas)
+		if err := scaleSite(site, replicas, ""); err != nil {
+			return fmt.Errorf("scaling site: %w", err)
+		}
+		color.Green("%s is running %d replicas", site.Domain, site.Replicas)
+		return nil
+	},
+}
+
+var autoscaleRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Run the autoscaler loop",
+	Long:  `Check the CPU and memory usage of every dynamic site at each interval and add or remove a replica when it crosses the thresholds.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		policy := autoscale.Policy{}
+		policy.CPUHigh, _ = flags.GetFloat64("cpu_high")
+		policy.CPULow, _ = flags.GetFloat64("cpu_low")
+		policy.MemoryHigh, _ = flags.GetFloat64("memory_high")
+		policy.MemoryLow, _ = flags.GetFloat64("memory_low")
+		policy.ScaleUpCooldown, _ = flags.GetDuration("scale_up_cooldown")
+		policy.ScaleDownCooldown, _ = flags.GetDuration("scale_down_cooldown")
+		interval, _ := flags.GetDuration("interval")
+		once, _ := flags.GetBool("once")
+
+		if err := policy.Validate(); err != nil {
+			return fmt.Errorf("invalid autoscaling policy: %w", err)
+		}
+
+		for {
+			autoscaleSites(policy, time.Now())
+			if once {
+				return nil
+			}
+			time.Sleep(interval)
+		}
+	},
+}
+
+// scaleSite runs the given number of replicas for a site, records the new count
+// and points the nginx upstream at the running replicas
+func scaleSite(site *registry.Site, replicas int, webhook string) error {
+	min, max := site.ReplicaBounds()
+	if site.ScalingType != "dynamic" {
+		// Static sites are only limited by the free ports
+		min = 1
+	}
+	if replicas < min || replicas > max {
+		return fmt.Errorf("replicas for %s must be between %d and %d", site.Domain, min, max)
+	}
+
+	previous, previousPort, previousPortCount := site.Replicas, site.HostPort, site.PortCount
+	restore := func() {
+		site.Replicas, site.HostPort, site.PortCount = previous, previousPort, previousPortCount
+	}
+	moved, err := registry.ReservePorts(site, replicas)
+	if err != nil {
+		return fmt.Errorf("failed to reserve ports for %d replicas: %w", replicas, err)
+	}
+	site.Replicas = replicas
+	site.ScaledAt = time.Now().UTC()
+
+	// Re-render the compose file so a later `up` keeps the new count
+	composeContent, err := renderSiteCompose(site)
+	if err != nil {
+		restore()
+		return err
+	}
+	if err := runner.WriteFile(site.ComposePath(), []byte(composeContent), 0644); err != nil {
+		restore()
+		return fmt.Errorf("failed to write docker-compose file: %w", err)
+	}
+
+	if os.Getenv("PLOY_TEST_ENV") != "true" {
+		args := []string{"up", "-d", "--scale", fmt.Sprintf("wordpress=%d", replicas)}
+		if !moved {
+			// Running replicas keep serving; only the added ones are started
+			args = append(args, "--no-recreate")
+		}
+		cmd := composeCommand(site.ComposePath(), args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := runner.Run(cmd); err != nil {
+			restore()
+			return fmt.Errorf("failed to scale containers: %w", err)
+		}
+	}
+	if moved {
+		createSiteLog(site.Name(), fmt.Sprintf("Web containers moved to 127.0.0.1:%d-%d for %d replicas",
+			site.HostPort, site.LastPort(), replicas))
+	}
+
+	if err := registry.Save(site); err != nil {
+		return fmt.Errorf("failed to record site: %w", err)
+	}
+	createSiteLog(site.Name(), fmt.Sprintf("Scaled from %d to %d replicas", previous, replicas))
+
+	return refreshSiteUpstream(site, webhook)
+}
+
+// autoscaleSites checks every dynamic site once and scales those whose usage
+// crossed a threshold
+func autoscaleSites(policy autoscale.Policy, now time.Time) {
+	sites, err := registry.List()
+	if err != nil {
+		color.Red("Error listing sites: %v", err)
+		return
+	}
+
+	for _, site := range sites {
+		if site.ScalingType != "dynamic" || site.Stopped {
+			continue
+		}
+		autoscaleSite(policy, site.Domain, now)
+	}
+}
+
+// autoscaleSite scales a site when its usage crossed a threshold. It holds the
+// site's lock, so a change saved by `ploy sites scale`, `ploy apply` or `ploy
+// sites stop` in the meantime is neither lost nor undone.
+func autoscaleSite(policy autoscale.Policy, domain string, now time.Time) {
+	site, unlock, err := registry.Lock(domain)
+	if err != nil {
+		color.Red("%s: error loading site: %v", domain, err)
+		return
+	}
+	defer unlock()
+	if site.ScalingType != "dynamic" || site.Stopped {
+		return
+	}
+
+	usage, err := siteUsage(site)
+	if err != nil {
+		color.Red("%s: error reading container usage: %v", site.Domain, err)
+		return
+	}
+
+	min, max := site.ReplicaBounds()
+	desired := autoscale.Decide(policy, site.Replicas, min, max, usage, site.ScaledAt, now)
+	if desired == site.Replicas {
+		return
+	}
+
+	fmt.Printf("%s: cpu %.1f%%, memory %.1f%%, scaling from %d to %d replicas\n",
+		site.Domain, usage.CPU, usage.Memory, site.Replicas, desired)
+	if err := scaleSite(site, desired, ""); err != nil {
+		color.Red("%s: error scaling site: %v", site.Domain, err)
+	}
+}
+
+// siteUsage returns the average CPU and memory usage over a site's web containers
+func siteUsage(site *registry.Site) (autoscale.Usage, error) {
+	output, err := runner.Query(composeCommand(site.ComposePath(), "ps", "-q", "wordpress"))
+	if err != nil {
+		return autoscale.Usage{}, fmt.Errorf("failed to list containers: %w", err)
+	}
+	ids := strings.Fields(string(output))
+	if len(ids) == 0 {
+		return autoscale.Usage{}, fmt.Errorf("no running containers")
+	}
+
+	args := append([]string{"stats", "--no-stream", "--format", "{{.ID}}\t{{.CPUPerc}}\t{{.MemPerc}}"}, ids...)
+	output, err = runner.Query(execCommand("docker", args...))
+	if err != nil {
+		return autoscale.Usage{}, fmt.Errorf("failed to read docker stats: %w", err)
+	}
+
+	usages, err := autoscale.ParseStats(string(output))
+	if err != nil {
+		return autoscale.Usage{}, err
+	}
+	return autoscale.Average(usages), nil
+}
@@ -0,0 +1,164 @@
+package commands
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/autoscale"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupScaleTest(t *testing.T) (string, *registry.Site) {
+	tempDir := setupNginxTest(t)
+
+	oldGetDockerComposeTemplate := getDockerComposeTemplate
+	getDockerComposeTemplate = func(filename string) ([]byte, error) {
+		return []byte("services:\n  wordpress:\n    deploy:\n      replicas: ${REPLICAS}\n"), nil
+	}
+	oldExecCommand := execCommand
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		return exec.Command("false")
+	}
+	t.Cleanup(func() {
+		getDockerComposeTemplate = oldGetDockerComposeTemplate
+		execCommand = oldExecCommand
+	})
+
+	site := &registry.Site{
+		Domain:      "shop.com",
+		ScalingType: "dynamic",
+		Replicas:    1,
+		MinReplicas: 1,
+		MaxReplicas: 3,
+		HostPort:    20010,
+		PortCount:   3,
+		ComposeFile: "docker-compose-wp-php8.3.yml",
+	}
+	assert.NoError(t, registry.Save(site))
+	return tempDir, site
+}
+
+func TestScaleSite(t *testing.T) {
+	tempDir, site := setupScaleTest(t)
+
+	assert.NoError(t, scaleSite(site, 3, ""))
+
+	recorded, err := registry.Load("shop.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, recorded.Replicas)
+	assert.False(t, recorded.ScaledAt.IsZero())
+
+	compose, err := os.ReadFile(site.ComposePath())
+	assert.NoError(t, err)
+	assert.Contains(t, string(compose), "replicas: 3")
+
+	content, err := os.ReadFile(filepath.Join(tempDir, "sites-available", "shop.com.conf"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(content), "\tserver 127.0.0.1:"))
+
+	err = scaleSite(site, 4, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "between 1 and 3")
+	assert.Equal(t, 3, site.Replicas)
+
+	assert.Error(t, scaleSite(site, 0, ""))
+}
+
+func TestScaleStaticSitePastItsPorts(t *testing.T) {
+	setupScaleTest(t)
+	site := &registry.Site{Domain: "blog.com", ScalingType: "static", Replicas: 1, HostPort: 20020,
+		PortCount: 1, ComposeFile: "docker-compose-wp-php8.3.yml"}
+	assert.NoError(t, registry.Save(site))
+
+	assert.NoError(t, scaleSite(site, 2, ""))
+
+	recorded, err := registry.Load("blog.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, recorded.Replicas)
+	assert.Len(t, recorded.Ports(), 2)
+	assert.NotEqual(t, 20020, recorded.HostPort, "the block is reserved anew")
+	for _, other := range []int{20010, 20011, 20012} {
+		assert.NotContains(t, recorded.Ports(), other, "ports of shop.com")
+	}
+}
+
+func TestAutoscaleSites(t *testing.T) {
+	_, site := setupScaleTest(t)
+
+	cpu := "90.00%"
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		switch {
+		case name == "docker" && len(arg) > 3 && arg[0] == "compose" && arg[3] == "ps":
+			return exec.Command("echo", "abc123")
+		case name == "docker" && len(arg) > 0 && arg[0] == "stats":
+			return exec.Command("echo", "abc123\t"+cpu+"\t10.00%")
+		}
+		return exec.Command("false")
+	}
+
+	policy := autoscale.DefaultPolicy()
+	now := time.Now()
+	autoscaleSites(policy, now)
+
+	recorded, err := registry.Load(site.Domain)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, recorded.Replicas)
+
+	// Within the cooldown nothing changes
+	autoscaleSites(policy, now.Add(time.Minute))
+	recorded, _ = registry.Load(site.Domain)
+	assert.Equal(t, 2, recorded.Replicas)
+
+	// Idle after the scale down cooldown removes a replica
+	cpu = "1.00%"
+	autoscaleSites(policy, now.Add(time.Hour))
+	recorded, _ = registry.Load(site.Domain)
+	assert.Equal(t, 1, recorded.Replicas)
+
+	// Stopped sites are left alone
+	recorded.Stopped = true
+	assert.NoError(t, registry.Save(recorded))
+	cpu = "99.00%"
+	autoscaleSites(policy, now.Add(2*time.Hour))
+	recorded, _ = registry.Load(site.Domain)
+	assert.Equal(t, 1, recorded.Replicas)
+	assert.True(t, recorded.Stopped)
+
+	// Static sites are left alone
+	recorded.Stopped = false
+	recorded.ScalingType = "static"
+	assert.NoError(t, registry.Save(recorded))
+	cpu = "99.00%"
+	autoscaleSites(policy, now.Add(2*time.Hour))
+	recorded, _ = registry.Load(site.Domain)
+	assert.Equal(t, 1, recorded.Replicas)
+}
+
+func TestAutoscaleKeepsChangesSavedMeanwhile(t *testing.T) {
+	_, site := setupScaleTest(t)
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		switch {
+		case name == "docker" && len(arg) > 3 && arg[0] == "compose" && arg[3] == "ps":
+			return exec.Command("echo", "abc123")
+		case name == "docker" && len(arg) > 0 && arg[0] == "stats":
+			return exec.Command("echo", "abc123\t90.00%\t10.00%")
+		}
+		return exec.Command("false")
+	}
+
+	// The site is stopped after the autoscaler listed it
+	stale, err := registry.Load(site.Domain)
+	assert.NoError(t, err)
+	assert.NoError(t, recordStopped(site, true))
+	autoscaleSite(autoscale.DefaultPolicy(), stale.Domain, time.Now())
+
+	recorded, err := registry.Load(site.Domain)
+	assert.NoError(t, err)
+	assert.True(t, recorded.Stopped)
+	assert.Equal(t, 1, recorded.Replicas)
+}
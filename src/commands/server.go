@@ -0,0 +1,243 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/agent"
+	"github.com/ploycloud/ploy-server-cli/src/cloud"
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/config"
+	"github.com/ploycloud/ploy-server-cli/src/jobs"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/spf13/cobra"
+)
+
+// heartbeatJobWindow is how long finished jobs keep being reported in heartbeats
+const heartbeatJobWindow = time.Hour
+
+var ServerCmd = &cobra.Command{
+	Use:   "server",
+	Short: "Manage this server's connection to PloyCloud",
+}
+
+func init() {
+	ServerCmd.AddCommand(serverRegisterCmd)
+	ServerCmd.AddCommand(serverHeartbeatCmd)
+	ServerCmd.AddCommand(serverStatusCmd)
+
+	serverRegisterCmd.Flags().String("api_url", "", "PloyCloud API URL (default: api_url from the configuration)")
+	serverRegisterCmd.Flags().Bool("force", false, "Register again even if the server already has an identity")
+	serverHeartbeatCmd.Flags().Bool("once", false, "Send a single heartbeat and exit")
+}
+
+var serverRegisterCmd = &cobra.Command{
+	Use:   "register",
+	Short: "Register this server with PloyCloud using the configured API key",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		force, _ := cmd.Flags().GetBool("force")
+		apiURL, _ := cmd.Flags().GetString("api_url")
+
+		if identity, err := cloud.LoadIdentity(); err == nil && !force {
+			color.Yellow("Server is already registered as %s (use --force to register again)", identity.ServerID)
+			return nil
+		}
+
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			return fmt.Errorf("loading configuration: %w", err)
+		}
+		if cfg.APIKey == "" || cfg.APIKey == "your-api-key" {
+			return errUsage("set api_key in %s or PLOY_API_KEY first", config.Path())
+		}
+		if apiURL == "" {
+			apiURL = cfg.APIURL
+		}
+
+		facts := serverFacts()
+		identity, err := cloud.NewClient(apiURL, cfg.APIKey).Register(context.Background(), cloud.RegisterRequest{
+			Hostname: facts.Hostname,
+			Region:   cfg.Region,
+			Version:  common.CurrentCliVersion,
+			Facts:    facts,
+		})
+		if err != nil {
+			return fmt.Errorf("registering server: %w", err)
+		}
+		identity.APIURL = apiURL
+		identity.Region = cfg.Region
+		identity.RegisteredAt = time.Now().UTC()
+		if err := cloud.SaveIdentity(identity); err != nil {
+			return fmt.Errorf("saving server identity: %w", err)
+		}
+
+		color.Green("Server registered as %s", identity.ServerID)
+		fmt.Println("The ploy agent sends heartbeats from now on; run `ploy server heartbeat --once` to send one now.")
+		return nil
+	},
+}
+
+var serverHeartbeatCmd = &cobra.Command{
+	Use:   "heartbeat",
+	Short: "Report the state of the server to PloyCloud and pick up pending commands",
+	Long:  `Report server facts, the ploy version, sites and service health to PloyCloud, and queue the commands it sends back as jobs. The ploy agent does this continuously once the server is registered.`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		once, _ := cmd.Flags().GetBool("once")
+
+		identity, err := cloud.LoadIdentity()
+		if err != nil {
+			return err
+		}
+		client := cloud.NewClient(identity.APIURL, identity.Token)
+		reporter := &cloudReporter{backend: &agentBackend{}}
+
+		if once {
+			_, err := cloud.Beat(context.Background(), client, identity, reporter)
+			if err != nil {
+				identity.LastError = err.Error()
+			} else {
+				identity.LastError = ""
+			}
+			if saveErr := cloud.SaveIdentity(identity); saveErr != nil && err == nil {
+				err = saveErr
+			}
+			if err != nil {
+				return err
+			}
+			color.Green("Heartbeat sent")
+			return nil
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return cloud.Run(ctx, client, identity, reporter, heartbeatLogf)
+	},
+}
+
+var serverStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the PloyCloud registration of this server",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		identity, err := cloud.LoadIdentity()
+		if errors.Is(err, cloud.ErrNotRegistered) {
+			fmt.Println("Server is not registered with PloyCloud.")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Server ID:      %s\n", identity.ServerID)
+		fmt.Printf("API:            %s\n", identity.APIURL)
+		if identity.Region != "" {
+			fmt.Printf("Region:         %s\n", identity.Region)
+		}
+		fmt.Printf("Registered:     %s\n", identity.RegisteredAt.Local().Format(time.RFC3339))
+		if identity.LastHeartbeatAt != nil {
+			fmt.Printf("Last heartbeat: %s (%s ago)\n", identity.LastHeartbeatAt.Local().Format(time.RFC3339),
+				time.Since(*identity.LastHeartbeatAt).Round(time.Second))
+		} else {
+			fmt.Println("Last heartbeat: never")
+		}
+		if identity.LastError != "" {
+			fmt.Printf("Last error:     %s\n", identity.LastError)
+		}
+		return nil
+	},
+}
+
+func heartbeatLogf(format string, args ...interface{}) {
+	color.Yellow(format, args...)
+}
+
+// startHeartbeat sends heartbeats in the background while the agent runs, once
+// the server is registered
+func startHeartbeat(ctx context.Context, backend *agentBackend) {
+	identity, err := cloud.LoadIdentity()
+	if errors.Is(err, cloud.ErrNotRegistered) {
+		return
+	}
+	if err != nil {
+		color.Red("Error loading server identity: %v", err)
+		return
+	}
+
+	fmt.Printf("Sending heartbeats to %s as %s\n", identity.APIURL, identity.ServerID)
+	go func() {
+		client := cloud.NewClient(identity.APIURL, identity.Token)
+		if err := cloud.Run(ctx, client, identity, &cloudReporter{backend: backend}, heartbeatLogf); err != nil {
+			color.Red("Error sending heartbeats: %v", err)
+		}
+	}()
+}
+
+// serverFacts describes this machine, including the Docker version when Docker runs
+func serverFacts() cloud.Facts {
+	facts := cloud.CollectFacts(common.ServicesDir)
+	if output, err := runner.Query(execCommand("docker", "version", "--format", "{{.Server.Version}}")); err == nil {
+		facts.DockerVersion = strings.TrimSpace(string(output))
+	}
+	return facts
+}
+
+// cloudReporter reports the same state the agent API serves and queues the
+// commands PloyCloud sends as jobs
+type cloudReporter struct {
+	backend *agentBackend
+}
+
+func (r *cloudReporter) Heartbeat(ctx context.Context) (cloud.Heartbeat, error) {
+	status, err := r.backend.Status(ctx)
+	if err != nil {
+		return cloud.Heartbeat{}, err
+	}
+	list, err := jobs.List()
+	if err != nil {
+		return cloud.Heartbeat{}, err
+	}
+
+	heartbeat := cloud.Heartbeat{
+		Version:  status.Version,
+		Facts:    serverFacts(),
+		Proxy:    status.Proxy,
+		Services: status.Services,
+		Sites:    status.Sites,
+		Jobs:     []cloud.JobSummary{},
+	}
+	since := time.Now().Add(-heartbeatJobWindow)
+	for _, job := range list {
+		if job.FinishedAt != nil && job.FinishedAt.Before(since) {
+			continue
+		}
+		heartbeat.Jobs = append(heartbeat.Jobs, cloud.JobSummary{
+			ID:         job.ID,
+			CommandID:  job.CommandID,
+			Type:       job.Type,
+			Site:       job.Site,
+			State:      job.State,
+			Error:      job.Error,
+			FinishedAt: job.FinishedAt,
+		})
+	}
+	return heartbeat, nil
+}
+
+func (r *cloudReporter) Accept(ctx context.Context, command cloud.Command) (string, error) {
+	job, err := r.backend.Enqueue(ctx, agent.JobRequest{
+		Type:      command.Type,
+		Site:      command.Site,
+		Params:    command.Params,
+		CommandID: command.ID,
+	})
+	return job.ID, err
+}
@@ -0,0 +1,468 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ploycloud/ploy-server-cli/src/bootstrap"
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/docker"
+	"github.com/ploycloud/ploy-server-cli/src/firewall"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// serverInitRoot is prefixed to the system files server init reads and writes
+	serverInitRoot = "/"
+	geteuid        = os.Geteuid
+	// ployBinary is the binary whose root helper the sudoers rules allow
+	ployBinary = os.Executable
+)
+
+// siteLogDir holds the deploy logs of sites
+var siteLogDir = filepath.Join(logBasePath, "sites")
+
+func init() {
+	ServerCmd.AddCommand(serverInitCmd)
+
+	serverInitCmd.Flags().Bool("check", false, "Report which steps are not done without changing anything")
+	serverInitCmd.Flags().String("user", "ploy", "User that runs ploy and its sites")
+	serverInitCmd.Flags().Int("swap_mb", 2048, "Size of the swap file in MB")
+	serverInitCmd.Flags().Int("ssh-port", 0, "Port the firewall allows SSH on, when it cannot be found from the sshd configuration")
+}
+
+var serverInitCmd = &cobra.Command{
+	Use:   "init [step...]",
+	Short: "Prepare this server for ploy, or only the given steps",
+	Long: `Prepare a fresh Ubuntu server for ploy: upgrade packages, install Docker, add swap,
+create the ploy user with scoped sudo rules, enable unattended upgrades and install nginx.
+
+Every step checks the server first and only changes what is missing, so init can be
+run again at any time. Name steps to run only those; --check reports what would change
+and exits non-zero when a step is pending.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		check, _ := cmd.Flags().GetBool("check")
+		user, _ := cmd.Flags().GetString("user")
+		swapMB, _ := cmd.Flags().GetInt("swap_mb")
+		sshPort, _ := cmd.Flags().GetInt("ssh-port")
+
+		steps, err := bootstrap.Select(serverInitSteps(user, swapMB, sshPort), args)
+		if err != nil {
+			return errUsage("%v", err)
+		}
+		if !check && !runner.DryRun && geteuid() != 0 {
+			return errPermission("server init must be run as root, run 'sudo ploy server init'")
+		}
+		return bootstrap.Run(os.Stdout, steps, check)
+	},
+}
+
+// serverInitSteps returns the steps of `ploy server init` in the order they run
+func serverInitSteps(user string, swapMB, sshPort int) []bootstrap.Step {
+	return []bootstrap.Step{
+		{
+			Name:        "upgrade",
+			Description: "upgrade the installed packages",
+			Done: func() (bool, error) {
+				output, err := runner.Query(execCommand("apt-get", "-s", "upgrade"))
+				if err != nil {
+					return false, fmt.Errorf("listing upgrades: %w", err)
+				}
+				return bootstrap.PendingUpgrades(string(output)) == 0, nil
+			},
+			Apply: func() error {
+				return runInitCommands([]string{"apt-get", "update"}, []string{"apt-get", "upgrade", "-y"})
+			},
+		},
+		{
+			Name:        "docker",
+			Description: "install Docker and Docker Compose and start Docker on boot",
+			Done: func() (bool, error) {
+				return queriesSucceed(
+					[]string{"docker", "version", "--format", "{{.Server.Version}}"},
+					append([]string{"docker"}, docker.ComposeVersionArgs()...),
+					[]string{"systemctl", "is-enabled", "docker"},
+				), nil
+			},
+			Apply: func() error {
+				return runInitCommands(
+					[]string{"apt-get", "install", "-y", "docker.io", "docker-compose-v2"},
+					[]string{"systemctl", "enable", "--now", "docker"},
+				)
+			},
+		},
+		{
+			Name:        "swap",
+			Description: fmt.Sprintf("add a %d MB swap file at %s", swapMB, bootstrap.SwapFile),
+			Done: func() (bool, error) {
+				fstab, err := readInitFile("/etc/fstab")
+				if err != nil {
+					return false, err
+				}
+				return swapActive() && bootstrap.WithLine(fstab, bootstrap.FstabEntry) == fstab, nil
+			},
+			Apply: func() error {
+				if !swapActive() {
+					var commands [][]string
+					if _, err := os.Stat(initPath(bootstrap.SwapFile)); err != nil {
+						commands = append(commands,
+							[]string{"dd", "if=/dev/zero", "of=" + bootstrap.SwapFile, "bs=1M", "count=" + strconv.Itoa(swapMB)},
+							[]string{"chmod", "600", bootstrap.SwapFile},
+							[]string{"mkswap", bootstrap.SwapFile},
+						)
+					}
+					commands = append(commands, []string{"swapon", bootstrap.SwapFile})
+					if err := runInitCommands(commands...); err != nil {
+						return err
+					}
+				}
+				fstab, err := readInitFile("/etc/fstab")
+				if err != nil {
+					return err
+				}
+				return runner.WriteFile(initPath("/etc/fstab"), []byte(bootstrap.WithLine(fstab, bootstrap.FstabEntry)), 0644)
+			},
+		},
+		{
+			Name:        "swappiness",
+			Description: "set vm.swappiness to 10 in " + bootstrap.SysctlPath,
+			Done: func() (bool, error) {
+				sysctl, err := readInitFile(bootstrap.SysctlPath)
+				if err != nil {
+					return false, err
+				}
+				legacy, err := readInitFile("/etc/sysctl.conf")
+				if err != nil {
+					return false, err
+				}
+				return sysctl == bootstrap.Sysctl && bootstrap.WithoutLines(legacy, bootstrap.IsSwappinessTypo) == legacy, nil
+			},
+			Apply: func() error {
+				if err := runner.WriteFile(initPath(bootstrap.SysctlPath), []byte(bootstrap.Sysctl), 0644); err != nil {
+					return err
+				}
+				legacy, err := readInitFile("/etc/sysctl.conf")
+				if err != nil {
+					return err
+				}
+				if fixed := bootstrap.WithoutLines(legacy, bootstrap.IsSwappinessTypo); fixed != legacy {
+					if err := runner.WriteFile(initPath("/etc/sysctl.conf"), []byte(fixed), 0644); err != nil {
+						return err
+					}
+				}
+				return runInitCommands([]string{"sysctl", "-p", bootstrap.SysctlPath})
+			},
+		},
+		{
+			Name:        "user",
+			Description: fmt.Sprintf("create the %s user in the docker group with its sites, log and ACME challenge directories", user),
+			Done: func() (bool, error) {
+				if !queriesSucceed([]string{"id", "-u", user}) || !inGroup(user, "docker") {
+					return false, nil
+				}
+				home, err := userHome(user)
+				if err != nil {
+					return false, err
+				}
+				return dirExists(filepath.Join(home, ".ploy", "sites")) && dirExists(initPath(siteLogDir)) &&
+					dirExists(initPath(common.AcmeWebroot)), nil
+			},
+			Apply: func() error {
+				if !queriesSucceed([]string{"id", "-u", user}) {
+					if err := runInitCommands([]string{"useradd", "-m", "-s", "/bin/bash", user}); err != nil {
+						return err
+					}
+				}
+				if !inGroup(user, "docker") {
+					if err := runInitCommands([]string{"usermod", "-aG", "docker", user}); err != nil {
+						return err
+					}
+				}
+				home, err := userHome(user)
+				if err != nil {
+					return err
+				}
+				sitesDir := filepath.Join(home, ".ploy", "sites")
+				for _, dir := range []string{sitesDir, initPath(siteLogDir), initPath(common.AcmeWebroot)} {
+					if err := runner.MkdirAll(dir, 0755); err != nil {
+						return err
+					}
+				}
+				// Sites, their logs and challenge responses are written by the user, not
+				// through sudo; nginx reads the challenge responses
+				return runInitCommands(
+					[]string{"chown", "-R", user + ":" + user, filepath.Join(home, ".ploy")},
+					[]string{"chown", user + ":" + user, initPath(siteLogDir)},
+					[]string{"chown", user + ":" + user, initPath(common.AcmeWebroot)},
+				)
+			},
+		},
+		{
+			Name:        "sudoers",
+			Description: fmt.Sprintf("allow %s only the commands ploy runs with sudo, in %s", user, bootstrap.SudoersPath),
+			Done: func() (bool, error) {
+				binary, err := ployBinary()
+				if err != nil {
+					return false, err
+				}
+				current, err := readInitFile(bootstrap.SudoersPath)
+				if err != nil {
+					return false, err
+				}
+				sudoers, err := readInitFile("/etc/sudoers")
+				if err != nil {
+					return false, err
+				}
+				return current == ploySudoers(user, binary) && bootstrap.WithoutLines(sudoers, bootstrap.IsBlanketSudo(user)) == sudoers, nil
+			},
+			Apply: func() error {
+				binary, err := ployBinary()
+				if err != nil {
+					return err
+				}
+				// The user may run the root helper of this binary as root
+				if err := checkRootOwned(binary); err != nil {
+					return err
+				}
+				// The scoped rules go in first so the user never loses sudo half way
+				if err := installSudoers(ploySudoers(user, binary), initPath(bootstrap.SudoersPath)); err != nil {
+					return err
+				}
+				sudoers, err := readInitFile("/etc/sudoers")
+				if err != nil {
+					return err
+				}
+				if scoped := bootstrap.WithoutLines(sudoers, bootstrap.IsBlanketSudo(user)); scoped != sudoers {
+					return installSudoers(scoped, initPath("/etc/sudoers"))
+				}
+				return nil
+			},
+		},
+		{
+			Name:        "unattended-upgrades",
+			Description: "install unattended-upgrades and enable daily security updates",
+			Done: func() (bool, error) {
+				files, err := initFilesMatch(map[string]string{
+					bootstrap.UnattendedUpgradesPath: bootstrap.UnattendedUpgrades,
+					bootstrap.AutoUpgradesPath:       bootstrap.AutoUpgrades,
+				})
+				if err != nil {
+					return false, err
+				}
+				distro, err := readInitFile(bootstrap.DistroUnattendedUpgradesPath)
+				return files && !bootstrap.ManagedByPloy(distro) && packageInstalled("unattended-upgrades"), err
+			},
+			Apply: func() error {
+				distro, err := readInitFile(bootstrap.DistroUnattendedUpgradesPath)
+				if err != nil {
+					return err
+				}
+				if bootstrap.ManagedByPloy(distro) {
+					// Put back the configuration of the package that older versions replaced
+					if err := runner.Remove(initPath(bootstrap.DistroUnattendedUpgradesPath)); err != nil {
+						return err
+					}
+					if err := runInitCommands([]string{"apt-get", "install", "-y", "--reinstall",
+						"-o", "Dpkg::Options::=--force-confmiss", "unattended-upgrades"}); err != nil {
+						return err
+					}
+				} else if !packageInstalled("unattended-upgrades") {
+					if err := runInitCommands([]string{"apt-get", "install", "-y", "unattended-upgrades"}); err != nil {
+						return err
+					}
+				}
+				if err := runner.WriteFile(initPath(bootstrap.UnattendedUpgradesPath), []byte(bootstrap.UnattendedUpgrades), 0644); err != nil {
+					return err
+				}
+				return runner.WriteFile(initPath(bootstrap.AutoUpgradesPath), []byte(bootstrap.AutoUpgrades), 0644)
+			},
+		},
+		{
+			Name:        "nginx",
+			Description: "install nginx as the proxy and start it on boot",
+			Done: func() (bool, error) {
+				if !queriesSucceed([]string{"nginx", "-v"}) {
+					return false, nil
+				}
+				return serviceRunning("nginx-proxy")
+			},
+			Apply: func() error {
+				if !queriesSucceed([]string{"nginx", "-v"}) {
+					if err := runInitCommands([]string{"apt-get", "install", "-y", "nginx"}); err != nil {
+						return err
+					}
+				}
+				return runInitCommands([]string{"systemctl", "enable", "--now", "nginx"})
+			},
+		},
+		{
+			Name:        "firewall",
+			Description: "allow SSH, HTTP and HTTPS and close the MySQL port with the ploy firewall rules",
+			Done: func() (bool, error) {
+				rs, err := firewall.Load(initPath(firewall.RulesetPath))
+				if errors.Is(err, os.ErrNotExist) {
+					return false, nil
+				}
+				if err != nil {
+					return false, err
+				}
+				return firewallApplied(rs), nil
+			},
+			Apply: func() error {
+				rs, _, err := loadFirewallRuleset(sshPort)
+				if err != nil {
+					return err
+				}
+				return applyFirewall(rs)
+			},
+		},
+	}
+}
+
+// ploySudoers renders the sudoers rules for the commands ploy runs as user, with
+// the root helper of binary
+func ploySudoers(user, binary string) string {
+	return bootstrap.Sudoers(bootstrap.SudoersConfig{User: user, Ploy: binary})
+}
+
+// checkRootOwned fails unless a file and its directory are owned by root and
+// writable by nobody else, so that no other user can replace it
+var checkRootOwned = func(path string) error {
+	for _, p := range []string{path, filepath.Dir(path)} {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || stat.Uid != 0 || info.Mode().Perm()&0022 != 0 {
+			return fmt.Errorf("%s must be owned by root and writable only by root, move the ploy binary to /usr/local/bin", p)
+		}
+	}
+	return nil
+}
+
+// installSudoers validates content with visudo before it replaces the file at path,
+// so a bad rule can never lock root out of sudo
+func installSudoers(content, path string) error {
+	if runner.DryRun {
+		runner.PlanFile(path, 0440, []byte(content))
+		return nil
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(path), ".ploy-sudoers-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.WriteString(content); err != nil {
+		return fmt.Errorf("failed to write to temporary file: %w", err)
+	}
+	tempFile.Close()
+
+	if err := runInitCommands([]string{"visudo", "-cf", tempFile.Name()}); err != nil {
+		return fmt.Errorf("invalid sudoers rules: %w", err)
+	}
+	if err := os.Chmod(tempFile.Name(), 0440); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
+
+// runInitCommands runs commands in order and stops at the first that fails
+func runInitCommands(commands ...[]string) error {
+	for _, command := range commands {
+		cmd := execCommand(command[0], command[1:]...)
+		cmd.Env = append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
+		if err := runner.Run(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queriesSucceed reports whether all commands exit successfully
+func queriesSucceed(commands ...[]string) bool {
+	for _, command := range commands {
+		if _, err := runner.Query(execCommand(command[0], command[1:]...)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func swapActive() bool {
+	output, err := runner.Query(execCommand("swapon", "--show=NAME", "--noheadings"))
+	return err == nil && containsLine(string(output), bootstrap.SwapFile)
+}
+
+func inGroup(user, group string) bool {
+	output, err := runner.Query(execCommand("id", "-nG", user))
+	return err == nil && containsLine(strings.ReplaceAll(string(output), " ", "\n"), group)
+}
+
+func packageInstalled(name string) bool {
+	output, err := runner.Query(execCommand("dpkg-query", "-W", "-f=${Status}", name))
+	return err == nil && strings.Contains(string(output), "install ok installed")
+}
+
+// userHome looks up the home directory of user. In dry-run mode a user that does
+// not exist yet has the home directory useradd would create.
+func userHome(user string) (string, error) {
+	output, err := runner.Query(execCommand("getent", "passwd", user))
+	if err != nil {
+		if runner.DryRun {
+			return filepath.Join("/home", user), nil
+		}
+		return "", fmt.Errorf("looking up the home of %s: %w", user, err)
+	}
+	fields := strings.Split(strings.TrimSpace(string(output)), ":")
+	if len(fields) < 6 || fields[5] == "" {
+		return "", fmt.Errorf("no home directory for %s", user)
+	}
+	return fields[5], nil
+}
+
+func containsLine(output, line string) bool {
+	for _, l := range strings.Split(output, "\n") {
+		if strings.TrimSpace(l) == line {
+			return true
+		}
+	}
+	return false
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// initPath returns where a system file is under serverInitRoot
+func initPath(path string) string {
+	return filepath.Join(serverInitRoot, path)
+}
+
+// readInitFile reads a system file, which is empty when it does not exist yet
+func readInitFile(path string) (string, error) {
+	data, err := os.ReadFile(initPath(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func initFilesMatch(files map[string]string) (bool, error) {
+	for path, want := range files {
+		got, err := readInitFile(path)
+		if err != nil || got != want {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,237 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ploycloud/ploy-server-cli/src/bootstrap"
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// initServer is a fresh server as set up by the old user-data script: packages to
+// upgrade, nothing installed, a misspelt swappiness setting and blanket sudo
+type initServer struct {
+	root     string
+	home     string
+	upgrades int
+	packages map[string]bool
+	swapOn   bool
+	user     bool
+	groups   string
+	// mysqlPort is the port the MySQL container is published on, if it runs
+	mysqlPort string
+	ufwOn     bool
+	// sshdConfig is what `sshd -T` prints
+	sshdConfig string
+	commands   []string
+}
+
+func setupServerInitTest(t *testing.T) *initServer {
+	root := t.TempDir()
+	server := &initServer{root: root, home: filepath.Join(root, "home", "ploy"), upgrades: 3, packages: map[string]bool{},
+		sshdConfig: "port 22\naddressfamily any\n"}
+
+	for _, dir := range []string{"etc/sysctl.d", "etc/sudoers.d", "etc/apt/apt.conf.d", "etc/ufw", "var/log"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "etc/fstab"), []byte("LABEL=root / ext4 defaults 0 1\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "etc/sysctl.conf"), []byte("vm.sappiness=10\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "etc/sudoers"),
+		[]byte("root ALL=(ALL:ALL) ALL\n@includedir /etc/sudoers.d\nploy ALL=(ALL) NOPASSWD:ALL\n"), 0440))
+
+	oldExecCommand, oldRoot, oldGeteuid := execCommand, serverInitRoot, geteuid
+	oldPloyBinary, oldCheckRootOwned := ployBinary, checkRootOwned
+	serverInitRoot = root
+	geteuid = func() int { return 0 }
+	execCommand = server.command
+	ployBinary = func() (string, error) { return "/usr/local/bin/ploy", nil }
+	checkRootOwned = func(path string) error { return nil }
+	t.Cleanup(func() {
+		execCommand, serverInitRoot, geteuid = oldExecCommand, oldRoot, oldGeteuid
+		ployBinary, checkRootOwned = oldPloyBinary, oldCheckRootOwned
+	})
+	return server
+}
+
+// command answers queries from the server state and applies changes to it
+func (s *initServer) command(name string, arg ...string) *exec.Cmd {
+	cmdline := strings.TrimSpace(name + " " + strings.Join(arg, " "))
+	s.commands = append(s.commands, cmdline)
+
+	ok := exec.Command("true")
+	echo := func(output string) *exec.Cmd { return exec.Command("echo", output) }
+	fail := exec.Command("false")
+	when := func(cond bool, cmd *exec.Cmd) *exec.Cmd {
+		if cond {
+			return cmd
+		}
+		return fail
+	}
+
+	switch {
+	case cmdline == "apt-get -s upgrade":
+		return echo(fmt.Sprintf("%d upgraded, 0 newly installed, 0 to remove and 0 not upgraded.", s.upgrades))
+	case cmdline == "apt-get upgrade -y":
+		s.upgrades = 0
+	case strings.HasPrefix(cmdline, "apt-get install -y --reinstall -o Dpkg::Options::=--force-confmiss "):
+		// Missing configuration files of the package are put back
+		s.packages[arg[len(arg)-1]] = true
+		os.WriteFile(filepath.Join(s.root, bootstrap.DistroUnattendedUpgradesPath), []byte("// distro defaults\n"), 0644)
+	case strings.HasPrefix(cmdline, "apt-get install -y "):
+		for _, pkg := range arg[2:] {
+			s.packages[pkg] = true
+		}
+	case strings.HasPrefix(cmdline, "docker ps"):
+		return when(s.mysqlPort != "", echo("mysql"))
+	case strings.HasPrefix(cmdline, "docker inspect"):
+		return echo(s.mysqlPort)
+	case strings.HasPrefix(cmdline, "docker "):
+		return when(s.packages["docker.io"], echo("24.0.7"))
+	case cmdline == "systemctl is-enabled docker":
+		return when(s.packages["docker.io"], echo("enabled"))
+	case cmdline == "systemctl is-active nginx":
+		return when(s.packages["nginx"], echo("active"))
+	case cmdline == "nginx -v":
+		return when(s.packages["nginx"], ok)
+	case strings.HasPrefix(cmdline, "dpkg-query"):
+		return when(s.packages[arg[len(arg)-1]], echo("install ok installed"))
+	case strings.HasPrefix(cmdline, "swapon --show"):
+		return when(s.swapOn, echo(bootstrap.SwapFile))
+	case cmdline == "swapon "+bootstrap.SwapFile:
+		s.swapOn = true
+	case cmdline == "id -u ploy":
+		return when(s.user, echo("1001"))
+	case cmdline == "id -nG ploy":
+		return when(s.user, echo(s.groups))
+	case cmdline == "getent passwd ploy":
+		return when(s.user, echo("ploy:x:1001:1001::"+s.home+":/bin/bash"))
+	case cmdline == "ufw status":
+		if s.ufwOn {
+			return echo("Status: active")
+		}
+		return echo("Status: inactive")
+	case cmdline == "sshd -T":
+		return when(s.sshdConfig != "", echo(s.sshdConfig))
+	case cmdline == "ufw --force enable":
+		s.ufwOn = true
+	case strings.HasPrefix(cmdline, "useradd"):
+		s.user, s.groups = true, "ploy"
+	case strings.HasPrefix(cmdline, "usermod -aG docker"):
+		s.groups += " docker"
+	}
+	return ok
+}
+
+func (s *initServer) read(t *testing.T, path string) string {
+	data, err := os.ReadFile(filepath.Join(s.root, path))
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestServerInitCmd(t *testing.T) {
+	server := setupServerInitTest(t)
+
+	var err error
+	output := CaptureOutput(func() {
+		err = serverInitCmd.RunE(serverInitCmd, []string{})
+	})
+	assert.NoError(t, err)
+	for i, step := range []string{"upgrade", "docker", "swap", "swappiness", "user", "sudoers", "unattended-upgrades", "nginx", "firewall"} {
+		assert.Contains(t, output, fmt.Sprintf("[%d/9] %s: applied", i+1, step))
+	}
+
+	assert.Contains(t, server.commands, "dd if=/dev/zero of=/swapfile bs=1M count=2048")
+	assert.Contains(t, server.commands, "useradd -m -s /bin/bash ploy")
+	assert.Contains(t, server.commands, "systemctl enable --now nginx")
+	assert.Contains(t, server.commands, "ufw deny proto tcp from any to any port 3306 comment ploy")
+	assert.Equal(t, "LABEL=root / ext4 defaults 0 1\n"+bootstrap.FstabEntry+"\n", server.read(t, "etc/fstab"))
+	assert.Equal(t, bootstrap.Sysctl, server.read(t, bootstrap.SysctlPath))
+	assert.Equal(t, "", server.read(t, "etc/sysctl.conf"))
+	assert.DirExists(t, filepath.Join(server.home, ".ploy", "sites"))
+	assert.DirExists(t, filepath.Join(server.root, siteLogDir))
+	assert.DirExists(t, filepath.Join(server.root, common.AcmeWebroot))
+	assert.Contains(t, server.commands, "chown ploy:ploy "+filepath.Join(server.root, common.AcmeWebroot))
+
+	// The blanket rule is replaced by rules for the commands ploy runs
+	assert.Equal(t, ploySudoers("ploy", "/usr/local/bin/ploy"), server.read(t, bootstrap.SudoersPath))
+	assert.Equal(t, "root ALL=(ALL:ALL) ALL\n@includedir /etc/sudoers.d\n", server.read(t, "etc/sudoers"))
+	info, err := os.Stat(filepath.Join(server.root, bootstrap.SudoersPath))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0440), info.Mode().Perm())
+
+	// Running again finds everything done
+	server.commands = nil
+	output = CaptureOutput(func() {
+		err = serverInitCmd.RunE(serverInitCmd, []string{})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 9, strings.Count(output, ": ok\n"))
+	assert.NotContains(t, server.commands, "apt-get update")
+}
+
+func TestServerInitRestoresDistroUnattendedUpgrades(t *testing.T) {
+	server := setupServerInitTest(t)
+	server.packages["unattended-upgrades"] = true
+	// Written by an older server init in place of the package's file
+	distro := filepath.Join(server.root, bootstrap.DistroUnattendedUpgradesPath)
+	assert.NoError(t, os.WriteFile(distro, []byte(bootstrap.UnattendedUpgrades), 0644))
+
+	var err error
+	CaptureOutput(func() {
+		err = serverInitCmd.RunE(serverInitCmd, []string{"unattended-upgrades"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, server.commands,
+		"apt-get install -y --reinstall -o Dpkg::Options::=--force-confmiss unattended-upgrades")
+	assert.Equal(t, "// distro defaults\n", server.read(t, bootstrap.DistroUnattendedUpgradesPath))
+	assert.Equal(t, bootstrap.UnattendedUpgrades, server.read(t, bootstrap.UnattendedUpgradesPath))
+	assert.Equal(t, bootstrap.AutoUpgrades, server.read(t, bootstrap.AutoUpgradesPath))
+
+	// The package's own file is left alone from then on
+	assert.NoError(t, os.WriteFile(distro, []byte("// edited by the admin\n"), 0644))
+	output := CaptureOutput(func() {
+		err = serverInitCmd.RunE(serverInitCmd, []string{"unattended-upgrades"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, output, "unattended-upgrades: ok")
+	assert.Equal(t, "// edited by the admin\n", server.read(t, bootstrap.DistroUnattendedUpgradesPath))
+}
+
+func TestServerInitCmdCheck(t *testing.T) {
+	server := setupServerInitTest(t)
+	server.packages["docker.io"] = true
+	geteuid = func() int { return 1000 }
+
+	cmd := serverInitCmd
+	cmd.Flags().Set("check", "true")
+	defer cmd.Flags().Set("check", "false")
+
+	var err error
+	output := CaptureOutput(func() {
+		err = cmd.RunE(cmd, []string{"docker", "swappiness", "sudoers"})
+	})
+
+	assert.EqualError(t, err, "the server is not fully set up: 2 step(s) pending")
+	assert.Equal(t, "[1/3] docker: ok\n"+
+		"[2/3] swappiness: pending, would set vm.swappiness to 10 in /etc/sysctl.d/60-ploy.conf\n"+
+		"[3/3] sudoers: pending, would allow ploy only the commands ploy runs with sudo, in /etc/sudoers.d/ploy\n", output)
+	assert.Equal(t, "vm.sappiness=10\n", server.read(t, "etc/sysctl.conf"))
+	assert.NoFileExists(t, filepath.Join(server.root, bootstrap.SudoersPath))
+}
+
+func TestServerInitCmdErrors(t *testing.T) {
+	setupServerInitTest(t)
+
+	err := serverInitCmd.RunE(serverInitCmd, []string{"mail"})
+	assert.Equal(t, ExitUsage, ExitCode(err))
+	assert.Contains(t, err.Error(), "unknown step mail")
+
+	geteuid = func() int { return 1000 }
+	err = serverInitCmd.RunE(serverInitCmd, []string{"swap"})
+	assert.Equal(t, ExitPermission, ExitCode(err))
+}
@@ -0,0 +1,104 @@
+package commands
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ploycloud/ploy-server-cli/src/cloud"
+	"github.com/ploycloud/ploy-server-cli/src/jobs"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupServerTest starts a PloyCloud stand-in that registers servers, records
+// heartbeats and hands out a backup command once
+func setupServerTest(t *testing.T) (*[]cloud.Heartbeat, map[string]cloud.Ack) {
+	setupAgentTest(t)
+
+	var heartbeats []cloud.Heartbeat
+	acks := make(map[string]cloud.Ack)
+	commands := []cloud.Command{{ID: "cmd-1", Type: jobs.TypeBackup, Site: "shop.com"}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/servers/register", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer account-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(cloud.Identity{ServerID: "srv-1", Token: "server-token"})
+	})
+	mux.HandleFunc("POST /v1/servers/srv-1/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		var heartbeat cloud.Heartbeat
+		json.NewDecoder(r.Body).Decode(&heartbeat)
+		heartbeats = append(heartbeats, heartbeat)
+		json.NewEncoder(w).Encode(cloud.HeartbeatResponse{Commands: commands})
+	})
+	mux.HandleFunc("POST /v1/servers/srv-1/commands/{id}/ack", func(w http.ResponseWriter, r *http.Request) {
+		var ack cloud.Ack
+		json.NewDecoder(r.Body).Decode(&ack)
+		acks[r.PathValue("id")] = ack
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	t.Setenv("PLOY_API_URL", server.URL)
+	t.Setenv("PLOY_API_KEY", "account-key")
+	return &heartbeats, acks
+}
+
+func TestServerRegisterAndHeartbeat(t *testing.T) {
+	heartbeats, acks := setupServerTest(t)
+
+	CaptureOutput(func() { assert.NoError(t, serverRegisterCmd.RunE(serverRegisterCmd, nil)) })
+	identity, err := cloud.LoadIdentity()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "srv-1", identity.ServerID)
+	assert.Equal(t, "server-token", identity.Token)
+	assert.Equal(t, "us-west-2", identity.Region)
+
+	cmd := serverHeartbeatCmd
+	cmd.Flags().Set("once", "true")
+	defer cmd.Flags().Set("once", "false")
+
+	// A redelivered command is only queued once
+	CaptureOutput(func() { assert.NoError(t, cmd.RunE(cmd, nil)) })
+	CaptureOutput(func() { assert.NoError(t, cmd.RunE(cmd, nil)) })
+
+	if assert.Len(t, *heartbeats, 2) {
+		heartbeat := (*heartbeats)[0]
+		assert.Len(t, heartbeat.Sites, 2)
+		assert.Contains(t, heartbeat.Services, "mysql")
+		assert.NotEmpty(t, heartbeat.Facts.Hostname)
+		assert.Empty(t, heartbeat.Jobs)
+		if assert.Len(t, (*heartbeats)[1].Jobs, 1) {
+			assert.Equal(t, "cmd-1", (*heartbeats)[1].Jobs[0].CommandID)
+		}
+	}
+
+	list, err := jobs.List()
+	assert.NoError(t, err)
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, jobs.TypeBackup, list[0].Type)
+		assert.Equal(t, "cmd-1", list[0].CommandID)
+		assert.Equal(t, cloud.Ack{JobID: list[0].ID}, acks["cmd-1"])
+	}
+
+	identity, err = cloud.LoadIdentity()
+	assert.NoError(t, err)
+	assert.NotNil(t, identity.LastHeartbeatAt)
+	assert.Empty(t, identity.LastError)
+}
+
+func TestServerRegisterRequiresAPIKey(t *testing.T) {
+	setupServerTest(t)
+	t.Setenv("PLOY_API_KEY", "")
+
+	err := serverRegisterCmd.RunE(serverRegisterCmd, nil)
+	assert.Equal(t, ExitUsage, ExitCode(err))
+	_, err = cloud.LoadIdentity()
+	assert.ErrorIs(t, err, cloud.ErrNotRegistered)
+}
@@ -3,7 +3,6 @@ package commands
 import (
 	"bytes"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -12,12 +11,18 @@ import (
 	"github.com/fatih/color"
 	"github.com/ploycloud/ploy-server-cli/src/common"
 	"github.com/ploycloud/ploy-server-cli/src/docker"
+	"github.com/ploycloud/ploy-server-cli/src/proxy"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
 	"github.com/spf13/cobra"
 )
 
 var execCommand = exec.Command
 
-var osExit = os.Exit
+// composeCommand returns a `docker compose` command on a compose file
+func composeCommand(composePath string, arg ...string) *exec.Cmd {
+	return execCommand("docker", docker.ComposeArgs(composePath, arg...)...)
+}
 
 var ServicesCmd = &cobra.Command{
 	Use:   "services",
@@ -44,12 +49,10 @@ func init() {
 var globalStartCmd = &cobra.Command{
 	Use:   "start",
 	Short: "Start global services",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		fmt.Println("Starting global services (mysql, redis, nginx-proxy)...")
 		if err := docker.RunCompose(common.GlobalCompose, "up", "-d"); err != nil {
-			fmt.Printf("Error starting global services: %v\n", err)
-			osExit(1)
-			return
+			return errDocker("starting global services: %w", err)
 		}
 
 		if err := docker.RunCompose(common.GlobalCompose, "ps"); err != nil {
@@ -57,36 +60,35 @@ var globalStartCmd = &cobra.Command{
 		}
 
 		fmt.Println("Global services started successfully")
+		return nil
 	},
 }
 
 var globalStopCmd = &cobra.Command{
 	Use:   "stop",
 	Short: "Stop global services",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		fmt.Println("Stopping global services...")
 		if err := docker.RunCompose(common.GlobalCompose, "down"); err != nil {
-			fmt.Printf("Error stopping global services: %v\n", err)
-			return
+			return errDocker("stopping global services: %w", err)
 		}
 
 		fmt.Println("Global services stopped successfully")
+		return nil
 	},
 }
 
 var globalRestartCmd = &cobra.Command{
 	Use:   "restart",
 	Short: "Restart global services",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		fmt.Println("Restarting global services...")
 		if err := docker.RunCompose(common.GlobalCompose, "down"); err != nil {
-			fmt.Printf("Error stopping global services: %v\n", err)
-			return
+			return errDocker("stopping global services: %w", err)
 		}
 
 		if err := docker.RunCompose(common.GlobalCompose, "up", "-d"); err != nil {
-			fmt.Printf("Error starting global services: %v\n", err)
-			return
+			return errDocker("starting global services: %w", err)
 		}
 
 		if err := docker.RunCompose(common.GlobalCompose, "ps"); err != nil {
@@ -94,6 +96,7 @@ var globalRestartCmd = &cobra.Command{
 		}
 
 		fmt.Println("Global services restarted successfully")
+		return nil
 	},
 }
 
@@ -106,75 +109,85 @@ var installCmd = &cobra.Command{
 var installNginxProxyCmd = &cobra.Command{
 	Use:   "nginx-proxy",
 	Short: "Install Nginx as a proxy on the host machine",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		if GetGOOS() == "darwin" {
 			fmt.Println("Nginx installation is not supported on macOS. Please install Nginx manually.")
-			return
+			return nil
+		}
+		if err := installNginxProxy(); err != nil {
+			return fmt.Errorf("installing Nginx: %w", err)
 		}
+		fmt.Println("You can now configure Nginx as a proxy for your Docker containers.")
+		fmt.Println("Don't forget to configure your Nginx configuration file to proxy requests to your Docker containers.")
+		return nil
+	},
+}
 
-		fmt.Println("Checking if Nginx is already installed...")
+// installNginxProxy installs and enables nginx on the host unless it is already installed
+func installNginxProxy() error {
+	if GetGOOS() == "darwin" {
+		return fmt.Errorf("nginx installation is not supported on macOS, install nginx manually")
+	}
 
-		// Check if Nginx is already installed
-		checkCmd := execCommand("nginx", "-v")
-		if err := checkCmd.Run(); err == nil {
-			fmt.Println("Nginx is already installed.")
-			return
-		}
+	fmt.Println("Checking if Nginx is already installed...")
 
-		fmt.Println("Installing Nginx as a proxy...")
+	// Check if Nginx is already installed
+	checkCmd := execCommand("nginx", "-v")
+	if _, err := runner.Query(checkCmd); err == nil {
+		fmt.Println("Nginx is already installed.")
+		return nil
+	}
 
-		// Install Nginx (this assumes a Debian-based system like Ubuntu)
-		installCmd := execCommand("sudo", "apt-get", "update")
-		installCmd.Stdout = os.Stdout
-		installCmd.Stderr = os.Stderr
-		if err := installCmd.Run(); err != nil {
-			color.Red("Error updating package list: %v", err)
-			return
-		}
+	fmt.Println("Installing Nginx as a proxy...")
 
-		installCmd = execCommand("sudo", "apt-get", "install", "-y", "nginx")
-		installCmd.Stdout = os.Stdout
-		installCmd.Stderr = os.Stderr
-		if err := installCmd.Run(); err != nil {
-			color.Red("Error installing Nginx: %v", err)
-			return
-		}
+	// Install Nginx (this assumes a Debian-based system like Ubuntu). sudo must not
+	// prompt for a password: commands run in their own process group, where a
+	// prompt would wait for input until the command times out.
+	installCmd := execSudo("apt-get", "update")
+	installCmd.Stdout = os.Stdout
+	installCmd.Stderr = os.Stderr
+	if err := runner.Run(installCmd); err != nil {
+		return fmt.Errorf("failed to update package list: %w", err)
+	}
 
-		// Start Nginx service
-		startCmd := execCommand("sudo", "systemctl", "start", "nginx")
-		if err := startCmd.Run(); err != nil {
-			color.Red("Error starting Nginx service: %v", err)
-			return
-		}
+	installCmd = execSudo("apt-get", "install", "-y", "nginx")
+	installCmd.Stdout = os.Stdout
+	installCmd.Stderr = os.Stderr
+	if err := runner.Run(installCmd); err != nil {
+		return fmt.Errorf("failed to install nginx: %w", err)
+	}
 
-		// Enable Nginx to start on boot
-		enableCmd := execCommand("sudo", "systemctl", "enable", "nginx")
-		if err := enableCmd.Run(); err != nil {
-			color.Red("Error enabling Nginx service: %v", err)
-			return
-		}
+	// Start Nginx service
+	startCmd := execSudo("systemctl", "start", "nginx")
+	if err := runner.Run(startCmd); err != nil {
+		return fmt.Errorf("failed to start nginx: %w", err)
+	}
 
-		fmt.Println("Nginx installed and configured successfully as a proxy")
-		fmt.Println("You can now configure Nginx as a proxy for your Docker containers.")
-		fmt.Println("Don't forget to configure your Nginx configuration file to proxy requests to your Docker containers.")
-	},
+	// Enable Nginx to start on boot
+	enableCmd := execSudo("systemctl", "enable", "nginx")
+	if err := runner.Run(enableCmd); err != nil {
+		return fmt.Errorf("failed to enable nginx: %w", err)
+	}
+
+	fmt.Println("Nginx installed and configured successfully as a proxy")
+	return nil
 }
 
 var installMySQLCmd = &cobra.Command{
 	Use:   "mysql",
 	Short: "Install MySQL service",
 	Long:  `Install MySQL service with optional parameters for user, password, and port.`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		user, _ := cmd.Flags().GetString("user")
 		password, _ := cmd.Flags().GetString("password")
 		port, _ := cmd.Flags().GetString("port")
 
 		fmt.Println("Installing MySQL service...")
 		if err := installMySQL(user, password, port); err != nil {
-			color.Red("Error installing MySQL: %v", err)
-			return
+			return fmt.Errorf("installing MySQL: %w", err)
 		}
 		color.Green("MySQL installed successfully")
+		return nil
 	},
 }
 
@@ -182,19 +195,19 @@ var detailsCmd = &cobra.Command{
 	Use:   "details [service]",
 	Short: "Show details for a specific service",
 	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		service := args[0]
 		details, err := getServiceDetails(service)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error getting %s details: %v\n", service, err)
-			return
+			return fmt.Errorf("getting %s details: %w", service, err)
 		}
 		if details == nil {
-			return // Info message already displayed by getServiceDetails
+			return nil // Info message already displayed by getServiceDetails
 		}
 		for k, v := range details {
 			fmt.Printf("%s: %s\n", k, v)
 		}
+		return nil
 	},
 }
 
@@ -211,7 +224,7 @@ func installMySQL(user, password, port string) error {
 	// Read the compose file
 	content, err := getDockerComposeTemplate(composePath)
 	if err != nil {
-		return fmt.Errorf("failed to read MySQL compose file: %v", err)
+		return fmt.Errorf("failed to read MySQL compose file: %w", err)
 	}
 
 	// Replace placeholders with provided or default values
@@ -227,18 +240,18 @@ func installMySQL(user, password, port string) error {
 
 	// Write the updated compose file
 	tempComposePath := filepath.Join(os.TempDir(), "temp-mysql-compose.yml")
-	if err := ioutil.WriteFile(tempComposePath, content, 0644); err != nil {
-		return fmt.Errorf("failed to write temporary MySQL compose file: %v", err)
+	if err := runner.WriteFile(tempComposePath, content, 0644); err != nil {
+		return fmt.Errorf("failed to write temporary MySQL compose file: %w", err)
 	}
 
-	// Run docker-compose with the updated file
-	cmd := execCommand("docker-compose", "-f", tempComposePath, "up", "-d")
+	// Run docker compose with the updated file, as a project of its own
+	cmd := composeCommand(tempComposePath, "-p", mysqlProject, "up", "-d")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	err = runner.Run(cmd)
 
 	// Clean up the temporary file
-	os.Remove(tempComposePath)
+	runner.Remove(tempComposePath)
 
 	return err
 }
@@ -253,26 +266,61 @@ func getServiceDetails(service string) (map[string]string, error) {
 		}
 		return details, nil
 	default:
-		return nil, fmt.Errorf("unsupported service: %s", service)
+		return nil, errUsage("unsupported service: %s", service)
+	}
+}
+
+// mysqlProject is the compose project the global MySQL service is installed as
+const mysqlProject = "ploy-mysql"
+
+// legacyMySQLProject is the project of MySQL installed by older versions, which
+// ran compose on a file in /tmp without naming the project
+const legacyMySQLProject = "tmp"
+
+// queryMySQLContainer runs `docker ps` for the container of the global MySQL
+// service and returns the first line it prints with format, or "" when there is no
+// such container; all includes stopped containers. The container is matched by
+// compose project and service, so the mysql service of another project, such as
+// a site's own, is never taken for it.
+func queryMySQLContainer(format string, all bool) (string, error) {
+	var queryErr error
+	for _, project := range []string{mysqlProject, legacyMySQLProject} {
+		args := []string{"ps"}
+		if all {
+			args = append(args, "-a")
+		}
+		args = append(args, "--filter", "label=com.docker.compose.project="+project,
+			"--filter", "label=com.docker.compose.service=mysql", "--format", format)
+		output, err := runner.Query(execCommand("docker", args...))
+		if err != nil {
+			queryErr = err
+			continue
+		}
+		if line := strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0]); line != "" {
+			return line, nil
+		}
 	}
+	return "", queryErr
 }
 
+// mysqlClientImage runs the MySQL client programs for sites with an external database
+const mysqlClientImage = "mysql:8.0"
+
+// mysqlHostPortFormat makes `docker inspect` print the host port MySQL is published on
+const mysqlHostPortFormat = "{{range $p, $conf := .NetworkSettings.Ports}}{{if eq $p \"3306/tcp\"}}{{(index $conf 0).HostPort}}{{end}}{{end}}"
+
 func getMySQLDetails() (map[string]string, error) {
 	// Check if MySQL container is running
-	cmd := execCommand("docker", "ps", "--filter", "name=mysql", "--format", "{{.Names}}")
-	output, err := cmd.Output()
-	if err != nil || len(output) == 0 {
+	containerName, err := queryMySQLContainer("{{.Names}}", false)
+	if err != nil || containerName == "" {
 		return nil, fmt.Errorf("MySQL container is not running")
 	}
 
-	// Get container ID
-	containerName := strings.TrimSpace(string(output))
-
 	// Get MySQL environment variables
-	cmd = execCommand("docker", "inspect", "--format", "{{range .Config.Env}}{{println .}}{{end}}", containerName)
-	output, err = cmd.Output()
+	cmd := execCommand("docker", "inspect", "--format", "{{range .Config.Env}}{{println .}}{{end}}", containerName)
+	output, err := runner.Query(cmd)
 	if err != nil {
-		return nil, fmt.Errorf("failed to inspect MySQL container: %v", err)
+		return nil, fmt.Errorf("failed to inspect MySQL container: %w", err)
 	}
 
 	// Parse environment variables
@@ -294,17 +342,17 @@ func getMySQLDetails() (map[string]string, error) {
 
 	// Get container IP address
 	cmd = execCommand("docker", "inspect", "--format", "{{range .NetworkSettings.Networks}}{{.IPAddress}}{{end}}", containerName)
-	output, err = cmd.Output()
+	output, err = runner.Query(cmd)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get MySQL container IP: %v", err)
+		return nil, fmt.Errorf("failed to get MySQL container IP: %w", err)
 	}
 	details["Host"] = strings.TrimSpace(string(output))
 
 	// Get exposed port
-	cmd = execCommand("docker", "inspect", "--format", "{{range $p, $conf := .NetworkSettings.Ports}}{{if eq $p \"3306/tcp\"}}{{(index $conf 0).HostPort}}{{end}}{{end}}", containerName)
-	output, err = cmd.Output()
+	cmd = execCommand("docker", "inspect", "--format", mysqlHostPortFormat, containerName)
+	output, err = runner.Query(cmd)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get MySQL container port: %v", err)
+		return nil, fmt.Errorf("failed to get MySQL container port: %w", err)
 	}
 	details["Port"] = strings.TrimSpace(string(output))
 
@@ -316,44 +364,125 @@ func getMySQLDetails() (map[string]string, error) {
 	return details, nil
 }
 
+// siteMySQLCommand returns a docker command that runs a MySQL client program, such
+// as mysql or mysqldump, against a site's database with the given arguments. The
+// client in the mysql container is used, or a throwaway client container for an
+// external database, so none is needed on the host. The password is passed
+// through the environment, never on a command line.
+func siteMySQLCommand(site *registry.Site, program string, arg ...string) (*exec.Cmd, error) {
+	db := site.Database
+	if db.Name == "" || strings.ContainsAny(db.Name, "'\\`") {
+		return nil, fmt.Errorf("no database recorded for %s", site.Domain)
+	}
+
+	// -e with only a name copies the variable from the environment of docker itself
+	var args []string
+	if db.Source == "external" {
+		// The host network resolves the database host as the server itself does
+		args = []string{"run", "--rm", "--network", "host", "-e", "MYSQL_PWD", mysqlClientImage,
+			program, "-u", db.User, "-h", db.Host, "-P", db.Port}
+	} else {
+		container, err := queryMySQLContainer("{{.Names}}", false)
+		if err != nil || container == "" {
+			return nil, fmt.Errorf("MySQL container is not running")
+		}
+		args = []string{"exec", "-e", "MYSQL_PWD", container, program, "-u", db.User}
+	}
+	cmd := execCommand("docker", append(args, arg...)...)
+	cmd.Env = append(os.Environ(), "MYSQL_PWD="+db.Password)
+	return cmd, nil
+}
+
 var statusCmd = &cobra.Command{
 	Use:   "status [service]",
 	Short: "Check status of services",
-	Long:  `Check status of services like mysql and nginx-proxy.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) == 0 {
+	Long: `Check status of services like mysql and nginx-proxy.
+
+Exits non-zero when a service is not running.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		services := args
+		if len(services) == 0 {
 			// If no service specified, check all
-			checkServiceStatus("mysql")
-			checkServiceStatus("nginx-proxy")
-		} else {
-			for _, service := range args {
-				checkServiceStatus(service)
+			services = []string{"mysql", "nginx-proxy"}
+		}
+		// Every service is checked before printing, so a misspelt one fails early
+		running := make([]bool, len(services))
+		for i, service := range services {
+			up, err := serviceRunning(service)
+			if err != nil {
+				return err
 			}
+			running[i] = up
 		}
+
+		var down []string
+		for i, service := range services {
+			if running[i] {
+				color.Green("%s is running", service)
+			} else {
+				color.Red("%s is not running", service)
+				down = append(down, service)
+			}
+		}
+		if len(down) > 0 {
+			return fmt.Errorf("not running: %s", strings.Join(down, ", "))
+		}
+		return nil
 	},
 }
 
-func checkServiceStatus(service string) {
+// serviceRunning reports whether a global service is up
+func serviceRunning(service string) (bool, error) {
 	var cmd *exec.Cmd
 	switch service {
 	case "mysql":
-		cmd = execCommand("docker", "ps", "--filter", "name=mysql", "--format", "{{.Status}}")
+		status, _ := queryMySQLContainer("{{.Status}}", false)
+		return strings.HasPrefix(status, "Up"), nil
 	case "nginx-proxy":
 		cmd = execCommand("systemctl", "is-active", "nginx")
+	case "traefik":
+		cmd = execCommand("docker", "ps", "--filter", "name="+proxy.TraefikContainer, "--format", "{{.Status}}")
+	case "caddy":
+		cmd = execCommand("docker", "ps", "--filter", "name="+proxy.CaddyContainer, "--format", "{{.Status}}")
 	default:
-		fmt.Printf("Unknown service: %s\n", service)
-		return
+		return false, errUsage("unknown service: %s", service)
 	}
 
-	output, err := cmd.Output()
+	output, err := runner.Query(cmd)
 	if err != nil {
-		color.Red("%s is not running", service)
-	} else {
-		status := strings.TrimSpace(string(output))
-		if status == "active" || strings.HasPrefix(status, "Up") {
-			color.Green("%s is running", service)
+		return false, nil
+	}
+	status := strings.TrimSpace(string(output))
+	return status == "active" || strings.HasPrefix(status, "Up"), nil
+}
+
+// mysqlInUse reports whether this server uses the global MySQL service: a site
+// has the internal database or the MySQL container exists, even if stopped
+func mysqlInUse() bool {
+	if sites, err := registry.List(); err == nil {
+		for _, site := range sites {
+			if site.Database.Source != "external" {
+				return true
+			}
+		}
+	}
+	container, err := queryMySQLContainer("{{.Names}}", true)
+	return err == nil && container != ""
+}
+
+// monitoredServices returns the service name of the configured proxy, and MySQL
+// when the server uses it
+func monitoredServices() []string {
+	var services []string
+	if mysqlInUse() {
+		services = append(services, "mysql")
+	}
+	if p, err := loadProxy(); err == nil {
+		if p.Name() == "nginx" {
+			services = append(services, "nginx-proxy")
 		} else {
-			color.Red("%s is not running", service)
+			services = append(services, p.Name())
 		}
 	}
+	return services
 }
@@ -2,9 +2,16 @@ package commands
 
 import (
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/fatih/color"
@@ -16,8 +23,6 @@ import (
 // Mock functions
 var mockRunCompose func(composePath string, args ...string) error
 var mockExecCommand func(name string, arg ...string) *exec.Cmd
-var exitCalled bool
-var exitCode int
 
 // TestMain sets up the test environment
 func TestMain(m *testing.M) {
@@ -27,6 +32,7 @@ func TestMain(m *testing.M) {
 	// Save original functions
 	originalRunCompose := docker.RunCompose
 	originalExecCommand := execCommand
+	originalRunRootHelper := runRootHelper
 
 	// Set up mocks
 	docker.RunCompose = func(composePath string, args ...string) error {
@@ -35,6 +41,8 @@ func TestMain(m *testing.M) {
 	execCommand = func(name string, arg ...string) *exec.Cmd {
 		return mockExecCommand(name, arg...)
 	}
+	// The root helper runs in the test process, on the test paths
+	runRootHelper = callRootHelper
 
 	// Disable color output for tests
 	color.NoColor = true
@@ -45,6 +53,7 @@ func TestMain(m *testing.M) {
 	// Restore original functions
 	docker.RunCompose = originalRunCompose
 	execCommand = originalExecCommand
+	runRootHelper = originalRunRootHelper
 
 	os.Exit(code)
 }
@@ -57,8 +66,6 @@ func setupTest() {
 	mockExecCommand = func(name string, arg ...string) *exec.Cmd {
 		return exec.Command("echo", "Mock command executed")
 	}
-	exitCalled = false
-	exitCode = 0
 }
 
 func createMockMySQLComposeFile() {
@@ -82,7 +89,7 @@ func TestGlobalStartCmd(t *testing.T) {
 
 	output := CaptureOutput(
 		func() {
-			globalStartCmd.Run(&cobra.Command{}, []string{})
+			assert.NoError(t, globalStartCmd.RunE(&cobra.Command{}, []string{}))
 		},
 	)
 
@@ -90,6 +97,12 @@ func TestGlobalStartCmd(t *testing.T) {
 	assert.Contains(t, output, "Starting global services (mysql, redis, nginx-proxy)")
 	assert.Contains(t, output, "Mock docker-compose command executed")
 	assert.Contains(t, output, "Global services started successfully")
+
+	mockRunCompose = func(composePath string, args ...string) error {
+		return assert.AnError
+	}
+	err := globalStartCmd.RunE(&cobra.Command{}, []string{})
+	assert.Equal(t, ExitDocker, ExitCode(err))
 }
 
 func TestGlobalStopCmd(t *testing.T) {
@@ -97,7 +110,7 @@ func TestGlobalStopCmd(t *testing.T) {
 
 	output := CaptureOutput(
 		func() {
-			globalStopCmd.Run(&cobra.Command{}, []string{})
+			assert.NoError(t, globalStopCmd.RunE(&cobra.Command{}, []string{}))
 		},
 	)
 
@@ -112,7 +125,7 @@ func TestGlobalRestartCmd(t *testing.T) {
 
 	output := CaptureOutput(
 		func() {
-			globalRestartCmd.Run(&cobra.Command{}, []string{})
+			assert.NoError(t, globalRestartCmd.RunE(&cobra.Command{}, []string{}))
 		},
 	)
 
@@ -122,8 +135,81 @@ func TestGlobalRestartCmd(t *testing.T) {
 	assert.Contains(t, output, "Global services restarted successfully")
 }
 
+func TestStatusCmd(t *testing.T) {
+	oldExecCommand := execCommand
+	defer func() { execCommand = oldExecCommand }()
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		if name == "systemctl" {
+			return exec.Command("echo", "active")
+		}
+		return exec.Command("echo", "")
+	}
+
+	var err error
+	output := captureColorOutput(func() {
+		err = statusCmd.RunE(statusCmd, []string{})
+	})
+	assert.Contains(t, output, "mysql is not running")
+	assert.Contains(t, output, "nginx-proxy is running")
+	assert.EqualError(t, err, "not running: mysql")
+	assert.Equal(t, ExitFailure, ExitCode(err))
+
+	captureColorOutput(func() {
+		err = statusCmd.RunE(statusCmd, []string{"nginx-proxy"})
+	})
+	assert.NoError(t, err)
+
+	err = statusCmd.RunE(statusCmd, []string{"nginx-proxy", "postgres"})
+	assert.Equal(t, ExitUsage, ExitCode(err))
+	assert.EqualError(t, err, "unknown service: postgres")
+}
+
+func TestQueryMySQLContainer(t *testing.T) {
+	oldExecCommand := execCommand
+	defer func() { execCommand = oldExecCommand }()
+
+	// containers are the mysql services running in each compose project
+	var containers map[string]string
+	var commands []string
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		cmdline := name + " " + strings.Join(arg, " ")
+		commands = append(commands, cmdline)
+		for project, container := range containers {
+			if strings.Contains(cmdline, "label=com.docker.compose.project="+project+" ") &&
+				strings.Contains(cmdline, "label=com.docker.compose.service=mysql ") {
+				return exec.Command("echo", container)
+			}
+		}
+		return exec.Command("echo", "")
+	}
+
+	// The mysql service of a site's own project is not the global one
+	containers = map[string]string{"shop-com": "shop-com-mysql-1"}
+	name, err := queryMySQLContainer("{{.Names}}", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "", name)
+	running, _ := serviceRunning("mysql")
+	assert.False(t, running)
+
+	containers["ploy-mysql"] = "ploy-mysql-mysql-1"
+	name, err = queryMySQLContainer("{{.Names}}", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "ploy-mysql-mysql-1", name)
+
+	// MySQL installed by older versions runs in the project named after /tmp
+	containers = map[string]string{"shop-com": "shop-com-mysql-1", "tmp": "tmp-mysql-1"}
+	commands = nil
+	name, err = queryMySQLContainer("{{.Names}}", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "tmp-mysql-1", name)
+	assert.Equal(t, "docker ps -a --filter label=com.docker.compose.project=ploy-mysql "+
+		"--filter label=com.docker.compose.service=mysql --format {{.Names}}", commands[0])
+}
+
 func TestInstallNginxProxyCmd(t *testing.T) {
 	setupTest()
+	oldExecSudo := execSudo
+	defer func() { execSudo = oldExecSudo }()
 
 	testCases := []struct {
 		name     string
@@ -165,10 +251,11 @@ func TestInstallNginxProxyCmd(t *testing.T) {
 			tc.name, func(t *testing.T) {
 				MockGOOS = tc.goos
 				mockExecCommand = tc.nginxCmd
+				execSudo = tc.nginxCmd
 
 				output := CaptureOutput(
 					func() {
-						installNginxProxyCmd.Run(installNginxProxyCmd, []string{})
+						assert.NoError(t, installNginxProxyCmd.RunE(installNginxProxyCmd, []string{}))
 					},
 				)
 
@@ -224,7 +311,9 @@ services:
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			// Mock the docker-compose command
+			var cmdline string
 			mockExecCommand = func(name string, arg ...string) *exec.Cmd {
+				cmdline = name + " " + strings.Join(arg, " ")
 				return exec.Command("echo", "MySQL installed successfully")
 			}
 
@@ -239,11 +328,12 @@ services:
 
 			// Capture output
 			output := CaptureOutput(func() {
-				installMySQLCmd.Run(cmd, []string{})
+				assert.NoError(t, installMySQLCmd.RunE(cmd, []string{}))
 			})
 
 			assert.Contains(t, output, "Installing MySQL service...")
 			assert.Contains(t, output, tc.expected)
+			assert.Contains(t, cmdline, " -p ploy-mysql up -d")
 		})
 	}
 }
@@ -271,7 +361,7 @@ func TestDetailsCmd(t *testing.T) {
 
 	// Test MySQL details
 	stdout, _ := CaptureOutputAndError(func() {
-		detailsCmd.Run(detailsCmd, []string{"mysql"})
+		assert.NoError(t, detailsCmd.RunE(detailsCmd, []string{"mysql"}))
 	})
 
 	assert.Contains(t, stdout, "Host: 172.17.0.2")
@@ -281,9 +371,35 @@ func TestDetailsCmd(t *testing.T) {
 	assert.Contains(t, stdout, "Password: wp_password")
 
 	// Test unsupported service
-	_, stderr := CaptureOutputAndError(func() {
-		detailsCmd.Run(detailsCmd, []string{"unsupported"})
-	})
+	err := detailsCmd.RunE(detailsCmd, []string{"unsupported"})
+	assert.EqualError(t, err, "getting unsupported details: unsupported service: unsupported")
+	assert.Equal(t, ExitUsage, ExitCode(err))
+}
 
-	assert.Contains(t, stderr, "Error getting unsupported details: unsupported service: unsupported")
+// The standalone docker-compose binary is not installed by `ploy server init`, so
+// every compose command must go through the docker compose plugin
+func TestNoStandaloneComposeBinary(t *testing.T) {
+	err := filepath.WalkDir("..", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return err
+		}
+		file, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+		if err != nil {
+			return err
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			lit, ok := n.(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				return true
+			}
+			// The binary name on its own, or followed by flags as in a cron line
+			value, _ := strconv.Unquote(lit.Value)
+			if value == "docker-compose" || strings.Contains(value, "docker-compose -") {
+				t.Errorf("%s runs the docker-compose binary: %s", path, lit.Value)
+			}
+			return true
+		})
+		return nil
+	})
+	assert.NoError(t, err)
 }
@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,12 +9,19 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/agent"
 	"github.com/ploycloud/ploy-server-cli/src/common"
 	"github.com/ploycloud/ploy-server-cli/src/docker"
+	"github.com/ploycloud/ploy-server-cli/src/health"
+	"github.com/ploycloud/ploy-server-cli/src/jobs"
+	"github.com/ploycloud/ploy-server-cli/src/nginx"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
 	"github.com/spf13/cobra"
 )
 
@@ -27,7 +35,7 @@ var logBasePath = "/var/log"
 
 var execSudo = func(name string, arg ...string) *exec.Cmd {
 	// Add -n flag to prevent password prompt
-	args := append([]string{"-n"}, arg...)
+	args := append([]string{"-n", name}, arg...)
 	cmd := exec.Command("sudo", args...)
 
 	// Set SUDO_ASKPASS to /bin/true to handle password prompts
@@ -41,6 +49,12 @@ func init() {
 	SitesCmd.AddCommand(sitesStopCmd)
 	SitesCmd.AddCommand(sitesRestartCmd)
 	SitesCmd.AddCommand(sitesNewCmd)
+	SitesCmd.AddCommand(sitesDeleteCmd)
+	sitesDeleteCmd.Flags().Bool("yes", false, "Do not ask for confirmation")
+	sitesDeleteCmd.Flags().Bool("async", false, "Queue the deletion as a background job")
+	sitesStartCmd.Flags().Bool("async", false, "Queue starting a single site as a background job")
+	sitesStopCmd.Flags().Bool("async", false, "Queue stopping a single site as a background job")
+	sitesNewCmd.Flags().Bool("async", false, "Queue the site creation as a background job")
 
 	// Add flags for the new command
 	sitesNewCmd.Flags().String("type", "", "Site type (e.g., wp)")
@@ -58,36 +72,188 @@ func init() {
 	sitesNewCmd.Flags().String("site_id", "", "Unique identifier for the site (optional)")
 	sitesNewCmd.Flags().String("hostname", "", "Hostname for the site (optional)")
 	sitesNewCmd.Flags().String("php_version", "8.3", "PHP version for WordPress (default: 8.3)")
+	sitesNewCmd.Flags().String("health_path", "/", "Path requested to check that the site is up")
+	sitesNewCmd.Flags().Int("health_status", 0, "HTTP status the health check expects (default: any status below 400)")
+	sitesNewCmd.Flags().String("health_timeout", "10s", "Timeout of a single health check request")
+	sitesNewCmd.Flags().Bool("tls", false, "Issue a TLS certificate for the domain via ACME (contact email from $PLOY_ACME_EMAIL)")
 }
 
 var sitesStartCmd = &cobra.Command{
-	Use:   "start",
-	Short: "Start all sites",
-	Long:  `Start all sites on the server.`,
-	Run: func(cmd *cobra.Command, args []string) {
+	Use:   "start [host]",
+	Short: "Start one or all sites",
+	Long:  `Start a single site, or all sites on the server when no host is given.`,
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 1 {
+			if queued, err := queueJob(cmd, jobs.TypeStartSite, args[0], nil); queued || err != nil {
+				return err
+			}
+			return runSiteOperation(args[0], "Starting", (*agent.Client).StartSite, startSite)
+		}
 		fmt.Println("Starting all sites...")
-		startAllSites()
+		return startAllSites()
 	},
 }
 
 var sitesStopCmd = &cobra.Command{
-	Use:   "stop",
-	Short: "Stop all sites",
-	Long:  `Stop all sites on the server.`,
-	Run: func(cmd *cobra.Command, args []string) {
+	Use:   "stop [host]",
+	Short: "Stop one or all sites",
+	Long:  `Stop a single site, or all sites on the server when no host is given.`,
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 1 {
+			if queued, err := queueJob(cmd, jobs.TypeStopSite, args[0], nil); queued || err != nil {
+				return err
+			}
+			return runSiteOperation(args[0], "Stopping", (*agent.Client).StopSite, stopSite)
+		}
 		fmt.Println("Stopping all sites...")
-		stopAllSites()
+		return stopAllSites()
+	},
+}
+
+var sitesDeleteCmd = &cobra.Command{
+	Use:   "delete [host]",
+	Short: "Stop a site and delete its containers, files and proxy configuration",
+	Long:  `Stop a site and delete its containers, volumes, site directory and proxy configuration. The database and certificates are kept.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if yes, _ := cmd.Flags().GetBool("yes"); !yes {
+			answer := promptIfEmpty("", fmt.Sprintf("Delete %s and all of its files? (yes/no):", args[0]), "no")
+			if answer != "yes" {
+				fmt.Println("Aborted.")
+				return nil
+			}
+		}
+		if queued, err := queueJob(cmd, jobs.TypeDeleteSite, args[0], nil); queued || err != nil {
+			return err
+		}
+		return runSiteOperation(args[0], "Deleting", (*agent.Client).DeleteSite, deleteSite)
 	},
 }
 
+// runSiteOperation carries out an operation on one site, through the agent when
+// one is configured
+func runSiteOperation(host, verb string, remote func(*agent.Client, context.Context, string) error, local func(*registry.Site) error) error {
+	fmt.Printf("%s %s...\n", verb, host)
+
+	client, err := agentClient()
+	if err != nil {
+		return err
+	}
+	if client != nil {
+		err = remote(client, context.Background(), host)
+	} else {
+		var site *registry.Site
+		if site, err = registry.Load(host); err == nil {
+			err = local(site)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	color.Green("Done")
+	return nil
+}
+
+// startSite starts a site's containers and points the proxy at them
+func startSite(site *registry.Site) error {
+	reportStep("start containers")
+	if err := docker.RunCompose(site.ComposePath(), "up", "-d"); err != nil {
+		return fmt.Errorf("failed to start %s: %w", site.Domain, err)
+	}
+	if err := recordStopped(site, false); err != nil {
+		return err
+	}
+	reportStep("update proxy")
+	if err := refreshSiteUpstream(site, ""); err != nil {
+		return fmt.Errorf("failed to update proxy upstream for %s: %w", site.Domain, err)
+	}
+	return nil
+}
+
+// stopSite stops a site's containers and records that the site is stopped, so
+// drift checks do not start it again
+func stopSite(site *registry.Site) error {
+	reportStep("stop containers")
+	if err := docker.RunCompose(site.ComposePath(), "down"); err != nil {
+		return fmt.Errorf("failed to stop %s: %w", site.Domain, err)
+	}
+	return recordStopped(site, true)
+}
+
+// recordStopped saves whether a site is stopped, holding the site's lock so that
+// a running autoscaler does not save over it
+func recordStopped(site *registry.Site, stopped bool) error {
+	site.Stopped = stopped
+	locked, unlock, err := registry.Lock(site.Domain)
+	if err != nil {
+		return fmt.Errorf("failed to record site: %w", err)
+	}
+	defer unlock()
+	if locked.Stopped == stopped {
+		return nil
+	}
+	locked.Stopped = stopped
+	if err := registry.Save(locked); err != nil {
+		return fmt.Errorf("failed to record site: %w", err)
+	}
+	return nil
+}
+
+// deleteSite removes a site's containers and volumes, its routing and its directory
+func deleteSite(site *registry.Site) error {
+	reportStep("remove containers")
+	if err := docker.RunCompose(site.ComposePath(), "down", "--volumes"); err != nil {
+		return fmt.Errorf("failed to remove containers of %s: %w", site.Domain, err)
+	}
+
+	reportStep("remove proxy configuration")
+	siteProxy, err := loadProxy()
+	if err != nil {
+		return err
+	}
+	if err := siteProxy.RemoveVhost(site.Domain); err != nil {
+		return fmt.Errorf("failed to remove proxy configuration of %s: %w", site.Domain, err)
+	}
+
+	reportStep("remove site directory")
+	if err := runner.RemoveAll(site.Dir()); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", site.Dir(), err)
+	}
+	createSiteLog(site.Name(), "Site deleted")
+	return nil
+}
+
 var sitesRestartCmd = &cobra.Command{
 	Use:   "restart",
 	Short: "Restart all sites",
 	Long:  `Restart all sites on the server.`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		fmt.Println("Restarting all sites...")
-		stopAllSites()
-		startAllSites()
+		if err := stopAllSites(); err != nil {
+			color.Red("%v", err)
+		}
+		if err := startAllSites(); err != nil {
+			color.Red("%v", err)
+		}
+
+		// Report sites that do not come back
+		sites, err := registry.List()
+		if err != nil {
+			return fmt.Errorf("listing sites: %w", err)
+		}
+		unhealthy := 0
+		for _, site := range sites {
+			if err := waitForSiteReady(site, ""); err != nil {
+				color.Red("%v", err)
+				unhealthy++
+			}
+		}
+		if unhealthy > 0 {
+			return fmt.Errorf("%d site(s) did not come back healthy", unhealthy)
+		}
+		return nil
 	},
 }
 
@@ -95,19 +261,19 @@ var sitesNewCmd = &cobra.Command{
 	Use:   "new",
 	Short: "Launch a new site",
 	Long:  `Launch a new site with specified parameters`,
-	Run:   runNewSite,
+	RunE:  runNewSite,
 }
 
 var getDockerComposeTemplate = docker.GetDockerComposeTemplate
 
-func startAllSites() {
+func startAllSites() error {
 	sitesDir := common.HomeDir
 	foundSite := false
+	failed := 0
 
 	entries, err := os.ReadDir(sitesDir)
 	if err != nil {
-		color.Red("Error reading directory %s: %v\n", sitesDir, err)
-		return
+		return fmt.Errorf("reading directory %s: %w", sitesDir, err)
 	}
 
 	for _, entry := range entries {
@@ -120,9 +286,9 @@ func startAllSites() {
 			composePath := filepath.Join(path, "docker-compose.yml")
 			if _, err := os.Stat(composePath); err == nil {
 				color.Yellow("Starting site in %s\n", filepath.Base(path))
-				err := docker.RunCompose(composePath, "up", "-d")
-
-				if nil != err {
+				if err := docker.RunCompose(composePath, "up", "-d"); err != nil {
+					color.Red("%v\n", err)
+					failed++
 					continue
 				}
 
@@ -131,19 +297,37 @@ func startAllSites() {
 		}
 	}
 
+	sites, err := registry.List()
+	if err != nil {
+		return fmt.Errorf("listing sites: %w", err)
+	}
+	for _, site := range sites {
+		color.Yellow("Starting site %s\n", site.Domain)
+		if err := startSite(site); err != nil {
+			color.Red("%v\n", err)
+			failed++
+			continue
+		}
+		foundSite = true
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d site(s) could not be started", failed)
+	}
 	if !foundSite {
 		fmt.Println("No sites found to start.")
 	}
+	return nil
 }
 
-func stopAllSites() {
+func stopAllSites() error {
 	sitesDir := common.HomeDir
 	foundSite := false
+	failed := 0
 
 	entries, err := os.ReadDir(sitesDir)
 	if err != nil {
-		color.Red("Error reading directory %s: %v\n", sitesDir, err)
-		return
+		return fmt.Errorf("reading directory %s: %w", sitesDir, err)
 	}
 
 	for _, entry := range entries {
@@ -156,9 +340,9 @@ func stopAllSites() {
 			composePath := filepath.Join(path, "docker-compose.yml")
 			if _, err := os.Stat(composePath); err == nil {
 				color.Yellow("Stopping site in %s\n", filepath.Base(path))
-				err := docker.RunCompose(composePath, "down")
-
-				if nil != err {
+				if err := docker.RunCompose(composePath, "down"); err != nil {
+					color.Red("%v\n", err)
+					failed++
 					continue
 				}
 
@@ -167,12 +351,30 @@ func stopAllSites() {
 		}
 	}
 
+	sites, err := registry.List()
+	if err != nil {
+		return fmt.Errorf("listing sites: %w", err)
+	}
+	for _, site := range sites {
+		color.Yellow("Stopping site %s\n", site.Domain)
+		if err := stopSite(site); err != nil {
+			color.Red("%v\n", err)
+			failed++
+			continue
+		}
+		foundSite = true
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d site(s) could not be stopped", failed)
+	}
 	if !foundSite {
 		fmt.Println("No sites found to stop.")
 	}
+	return nil
 }
 
-func runNewSite(cmd *cobra.Command, args []string) {
+func runNewSite(cmd *cobra.Command, args []string) error {
 	// Get all flags
 	siteType, _ := cmd.Flags().GetString("type")
 	domain, _ := cmd.Flags().GetString("domain")
@@ -184,6 +386,11 @@ func runNewSite(cmd *cobra.Command, args []string) {
 	siteID, _ := cmd.Flags().GetString("site_id")
 	hostname, _ := cmd.Flags().GetString("hostname")
 	phpVersion, _ := cmd.Flags().GetString("php_version")
+	enableTLS, _ := cmd.Flags().GetBool("tls")
+	healthCheck := health.Check{}
+	healthCheck.Path, _ = cmd.Flags().GetString("health_path")
+	healthCheck.ExpectedStatus, _ = cmd.Flags().GetInt("health_status")
+	healthCheck.Timeout, _ = cmd.Flags().GetString("health_timeout")
 
 	// Set default domain if not provided
 	if domain == "" {
@@ -194,18 +401,6 @@ func runNewSite(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	// Check nginx-proxy status and install if needed
-	if err := setupNginxProxy(webhook); err != nil {
-		color.Red("Error setting up nginx-proxy: %v", err)
-		return
-	}
-
-	// Create nginx configuration
-	if err := createNginxConfig(domain, webhook); err != nil {
-		color.Red("Error creating nginx configuration: %v", err)
-		return
-	}
-
 	// Validate and prompt for missing required fields
 	siteType = promptIfEmpty(siteType, "Enter site type (wp):", "wp")
 	domain = promptIfEmpty(domain, "Enter domain or subdomain:", "")
@@ -231,35 +426,102 @@ func runNewSite(cmd *cobra.Command, args []string) {
 		maxReplicas = promptInt("Enter maximum number of replicas:", replicas)
 	}
 
+	req := agent.SiteRequest{
+		Type:        siteType,
+		Domain:      domain,
+		Hostname:    hostname,
+		SiteID:      siteID,
+		PHPVersion:  phpVersion,
+		DBSource:    dbSource,
+		DBHost:      dbHost,
+		DBPort:      dbPort,
+		DBName:      dbName,
+		DBUser:      dbUser,
+		DBPassword:  dbPassword,
+		ScalingType: scalingType,
+		Replicas:    replicas,
+		MaxReplicas: maxReplicas,
+		HealthCheck: healthCheck,
+		TLS:         enableTLS,
+		Webhook:     webhook,
+	}
+	if queued, err := queueJob(cmd, jobs.TypeCreateSite, req.Domain, req); queued || err != nil {
+		return err
+	}
+
+	client, err := agentClient()
+	if err != nil {
+		return err
+	}
+	if client != nil {
+		if _, err := client.CreateSite(context.Background(), req); err != nil {
+			return fmt.Errorf("launching site: %w", err)
+		}
+		color.Green("Site launched successfully!")
+		return nil
+	}
+
+	return createSite(req, newCertIssuer(cmd))
+}
+
+// createSite sets up the proxy and MySQL if needed, launches the site and issues
+// its certificate. It backs both `sites new` and the agent API.
+func createSite(req agent.SiteRequest, issuer certIssuer) error {
+	webhook := req.Webhook
+
+	// Make sure the configured reverse proxy is installed and running
+	reportStep("set up proxy")
+	siteProxy, err := loadProxy()
+	if err != nil {
+		return fmt.Errorf("failed to load proxy configuration: %w", err)
+	}
+	if err := siteProxy.Setup(webhook); err != nil {
+		return fmt.Errorf("failed to set up %s: %w", siteProxy.Name(), err)
+	}
+
 	// Validate inputs
-	if err := validateInputs(siteType, domain, dbSource, scalingType, replicas, maxReplicas); err != nil {
-		color.Red("Error: %v", err)
-		return
+	if err := validateInputs(req.Type, req.Domain, req.DBSource, req.ScalingType, req.Replicas, req.MaxReplicas); err != nil {
+		return fmt.Errorf("%w: %w", agent.ErrBadRequest, err)
+	}
+	if err := req.HealthCheck.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", agent.ErrBadRequest, err)
 	}
 
 	// Check and setup MySQL if needed
-	if dbSource == "internal" {
+	if req.DBSource == "internal" {
+		reportStep("set up MySQL")
 		if err := setupInternalMySQL(); err != nil {
-			color.Red("Error setting up internal MySQL: %v", err)
-			return
+			return fmt.Errorf("failed to set up internal MySQL: %w", err)
 		}
 	}
 
 	// Launch the site
+	reportStep("launch site")
 	if err := launchSite(
-		siteType, domain, dbSource, dbHost, dbPort, dbName, dbUser, dbPassword, scalingType, replicas, maxReplicas,
-		siteID, hostname, phpVersion, webhook,
+		req.Type, req.Domain, req.DBSource, req.DBHost, req.DBPort, req.DBName, req.DBUser, req.DBPassword,
+		req.ScalingType, req.Replicas, req.MaxReplicas, req.SiteID, req.Hostname, req.PHPVersion, req.HealthCheck, webhook,
 	); err != nil {
-		color.Red("Error launching site: %v", err)
-		return
+		return fmt.Errorf("failed to launch site: %w", err)
 	}
 
 	color.Green("Site launched successfully!")
 
+	if req.TLS && siteProxy.IssuesCertificates() {
+		color.Green("%s obtains the TLS certificate for %s automatically", siteProxy.Name(), req.Domain)
+	} else if req.TLS {
+		reportStep("issue certificate")
+		if err := issueCertificate(issuer, req.Domain, webhook); err != nil {
+			sendWebhook(webhook, fmt.Sprintf("Error issuing TLS certificate: %v", err))
+			return fmt.Errorf("failed to issue TLS certificate: %w", err)
+		}
+		color.Green("TLS certificate issued for %s", req.Domain)
+	}
+
 	// Send webhook if provided
 	if webhook != "" {
 		sendWebhook(webhook, "Site launched successfully")
 	}
+	return nil
 }
 
 func promptIfEmpty(value, prompt, defaultValue string) string {
@@ -308,16 +570,15 @@ func validateInputs(siteType, domain, dbSource, scalingType string, replicas, ma
 	return nil
 }
 
+// setupInternalMySQL installs the MySQL service unless it is already running
 func setupInternalMySQL() error {
-	// Check if MySQL is running
-	output, err := execCommand("ploy", "services", "status", "mysql").Output()
-	if err != nil || !strings.Contains(string(output), "running") {
-		// Install MySQL
-		cmd := execCommand("ploy", "services", "install", "mysql")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to install MySQL: %v", err)
+	running, err := checkMySQLStatus()
+	if err != nil {
+		return err
+	}
+	if !running {
+		if err := installMySQL("default_user", "default_password", "3306"); err != nil {
+			return fmt.Errorf("failed to install MySQL: %w", err)
 		}
 	}
 	return nil
@@ -334,11 +595,11 @@ func replaceTemplateVariables(content string, vars map[string]string) string {
 
 func launchSite(
 	siteType, domain, dbSource, dbHost, dbPort, dbName, dbUser, dbPassword, scalingType string,
-	replicas, maxReplicas int, siteID, hostname, phpVersion string, webhook string,
+	replicas, maxReplicas int, siteID, hostname, phpVersion string, healthCheck health.Check, webhook string,
 ) error {
 	// Start logging
 	if err := createSiteLog(hostname, "Starting site creation process"); err != nil {
-		return fmt.Errorf("failed to create site log: %v", err)
+		return fmt.Errorf("failed to create site log: %w", err)
 	}
 
 	// Set default domain if not provided
@@ -351,14 +612,6 @@ func launchSite(
 		createSiteLog(hostname, fmt.Sprintf("Using default domain: %s", domain))
 	}
 
-	// Create nginx configuration first
-	createSiteLog(hostname, "Creating nginx configuration...")
-	if err := createNginxConfig(domain, webhook); err != nil {
-		createSiteLog(hostname, fmt.Sprintf("Failed to create nginx configuration: %v", err))
-		return fmt.Errorf("failed to create nginx configuration: %v", err)
-	}
-	createSiteLog(hostname, "Nginx configuration created successfully")
-
 	// Get MySQL details if using internal database
 	if dbSource == "internal" {
 		createSiteLog(hostname, "Checking MySQL status...")
@@ -398,86 +651,164 @@ func launchSite(
 		createSiteLog(hostname, "MySQL details fetched successfully")
 	}
 
-	// Choose the appropriate Docker Compose template
-	templateFilename := docker.WPComposeStaticTemplate
-	if scalingType == "dynamic" {
-		templateFilename = docker.WPComposeDynamicTemplate
-	}
-
-	// Fetch the Docker Compose template from GitHub
-	templateContent, err := getDockerComposeTemplate(templateFilename)
-	if err != nil {
-		return fmt.Errorf("failed to fetch Docker Compose template: %v", err)
-	}
-
 	// If phpVersion is not provided, use the default
 	if phpVersion == "" {
 		phpVersion = "8.3"
 	}
 
-	// Create variables map for replacement
-	vars := map[string]string{
-		"PHP_VERSION":           phpVersion,
-		"HOSTNAME":              hostname,
-		"SITE_ID":               siteID,
-		"DOMAIN":                domain,
-		"WORDPRESS_DB_HOST":     dbHost,
-		"WORDPRESS_DB_USER":     dbUser,
-		"WORDPRESS_DB_PASSWORD": dbPassword,
-		"WORDPRESS_DB_NAME":     dbName,
+	site := &registry.Site{
+		Domain:      domain,
+		Hostname:    hostname,
+		SiteID:      siteID,
+		Type:        siteType,
+		PHPVersion:  phpVersion,
+		ScalingType: scalingType,
+		Replicas:    replicas,
+		MinReplicas: replicas,
+		MaxReplicas: maxReplicas,
+		ComposeFile: fmt.Sprintf("docker-compose-wp-php%s.yml", phpVersion),
+		Database: registry.Database{
+			Source:   dbSource,
+			Host:     dbHost,
+			Port:     dbPort,
+			Name:     dbName,
+			User:     dbUser,
+			Password: dbPassword,
+		},
+		HealthCheck: healthCheck.WithDefaults(),
+	}
+
+	// Keep the ports of an existing record, otherwise reserve one loopback port per
+	// replica the site can scale to, for nginx to reach the web containers on
+	if existing, err := registry.Load(domain); err == nil {
+		site.HostPort = existing.HostPort
+		site.PortCount = existing.PortCount
+		site.CreatedAt = existing.CreatedAt
+	} else {
+		site.PortCount = replicas
+		if maxReplicas > site.PortCount {
+			site.PortCount = maxReplicas
+		}
+		port, err := registry.AllocatePorts(site.PortCount)
+		if err != nil {
+			return fmt.Errorf("failed to allocate ports for the site: %w", err)
+		}
+		site.HostPort = port
 	}
 
-	// Replace variables in the template
-	composeContent := string(templateContent)
-	for key, value := range vars {
-		if value == "" {
-			continue // Skip empty values
-		}
-		placeholder := "${" + key + "}"
-		composeContent = strings.ReplaceAll(composeContent, placeholder, value)
+	if err := registry.Save(site); err != nil {
+		return fmt.Errorf("failed to record site: %w", err)
 	}
+	createSiteLog(hostname, fmt.Sprintf("Site recorded, web containers published on 127.0.0.1:%d-%d", site.HostPort, site.LastPort()))
 
-	// Create the site directory
-	siteDir := filepath.Join(common.SitesDir, hostname)
-	if err := os.MkdirAll(siteDir, 0755); err != nil {
-		return fmt.Errorf("failed to create site directory: %v", err)
+	// Route the domain to the recorded ports through the configured proxy
+	createSiteLog(hostname, "Creating proxy configuration...")
+	if err := configureSiteProxy(domain, webhook); err != nil {
+		createSiteLog(hostname, fmt.Sprintf("Failed to create proxy configuration: %v", err))
+		return fmt.Errorf("failed to create proxy configuration: %w", err)
+	}
+	createSiteLog(hostname, "Proxy configuration created successfully")
+
+	composeContent, err := renderSiteCompose(site)
+	if err != nil {
+		return err
 	}
 
 	// Write the Docker Compose file
-	composeFileName := fmt.Sprintf("docker-compose-wp-php%s.yml", phpVersion)
-	composeFilePath := filepath.Join(siteDir, composeFileName)
-	if err := os.WriteFile(composeFilePath, []byte(composeContent), 0644); err != nil {
-		return fmt.Errorf("failed to write docker-compose file: %v", err)
+	composeFilePath := site.ComposePath()
+	if err := runner.WriteFile(composeFilePath, []byte(composeContent), 0644); err != nil {
+		return fmt.Errorf("failed to write docker-compose file: %w", err)
 	}
 
 	// Launch the containers
 	if os.Getenv("PLOY_TEST_ENV") != "true" {
-		cmd := execCommand("docker-compose", "-f", composeFilePath, "up", "-d")
+		cmd := composeCommand(composeFilePath, "up", "-d")
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to launch containers: %v", err)
+		if err := runner.Run(cmd); err != nil {
+			return fmt.Errorf("failed to launch containers: %w", err)
 		}
 	}
 
+	// Point the upstream at the ports the replicas were actually published on
+	if err := refreshSiteUpstream(site, webhook); err != nil {
+		return fmt.Errorf("failed to update proxy upstream: %w", err)
+	}
+
+	// Only report success once the site answers through the proxy
+	createSiteLog(hostname, "Waiting for the site to become healthy...")
+	if err := waitForSiteReady(site, webhook); err != nil {
+		createSiteLog(hostname, fmt.Sprintf("Site failed its health check: %v", err))
+		return err
+	}
+
 	createSiteLog(hostname, "Site launched successfully")
 	sendWebhook(webhook, "Site launched successfully!")
 	return nil
 }
 
-func checkMySQLStatus() (bool, error) {
-	cmd := execCommand("ploy", "services", "status", "mysql")
-	output, err := cmd.Output()
+// renderSiteCompose renders the Docker Compose file for a recorded site from the
+// template matching its scaling type
+func renderSiteCompose(site *registry.Site) (string, error) {
+	// Choose the appropriate Docker Compose template
+	templateFilename := docker.WPComposeStaticTemplate
+	if site.ScalingType == "dynamic" {
+		templateFilename = docker.WPComposeDynamicTemplate
+	}
+
+	// The compose templates are embedded in the binary, so drift and apply compare
+	// against the template of the running version
+	templateContent, err := getDockerComposeTemplate(templateFilename)
 	if err != nil {
-		return false, err
+		return "", fmt.Errorf("failed to read Docker Compose template: %w", err)
+	}
+
+	// Create variables map for replacement
+	vars := map[string]string{
+		"PHP_VERSION":           site.PHPVersion,
+		"HOSTNAME":              site.Hostname,
+		"SITE_ID":               site.SiteID,
+		"DOMAIN":                site.Domain,
+		"PROXY_NAME":            nginx.UpstreamName(site.Domain),
+		"HOST_PORT":             strconv.Itoa(site.HostPort),
+		"HOST_PORT_END":         strconv.Itoa(site.LastPort()),
+		"REPLICAS":              strconv.Itoa(site.Replicas),
+		"DB_HOST":               site.Database.Host,
+		"DB_PORT":               site.Database.Port,
+		"DB_NAME":               site.Database.Name,
+		"DB_USER":               site.Database.User,
+		"DB_PASSWORD":           site.Database.Password,
+		"WORDPRESS_DB_HOST":     site.Database.Host,
+		"WORDPRESS_DB_USER":     site.Database.User,
+		"WORDPRESS_DB_PASSWORD": site.Database.Password,
+		"WORDPRESS_DB_NAME":     site.Database.Name,
 	}
-	return strings.Contains(string(output), "is running"), nil
+
+	// Replace variables in the template
+	composeContent := string(templateContent)
+	for key, value := range vars {
+		if value == "" {
+			continue // Skip empty values
+		}
+		placeholder := "${" + key + "}"
+		composeContent = strings.ReplaceAll(composeContent, placeholder, value)
+	}
+
+	return docker.WithEnvironment(composeContent, "wordpress", site.Env)
+}
+
+func checkMySQLStatus() (bool, error) {
+	return serviceRunning("mysql")
 }
 
 func sendWebhook(url, message string) {
 	if url == "" {
 		return
 	}
+	if runner.DryRun {
+		runner.Plan("POST %s: %s", url, message)
+		return
+	}
 	payload, _ := json.Marshal(map[string]string{"message": message})
 	resp, err := http.Post(url, "application/json", strings.NewReader(string(payload)))
 	if err != nil {
@@ -494,17 +825,10 @@ func setupNginxProxy(webhook string) error {
 	sendWebhook(webhook, "Checking nginx-proxy status...")
 
 	// Check if nginx-proxy is running
-	cmd := execCommand("ploy", "services", "status", "nginx-proxy")
-	output, err := cmd.Output()
-	if err != nil || !strings.Contains(string(output), "is running") {
+	if running, _ := serviceRunning("nginx-proxy"); !running {
 		sendWebhook(webhook, "Installing nginx-proxy...")
-
-		// Install nginx-proxy
-		cmd = execCommand("ploy", "services", "install", "nginx-proxy")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to install nginx-proxy: %v", err)
+		if err := installNginxProxy(); err != nil {
+			return fmt.Errorf("failed to install nginx-proxy: %w", err)
 		}
 		sendWebhook(webhook, "nginx-proxy installed successfully")
 	}
@@ -512,139 +836,22 @@ func setupNginxProxy(webhook string) error {
 	return nil
 }
 
-var nginxBasePath = "/etc/nginx"
-
-func createNginxConfig(domain string, webhook string) error {
-	sendWebhook(webhook, "Creating nginx configuration...")
-
-	// Create container name based on domain
-	containerName := strings.ReplaceAll(domain, ".", "-")
-
-	configContent := fmt.Sprintf(
-		`server {
-	listen 80;
-	server_name %s;
-	
-	location / {
-		proxy_pass http://%s:80;
-		proxy_set_header Host $host;
-		proxy_set_header X-Real-IP $remote_addr;
-		proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
-		proxy_set_header X-Forwarded-Proto $scheme;
-		proxy_redirect off;
-		proxy_buffering off;
-		
-		# Add WebSocket support
-		proxy_http_version 1.1;
-		proxy_set_header Upgrade $http_upgrade;
-		proxy_set_header Connection "upgrade";
-	}
-}`, domain, containerName,
-	)
-
-	// Create nginx sites directory if it doesn't exist
-	nginxSitesDir := filepath.Join(nginxBasePath, "sites-available")
-	nginxEnabledDir := filepath.Join(nginxBasePath, "sites-enabled")
-
-	// First, try to create the directories with sudo
-	cmd := execSudo("sh", "-c", fmt.Sprintf("mkdir -p %s %s", nginxSitesDir, nginxEnabledDir))
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create nginx directories: %v", err)
-	}
-
-	// Write nginx configuration using a temporary file
-	tempFile, err := os.CreateTemp("", "nginx-conf-")
-	if err != nil {
-		return fmt.Errorf("failed to create temporary file: %v", err)
-	}
-	defer os.Remove(tempFile.Name())
-
-	if _, err := tempFile.WriteString(configContent); err != nil {
-		return fmt.Errorf("failed to write to temporary file: %v", err)
-	}
-	tempFile.Close()
-
-	// Move the temporary file to the nginx sites-available directory using sudo
-	configPath := filepath.Join(nginxSitesDir, domain+".conf")
-	cmd = execSudo("sh", "-c", fmt.Sprintf("mv %s %s && chown root:root %s && chmod 644 %s",
-		tempFile.Name(), configPath, configPath, configPath))
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to install nginx configuration: %v", err)
-	}
-
-	// Create symlink in sites-enabled using sudo
-	enabledPath := filepath.Join(nginxEnabledDir, domain+".conf")
-	cmd = execSudo("sh", "-c", fmt.Sprintf("rm -f %s && ln -s %s %s",
-		enabledPath, configPath, enabledPath))
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to enable nginx configuration: %v", err)
-	}
-
-	// Skip nginx reload in test environment
-	if os.Getenv("PLOY_TEST_ENV") != "true" {
-		// Reload nginx using sudo
-		cmd = execSudo("systemctl", "reload", "nginx")
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to reload nginx: %v", err)
-		}
+// createSiteLog appends a message to the site's deploy log. Nothing is logged in
+// dry-run mode.
+func createSiteLog(hostname, message string) error {
+	if runner.DryRun {
+		return nil
 	}
 
-	sendWebhook(webhook, "Nginx configuration created and enabled")
-	return nil
-}
-
-func createSiteLog(hostname, message string) error {
-	// Create log directory with sudo if needed
+	// server init hands the site log directory to the ploy user
 	logDir := filepath.Join(logBasePath, "sites", hostname)
 	if err := os.MkdirAll(logDir, 0755); err != nil {
-		// Try with sudo if regular mkdir fails
-		cmd := execSudo("mkdir", "-p", logDir)
-		if err := cmd.Run(); err != nil {
-			// If sudo fails, try to create directory as current user
-			if err := os.MkdirAll(logDir, 0755); err != nil {
-				return fmt.Errorf("failed to create log directory: %v", err)
-			}
-		}
-		// Set permissions
-		cmd = execSudo("chmod", "755", logDir)
-		if err := cmd.Run(); err != nil {
-			// If sudo fails, try to set permissions as current user
-			if err := os.Chmod(logDir, 0755); err != nil {
-				return fmt.Errorf("failed to set log directory permissions: %v", err)
-			}
-		}
+		return fmt.Errorf("failed to create log directory: %w", err)
 	}
 
-	// Use deploy.log instead of creating.log
-	logFile := filepath.Join(logDir, "deploy.log")
-
-	// Try to open file directly first
-	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(filepath.Join(logDir, "deploy.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		// If direct access fails, try with sudo
-		cmd := execSudo("touch", logFile)
-		if err := cmd.Run(); err != nil {
-			// If sudo fails, try to create file as current user
-			f, err = os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				return fmt.Errorf("failed to create log file: %v", err)
-			}
-		}
-
-		// Set permissions
-		cmd = execSudo("chmod", "644", logFile)
-		if err := cmd.Run(); err != nil {
-			// If sudo fails, try to set permissions as current user
-			if err := os.Chmod(logFile, 0644); err != nil {
-				return fmt.Errorf("failed to set log file permissions: %v", err)
-			}
-		}
-
-		// Try opening again after setting permissions
-		f, err = os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			return fmt.Errorf("failed to open log file after setting permissions: %v", err)
-		}
+		return fmt.Errorf("failed to open log file: %w", err)
 	}
 	defer f.Close()
 
@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -13,6 +14,9 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/health"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
 )
 
 // Existing imports and test setup...
@@ -104,17 +108,13 @@ services:
 	// Mock execCommand to return actual values
 	oldExecCommand := execCommand
 	execCommand = func(name string, arg ...string) *exec.Cmd {
-		// For docker-compose
-		if name == "docker-compose" {
+		// For docker compose
+		if name == "docker" && len(arg) > 0 && arg[0] == "compose" {
 			return exec.Command("echo", "docker-compose mock")
 		}
 		// For MySQL status check
-		if name == "ploy" && len(arg) > 2 && arg[1] == "services" && arg[2] == "status" {
-			return exec.Command("echo", "mysql is running")
-		}
-		// For MySQL details
-		if name == "ploy" && len(arg) > 2 && arg[1] == "services" && arg[2] == "details" {
-			return exec.Command("echo", `{"Host":"localhost","Port":"3306","Database":"wordpress","User":"user","Password":"password"}`)
+		if name == "docker" && len(arg) > 0 && arg[0] == "ps" {
+			return exec.Command("echo", "Up 2 hours")
 		}
 		// For all other commands, return empty string
 		return exec.Command("echo", "")
@@ -152,6 +152,7 @@ services:
 		testSiteID,     // siteID
 		testHostname,   // hostname
 		testPhpVersion, // phpVersion
+		health.Check{}, // healthCheck
 		"",             // webhook
 	)
 	assert.NoError(t, err)
@@ -206,6 +207,14 @@ services:
 	assert.NoError(t, err)
 	nginxContent := string(content)
 	assert.Contains(t, nginxContent, "server_name test.com;")
+
+	// The vhost proxies to the loopback port recorded for the site
+	site, err := registry.Load(testDomain)
+	assert.NoError(t, err)
+	assert.NotZero(t, site.HostPort)
+	assert.Contains(t, nginxContent, "proxy_pass http://ploy_test_com;")
+	assert.Contains(t, nginxContent, fmt.Sprintf("server 127.0.0.1:%d ", site.HostPort))
+	assert.NotContains(t, nginxContent, "http://test-com:80")
 }
 
 // Add more tests for other functions as needed...
@@ -213,7 +222,11 @@ services:
 func TestSetupNginxProxy(t *testing.T) {
 	// Save original execCommand and restore after test
 	oldExecCommand := execCommand
-	defer func() { execCommand = oldExecCommand }()
+	oldExecSudo := execSudo
+	defer func() {
+		execCommand = oldExecCommand
+		execSudo = oldExecSudo
+	}()
 
 	tests := []struct {
 		name          string
@@ -224,18 +237,18 @@ func TestSetupNginxProxy(t *testing.T) {
 	}{
 		{
 			name:        "nginx-proxy already running",
-			nginxStatus: "nginx-proxy is running",
+			nginxStatus: "active",
 			expectError: false,
 		},
 		{
 			name:          "nginx-proxy install success",
-			nginxStatus:   "nginx-proxy is not running",
+			nginxStatus:   "inactive",
 			installOutput: "Installation successful",
 			expectError:   false,
 		},
 		{
 			name:          "nginx-proxy install failure",
-			nginxStatus:   "nginx-proxy is not running",
+			nginxStatus:   "inactive",
 			installOutput: "",
 			expectError:   true,
 			expectedError: "failed to install nginx-proxy",
@@ -245,17 +258,21 @@ func TestSetupNginxProxy(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			execCommand = func(name string, arg ...string) *exec.Cmd {
-				if arg[0] == "services" && arg[1] == "status" {
+				if name == "systemctl" && arg[0] == "is-active" {
 					return exec.Command("echo", tt.nginxStatus)
 				}
-				if arg[0] == "services" && arg[1] == "install" {
-					if tt.installOutput != "" {
-						return exec.Command("echo", tt.installOutput)
-					}
+				if name == "nginx" {
+					// Not installed yet
 					return exec.Command("false")
 				}
 				return exec.Command("echo", "unexpected command")
 			}
+			execSudo = func(name string, arg ...string) *exec.Cmd {
+				if tt.installOutput != "" {
+					return exec.Command("echo", tt.installOutput)
+				}
+				return exec.Command("false")
+			}
 
 			err := setupNginxProxy("")
 			if tt.expectError {
@@ -271,101 +288,88 @@ func TestSetupNginxProxy(t *testing.T) {
 // Mock execSudo with actual file operations
 func mockExecSudo(t *testing.T, tempDir string) func(name string, arg ...string) *exec.Cmd {
 	return func(name string, arg ...string) *exec.Cmd {
-		t.Logf("Mock sudo command: %v", arg)
+		t.Logf("Mock sudo command: %s %v", name, arg)
 
-		// Handle different sudo commands
-		if len(arg) == 0 {
-			return exec.Command("echo", "mock sudo command")
+		// Shell commands are split into their parts, other commands are carried out as they are
+		var parts [][]string
+		if name == "sh" && len(arg) >= 2 && arg[0] == "-c" {
+			t.Logf("Shell command: %s", arg[1])
+			for _, part := range strings.Split(arg[1], "&&") {
+				parts = append(parts, strings.Fields(part))
+			}
+		} else {
+			parts = [][]string{append([]string{name}, arg...)}
 		}
 
-		// Handle shell commands
-		if name == "sh" && len(arg) >= 2 && arg[0] == "-c" {
-			shellCmd := arg[1]
-			t.Logf("Shell command: %s", shellCmd)
-
-			// Split the command into parts
-			cmdParts := strings.Split(shellCmd, "&&")
-			for _, part := range cmdParts {
-				part = strings.TrimSpace(part)
-				words := strings.Fields(part)
-				if len(words) == 0 {
-					continue
-				}
+		for _, words := range parts {
+			if len(words) == 0 {
+				continue
+			}
 
-				switch words[0] {
-				case "mkdir":
-					if len(words) >= 3 && words[1] == "-p" {
-						for _, dir := range words[2:] {
-							if err := os.MkdirAll(dir, 0755); err != nil {
-								t.Logf("Failed to create directory %s: %v", dir, err)
-								return exec.Command("false")
-							}
+			switch words[0] {
+			case "mkdir":
+				if len(words) >= 3 && words[1] == "-p" {
+					for _, dir := range words[2:] {
+						if err := os.MkdirAll(dir, 0755); err != nil {
+							t.Logf("Failed to create directory %s: %v", dir, err)
+							return exec.Command("false")
 						}
 					}
+				}
 
-				case "mv":
-					if len(words) >= 3 {
-						src, dst := words[1], words[2]
-						// Read source file
-						content, err := os.ReadFile(src)
-						if err != nil {
-							t.Logf("Failed to read source file %s: %v", src, err)
-							return exec.Command("false")
-						}
-						// Ensure destination directory exists
-						dstDir := filepath.Dir(dst)
-						if err := os.MkdirAll(dstDir, 0755); err != nil {
-							t.Logf("Failed to create destination directory %s: %v", dstDir, err)
-							return exec.Command("false")
-						}
-						// Write to destination
-						if err := os.WriteFile(dst, content, 0644); err != nil {
-							t.Logf("Failed to write destination file %s: %v", dst, err)
-							return exec.Command("false")
-						}
-						// Clean up source file
+			case "mv", "install":
+				// install -o root -g root -m 644 src dst
+				if len(words) >= 3 {
+					src, dst := words[len(words)-2], words[len(words)-1]
+					// Read source file
+					content, err := os.ReadFile(src)
+					if err != nil {
+						t.Logf("Failed to read source file %s: %v", src, err)
+						return exec.Command("false")
+					}
+					// Ensure destination directory exists
+					dstDir := filepath.Dir(dst)
+					if err := os.MkdirAll(dstDir, 0755); err != nil {
+						t.Logf("Failed to create destination directory %s: %v", dstDir, err)
+						return exec.Command("false")
+					}
+					// Write to destination
+					if err := os.WriteFile(dst, content, 0644); err != nil {
+						t.Logf("Failed to write destination file %s: %v", dst, err)
+						return exec.Command("false")
+					}
+					if words[0] == "mv" {
 						os.Remove(src)
 					}
+				}
 
-				case "chown":
-					// No-op in tests
-					continue
-
-				case "chmod":
-					// No-op in tests
-					continue
+			case "chown", "chmod", "systemctl":
+				// No-op in tests
+				continue
 
-				case "rm":
-					if len(words) >= 3 && words[1] == "-f" {
-						os.Remove(words[2]) // Ignore errors for non-existent files
+			case "rm":
+				if len(words) >= 3 && words[1] == "-f" {
+					for _, path := range words[2:] {
+						os.Remove(path) // Ignore errors for non-existent files
 					}
+				}
 
-				case "ln":
-					if len(words) >= 4 && words[1] == "-s" {
-						target, linkPath := words[2], words[3]
-						// Remove existing symlink if it exists
-						os.Remove(linkPath)
-						// Create symlink
-						if err := os.Symlink(target, linkPath); err != nil {
-							t.Logf("Failed to create symlink from %s to %s: %v", target, linkPath, err)
-							return exec.Command("false")
-						}
+			case "ln":
+				if len(words) >= 4 && strings.HasPrefix(words[1], "-s") {
+					target, linkPath := words[2], words[3]
+					// Remove existing symlink if it exists
+					os.Remove(linkPath)
+					// Create symlink
+					if err := os.Symlink(target, linkPath); err != nil {
+						t.Logf("Failed to create symlink from %s to %s: %v", target, linkPath, err)
+						return exec.Command("false")
 					}
 				}
-			}
-			return exec.Command("echo", "mock sudo command")
-		}
 
-		// Handle regular commands
-		switch arg[0] {
-		case "systemctl":
-			// No-op in tests
-			return exec.Command("echo", "mock systemctl command")
-		default:
-			t.Logf("Unhandled sudo command: %v", arg[0])
-			t.Logf("With args: %v", arg[1:])
+			default:
+				t.Logf("Unhandled sudo command: %v", words)
+			}
 		}
-
 		return exec.Command("echo", "mock sudo command")
 	}
 }
@@ -437,15 +441,6 @@ func TestCreateSiteLog(t *testing.T) {
 	logBasePath = tempDir
 	defer func() { logBasePath = oldLogBasePath }()
 
-	// Save original execSudo and restore after test
-	oldExecSudo := execSudo
-	defer func() { execSudo = oldExecSudo }()
-
-	// Mock execSudo
-	execSudo = func(name string, arg ...string) *exec.Cmd {
-		return exec.Command("echo", "mock sudo command")
-	}
-
 	hostname := "test.example.com"
 	message := "Test log message"
 
@@ -462,3 +457,115 @@ func TestCreateSiteLog(t *testing.T) {
 	assert.Contains(t, string(content), message)
 	assert.Regexp(t, `\[\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}\] Test log message`, string(content))
 }
+
+func TestCreateNginxConfigRollsBackInvalidConfig(t *testing.T) {
+	tempDir := t.TempDir()
+
+	oldNginxBasePath := nginxBasePath
+	nginxBasePath = tempDir
+	defer func() { nginxBasePath = oldNginxBasePath }()
+
+	os.Setenv("PLOY_TEST_ENV", "true")
+	defer os.Unsetenv("PLOY_TEST_ENV")
+
+	// nginx -t fails, every other sudo command behaves like the file based mock
+	nginxTestCalls := 0
+	fileMock := mockExecSudo(t, tempDir)
+	oldExecSudo := execSudo
+	execSudo = func(name string, arg ...string) *exec.Cmd {
+		if name == "nginx" && len(arg) > 0 && arg[0] == "-t" {
+			nginxTestCalls++
+			return exec.Command("sh", "-c", `echo 'nginx: [emerg] unknown directive "bogus"' >&2; exit 1`)
+		}
+		return fileMock(name, arg...)
+	}
+	defer func() { execSudo = oldExecSudo }()
+
+	configPath := filepath.Join(tempDir, "sites-available", "test.com.conf")
+	enabledPath := filepath.Join(tempDir, "sites-enabled", "test.com.conf")
+
+	// A new site is removed completely
+	err := createNginxConfig("test.com", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `unknown directive "bogus"`)
+	assert.Contains(t, err.Error(), "rolled back")
+	assert.NoFileExists(t, configPath)
+	assert.NoFileExists(t, enabledPath)
+
+	// An existing site keeps its previous vhost
+	assert.NoError(t, os.WriteFile(configPath, []byte("# previous config"), 0644))
+	err = createNginxConfig("test.com", "")
+	assert.Error(t, err)
+
+	content, err := os.ReadFile(configPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "# previous config", string(content))
+	assert.Equal(t, 2, nginxTestCalls)
+}
+
+func TestLaunchSiteDryRun(t *testing.T) {
+	tempDir := setupNginxTest(t)
+	t.Setenv("PLOY_TEST_ENV", "")
+
+	var plan bytes.Buffer
+	runner.DryRun = true
+	runner.Out = &plan
+	defer func() {
+		runner.DryRun = false
+		runner.Out = os.Stdout
+	}()
+
+	oldGetDockerComposeTemplate := getDockerComposeTemplate
+	getDockerComposeTemplate = func(filename string) ([]byte, error) {
+		return []byte("services:\n  wordpress:\n    environment:\n      DOMAIN: ${DOMAIN}\n"), nil
+	}
+	defer func() { getDockerComposeTemplate = oldGetDockerComposeTemplate }()
+
+	// Commands keep their arguments but can never run, apart from the MySQL check
+	unrunnable := func(name string, arg ...string) *exec.Cmd {
+		cmd := exec.Command(name, arg...)
+		cmd.Path = filepath.Join(tempDir, "missing", name)
+		cmd.Err = nil
+		return cmd
+	}
+	oldExecCommand := execCommand
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		if name == "docker" && len(arg) > 0 && arg[0] == "ps" {
+			return exec.Command("echo", "Up 2 hours")
+		}
+		return unrunnable(name, arg...)
+	}
+	defer func() { execCommand = oldExecCommand }()
+	oldExecSudo := execSudo
+	execSudo = func(name string, arg ...string) *exec.Cmd {
+		return unrunnable("sudo", append([]string{"-n", name}, arg...)...)
+	}
+	defer func() { execSudo = oldExecSudo }()
+
+	err := launchSite("wp", "dry.com", "internal", "mysql", "3306", "dry", "dry", "secret",
+		"static", 1, 0, "", "", "8.3", health.Check{}, "")
+	assert.NoError(t, err)
+
+	siteDir := filepath.Join(common.SitesDir, "dry.com")
+	composePath := filepath.Join(siteDir, "docker-compose-wp-php8.3.yml")
+	output := plan.String()
+	assert.Contains(t, output, "[dry-run] mkdir -p "+siteDir)
+	assert.Contains(t, output, "[dry-run] write "+filepath.Join(siteDir, "site.yml")+" (0600")
+	assert.Contains(t, output, "[dry-run] write "+composePath+" (0644")
+	assert.Contains(t, output, "    |       DOMAIN: dry.com\n")
+	assert.Contains(t, output, "[dry-run] write "+filepath.Join(tempDir, "sites-available", "dry.com.conf"))
+	assert.Contains(t, output, "server_name dry.com;")
+	assert.Contains(t, output, "[dry-run] run: sudo -n systemctl reload nginx\n")
+	assert.Contains(t, output, "[dry-run] run: docker compose -f "+composePath+" up -d\n")
+	assert.Contains(t, output, "[dry-run] wait for dry.com to pass its health check")
+
+	// Nothing was written
+	assert.NoDirExists(t, siteDir)
+	assert.NoFileExists(t, filepath.Join(tempDir, "sites-available", "dry.com.conf"))
+	assert.NoDirExists(t, filepath.Join(tempDir, "sites", "dry.com"))
+}
+
+func TestExecSudo(t *testing.T) {
+	cmd := execSudo("apt-get", "install", "-y", "nginx")
+	assert.Equal(t, []string{"sudo", "-n", "apt-get", "install", "-y", "nginx"}, cmd.Args)
+}
@@ -0,0 +1,330 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"github.com/ploycloud/ploy-server-cli/src/stats"
+	"github.com/spf13/cobra"
+)
+
+// How long `ploy top` reuses disk usage before measuring again
+var topDiskRefresh = time.Minute
+
+var TopCmd = &cobra.Command{
+	Use:   "top",
+	Short: "Show live resource usage per site",
+	Long:  `Show CPU, memory, network and block IO summed over each site's containers, plus the disk used by its files, volumes and database. Refreshes until interrupted.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		interval, _ := cmd.Flags().GetDuration("interval")
+		sortKey, _ := cmd.Flags().GetString("sort")
+		asJSON, _ := cmd.Flags().GetBool("json")
+		withDisk, _ := cmd.Flags().GetBool("disk")
+
+		sites, err := registry.List()
+		if err != nil {
+			return fmt.Errorf("listing sites: %w", err)
+		}
+
+		if asJSON {
+			usage, err := collectSiteStats(sites, withDisk, nil)
+			if err != nil {
+				return fmt.Errorf("reading container stats: %w", err)
+			}
+			if err := stats.SortBy(usage, sortKey); err != nil {
+				return fmt.Errorf("%w", err)
+			}
+			printStatsJSON(usage)
+			return nil
+		}
+
+		// Disk usage is slow to measure, so it is only refreshed every topDiskRefresh
+		disks := make(map[string]stats.Disk)
+		var measured time.Time
+		for {
+			if withDisk && time.Since(measured) > topDiskRefresh {
+				for _, site := range sites {
+					disks[site.Domain] = siteDiskUsage(site)
+				}
+				measured = time.Now()
+			}
+
+			usage, err := collectSiteStats(sites, false, disks)
+			if err != nil {
+				return fmt.Errorf("reading container stats: %w", err)
+			}
+			if err := stats.SortBy(usage, sortKey); err != nil {
+				return fmt.Errorf("%w", err)
+			}
+
+			// Clear the screen and redraw from the top left
+			fmt.Print("\033[H\033[2J")
+			fmt.Printf("ploy top - %s - %d site(s), sorted by %s, every %s (Ctrl-C to quit)\n\n",
+				time.Now().Format("15:04:05"), len(usage), sortKey, interval)
+			printSiteStats(os.Stdout, usage)
+
+			time.Sleep(interval)
+			if refreshed, err := registry.List(); err == nil {
+				sites = refreshed
+			}
+		}
+	},
+}
+
+func init() {
+	TopCmd.Flags().Duration("interval", 2*time.Second, "How often the view is refreshed")
+	TopCmd.Flags().String("sort", stats.SortCPU, "Sort by cpu, memory, net, io, disk or name")
+	TopCmd.Flags().Bool("json", false, "Print a single snapshot as JSON and exit")
+	TopCmd.Flags().Bool("disk", true, "Measure disk usage of site files, volumes and databases")
+
+	SitesCmd.AddCommand(sitesStatsCmd)
+	sitesStatsCmd.Flags().String("sort", stats.SortCPU, "Sort by cpu, memory, net, io, disk or name")
+	sitesStatsCmd.Flags().Bool("json", false, "Print the results as JSON")
+}
+
+var sitesStatsCmd = &cobra.Command{
+	Use:   "stats [host]",
+	Short: "Show resource and disk usage of sites",
+	Long:  `Show CPU, memory, network, block IO and disk usage for one site, including each of its containers, or for every site.`,
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sortKey, _ := cmd.Flags().GetString("sort")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		var sites []*registry.Site
+		if len(args) == 1 {
+			site, err := registry.Load(args[0])
+			if err != nil {
+				return fmt.Errorf("loading site: %w", err)
+			}
+			sites = append(sites, site)
+		} else {
+			var err error
+			if sites, err = registry.List(); err != nil {
+				return fmt.Errorf("listing sites: %w", err)
+			}
+		}
+
+		usage, err := collectSiteStats(sites, true, nil)
+		if err != nil {
+			return fmt.Errorf("reading container stats: %w", err)
+		}
+		if err := stats.SortBy(usage, sortKey); err != nil {
+			return fmt.Errorf("%w", err)
+		}
+
+		if asJSON {
+			printStatsJSON(usage)
+			return nil
+		}
+		if len(usage) == 0 {
+			fmt.Println("No sites found.")
+			return nil
+		}
+		printSiteStats(os.Stdout, usage)
+		if len(args) == 1 {
+			fmt.Println()
+			printContainerStats(os.Stdout, usage[0].Containers)
+		}
+		return nil
+	},
+}
+
+func printStatsJSON(usage []stats.Site) {
+	data, _ := json.MarshalIndent(usage, "", "  ")
+	fmt.Println(string(data))
+}
+
+func printSiteStats(out io.Writer, usage []stats.Site) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SITE\tCONTAINERS\tCPU %\tMEMORY\tNET RX / TX\tBLOCK R / W\tFILES\tVOLUMES\tDATABASE")
+	for _, s := range usage {
+		files, volumes, database := "-", "-", "-"
+		if s.Disk != nil {
+			files, volumes, database = formatDisk(s.Disk.SiteDir), formatDisk(s.Disk.Volumes), formatDisk(s.Disk.Database)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.1f\t%s\t%s / %s\t%s / %s\t%s\t%s\t%s\n", s.Site, len(s.Containers), s.CPU,
+			stats.FormatBytes(s.Memory), stats.FormatBytes(s.NetRx), stats.FormatBytes(s.NetTx),
+			stats.FormatBytes(s.BlockRead), stats.FormatBytes(s.BlockWrite), files, volumes, database)
+	}
+	w.Flush()
+}
+
+func printContainerStats(out io.Writer, containers []stats.Container) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tCPU %\tMEMORY\tMEM %\tNET RX / TX\tBLOCK R / W")
+	for _, c := range containers {
+		fmt.Fprintf(w, "%s\t%.1f\t%s / %s\t%.1f\t%s / %s\t%s / %s\n", c.Name, c.CPU,
+			stats.FormatBytes(c.Memory), stats.FormatBytes(c.MemoryLimit), c.MemoryPercent,
+			stats.FormatBytes(c.NetRx), stats.FormatBytes(c.NetTx),
+			stats.FormatBytes(c.BlockRead), stats.FormatBytes(c.BlockWrite))
+	}
+	w.Flush()
+}
+
+func formatDisk(n int64) string {
+	if n < 0 {
+		return "?"
+	}
+	return stats.FormatBytes(uint64(n))
+}
+
+// collectSiteStats reads docker stats for the containers of every site in a single
+// call. Disk usage is measured when withDisk is set, or taken from disks.
+func collectSiteStats(sites []*registry.Site, withDisk bool, disks map[string]stats.Disk) ([]stats.Site, error) {
+	siteIDs := make(map[string][]string, len(sites))
+	var ids []string
+	for _, site := range sites {
+		containerIDs, err := siteContainerIDs(site)
+		if err != nil {
+			// A stopped or broken site still shows up, without containers
+			continue
+		}
+		siteIDs[site.Domain] = containerIDs
+		ids = append(ids, siteIDs[site.Domain]...)
+	}
+
+	var containers []stats.Container
+	if len(ids) > 0 {
+		args := append([]string{"stats", "--no-stream", "--format", stats.DockerStatsFormat}, ids...)
+		output, err := runner.Query(execCommand("docker", args...))
+		if err != nil {
+			return nil, fmt.Errorf("docker stats failed: %w", err)
+		}
+		if containers, err = stats.ParseDockerStats(string(output)); err != nil {
+			return nil, err
+		}
+	}
+
+	usage := make([]stats.Site, 0, len(sites))
+	for _, site := range sites {
+		var own []stats.Container
+		for _, c := range containers {
+			for _, id := range siteIDs[site.Domain] {
+				// docker stats prints short IDs, compose prints full ones
+				if strings.HasPrefix(id, c.ID) || strings.HasPrefix(c.ID, id) {
+					own = append(own, c)
+					break
+				}
+			}
+		}
+
+		s := stats.Aggregate(site.Domain, own)
+		if withDisk {
+			disk := siteDiskUsage(site)
+			s.Disk = &disk
+		} else if disk, ok := disks[site.Domain]; ok {
+			s.Disk = &disk
+		}
+		usage = append(usage, s)
+	}
+	return usage, nil
+}
+
+// siteContainerIDs returns the IDs of the running containers of a site
+func siteContainerIDs(site *registry.Site) ([]string, error) {
+	output, err := runner.Query(composeCommand(site.ComposePath(), "ps", "-q"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	return strings.Fields(string(output)), nil
+}
+
+// siteDiskUsage measures the site directory, the site's named volumes and its
+// database. Values that cannot be measured are -1.
+func siteDiskUsage(site *registry.Site) stats.Disk {
+	disk := stats.Disk{SiteDir: -1, Volumes: -1, Database: -1}
+	if size, err := dirSize(site.Dir()); err == nil {
+		disk.SiteDir = size
+	}
+	if size, err := siteVolumesSize(site); err == nil {
+		disk.Volumes = size
+	}
+	if size, err := siteDatabaseSize(site); err == nil {
+		disk.Database = size
+	}
+	return disk
+}
+
+// dirSize returns the total size of the regular files below dir
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+var composeProjectInvalid = regexp.MustCompile(`[^a-z0-9_-]`)
+
+// composeProject returns the project name docker compose derives from the site directory
+func composeProject(site *registry.Site) string {
+	return composeProjectInvalid.ReplaceAllString(strings.ToLower(filepath.Base(site.Dir())), "")
+}
+
+// siteVolumesSize returns the size of the named volumes of the site's compose project
+func siteVolumesSize(site *registry.Site) (int64, error) {
+	output, err := runner.Query(execCommand("docker", "volume", "ls", "-q",
+		"--filter", "label=com.docker.compose.project="+composeProject(site)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list volumes: %w", err)
+	}
+	volumes := strings.Fields(string(output))
+	if len(volumes) == 0 {
+		return 0, nil
+	}
+
+	args := append([]string{"volume", "inspect", "--format", "{{.Mountpoint}}"}, volumes...)
+	output, err = runner.Query(execCommand("docker", args...))
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect volumes: %w", err)
+	}
+	mountpoints := strings.Fields(string(output))
+
+	// Volume data is owned by root
+	output, err = runner.Query(execSudo("du", append([]string{"-sbc"}, mountpoints...)...))
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure volumes: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	total := strings.Fields(lines[len(lines)-1])
+	if len(total) == 0 {
+		return 0, fmt.Errorf("unexpected du output")
+	}
+	return strconv.ParseInt(total[0], 10, 64)
+}
+
+// siteDatabaseSize asks MySQL for the size of the site's database
+func siteDatabaseSize(site *registry.Site) (int64, error) {
+	query := fmt.Sprintf("SELECT COALESCE(SUM(data_length + index_length), 0) FROM information_schema.tables WHERE table_schema = '%s'", site.Database.Name)
+	cmd, err := siteMySQLCommand(site, "mysql", "-N", "-B", "-e", query)
+	if err != nil {
+		return 0, err
+	}
+	output, err := runner.Query(cmd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query database size: %w", err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+}
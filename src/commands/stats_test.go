@@ -0,0 +1,193 @@
+package commands
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/ploycloud/ploy-server-cli/src/stats"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupStatsTest(t *testing.T) {
+	setupNginxTest(t)
+
+	oldExecCommand := execCommand
+	oldExecSudo := execSudo
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		args := strings.Join(arg, " ")
+		switch {
+		case strings.HasPrefix(args, "compose") && strings.Contains(args, "shop.com"):
+			return exec.Command("echo", "aaaaaaaaaaaa1111\nbbbbbbbbbbbb2222")
+		case strings.HasPrefix(args, "compose"):
+			return exec.Command("echo", "cccccccccccc3333")
+		case strings.HasPrefix(args, "stats"):
+			return exec.Command("echo",
+				"aaaaaaaaaaaa\tshopcom-wordpress-1\t40.00%\t256MiB / 2GiB\t12.50%\t1MB / 2MB\t0B / 4kB\n"+
+					"bbbbbbbbbbbb\tshopcom-wordpress-2\t35.50%\t128MiB / 2GiB\t6.25%\t1MB / 2MB\t0B / 0B\n"+
+					"cccccccccccc\tblogcom-wordpress-1\t1.00%\t64MiB / 2GiB\t3.12%\t1kB / 2kB\t0B / 0B")
+		case strings.HasPrefix(args, "volume ls") && strings.Contains(args, "shopcom"):
+			return exec.Command("echo", "shopcom_uploads")
+		case strings.HasPrefix(args, "volume ls"):
+			return exec.Command("true")
+		case strings.HasPrefix(args, "volume"):
+			return exec.Command("echo", "/var/lib/docker/volumes/shopcom_uploads/_data")
+		case strings.HasPrefix(args, "ps"):
+			return exec.Command("echo", "mysql")
+		case strings.HasPrefix(args, "exec"):
+			return exec.Command("echo", "1048576")
+		}
+		return exec.Command("false")
+	}
+	execSudo = func(name string, arg ...string) *exec.Cmd {
+		return exec.Command("echo", "2048\t/var/lib/docker/volumes/shopcom_uploads/_data\n2048\ttotal")
+	}
+	t.Cleanup(func() {
+		execCommand = oldExecCommand
+		execSudo = oldExecSudo
+	})
+
+	shop := &registry.Site{Domain: "shop.com", HostPort: 20010, ComposeFile: "docker-compose.yml",
+		Database: registry.Database{Source: "internal", Name: "shop", User: "ploy", Password: "secret"}}
+	assert.NoError(t, registry.Save(shop))
+	assert.NoError(t, registry.Save(&registry.Site{Domain: "blog.com", HostPort: 20011, ComposeFile: "docker-compose.yml"}))
+	assert.NoError(t, os.MkdirAll(filepath.Join(shop.Dir(), "wp-content"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(shop.Dir(), "wp-content", "upload.jpg"), make([]byte, 1000), 0644))
+}
+
+func TestCollectSiteStats(t *testing.T) {
+	setupStatsTest(t)
+
+	sites, err := registry.List()
+	assert.NoError(t, err)
+	usage, err := collectSiteStats(sites, true, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, stats.SortBy(usage, stats.SortCPU))
+
+	if assert.Len(t, usage, 2) {
+		shop := usage[0]
+		assert.Equal(t, "shop.com", shop.Site)
+		assert.Len(t, shop.Containers, 2)
+		assert.Equal(t, 75.5, shop.CPU)
+		assert.Equal(t, uint64(384<<20), shop.Memory)
+		assert.Equal(t, uint64(4e6), shop.NetTx)
+
+		site, _ := registry.Load("shop.com")
+		recordSize, _ := os.Stat(filepath.Join(site.Dir(), "site.yml"))
+		assert.Equal(t, 1000+recordSize.Size(), shop.Disk.SiteDir)
+		assert.Equal(t, int64(2048), shop.Disk.Volumes)
+		assert.Equal(t, int64(1048576), shop.Disk.Database)
+
+		blog := usage[1]
+		assert.Len(t, blog.Containers, 1)
+		assert.Equal(t, int64(0), blog.Disk.Volumes)
+		assert.Equal(t, int64(-1), blog.Disk.Database)
+	}
+}
+
+func TestSitesStatsCmd(t *testing.T) {
+	setupStatsTest(t)
+	cmd := sitesStatsCmd
+
+	output := CaptureOutput(func() {
+		assert.NoError(t, cmd.RunE(cmd, []string{"shop.com"}))
+	})
+	assert.Contains(t, output, "SITE")
+	assert.Contains(t, output, "shop.com")
+	assert.Contains(t, output, "384.0MiB")
+	assert.Contains(t, output, "1.0MiB")
+	assert.Contains(t, output, "shopcom-wordpress-2")
+	assert.NotContains(t, output, "blog.com")
+
+	cmd.Flags().Set("json", "true")
+	cmd.Flags().Set("sort", "memory")
+	defer cmd.Flags().Set("json", "false")
+	defer cmd.Flags().Set("sort", "cpu")
+	output = CaptureOutput(func() {
+		assert.NoError(t, cmd.RunE(cmd, []string{}))
+	})
+
+	var usage []stats.Site
+	assert.NoError(t, json.Unmarshal([]byte(output), &usage))
+	if assert.Len(t, usage, 2) {
+		assert.Equal(t, "shop.com", usage[0].Site)
+		assert.Equal(t, "blog.com", usage[1].Site)
+	}
+}
+
+func TestTopCmdJSON(t *testing.T) {
+	setupStatsTest(t)
+	cmd := TopCmd
+
+	cmd.Flags().Set("json", "true")
+	cmd.Flags().Set("disk", "false")
+	defer cmd.Flags().Set("json", "false")
+	defer cmd.Flags().Set("disk", "true")
+	output := CaptureOutput(func() {
+		assert.NoError(t, cmd.RunE(cmd, []string{}))
+	})
+
+	var usage []stats.Site
+	assert.NoError(t, json.Unmarshal([]byte(output), &usage))
+	if assert.Len(t, usage, 2) {
+		assert.Equal(t, "shop.com", usage[0].Site)
+		assert.Nil(t, usage[0].Disk)
+	}
+}
+
+func TestComposeProject(t *testing.T) {
+	assert.Equal(t, "shopcom", composeProject(&registry.Site{Domain: "Shop.com"}))
+	assert.Equal(t, "my-blog_1", composeProject(&registry.Site{Domain: "x.com", Hostname: "my-blog_1"}))
+}
+
+func TestSiteMySQLCommandKeepsPasswordOutOfArgs(t *testing.T) {
+	setupStatsTest(t)
+
+	var ran []string
+	mockExec := execCommand
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		ran = append([]string{name}, arg...)
+		return mockExec(name, arg...)
+	}
+
+	site, err := registry.Load("shop.com")
+	assert.NoError(t, err)
+	cmd, err := siteMySQLCommand(site, "mysqldump", "shop")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docker", "exec", "-e", "MYSQL_PWD", "mysql", "mysqldump", "-u", "ploy", "shop"}, ran)
+	assert.Contains(t, cmd.Env, "MYSQL_PWD=secret")
+
+	// An external database is reached from a throwaway client container
+	site.Database = registry.Database{Source: "external", Name: "shop", User: "shop", Password: "secret", Host: "db.example.com", Port: "3306"}
+	_, err = siteMySQLCommand(site, "mysql", "-e", "SELECT 1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docker", "run", "--rm", "--network", "host", "-e", "MYSQL_PWD", "mysql:8.0",
+		"mysql", "-u", "shop", "-h", "db.example.com", "-P", "3306", "-e", "SELECT 1"}, ran)
+}
+
+func TestBackupSiteStreamsDump(t *testing.T) {
+	setupStatsTest(t)
+	mockExec := execCommand
+	execCommand = func(name string, arg ...string) *exec.Cmd {
+		if name == "docker" && arg[0] == "exec" {
+			return exec.Command("echo", "CREATE TABLE wp_posts;")
+		}
+		return mockExec(name, arg...)
+	}
+
+	site, err := registry.Load("shop.com")
+	assert.NoError(t, err)
+	result, err := backupSite(site)
+	assert.NoError(t, err)
+	assert.NotZero(t, result.Size)
+
+	// Only the archive is left, not the dump it was built from
+	files, err := os.ReadDir(backupDir(site))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.Equal(t, filepath.Base(result.Path), files[0].Name())
+}
@@ -1,36 +1,103 @@
 package commands
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/config"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
 	"github.com/ploycloud/ploy-server-cli/src/utils"
 	"github.com/spf13/cobra"
-	"os"
 )
 
-var yesFlag bool
+var (
+	yesFlag      bool
+	rollbackFlag bool
+	checkFlag    bool
+	channelFlag  string
+	versionFlag  string
+)
+
+// updateCheck is the result of `ploy update --check`
+type updateCheck struct {
+	Current         string `json:"current"`
+	Latest          string `json:"latest"`
+	Channel         string `json:"channel"`
+	UpdateAvailable bool   `json:"update_available"`
+}
 
 var UpdateCmd = &cobra.Command{
 	Use:   "update",
 	Short: "Update ploy cli to the latest version",
-	Run: func(cmd *cobra.Command, args []string) {
-		if os.Geteuid() != 0 {
-			fmt.Println("Error: The update command must be run as root.")
-			fmt.Println("Please run 'sudo ploy update'")
-			return
-		}
+	Long: `Update ploy cli to the latest release on the update channel. The stable channel
+only offers releases, beta also offers pre-releases; the channel defaults to
+update_channel in ~/.ploy/config.yaml (or PLOY_UPDATE_CHANNEL). --version installs
+a specific release, also an older one, so a fleet can be rolled out in stages.
 
-		latestVersion, hasUpdate, err := utils.CheckForUpdates()
+The release checksums must carry a valid signature and the downloaded archive must
+match its checksum before the binary is replaced. The replaced binary is kept, and
+--rollback switches back to it. --check prints the running and latest version as
+JSON without changing anything.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		channel, err := updateChannel(cmd)
 		if err != nil {
-			fmt.Println("Error checking for updates:", err)
-			return
+			return err
+		}
+		if checkFlag {
+			return printUpdateCheck(channel)
 		}
 
-		if !hasUpdate {
-			fmt.Println("You are already running the latest version.")
-			return
+		if os.Geteuid() != 0 {
+			return errPermission("the update command must be run as root, run 'sudo ploy update'")
 		}
 
-		fmt.Printf("New version available: %s\n", latestVersion)
+		if rollbackFlag {
+			if runner.DryRun {
+				runner.Plan("switch back to the ploy binary the last update replaced")
+				return nil
+			}
+			if err := utils.Rollback(); err != nil {
+				return fmt.Errorf("rolling back: %w", err)
+			}
+			fmt.Println("Rolled back to the previous version; run 'ploy update --rollback' again to undo.")
+			return nil
+		}
+
+		var release *utils.GitRelease
+		if versionFlag != "" {
+			release, err = utils.FindRelease(versionFlag)
+			if errors.Is(err, utils.ErrReleaseNotFound) {
+				return errNotFound("ploy %s was never released", versionFlag)
+			}
+			if err != nil {
+				return fmt.Errorf("looking up ploy %s: %w", versionFlag, err)
+			}
+			if c, err := utils.CompareVersions(release.TagName, common.CurrentCliVersion); err == nil && c == 0 {
+				fmt.Printf("You are already running %s.\n", release.TagName)
+				return nil
+			} else if err == nil && c < 0 {
+				fmt.Printf("Downgrading from %s to %s.\n", common.CurrentCliVersion, release.TagName)
+			} else {
+				fmt.Printf("Installing %s.\n", release.TagName)
+			}
+		} else {
+			release, err = utils.LatestRelease(channel, true)
+			if err != nil {
+				return fmt.Errorf("checking for updates: %w", err)
+			}
+			if c, err := utils.CompareVersions(release.TagName, common.CurrentCliVersion); err != nil {
+				return fmt.Errorf("checking for updates: %w", err)
+			} else if c <= 0 {
+				fmt.Printf("You are already running the latest %s version.\n", channel)
+				return nil
+			}
+			fmt.Printf("New version available: %s\n", release.TagName)
+		}
 
 		if !yesFlag {
 			fmt.Print("Do you want to update? (y/n): ")
@@ -38,20 +105,111 @@ var UpdateCmd = &cobra.Command{
 			fmt.Scanln(&response)
 			if response != "y" && response != "Y" {
 				fmt.Println("Update cancelled.")
-				return
+				return nil
 			}
 		}
 
+		if runner.DryRun {
+			runner.Plan("download ploy %s and replace the running binary", release.TagName)
+			return nil
+		}
+
 		fmt.Println("Updating...")
-		if _, err := utils.SelfUpdate(); err != nil {
-			fmt.Println("Error updating:", err)
-		} else {
-			fmt.Println("Update successful. Please restart ploy cli.")
-			os.Exit(0)
+		if err := utils.SelfUpdate(release); err != nil {
+			return fmt.Errorf("updating: %w", err)
 		}
+		fmt.Printf("Updated to %s. Please restart ploy cli; 'ploy update --rollback' restores the previous version.\n", release.TagName)
+		return nil
 	},
 }
 
 func init() {
 	UpdateCmd.Flags().BoolVarP(&yesFlag, "yes", "y", false, "Automatically answer yes to update confirmation")
+	UpdateCmd.Flags().BoolVar(&rollbackFlag, "rollback", false, "Switch back to the version the last update replaced")
+	UpdateCmd.Flags().BoolVar(&checkFlag, "check", false, "Print the running and latest version as JSON, without updating")
+	UpdateCmd.Flags().StringVar(&channelFlag, "channel", "", "Update channel to follow: stable or beta (default from the config)")
+	UpdateCmd.Flags().StringVar(&versionFlag, "version", "", "Install this release, such as 1.4.2, even if it is older")
+	UpdateCmd.MarkFlagsMutuallyExclusive("rollback", "version")
+	UpdateCmd.MarkFlagsMutuallyExclusive("rollback", "check")
+}
+
+// updateChannel returns the --channel flag, or the channel from the config
+func updateChannel(cmd *cobra.Command) (string, error) {
+	if cmd.Flags().Changed("channel") {
+		if err := config.ValidateUpdateChannel(channelFlag); err != nil {
+			return "", errUsage("%v", err)
+		}
+		return channelFlag, nil
+	}
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return "", err
+	}
+	return cfg.UpdateChannel, nil
+}
+
+func printUpdateCheck(channel string) error {
+	release, err := utils.LatestRelease(channel, false)
+	if err != nil {
+		return fmt.Errorf("checking for updates: %w", err)
+	}
+	newer, err := utils.CompareVersions(release.TagName, common.CurrentCliVersion)
+	if err != nil {
+		return fmt.Errorf("checking for updates: %w", err)
+	}
+	data, _ := json.MarshalIndent(updateCheck{
+		Current:         common.CurrentCliVersion,
+		Latest:          release.TagName,
+		Channel:         channel,
+		UpdateAvailable: newer > 0,
+	}, "", "  ")
+	fmt.Println(string(data))
+	return nil
+}
+
+// updateRefreshWait is how long a finished command waits for the background
+// refresh of the release cache before exiting
+var updateRefreshWait = 2 * time.Second
+
+// StartUpdateNotifier refreshes the release cache in the background when it is
+// stale, unless GitHub was asked within the cache TTL and failed, and returns a function that prints a notice about a newer release, at
+// most once a day. The function waits up to updateRefreshWait for the refresh,
+// so short commands still update the cache; a slower refresh is abandoned and
+// the notice uses the cache as it is. It goes to stderr and only when that is a
+// terminal, so scripts and JSON output are not affected;
+// PLOY_NO_UPDATE_NOTIFIER turns it off.
+func StartUpdateNotifier(cmd *cobra.Command) func() {
+	if os.Getenv("PLOY_NO_UPDATE_NOTIFIER") != "" || os.Getenv("PLOY_TEST_ENV") == "true" ||
+		cmd == UpdateCmd || cmd.Name() == "version" || !stderrIsTerminal() {
+		return func() {}
+	}
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return func() {}
+	}
+
+	refreshed := make(chan struct{})
+	if !utils.ReleaseRefreshDue() {
+		close(refreshed)
+	} else {
+		go func() {
+			defer close(refreshed)
+			utils.LatestRelease(cfg.UpdateChannel, true)
+		}()
+	}
+
+	return func() {
+		select {
+		case <-refreshed:
+		case <-time.After(updateRefreshWait):
+		}
+		if notice := utils.UpdateNotice(cfg.UpdateChannel); notice != "" {
+			fmt.Fprintln(os.Stderr, color.YellowString(notice))
+		}
+	}
+}
+
+func stderrIsTerminal() bool {
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
@@ -0,0 +1,52 @@
+package commands
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupUpdateCmdTest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"tag_name": "v0.6.0-beta.1", "prerelease": true}, {"tag_name": "v0.5.9"}]`))
+	}))
+	t.Cleanup(server.Close)
+
+	oldServicesDir, oldEndpoint := common.ServicesDir, utils.ReleaseEndpoint
+	common.SetServicesDir(t.TempDir())
+	utils.ReleaseEndpoint = server.URL
+	t.Setenv("PLOY_UPDATE_CHANNEL", "")
+	t.Cleanup(func() {
+		common.SetServicesDir(oldServicesDir)
+		utils.ReleaseEndpoint = oldEndpoint
+		checkFlag, channelFlag = false, ""
+		UpdateCmd.Flags().Lookup("channel").Changed = false
+	})
+}
+
+func TestUpdateCmdCheck(t *testing.T) {
+	setupUpdateCmdTest(t)
+
+	var result updateCheck
+	output := CaptureOutput(func() {
+		UpdateCmd.SetArgs([]string{"--check"})
+		assert.NoError(t, UpdateCmd.Execute())
+	})
+	assert.NoError(t, json.Unmarshal([]byte(output), &result))
+	assert.Equal(t, updateCheck{Current: "0.5.9", Latest: "v0.5.9", Channel: "stable"}, result)
+
+	output = CaptureOutput(func() {
+		UpdateCmd.SetArgs([]string{"--check", "--channel", "beta"})
+		assert.NoError(t, UpdateCmd.Execute())
+	})
+	assert.NoError(t, json.Unmarshal([]byte(output), &result))
+	assert.Equal(t, updateCheck{Current: "0.5.9", Latest: "v0.6.0-beta.1", Channel: "beta", UpdateAvailable: true}, result)
+
+	UpdateCmd.SetArgs([]string{"--check", "--channel", "nightly"})
+	assert.Equal(t, ExitUsage, ExitCode(UpdateCmd.Execute()))
+}
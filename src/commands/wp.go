@@ -1,7 +1,6 @@
 package commands
 
 import (
-	"github.com/fatih/color"
 	"github.com/ploycloud/ploy-server-cli/src/utils"
 
 	"github.com/ploycloud/ploy-server-cli/src/docker"
@@ -14,15 +13,15 @@ var WpCmd = &cobra.Command{
 	Use:   "wp",
 	Short: "Execute WP-CLI commands",
 	Long:  `Execute WP-CLI commands for the current WordPress site.`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		composePath := utils.FindComposeFile()
 		if composePath == "" {
-			color.Red("No docker-compose.yml file found.")
-			return
+			return errNotFound("no docker-compose.yml file found")
 		}
 
 		if err := runWpCli(composePath, args); err != nil {
-			color.Red("Error running wp-cli: %s", err)
+			return errDocker("running wp-cli: %w", err)
 		}
+		return nil
 	},
 }
@@ -33,7 +33,7 @@ func TestWpCmd(t *testing.T) {
 
 	// Run the command
 	output := CaptureOutput(func() {
-		WpCmd.Run(WpCmd, []string{"plugin", "list"})
+		assert.NoError(t, WpCmd.RunE(WpCmd, []string{"plugin", "list"}))
 	})
 
 	assert.Empty(t, output)
@@ -16,11 +16,34 @@ var (
 	MysqlDir      = filepath.Join(ServicesDir, "database", "mysql")
 	RedisDir      = filepath.Join(ServicesDir, "database", "redis")
 	NginxDir      = filepath.Join(ServicesDir, "nginx")
+	CertsDir      = filepath.Join(ServicesDir, "certs")
+	ProxyDir      = filepath.Join(ServicesDir, "proxy")
 )
 
+// AcmeWebroot receives the HTTP-01 challenge responses nginx serves. It is outside
+// the home directory, which nginx cannot read; `ploy server init` creates it.
+var AcmeWebroot = "/var/lib/ploy/acme"
+
+// SetHomeDir points the ploy directories in the home directory at those of another user
+func SetHomeDir(dir string) {
+	HomeDir = dir
+	ServicesDir = filepath.Join(HomeDir, ".ploy")
+	SitesDir = filepath.Join(ServicesDir, "sites")
+	GlobalCompose = filepath.Join(ServicesDir, "docker-compose.yml")
+	ProvisionsDir = filepath.Join(ServicesDir, "provisions")
+	MysqlDir = filepath.Join(ServicesDir, "database", "mysql")
+	RedisDir = filepath.Join(ServicesDir, "database", "redis")
+	NginxDir = filepath.Join(ServicesDir, "nginx")
+	CertsDir = filepath.Join(ServicesDir, "certs")
+	ProxyDir = filepath.Join(ServicesDir, "proxy")
+}
+
 func SetServicesDir(dir string)    { ServicesDir = dir }
 func SetGlobalCompose(path string) { GlobalCompose = path }
 func SetProvisionsDir(dir string)  { ProvisionsDir = dir }
 func SetMysqlDir(dir string)       { MysqlDir = dir }
 func SetRedisDir(dir string)       { RedisDir = dir }
 func SetNginxDir(dir string)       { NginxDir = dir }
+func SetCertsDir(dir string)       { CertsDir = dir }
+func SetAcmeWebroot(dir string)    { AcmeWebroot = dir }
+func SetProxyDir(dir string)       { ProxyDir = dir }
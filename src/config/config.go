@@ -1,16 +1,105 @@
 package config
 
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"gopkg.in/yaml.v2"
+)
+
+// Reverse proxies ploy can route site traffic through
+const (
+	ProxyNginx   = "nginx"
+	ProxyTraefik = "traefik"
+	ProxyCaddy   = "caddy"
+)
+
+// Update channels `ploy update` installs releases from. Beta includes pre-releases.
+const (
+	UpdateStable = "stable"
+	UpdateBeta   = "beta"
+)
+
+// DefaultAPIURL is the PloyCloud API servers register with
+const DefaultAPIURL = "https://api.ploy.cloud"
+
 // Config holds the configuration for the PloyCloud CLI
 type Config struct {
-	APIKey string
-	Region string
+	APIKey string `yaml:"api_key"`
+	APIURL string `yaml:"api_url,omitempty"`
+	Region string `yaml:"region"`
+	Proxy  string `yaml:"proxy"`
+	// Agent is the address of a running `ploy agent`. When set, site commands are
+	// sent to the agent instead of being carried out by the CLI itself.
+	Agent string `yaml:"agent,omitempty"`
+	// UpdateChannel is the release channel `ploy update` follows
+	UpdateChannel string `yaml:"update_channel,omitempty"`
+}
+
+// Path returns the location of the configuration file
+func Path() string {
+	return filepath.Join(common.ServicesDir, "config.yaml")
 }
 
-// LoadConfig loads the configuration from a file or environment variables
+// LoadConfig loads the configuration from ~/.ploy/config.yaml, with environment
+// variables taking precedence over the file
 func LoadConfig() (*Config, error) {
-	// Implement configuration loading logic
-	return &Config{
+	config := &Config{
 		APIKey: "your-api-key",
+		APIURL: DefaultAPIURL,
 		Region: "us-west-2",
-	}, nil
+		Proxy:  ProxyNginx,
+
+		UpdateChannel: UpdateStable,
+	}
+
+	data, err := os.ReadFile(Path())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("invalid configuration in %s: %v", Path(), err)
+		}
+	}
+
+	if value := os.Getenv("PLOY_API_KEY"); value != "" {
+		config.APIKey = value
+	}
+	if value := os.Getenv("PLOY_API_URL"); value != "" {
+		config.APIURL = value
+	}
+	if value := os.Getenv("PLOY_REGION"); value != "" {
+		config.Region = value
+	}
+	if value := os.Getenv("PLOY_PROXY"); value != "" {
+		config.Proxy = value
+	}
+	if value := os.Getenv("PLOY_AGENT"); value != "" {
+		config.Agent = value
+	}
+	if value := os.Getenv("PLOY_UPDATE_CHANNEL"); value != "" {
+		config.UpdateChannel = value
+	}
+
+	switch config.Proxy {
+	case ProxyNginx, ProxyTraefik, ProxyCaddy:
+	default:
+		return nil, fmt.Errorf("unknown proxy %q (use %s, %s or %s)", config.Proxy, ProxyNginx, ProxyTraefik, ProxyCaddy)
+	}
+	if err := ValidateUpdateChannel(config.UpdateChannel); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ValidateUpdateChannel returns an error for an unknown update channel
+func ValidateUpdateChannel(channel string) error {
+	switch channel {
+	case UpdateStable, UpdateBeta:
+		return nil
+	}
+	return fmt.Errorf("unknown update channel %q (use %s or %s)", channel, UpdateStable, UpdateBeta)
 }
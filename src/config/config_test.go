@@ -1,15 +1,69 @@
 package config
 
 import (
+	"os"
 	"testing"
 
+	"github.com/ploycloud/ploy-server-cli/src/common"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestLoadConfig(t *testing.T) {
+	oldServicesDir := common.ServicesDir
+	common.SetServicesDir(t.TempDir())
+	defer common.SetServicesDir(oldServicesDir)
+
 	config, err := LoadConfig()
 	assert.NoError(t, err)
 	assert.NotNil(t, config)
 	assert.Equal(t, "your-api-key", config.APIKey)
+	assert.Equal(t, DefaultAPIURL, config.APIURL)
 	assert.Equal(t, "us-west-2", config.Region)
+	assert.Equal(t, ProxyNginx, config.Proxy)
+	assert.Equal(t, UpdateStable, config.UpdateChannel)
+}
+
+func TestLoadConfigFileAndEnv(t *testing.T) {
+	oldServicesDir := common.ServicesDir
+	common.SetServicesDir(t.TempDir())
+	defer common.SetServicesDir(oldServicesDir)
+
+	assert.NoError(t, os.WriteFile(Path(), []byte("api_key: file-key\nregion: eu-west-1\nproxy: caddy\n"), 0600))
+
+	config, err := LoadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "file-key", config.APIKey)
+	assert.Equal(t, "eu-west-1", config.Region)
+	assert.Equal(t, ProxyCaddy, config.Proxy)
+
+	t.Setenv("PLOY_API_KEY", "env-key")
+	t.Setenv("PLOY_PROXY", "traefik")
+	t.Setenv("PLOY_AGENT", "unix:///run/ploy/agent.sock")
+	t.Setenv("PLOY_API_URL", "http://127.0.0.1:8080")
+	config, err = LoadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "unix:///run/ploy/agent.sock", config.Agent)
+	assert.Equal(t, "http://127.0.0.1:8080", config.APIURL)
+	assert.Equal(t, "env-key", config.APIKey)
+	assert.Equal(t, "eu-west-1", config.Region)
+	assert.Equal(t, ProxyTraefik, config.Proxy)
+
+	t.Setenv("PLOY_PROXY", "haproxy")
+	_, err = LoadConfig()
+	assert.Error(t, err)
+}
+
+func TestLoadConfigUpdateChannel(t *testing.T) {
+	oldServicesDir := common.ServicesDir
+	common.SetServicesDir(t.TempDir())
+	defer common.SetServicesDir(oldServicesDir)
+
+	assert.NoError(t, os.WriteFile(Path(), []byte("update_channel: beta\n"), 0600))
+	config, err := LoadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, UpdateBeta, config.UpdateChannel)
+
+	t.Setenv("PLOY_UPDATE_CHANNEL", "nightly")
+	_, err = LoadConfig()
+	assert.EqualError(t, err, `unknown update channel "nightly" (use stable or beta)`)
 }
@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/exec"
 
+	"github.com/ploycloud/ploy-server-cli/src/runner"
 	"gopkg.in/yaml.v2"
 )
 
@@ -18,10 +19,23 @@ func isInteractive() bool {
 	return (fileInfo.Mode() & os.ModeCharDevice) != 0
 }
 
+// ComposeArgs returns the docker arguments that run a compose subcommand on a
+// compose file. ploy always uses the compose plugin (`docker compose`), which
+// `ploy server init` installs, never the standalone docker-compose binary.
+func ComposeArgs(composePath string, args ...string) []string {
+	return append([]string{"compose", "-f", composePath}, args...)
+}
+
+// ComposeVersionArgs returns the docker arguments that print the version of the
+// compose plugin ComposeArgs runs
+func ComposeVersionArgs() []string {
+	return []string{"compose", "version", "--short"}
+}
+
 var RunCompose = runCompose
 
 func runCompose(composePath string, args ...string) error {
-	baseArgs := []string{"compose", "-f", composePath}
+	baseArgs := ComposeArgs(composePath)
 
 	// Check if 'exec' is the first argument and add -T if not interactive
 	if len(args) > 0 && args[0] == "exec" && !isInteractive() {
@@ -34,9 +48,14 @@ func runCompose(composePath string, args ...string) error {
 	cmd := exec.Command("docker", fullArgs...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
 
-	return cmd.Run()
+	// Commands run inside containers and logs are attached to the terminal and
+	// have no deadline
+	if len(fullArgs) > 3 && (fullArgs[3] == "exec" || fullArgs[3] == "run" || fullArgs[3] == "logs") {
+		cmd.Stdin = os.Stdin
+		return runner.Interactive(cmd)
+	}
+	return runner.Run(cmd)
 }
 
 func getContainerName(composePath string) (string, error) {
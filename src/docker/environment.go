@@ -0,0 +1,103 @@
+package docker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// WithEnvironment adds environment variables to a service of a compose file,
+// replacing variables of the same name. Dollar signs in the values are escaped so
+// compose does not interpolate them. The file is re-encoded, so comments are lost.
+func WithEnvironment(compose, service string, env map[string]string) (string, error) {
+	if len(env) == 0 {
+		return compose, nil
+	}
+
+	doc, services, svc, err := parseService(compose, service)
+	if err != nil {
+		return "", err
+	}
+
+	// Keep the variables of the template in their order, in the map form
+	var environment yaml.MapSlice
+	switch current := lookup(svc, "environment").(type) {
+	case yaml.MapSlice:
+		environment = current
+	case []interface{}:
+		for _, item := range current {
+			name, value, _ := strings.Cut(fmt.Sprint(item), "=")
+			environment = append(environment, yaml.MapItem{Key: name, Value: value})
+		}
+	}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		environment = set(environment, name, strings.ReplaceAll(env[name], "$", "$$"))
+	}
+
+	svc = set(svc, "environment", environment)
+	services = set(services, service, svc)
+	doc = set(doc, "services", services)
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// ServiceImage returns the image a service of a compose file runs
+func ServiceImage(compose, service string) (string, error) {
+	_, _, svc, err := parseService(compose, service)
+	if err != nil {
+		return "", err
+	}
+	image, _ := lookup(svc, "image").(string)
+	if image == "" {
+		return "", fmt.Errorf("the %s service has no image", service)
+	}
+	return image, nil
+}
+
+// parseService parses a compose file and returns it, its services and the named service
+func parseService(compose, service string) (doc, services, svc yaml.MapSlice, err error) {
+	if err := yaml.Unmarshal([]byte(compose), &doc); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid compose file: %w", err)
+	}
+	services, ok := lookup(doc, "services").(yaml.MapSlice)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("the compose file has no services")
+	}
+	svc, ok = lookup(services, service).(yaml.MapSlice)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("the compose file has no %s service", service)
+	}
+	return doc, services, svc, nil
+}
+
+func lookup(m yaml.MapSlice, key string) interface{} {
+	for _, item := range m {
+		if fmt.Sprint(item.Key) == key {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+// set replaces the value of key in m, or appends it
+func set(m yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i, item := range m {
+		if fmt.Sprint(item.Key) == key {
+			m[i].Value = value
+			return m
+		}
+	}
+	return append(m, yaml.MapItem{Key: key, Value: value})
+}
@@ -0,0 +1,58 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithEnvironment(t *testing.T) {
+	compose := `version: '3'
+services:
+  wordpress:
+    image: wordpress:php8.3-apache
+    environment:
+      WORDPRESS_DB_NAME: wp
+      WP_DEBUG: "true"
+  cron:
+    environment:
+      - TZ=UTC
+`
+	result, err := WithEnvironment(compose, "wordpress", map[string]string{"WP_DEBUG": "false", "SALT": "a$b"})
+	assert.NoError(t, err)
+	assert.Equal(t, `version: "3"
+services:
+  wordpress:
+    image: wordpress:php8.3-apache
+    environment:
+      WORDPRESS_DB_NAME: wp
+      WP_DEBUG: "false"
+      SALT: a$$b
+  cron:
+    environment:
+    - TZ=UTC
+`, result)
+
+	// The list form is converted to a map
+	result, err = WithEnvironment(compose, "cron", map[string]string{"LANG": "C"})
+	assert.NoError(t, err)
+	assert.Contains(t, result, "  cron:\n    environment:\n      TZ: UTC\n      LANG: C\n")
+
+	// Without variables the file is left as it is
+	result, err = WithEnvironment(compose, "wordpress", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, compose, result)
+
+	_, err = WithEnvironment(compose, "php", map[string]string{"A": "1"})
+	assert.EqualError(t, err, "the compose file has no php service")
+}
+
+func TestServiceImage(t *testing.T) {
+	compose := "services:\n  wordpress:\n    image: wordpress:php8.3-apache\n  cron:\n    command: cron\n"
+	image, err := ServiceImage(compose, "wordpress")
+	assert.NoError(t, err)
+	assert.Equal(t, "wordpress:php8.3-apache", image)
+
+	_, err = ServiceImage(compose, "cron")
+	assert.EqualError(t, err, "the cron service has no image")
+}
@@ -1,28 +1,25 @@
 package docker
 
 import (
+	"embed"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 )
 
-var getGitHubURL = func() string {
-	return "https://raw.githubusercontent.com/ploycloud/ploy-server-cli/main/docker/"
-}
+// templates are the compose templates of this version. They are embedded so a site
+// is always rendered from the templates the binary was released with; the copies
+// under docker/ in the repository are kept for older versions that download them.
+//
+//go:embed templates
+var templates embed.FS
 
+// GetDockerComposeTemplate returns an embedded compose template, such as
+// WPComposeStaticTemplate
 func GetDockerComposeTemplate(filename string) ([]byte, error) {
-	url := getGitHubURL() + filename
-	resp, err := http.Get(url)
+	content, err := templates.ReadFile("templates/" + filename)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch template from GitHub: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to fetch template from GitHub: status code %d", resp.StatusCode)
+		return nil, fmt.Errorf("unknown compose template %s", filename)
 	}
-
-	return ioutil.ReadAll(resp.Body)
+	return content, nil
 }
 
 // Docker Compose template references
@@ -0,0 +1,222 @@
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Status is the outcome of a check
+type Status string
+
+const (
+	Pass Status = "pass"
+	Warn Status = "warn"
+	Fail Status = "fail"
+)
+
+// Result is the outcome of one check. Hint tells how to fix a warning or failure.
+type Result struct {
+	Check   string `json:"check"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// Passed returns a passing result
+func Passed(check, message string) Result {
+	return Result{Check: check, Status: Pass, Message: message}
+}
+
+// Warning returns a result that does not stop sites from working today
+func Warning(check, message, hint string) Result {
+	return Result{Check: check, Status: Warn, Message: message, Hint: hint}
+}
+
+// Failure returns a result that breaks sites or ploy itself
+func Failure(check, message, hint string) Result {
+	return Result{Check: check, Status: Fail, Message: message, Hint: hint}
+}
+
+// Failed returns the number of failed checks
+func Failed(results []Result) int {
+	failed := 0
+	for _, r := range results {
+		if r.Status == Fail {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Print writes one line per check, with the hint below warnings and failures
+func Print(w io.Writer, results []Result) {
+	width := 0
+	for _, r := range results {
+		width = max(width, len(r.Check))
+	}
+	for _, r := range results {
+		fmt.Fprintf(w, "%-4s  %-*s  %s\n", strings.ToUpper(string(r.Status)), width, r.Check, r.Message)
+		if r.Hint != "" && r.Status != Pass {
+			fmt.Fprintf(w, "      %-*s  -> %s\n", width, "", r.Hint)
+		}
+	}
+}
+
+// Free space and inodes, in percent of the filesystem, below which checks warn or fail
+const (
+	DiskWarnPercent = 15
+	DiskFailPercent = 5
+)
+
+// statfs is swapped out in tests
+var statfs = syscall.Statfs
+
+// Disk checks the free space and inodes of the filesystem holding path
+func Disk(path string) []Result {
+	var fs syscall.Statfs_t
+	if err := statfs(path, &fs); err != nil {
+		return []Result{Warning("disk "+path, fmt.Sprintf("cannot read filesystem: %v", err), "")}
+	}
+
+	total := fs.Blocks * uint64(fs.Bsize)
+	free := fs.Bavail * uint64(fs.Bsize)
+	results := []Result{headroom("disk "+path, free, total,
+		fmt.Sprintf("%s of %s free", formatBytes(free), formatBytes(total)),
+		"Remove old backups and images (docker system prune) or grow the disk")}
+
+	// Filesystems such as btrfs have no fixed number of inodes
+	if fs.Files > 0 {
+		results = append(results, headroom("inodes "+path, fs.Ffree, fs.Files,
+			fmt.Sprintf("%d of %d inodes free", fs.Ffree, fs.Files),
+			"Delete directories with many small files, such as caches and sessions"))
+	}
+	return results
+}
+
+func headroom(check string, free, total uint64, message, hint string) Result {
+	if total == 0 {
+		return Passed(check, message)
+	}
+	percent := float64(free) * 100 / float64(total)
+	message = fmt.Sprintf("%s (%.0f%%)", message, percent)
+	switch {
+	case percent < DiskFailPercent:
+		return Failure(check, message, hint)
+	case percent < DiskWarnPercent:
+		return Warning(check, message, hint)
+	}
+	return Passed(check, message)
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Clock skew beyond which checks warn or fail. ACME and PloyCloud requests start
+// failing when the clock is off by minutes.
+const (
+	ClockWarnSkew = 5 * time.Second
+	ClockFailSkew = time.Minute
+)
+
+// ClockSkew compares the local clock with the Date header returned by url. A
+// positive skew means the local clock is ahead.
+func ClockSkew(ctx context.Context, url string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	remote, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no usable Date header from %s", url)
+	}
+	// Compare with the middle of the request, the Date header has a resolution of a second
+	local := start.Add(time.Since(start) / 2)
+	return local.Sub(remote).Truncate(time.Second), nil
+}
+
+// Clock turns a measured skew into a result
+func Clock(skew time.Duration) Result {
+	const hint = "Enable time synchronisation: sudo timedatectl set-ntp true"
+	abs := skew
+	if abs < 0 {
+		abs = -abs
+	}
+	message := fmt.Sprintf("clock is off by %s", skew)
+	switch {
+	case abs >= ClockFailSkew:
+		return Failure("clock", message, hint)
+	case abs >= ClockWarnSkew:
+		return Warning("clock", message, hint)
+	}
+	return Passed("clock", "clock is in sync")
+}
+
+// Listening reports whether something accepts TCP connections on addr
+func Listening(addr string) bool {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// VersionAtLeast reports whether a version such as "24.0.7" or "v2.24.5-desktop.1"
+// is at least min, such as "20.10". Versions that cannot be parsed pass.
+func VersionAtLeast(version, min string) bool {
+	have, ok := parseVersion(version)
+	if !ok {
+		return true
+	}
+	want, _ := parseVersion(min)
+	for i, w := range want {
+		h := 0
+		if i < len(have) {
+			h = have[i]
+		}
+		if h != w {
+			return h > w
+		}
+	}
+	return true
+}
+
+func parseVersion(version string) ([]int, bool) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexAny(version, "-+ "); i >= 0 {
+		version = version[:i]
+	}
+	var parts []int
+	for _, field := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+	return parts, len(parts) > 0
+}
@@ -0,0 +1,95 @@
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeStatfs(t *testing.T, fs syscall.Statfs_t, err error) {
+	old := statfs
+	statfs = func(path string, buf *syscall.Statfs_t) error {
+		*buf = fs
+		return err
+	}
+	t.Cleanup(func() { statfs = old })
+}
+
+func TestDisk(t *testing.T) {
+	// 10% space and 50% inodes left
+	fakeStatfs(t, syscall.Statfs_t{Bsize: 4096, Blocks: 2621440, Bavail: 262144, Files: 1000, Ffree: 500}, nil)
+	results := Disk("/root/.ploy")
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, Warning("disk /root/.ploy", "1.0GiB of 10.0GiB free (10%)",
+			"Remove old backups and images (docker system prune) or grow the disk"), results[0])
+		assert.Equal(t, Pass, results[1].Status)
+		assert.Equal(t, "500 of 1000 inodes free (50%)", results[1].Message)
+	}
+
+	fakeStatfs(t, syscall.Statfs_t{Bsize: 4096, Blocks: 1000, Bavail: 10, Files: 0}, nil)
+	results = Disk("/")
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, Fail, results[0].Status)
+	}
+
+	fakeStatfs(t, syscall.Statfs_t{}, errors.New("no such file or directory"))
+	results = Disk("/missing")
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, Warn, results[0].Status)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(-2*time.Minute).UTC().Format(http.TimeFormat))
+	}))
+	defer server.Close()
+
+	skew, err := ClockSkew(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.InDelta(t, 2*time.Minute, skew, float64(2*time.Second))
+	assert.Equal(t, Fail, Clock(skew).Status)
+
+	assert.Equal(t, Passed("clock", "clock is in sync"), Clock(-time.Second))
+	assert.Equal(t, Warn, Clock(-10*time.Second).Status)
+}
+
+func TestListening(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := l.Addr().String()
+	assert.True(t, Listening(addr))
+	l.Close()
+	assert.False(t, Listening(addr))
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	assert.True(t, VersionAtLeast("24.0.7", "20.10"))
+	assert.True(t, VersionAtLeast("20.10.0", "20.10"))
+	assert.False(t, VersionAtLeast("19.03.13", "20.10"))
+	assert.True(t, VersionAtLeast("v2.24.5-desktop.1", "2.0"))
+	assert.False(t, VersionAtLeast("1.29.2", "2.0"))
+	assert.False(t, VersionAtLeast("20", "20.10"))
+	assert.True(t, VersionAtLeast("unknown", "2.0"))
+}
+
+func TestPrint(t *testing.T) {
+	var out bytes.Buffer
+	Print(&out, []Result{
+		Passed("docker", "Docker 24.0.7 is running"),
+		Failure("sudo", "sudo asks for a password", "Allow passwordless sudo"),
+	})
+	assert.Equal(t, "PASS  docker  Docker 24.0.7 is running\n"+
+		"FAIL  sudo    sudo asks for a password\n"+
+		"              -> Allow passwordless sudo\n", out.String())
+}
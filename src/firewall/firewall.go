@@ -0,0 +1,196 @@
+package firewall
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+)
+
+// Files the firewall rules are kept in
+const (
+	// RulesetPath is the ploy-owned ruleset, the source of truth for the rules
+	// applied to the backend
+	RulesetPath = "/etc/ploy/firewall.json"
+	// UfwAfterRules is the ufw file the DOCKER-USER rules are added to
+	UfwAfterRules = "/etc/ufw/after.rules"
+	// NftPath holds the nftables table generated from the ruleset
+	NftPath = "/etc/ploy/firewall.nft"
+	// NftConf is loaded by the nftables service at boot
+	NftConf = "/etc/nftables.conf"
+)
+
+// Backends that enforce the ruleset
+const (
+	Ufw      = "ufw"
+	Nftables = "nftables"
+)
+
+// Action is what happens to traffic a rule matches
+type Action string
+
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// Anywhere matches every source address
+const Anywhere = "any"
+
+// MySQLPort is the port the global MySQL service publishes unless configured otherwise
+const MySQLPort = 3306
+
+// Rule allows or denies incoming traffic to a port
+type Rule struct {
+	Action Action `json:"action"`
+	Port   int    `json:"port"`
+	Proto  string `json:"proto"`
+	From   string `json:"from"`
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("%s %d/%s from %s", r.Action, r.Port, r.Proto, r.From)
+}
+
+// Ruleset is the ploy-owned set of firewall rules
+type Ruleset struct {
+	Backend string `json:"backend,omitempty"`
+	Rules   []Rule `json:"rules"`
+	// Applied are the rules last applied to the backend, so rules dropped from the
+	// ruleset are removed from the firewall as well
+	Applied []Rule `json:"applied,omitempty"`
+}
+
+// Default allows SSH on the ports sshd listens on, HTTP and HTTPS and keeps the
+// MySQL port closed
+func Default(sshPorts []int, mysqlPort int) *Ruleset {
+	rs := &Ruleset{}
+	for _, port := range sshPorts {
+		rs.Set(Rule{Action: Allow, Port: port, Proto: "tcp", From: Anywhere})
+	}
+	rs.Set(Rule{Action: Allow, Port: 80, Proto: "tcp", From: Anywhere})
+	rs.Set(Rule{Action: Allow, Port: 443, Proto: "tcp", From: Anywhere})
+	rs.Set(Rule{Action: Deny, Port: mysqlPort, Proto: "tcp", From: Anywhere})
+	return rs
+}
+
+// Load reads the ruleset at path
+func Load(path string) (*Ruleset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rs Ruleset
+	if err := json.Unmarshal(data, &rs); err != nil {
+		return nil, fmt.Errorf("invalid firewall ruleset in %s: %w", path, err)
+	}
+	return &rs, nil
+}
+
+// Save writes the ruleset to path
+func Save(path string, rs *Ruleset) error {
+	data, err := json.MarshalIndent(rs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := runner.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return runner.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Set adds rule, replacing the rule for the same port, protocol and source
+func (rs *Ruleset) Set(rule Rule) {
+	for i, r := range rs.Rules {
+		if r.Port == rule.Port && r.Proto == rule.Proto && r.From == rule.From {
+			rs.Rules[i] = rule
+			return
+		}
+	}
+	rs.Rules = append(rs.Rules, rule)
+}
+
+// Ordered returns the rules with those for specific sources first. Firewalls use
+// the first rule that matches, so `allow 3306 from 10.0.0.0/8` has to come before
+// `deny 3306 from any` to take effect.
+func (rs *Ruleset) Ordered() []Rule {
+	rules := append([]Rule(nil), rs.Rules...)
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].From != Anywhere && rules[j].From == Anywhere
+	})
+	return rules
+}
+
+// InSync reports whether the ruleset was applied as it is
+func (rs *Ruleset) InSync() bool {
+	ordered := rs.Ordered()
+	if len(ordered) != len(rs.Applied) {
+		return false
+	}
+	for i := range ordered {
+		if ordered[i] != rs.Applied[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Allows reports whether some rule allows traffic to port, from any source or only some
+func (rs *Ruleset) Allows(port int, proto string) bool {
+	for _, r := range rs.Rules {
+		if r.Port == port && r.Proto == proto && r.Action == Allow {
+			return true
+		}
+	}
+	return false
+}
+
+// Denies reports whether traffic to port from anywhere is denied
+func (rs *Ruleset) Denies(port int, proto string) bool {
+	for _, r := range rs.Ordered() {
+		if r.Port == port && r.Proto == proto && r.From == Anywhere {
+			return r.Action == Deny
+		}
+	}
+	return false
+}
+
+// ParseRule parses a rule from a port such as 3306 or 53/udp and a source address
+// or network, which is any when empty
+func ParseRule(action Action, spec, from string) (Rule, error) {
+	portSpec, proto, found := strings.Cut(spec, "/")
+	if !found {
+		proto = "tcp"
+	}
+	if proto != "tcp" && proto != "udp" {
+		return Rule{}, fmt.Errorf("unsupported protocol %q, use tcp or udp", proto)
+	}
+	port, err := strconv.Atoi(portSpec)
+	if err != nil || port < 1 || port > 65535 {
+		return Rule{}, fmt.Errorf("invalid port %q", portSpec)
+	}
+
+	if from == "" {
+		from = Anywhere
+	}
+	if from != Anywhere {
+		if ip := net.ParseIP(from); ip != nil {
+			from = ip.String()
+		} else if _, network, err := net.ParseCIDR(from); err == nil {
+			from = network.String()
+		} else {
+			return Rule{}, fmt.Errorf("invalid source %q, use an address or a network such as 10.0.0.0/8", from)
+		}
+	}
+	return Rule{Action: action, Port: port, Proto: proto, From: from}, nil
+}
+
+func isIPv6(address string) bool {
+	return strings.Contains(address, ":")
+}
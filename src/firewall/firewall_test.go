@@ -0,0 +1,128 @@
+package firewall
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule(Allow, "3306", "10.0.0.5/8")
+	assert.NoError(t, err)
+	assert.Equal(t, Rule{Action: Allow, Port: 3306, Proto: "tcp", From: "10.0.0.0/8"}, rule)
+
+	rule, err = ParseRule(Deny, "53/udp", "")
+	assert.NoError(t, err)
+	assert.Equal(t, Rule{Action: Deny, Port: 53, Proto: "udp", From: Anywhere}, rule)
+
+	_, err = ParseRule(Allow, "70000", "")
+	assert.EqualError(t, err, `invalid port "70000"`)
+	_, err = ParseRule(Allow, "22/sctp", "")
+	assert.EqualError(t, err, `unsupported protocol "sctp", use tcp or udp`)
+	_, err = ParseRule(Allow, "22", "office")
+	assert.Error(t, err)
+}
+
+func TestRulesetOrder(t *testing.T) {
+	rs := Default([]int{22}, 3306)
+	assert.True(t, rs.Denies(3306, "tcp"))
+
+	rs.Set(Rule{Action: Allow, Port: 3306, Proto: "tcp", From: "10.0.0.0/8"})
+	ordered := rs.Ordered()
+	assert.Equal(t, "allow 3306/tcp from 10.0.0.0/8", ordered[0].String())
+	assert.Equal(t, "deny 3306/tcp from any", ordered[4].String())
+	assert.True(t, rs.Denies(3306, "tcp"))
+
+	// Opening the port to anywhere replaces the deny rule
+	rs.Set(Rule{Action: Allow, Port: 3306, Proto: "tcp", From: Anywhere})
+	assert.Len(t, rs.Rules, 5)
+	assert.False(t, rs.Denies(3306, "tcp"))
+}
+
+func TestLoadSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ploy", "firewall.json")
+	rs := Default([]int{22}, 3307)
+	rs.Backend, rs.Applied = Ufw, rs.Ordered()
+	assert.NoError(t, Save(path, rs))
+
+	loaded, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, rs, loaded)
+	assert.True(t, loaded.InSync())
+}
+
+func TestUfwCommands(t *testing.T) {
+	rs := Default([]int{22}, 3306)
+	commands := UfwCommands(rs)
+	assert.Equal(t, []string{"ufw", "default", "deny", "incoming"}, commands[0])
+	assert.Equal(t, []string{"ufw", "allow", "proto", "tcp", "from", "any", "to", "any", "port", "22", "comment", "ploy"}, commands[2])
+	assert.Equal(t, []string{"ufw", "deny", "proto", "tcp", "from", "any", "to", "any", "port", "3306", "comment", "ploy"}, commands[5])
+	assert.Equal(t, []string{"ufw", "reload"}, commands[len(commands)-1])
+
+	// A changed ruleset removes the rules applied before and adds them again in order
+	rs.Applied = rs.Ordered()
+	rs.Set(Rule{Action: Allow, Port: 3306, Proto: "tcp", From: "10.0.0.0/8"})
+	commands = UfwCommands(rs)
+	assert.Equal(t, []string{"ufw", "delete", "allow", "proto", "tcp", "from", "any", "to", "any", "port", "22"}, commands[2])
+	assert.Equal(t, "ufw allow proto tcp from 10.0.0.0/8 to any port 3306 comment ploy", strings.Join(commands[6], " "))
+}
+
+func TestDockerUserRules(t *testing.T) {
+	rs := Default([]int{22}, 3306)
+	rs.Set(Rule{Action: Allow, Port: 3306, Proto: "tcp", From: "10.0.0.0/8"})
+	section := DockerUserRules(rs)
+
+	assert.Equal(t, `# BEGIN PLOY DOCKER-USER
+# Managed by ploy firewall; changes are overwritten.
+*filter
+:DOCKER-USER - [0:0]
+-A DOCKER-USER -p tcp -m conntrack --ctstate DNAT --ctorigdstport 3306 -s 10.0.0.0/8 -j RETURN
+-A DOCKER-USER -p tcp -m conntrack --ctstate DNAT --ctorigdstport 3306 -j DROP
+-A DOCKER-USER -j RETURN
+COMMIT
+# END PLOY DOCKER-USER
+`, section)
+
+	afterRules := "*filter\n:ufw-after-input - [0:0]\nCOMMIT\n"
+	withSection := WithDockerUserRules(afterRules, section)
+	assert.Equal(t, afterRules+section, withSection)
+
+	// The section is replaced, not added again
+	updated := DockerUserRules(Default([]int{22}, 3307))
+	assert.Equal(t, afterRules+updated, WithDockerUserRules(withSection, updated))
+}
+
+func TestNftTable(t *testing.T) {
+	rs := Default([]int{22}, 3306)
+	rs.Set(Rule{Action: Allow, Port: 3306, Proto: "tcp", From: "2001:db8::/32"})
+	table := NftTable(rs)
+
+	assert.Contains(t, table, "table inet ploy\ndelete table inet ploy\n")
+	assert.Contains(t, table, "\t\tip6 saddr 2001:db8::/32 tcp dport 3306 accept\n\t\ttcp dport 22 accept\n")
+	assert.Contains(t, table, "\t\ttcp dport 3306 drop\n")
+	assert.Contains(t, table, "\t\tct status dnat ip6 saddr 2001:db8::/32 meta l4proto tcp ct original proto-dst 3306 accept\n"+
+		"\t\tct status dnat meta l4proto tcp ct original proto-dst 3306 drop\n\t}")
+	assert.NotContains(t, table, "proto-dst 22 ")
+	assert.Equal(t, `include "/etc/ploy/firewall.nft"`, NftInclude(NftPath))
+}
+
+func TestSSHPorts(t *testing.T) {
+	config := "port 2222\naddressfamily any\nport 22\npermitrootlogin without-password\n"
+	assert.Equal(t, []int{22, 2222}, SSHDPorts(config))
+	assert.Empty(t, SSHDPorts(""))
+
+	ss := `LISTEN 0 128 0.0.0.0:2222 0.0.0.0:* users:(("sshd",pid=812,fd=3))
+LISTEN 0 128 [::]:2222 [::]:* users:(("sshd",pid=812,fd=4))
+LISTEN 0 511 0.0.0.0:80 0.0.0.0:* users:(("nginx",pid=901,fd=6))
+LISTEN 0 128 127.0.0.1:8022 0.0.0.0:* users:(("sshd-proxy",pid=950,fd=3))
+`
+	assert.Equal(t, []int{2222}, ListeningPorts(ss, "sshd"))
+	assert.Empty(t, ListeningPorts("", "sshd"))
+
+	rs := Default([]int{2222}, 3306)
+	assert.True(t, rs.Allows(2222, "tcp"))
+	assert.False(t, rs.Allows(22, "tcp"))
+	assert.False(t, rs.Allows(3306, "tcp"))
+}
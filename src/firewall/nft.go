@@ -0,0 +1,69 @@
+package firewall
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NftTable returns an nftables script that replaces the ploy table with the
+// ruleset. Incoming traffic is dropped unless a rule allows it. Published Docker
+// ports are forwarded before the input chain sees them, so the forward chain
+// repeats the rules that restrict a port for connections Docker translated.
+func NftTable(rs *Ruleset) string {
+	var b strings.Builder
+	fmt.Fprintln(&b, "#!/usr/sbin/nft -f")
+	fmt.Fprintln(&b, "# Managed by ploy firewall; changes are overwritten.")
+	fmt.Fprintln(&b, "table inet ploy")
+	fmt.Fprintln(&b, "delete table inet ploy")
+	fmt.Fprintln(&b, "table inet ploy {")
+
+	fmt.Fprintln(&b, "\tchain input {")
+	fmt.Fprintln(&b, "\t\ttype filter hook input priority filter; policy drop;")
+	fmt.Fprintln(&b, "\t\tct state established,related accept")
+	fmt.Fprintln(&b, "\t\tct state invalid drop")
+	fmt.Fprintln(&b, "\t\tiifname \"lo\" accept")
+	fmt.Fprintln(&b, "\t\tiifname \"docker0\" accept")
+	fmt.Fprintln(&b, "\t\tiifname \"br-*\" accept")
+	fmt.Fprintln(&b, "\t\tmeta l4proto { icmp, ipv6-icmp } accept")
+	fmt.Fprintln(&b, "\t\tudp sport 67 udp dport 68 accept")
+	for _, rule := range rs.Ordered() {
+		fmt.Fprintf(&b, "\t\t%s%s dport %d %s\n", nftSource(rule), rule.Proto, rule.Port, nftVerdict(rule))
+	}
+	fmt.Fprintln(&b, "\t}")
+
+	fmt.Fprintln(&b, "\tchain forward {")
+	fmt.Fprintln(&b, "\t\ttype filter hook forward priority filter - 1; policy accept;")
+	for _, rule := range rs.Ordered() {
+		if !restricts(rs, rule) {
+			continue
+		}
+		fmt.Fprintf(&b, "\t\tct status dnat %smeta l4proto %s ct original proto-dst %d %s\n",
+			nftSource(rule), rule.Proto, rule.Port, nftVerdict(rule))
+	}
+	fmt.Fprintln(&b, "\t}")
+
+	fmt.Fprintln(&b, "}")
+	return b.String()
+}
+
+// NftInclude is the line that loads the ploy table at boot
+func NftInclude(path string) string {
+	return fmt.Sprintf("include %q", path)
+}
+
+func nftSource(rule Rule) string {
+	switch {
+	case rule.From == Anywhere:
+		return ""
+	case isIPv6(rule.From):
+		return "ip6 saddr " + rule.From + " "
+	}
+	return "ip saddr " + rule.From + " "
+}
+
+func nftVerdict(rule Rule) string {
+	if rule.Action == Deny {
+		return "drop"
+	}
+	return "accept"
+}
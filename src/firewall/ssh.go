@@ -0,0 +1,53 @@
+package firewall
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SSHDPorts returns the ports in the effective sshd configuration printed by
+// `sshd -T`, which has a port line for every port sshd listens on
+func SSHDPorts(config string) []int {
+	var ports []int
+	for _, line := range strings.Split(config, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.ToLower(fields[0]) != "port" {
+			continue
+		}
+		if port, err := strconv.Atoi(fields[1]); err == nil && port > 0 && port <= 65535 {
+			ports = appendPort(ports, port)
+		}
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// ListeningPorts returns the TCP ports process listens on in the output of
+// `ss -Hltnp`, such as
+//
+//	LISTEN 0 128 0.0.0.0:22 0.0.0.0:* users:(("sshd",pid=812,fd=3))
+func ListeningPorts(ss, process string) []int {
+	var ports []int
+	for _, line := range strings.Split(ss, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || !strings.Contains(fields[5], `(("`+process+`",`) {
+			continue
+		}
+		local := fields[3]
+		if port, err := strconv.Atoi(local[strings.LastIndex(local, ":")+1:]); err == nil && port > 0 && port <= 65535 {
+			ports = appendPort(ports, port)
+		}
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+func appendPort(ports []int, port int) []int {
+	for _, p := range ports {
+		if p == port {
+			return ports
+		}
+	}
+	return append(ports, port)
+}
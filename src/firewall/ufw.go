@@ -0,0 +1,98 @@
+package firewall
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ufwComment marks the ufw rules that come from the ploy ruleset
+const ufwComment = "ploy"
+
+// Markers around the ploy section of /etc/ufw/after.rules
+const (
+	dockerUserBegin = "# BEGIN PLOY DOCKER-USER"
+	dockerUserEnd   = "# END PLOY DOCKER-USER"
+)
+
+// UfwCommands returns the ufw commands that apply the ruleset. Rules applied
+// before are deleted first when the ruleset changed, so the rules are added back
+// in order; adding a rule ufw already has is a no-op.
+func UfwCommands(rs *Ruleset) [][]string {
+	commands := [][]string{
+		{"ufw", "default", "deny", "incoming"},
+		{"ufw", "default", "allow", "outgoing"},
+	}
+	if !rs.InSync() {
+		for _, rule := range rs.Applied {
+			commands = append(commands, append([]string{"ufw", "delete", string(rule.Action)}, ufwRuleArgs(rule)...))
+		}
+	}
+	for _, rule := range rs.Ordered() {
+		args := append([]string{"ufw", string(rule.Action)}, ufwRuleArgs(rule)...)
+		commands = append(commands, append(args, "comment", ufwComment))
+	}
+	return append(commands, []string{"ufw", "--force", "enable"}, []string{"ufw", "reload"})
+}
+
+func ufwRuleArgs(rule Rule) []string {
+	return []string{"proto", rule.Proto, "from", rule.From, "to", "any", "port", strconv.Itoa(rule.Port)}
+}
+
+// DockerUserRules returns the ploy section of /etc/ufw/after.rules. Ports that
+// Docker publishes are forwarded to containers before ufw's input rules see them,
+// so the rules that restrict a port are repeated in the DOCKER-USER chain, which
+// Docker consults first. They only match connections Docker translated, leaving
+// traffic of the containers themselves alone. Docker does not publish on IPv6
+// unless it is enabled in daemon.json, so only IPv4 is covered.
+func DockerUserRules(rs *Ruleset) string {
+	var b strings.Builder
+	fmt.Fprintln(&b, dockerUserBegin)
+	fmt.Fprintln(&b, "# Managed by ploy firewall; changes are overwritten.")
+	fmt.Fprintln(&b, "*filter")
+	fmt.Fprintln(&b, ":DOCKER-USER - [0:0]")
+	for _, rule := range rs.Ordered() {
+		if !restricts(rs, rule) || isIPv6(rule.From) {
+			continue
+		}
+		target := "RETURN"
+		if rule.Action == Deny {
+			target = "DROP"
+		}
+		source := ""
+		if rule.From != Anywhere {
+			source = " -s " + rule.From
+		}
+		fmt.Fprintf(&b, "-A DOCKER-USER -p %s -m conntrack --ctstate DNAT --ctorigdstport %d%s -j %s\n",
+			rule.Proto, rule.Port, source, target)
+	}
+	fmt.Fprintln(&b, "-A DOCKER-USER -j RETURN")
+	fmt.Fprintln(&b, "COMMIT")
+	fmt.Fprintln(&b, dockerUserEnd)
+	return b.String()
+}
+
+// restricts reports whether rule matters for a port some traffic is denied to
+func restricts(rs *Ruleset, rule Rule) bool {
+	for _, r := range rs.Rules {
+		if r.Port == rule.Port && r.Proto == rule.Proto && r.Action == Deny {
+			return true
+		}
+	}
+	return false
+}
+
+// WithDockerUserRules returns the content of /etc/ufw/after.rules with its ploy
+// section replaced by section, or section appended when there is none
+func WithDockerUserRules(afterRules, section string) string {
+	begin := strings.Index(afterRules, dockerUserBegin)
+	end := strings.Index(afterRules, dockerUserEnd)
+	if begin >= 0 && end > begin {
+		rest := strings.TrimPrefix(afterRules[end+len(dockerUserEnd):], "\n")
+		return afterRules[:begin] + section + rest
+	}
+	if afterRules != "" && !strings.HasSuffix(afterRules, "\n") {
+		afterRules += "\n"
+	}
+	return afterRules + section
+}
@@ -0,0 +1,133 @@
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Check describes how a site is probed. An ExpectedStatus of 0 accepts any
+// status below 400, so redirects such as the WordPress installer count as up.
+type Check struct {
+	Path           string `yaml:"path" json:"path"`
+	ExpectedStatus int    `yaml:"expected_status" json:"expected_status"`
+	Timeout        string `yaml:"timeout" json:"timeout"`
+}
+
+// DefaultCheck returns the check used for sites without their own settings
+func DefaultCheck() Check {
+	return Check{Path: "/", ExpectedStatus: 0, Timeout: "10s"}
+}
+
+// WithDefaults fills in unset fields from DefaultCheck
+func (c Check) WithDefaults() Check {
+	defaults := DefaultCheck()
+	if c.Path == "" {
+		c.Path = defaults.Path
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		c.Path = "/" + c.Path
+	}
+	if c.Timeout == "" {
+		c.Timeout = defaults.Timeout
+	}
+	return c
+}
+
+// Validate checks that the timeout parses and the status is a valid HTTP status
+func (c Check) Validate() error {
+	if _, err := time.ParseDuration(c.WithDefaults().Timeout); err != nil {
+		return fmt.Errorf("invalid health check timeout %q", c.Timeout)
+	}
+	if c.ExpectedStatus != 0 && (c.ExpectedStatus < 100 || c.ExpectedStatus > 599) {
+		return fmt.Errorf("invalid expected status %d", c.ExpectedStatus)
+	}
+	return nil
+}
+
+// Result is the outcome of probing one site
+type Result struct {
+	Site      string        `json:"site"`
+	URL       string        `json:"url"`
+	Healthy   bool          `json:"healthy"`
+	Status    int           `json:"status,omitempty"`
+	Latency   time.Duration `json:"-"`
+	LatencyMS int64         `json:"latency_ms"`
+	Error     string        `json:"error,omitempty"`
+	CheckedAt time.Time     `json:"checked_at"`
+}
+
+// Probe requests the check path from the proxy at baseURL (for example
+// http://127.0.0.1:80) with the site's domain as Host header, so the request takes
+// the same route as visitor traffic. Redirects are not followed.
+func Probe(ctx context.Context, baseURL, domain string, check Check) Result {
+	check = check.WithDefaults()
+	result := Result{Site: domain, URL: strings.TrimSuffix(baseURL, "/") + check.Path, CheckedAt: time.Now().UTC()}
+
+	timeout, err := time.ParseDuration(check.Timeout)
+	if err != nil {
+		result.Error = fmt.Sprintf("invalid timeout %q", check.Timeout)
+		return result
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// The certificate is not what is being checked, and may not be issued yet
+			TLSClientConfig: &tls.Config{ServerName: domain, InsecureSkipVerify: true},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, result.URL, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req.Host = domain
+	req.Header.Set("User-Agent", "ploy-health-check")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	result.Latency = time.Since(start)
+	result.LatencyMS = result.Latency.Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp.Body.Close()
+
+	result.Status = resp.StatusCode
+	if check.ExpectedStatus != 0 {
+		result.Healthy = resp.StatusCode == check.ExpectedStatus
+	} else {
+		result.Healthy = resp.StatusCode < 400
+	}
+	if !result.Healthy {
+		result.Error = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+	return result
+}
+
+// WaitReady probes a site every interval until it is healthy or the timeout
+// passes, and returns the last result
+func WaitReady(ctx context.Context, baseURL, domain string, check Check, timeout, interval time.Duration) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		result := Probe(ctx, baseURL, domain, check)
+		if result.Healthy {
+			return result, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return result, fmt.Errorf("%s did not become healthy within %s: %s", domain, timeout, result.Error)
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "shop.com" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case "/":
+			http.Redirect(w, r, "/wp-admin/install.php", http.StatusFound)
+		case "/health":
+			w.WriteHeader(http.StatusOK)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+
+	result := Probe(ctx, server.URL, "shop.com", Check{})
+	assert.True(t, result.Healthy)
+	assert.Equal(t, http.StatusFound, result.Status)
+	assert.Equal(t, server.URL+"/", result.URL)
+
+	result = Probe(ctx, server.URL, "shop.com", Check{Path: "/", ExpectedStatus: 200})
+	assert.False(t, result.Healthy)
+	assert.Contains(t, result.Error, "unexpected status 302")
+
+	result = Probe(ctx, server.URL, "shop.com", Check{Path: "health", ExpectedStatus: 200})
+	assert.True(t, result.Healthy)
+
+	result = Probe(ctx, server.URL, "other.com", Check{})
+	assert.False(t, result.Healthy)
+	assert.Equal(t, http.StatusNotFound, result.Status)
+
+	result = Probe(ctx, server.URL, "shop.com", Check{Path: "/broken"})
+	assert.False(t, result.Healthy)
+
+	result = Probe(ctx, server.URL, "shop.com", Check{Path: "/slow", Timeout: "50ms"})
+	assert.False(t, result.Healthy)
+	assert.NotEmpty(t, result.Error)
+}
+
+func TestWaitReady(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	result, err := WaitReady(context.Background(), server.URL, "shop.com", Check{}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, result.Healthy)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	_, err = WaitReady(context.Background(), down.URL, "shop.com", Check{}, 50*time.Millisecond, 10*time.Millisecond)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "did not become healthy")
+}
+
+func TestCheckValidate(t *testing.T) {
+	assert.NoError(t, Check{}.Validate())
+	assert.NoError(t, Check{Path: "/", ExpectedStatus: 204, Timeout: "3s"}.Validate())
+	assert.Error(t, Check{Timeout: "soon"}.Validate())
+	assert.Error(t, Check{ExpectedStatus: 42}.Validate())
+}
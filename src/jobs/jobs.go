@@ -0,0 +1,298 @@
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+)
+
+// Job types
+const (
+	TypeCreateSite = "site.create"
+	TypeDeleteSite = "site.delete"
+	TypeStartSite  = "site.start"
+	TypeStopSite   = "site.stop"
+	TypeDeploy     = "site.deploy"
+	TypeBackup     = "site.backup"
+)
+
+// Types lists every job type the worker can run
+var Types = []string{TypeCreateSite, TypeDeleteSite, TypeStartSite, TypeStopSite, TypeDeploy, TypeBackup}
+
+// State is the state of a job or of one of its steps
+type State string
+
+const (
+	Queued    State = "queued"
+	Running   State = "running"
+	Succeeded State = "succeeded"
+	Failed    State = "failed"
+	Canceled  State = "canceled"
+)
+
+// Done reports whether the state is final
+func (s State) Done() bool {
+	return s == Succeeded || s == Failed || s == Canceled
+}
+
+// ErrNotFound is returned when no job has the requested ID
+var ErrNotFound = errors.New("job not found")
+
+// ErrFinished is returned when cancelling a job that already finished
+var ErrFinished = errors.New("job already finished")
+
+var idPattern = regexp.MustCompile(`^[0-9]{14}-[0-9a-f]{8}$`)
+
+// Step is one stage of a job, such as starting containers or issuing a certificate
+type Step struct {
+	Name       string     `json:"name"`
+	State      State      `json:"state"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Job is a queued or finished operation. Jobs are kept as JSON files next to
+// their logs in Dir.
+type Job struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Site       string          `json:"site,omitempty"`
+	State      State           `json:"state"`
+	Params     json.RawMessage `json:"params,omitempty"`
+	CommandID  string          `json:"command_id,omitempty"`
+	Steps      []Step          `json:"steps,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	LogPath    string          `json:"log_path"`
+}
+
+// Dir returns the directory holding jobs and their logs
+func Dir() string {
+	return filepath.Join(common.ServicesDir, "jobs")
+}
+
+func jobPath(id string) string {
+	return filepath.Join(Dir(), id+".json")
+}
+
+func cancelPath(id string) string {
+	return filepath.Join(Dir(), id+".cancel")
+}
+
+func claimPath(id string) string {
+	return filepath.Join(Dir(), id+".claim")
+}
+
+// Spec describes a job to queue
+type Spec struct {
+	Type string
+	Site string
+	// Params is stored as JSON and handed to the job when it runs
+	Params interface{}
+	// CommandID is the PloyCloud command the job carries out. Each command is
+	// only queued once, however often it is delivered.
+	CommandID string
+}
+
+// New queues a job
+func New(spec Spec) (*Job, error) {
+	known := false
+	for _, t := range Types {
+		known = known || t == spec.Type
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown job type %q", spec.Type)
+	}
+
+	if spec.CommandID != "" {
+		list, err := List()
+		if err != nil {
+			return nil, err
+		}
+		for _, job := range list {
+			if job.CommandID == spec.CommandID {
+				return job, nil
+			}
+		}
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	id := now.Format("20060102150405") + "-" + hex.EncodeToString(suffix)
+
+	job := &Job{
+		ID:        id,
+		Type:      spec.Type,
+		Site:      spec.Site,
+		State:     Queued,
+		CommandID: spec.CommandID,
+		CreatedAt: now,
+		LogPath:   filepath.Join(Dir(), id+".log"),
+	}
+	if spec.Params != nil {
+		data, err := json.Marshal(spec.Params)
+		if err != nil {
+			return nil, err
+		}
+		job.Params = data
+	}
+	return job, job.Save()
+}
+
+// Save writes the job, replacing the previous version atomically
+func (j *Job) Save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(Dir(), 0700); err != nil {
+		return fmt.Errorf("failed to create jobs directory: %v", err)
+	}
+
+	// Parameters may hold database passwords, so jobs are only readable by the owner
+	tmp, err := os.CreateTemp(Dir(), "."+j.ID+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), jobPath(j.ID))
+}
+
+// Load returns the job with the given ID
+func Load(id string) (*Job, error) {
+	if !idPattern.MatchString(id) {
+		return nil, fmt.Errorf("%s: %w", id, ErrNotFound)
+	}
+	data, err := os.ReadFile(jobPath(id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("invalid job %s: %v", id, err)
+	}
+	return &job, nil
+}
+
+// List returns every job, oldest first
+func List() ([]*Job, error) {
+	entries, err := os.ReadDir(Dir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Job
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !idPattern.MatchString(id) {
+			continue
+		}
+		job, err := Load(id)
+		if errors.Is(err, ErrNotFound) {
+			// Removed since the directory was read
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, job)
+	}
+
+	sort.SliceStable(list, func(i, k int) bool { return list[i].CreatedAt.Before(list[k].CreatedAt) })
+	return list, nil
+}
+
+// StartStep finishes the running step and starts the next one
+func (j *Job) StartStep(name string) error {
+	now := time.Now().UTC()
+	j.finishStep(Succeeded, now)
+	j.Steps = append(j.Steps, Step{Name: name, State: Running, StartedAt: now})
+	return j.Save()
+}
+
+func (j *Job) finishStep(state State, now time.Time) {
+	if n := len(j.Steps); n > 0 && j.Steps[n-1].State == Running {
+		j.Steps[n-1].State = state
+		j.Steps[n-1].FinishedAt = &now
+	}
+}
+
+// Finish records the outcome of the job
+func (j *Job) Finish(state State, err error) {
+	now := time.Now().UTC()
+	j.finishStep(state, now)
+	j.State = state
+	j.FinishedAt = &now
+	if err != nil && j.Error == "" {
+		j.Error = err.Error()
+	}
+}
+
+// Duration returns how long the job ran, or has been running so far
+func (j *Job) Duration(now time.Time) time.Duration {
+	if j.StartedAt == nil {
+		return 0
+	}
+	if j.FinishedAt != nil {
+		return j.FinishedAt.Sub(*j.StartedAt)
+	}
+	return now.Sub(*j.StartedAt)
+}
+
+// Cancel asks for a job to be stopped. Queued jobs are cancelled right away;
+// running jobs are stopped by the worker.
+func Cancel(id string) (*Job, error) {
+	job, err := Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.State.Done() {
+		return job, fmt.Errorf("%s: %w", id, ErrFinished)
+	}
+
+	if err := os.WriteFile(cancelPath(id), nil, 0600); err != nil {
+		return nil, err
+	}
+	if job.State == Queued {
+		job.Finish(Canceled, nil)
+		if err := job.Save(); err != nil {
+			return nil, err
+		}
+	}
+	return job, nil
+}
+
+// CancelRequested reports whether Cancel was called for the job
+func CancelRequested(id string) bool {
+	_, err := os.Stat(cancelPath(id))
+	return err == nil
+}
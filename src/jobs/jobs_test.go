@@ -0,0 +1,260 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupJobsTest(t *testing.T) {
+	oldServicesDir := common.ServicesDir
+	common.ServicesDir = t.TempDir()
+	t.Cleanup(func() { common.ServicesDir = oldServicesDir })
+}
+
+func TestJobStore(t *testing.T) {
+	setupJobsTest(t)
+
+	_, err := New(Spec{Type: "site.explode", Site: "shop.com"})
+	assert.Error(t, err)
+
+	first, err := New(Spec{Type: TypeBackup, Site: "shop.com"})
+	assert.NoError(t, err)
+	second, err := New(Spec{Type: TypeDeploy, Site: "shop.com", Params: map[string]string{"repo": "https://example.com/shop.git"}})
+	assert.NoError(t, err)
+
+	loaded, err := Load(second.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Queued, loaded.State)
+	assert.JSONEq(t, `{"repo": "https://example.com/shop.git"}`, string(loaded.Params))
+
+	assert.NoError(t, loaded.StartStep("clone"))
+	assert.NoError(t, loaded.StartStep("wait for health check"))
+	loaded.Finish(Failed, errors.New("site is not healthy"))
+	assert.NoError(t, loaded.Save())
+
+	loaded, err = Load(second.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, loaded.Steps, 2) {
+		assert.Equal(t, Succeeded, loaded.Steps[0].State)
+		assert.Equal(t, Failed, loaded.Steps[1].State)
+	}
+	assert.Equal(t, "site is not healthy", loaded.Error)
+
+	list, err := List()
+	assert.NoError(t, err)
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, first.ID, list[0].ID)
+	}
+
+	_, err = Load("../../etc/passwd")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestCommandsAreQueuedOnce(t *testing.T) {
+	setupJobsTest(t)
+
+	first, err := New(Spec{Type: TypeBackup, Site: "shop.com", CommandID: "cmd-1"})
+	assert.NoError(t, err)
+	again, err := New(Spec{Type: TypeBackup, Site: "shop.com", CommandID: "cmd-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, again.ID)
+
+	other, err := New(Spec{Type: TypeBackup, Site: "shop.com", CommandID: "cmd-2"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.ID, other.ID)
+}
+
+func TestCancelQueuedJob(t *testing.T) {
+	setupJobsTest(t)
+
+	job, err := New(Spec{Type: TypeBackup, Site: "shop.com"})
+	assert.NoError(t, err)
+
+	job, err = Cancel(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Canceled, job.State)
+	assert.True(t, CancelRequested(job.ID))
+
+	_, err = Cancel(job.ID)
+	assert.ErrorIs(t, err, ErrFinished)
+}
+
+// runWorker starts a worker and returns a function that stops it
+func runWorker(t *testing.T, run Runner) (*Worker, func()) {
+	worker := NewWorker(run)
+	worker.PollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- worker.Run(ctx) }()
+	return worker, func() {
+		cancel()
+		assert.NoError(t, <-done)
+	}
+}
+
+func waitForState(t *testing.T, id string, state State) *Job {
+	var job *Job
+	assert.Eventually(t, func() bool {
+		var err error
+		job, err = Load(id)
+		return err == nil && job.State == state
+	}, 5*time.Second, 10*time.Millisecond)
+	return job
+}
+
+func TestWorkerSerializesJobsPerSite(t *testing.T) {
+	setupJobsTest(t)
+
+	var mu sync.Mutex
+	running := make(map[string]int)
+	maxRunning := make(map[string]int)
+	var total, maxTotal int
+	run := func(ctx context.Context, job *Job, log io.Writer) error {
+		mu.Lock()
+		running[job.Site]++
+		total++
+		if running[job.Site] > maxRunning[job.Site] {
+			maxRunning[job.Site] = running[job.Site]
+		}
+		if total > maxTotal {
+			maxTotal = total
+		}
+		mu.Unlock()
+
+		fmt.Fprintf(log, "backing up %s\n", job.Site)
+		time.Sleep(50 * time.Millisecond)
+
+		mu.Lock()
+		running[job.Site]--
+		total--
+		mu.Unlock()
+		if job.Site == "fail.com" {
+			return errors.New("exit status 1")
+		}
+		return nil
+	}
+
+	var queued []*Job
+	for _, site := range []string{"shop.com", "shop.com", "blog.com", "fail.com"} {
+		job, err := New(Spec{Type: TypeBackup, Site: site})
+		assert.NoError(t, err)
+		queued = append(queued, job)
+	}
+
+	_, stop := runWorker(t, run)
+	defer stop()
+
+	for _, job := range queued[:3] {
+		done := waitForState(t, job.ID, Succeeded)
+		assert.NotNil(t, done.StartedAt)
+		assert.NotNil(t, done.FinishedAt)
+	}
+	failed := waitForState(t, queued[3].ID, Failed)
+	assert.Equal(t, "exit status 1", failed.Error)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, maxRunning["shop.com"])
+	assert.Greater(t, maxTotal, 1)
+}
+
+func TestWorkerCancelsRunningJob(t *testing.T) {
+	setupJobsTest(t)
+
+	started := make(chan struct{})
+	run := func(ctx context.Context, job *Job, log io.Writer) error {
+		job.StartStep("start containers")
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	job, err := New(Spec{Type: TypeStartSite, Site: "shop.com"})
+	assert.NoError(t, err)
+	_, stop := runWorker(t, run)
+	defer stop()
+
+	<-started
+	_, err = Cancel(job.ID)
+	assert.NoError(t, err)
+
+	job = waitForState(t, job.ID, Canceled)
+	assert.Empty(t, job.Error)
+	if assert.Len(t, job.Steps, 1) {
+		assert.Equal(t, Canceled, job.Steps[0].State)
+	}
+}
+
+func TestWorkerFailsInterruptedJobs(t *testing.T) {
+	setupJobsTest(t)
+
+	job, err := New(Spec{Type: TypeDeploy, Site: "shop.com"})
+	assert.NoError(t, err)
+	job.State = Running
+	assert.NoError(t, job.Save())
+
+	_, stop := runWorker(t, func(ctx context.Context, job *Job, log io.Writer) error {
+		t.Error("interrupted jobs must not run again")
+		return nil
+	})
+	defer stop()
+
+	job = waitForState(t, job.ID, Failed)
+	assert.Contains(t, job.Error, "interrupted")
+}
+
+func TestOnlyOneWorkerRuns(t *testing.T) {
+	setupJobsTest(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	job, err := New(Spec{Type: TypeDeploy, Site: "shop.com"})
+	assert.NoError(t, err)
+	_, stop := runWorker(t, func(ctx context.Context, job *Job, log io.Writer) error {
+		close(started)
+		<-release
+		return nil
+	})
+	defer stop()
+	<-started
+
+	// A second worker neither fails the running job nor starts it again
+	err = NewWorker(func(ctx context.Context, job *Job, log io.Writer) error {
+		t.Error("the job must only run once")
+		return nil
+	}).Run(context.Background())
+	assert.ErrorIs(t, err, ErrWorkerRunning)
+
+	job, err = Load(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Running, job.State)
+	close(release)
+	waitForState(t, job.ID, Succeeded)
+}
+
+func TestClaim(t *testing.T) {
+	setupJobsTest(t)
+	assert.NoError(t, os.MkdirAll(Dir(), 0700))
+
+	claimed, err := claim("20261001120000-0a1b2c3d")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	claimed, err = claim("20261001120000-0a1b2c3d")
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+	// Claims left by a worker that stopped are dropped by the next one
+	assert.NoError(t, failInterrupted())
+	claimed, err = claim("20261001120000-0a1b2c3d")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+}
@@ -0,0 +1,249 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrWorkerRunning is returned by Run when another worker already processes the jobs
+var ErrWorkerRunning = errors.New("another job worker is running")
+
+// Runner carries out a job, writing its output to log. It must return soon
+// after ctx is cancelled.
+type Runner func(ctx context.Context, job *Job, log io.Writer) error
+
+// Worker runs queued jobs. Jobs for different sites run in parallel; jobs for the
+// same site run one after another in the order they were queued.
+type Worker struct {
+	// PollInterval is how often the worker looks for new jobs and cancel requests
+	PollInterval time.Duration
+
+	run  Runner
+	wake chan struct{}
+	wg   sync.WaitGroup
+
+	mu    sync.Mutex
+	sites map[string]bool
+}
+
+// NewWorker returns a worker that carries out jobs with run
+func NewWorker(run Runner) *Worker {
+	return &Worker{
+		PollInterval: time.Second,
+		run:          run,
+		wake:         make(chan struct{}, 1),
+		sites:        make(map[string]bool),
+	}
+}
+
+// Wake makes the worker look for queued jobs without waiting for the next poll
+func (w *Worker) Wake() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run processes jobs until ctx is cancelled, then waits for running jobs to stop.
+// Only one worker runs at a time, so Run holds a lock on Dir while it runs and
+// fails with ErrWorkerRunning when another worker holds it. Jobs left running by
+// a previous worker are marked as failed first.
+func (w *Worker) Run(ctx context.Context) error {
+	unlock, err := lockDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := failInterrupted(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(w.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := w.dispatch(ctx); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			w.wg.Wait()
+			return nil
+		case <-ticker.C:
+		case <-w.wake:
+		}
+	}
+}
+
+// lockDir takes an exclusive lock on the jobs directory for the worker's lifetime
+func lockDir() (func(), error) {
+	if err := os.MkdirAll(Dir(), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create jobs directory: %v", err)
+	}
+	f, err := os.Open(Dir())
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrWorkerRunning
+		}
+		return nil, fmt.Errorf("failed to lock jobs directory: %v", err)
+	}
+	return func() { f.Close() }, nil
+}
+
+// claim marks a queued job as taken by this worker. Creating the claim file is
+// atomic, so a job is never started twice.
+func claim(id string) (bool, error) {
+	f, err := os.OpenFile(claimPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, f.Close()
+}
+
+// failInterrupted marks jobs that were running when the previous worker stopped
+// and drops the claims it left behind
+func failInterrupted() error {
+	list, err := List()
+	if err != nil {
+		return err
+	}
+	for _, job := range list {
+		if job.State == Running {
+			job.Finish(Failed, errors.New("interrupted: the worker stopped while the job was running"))
+			if err := job.Save(); err != nil {
+				return err
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(Dir())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".claim") {
+			if err := os.Remove(filepath.Join(Dir(), entry.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *Worker) dispatch(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	list, err := List()
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, job := range list {
+		if job.State != Queued || (job.Site != "" && w.sites[job.Site]) {
+			continue
+		}
+		if CancelRequested(job.ID) {
+			continue
+		}
+		claimed, err := claim(job.ID)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+
+		now := time.Now().UTC()
+		job.State = Running
+		job.StartedAt = &now
+		if err := job.Save(); err != nil {
+			return err
+		}
+		if job.Site != "" {
+			w.sites[job.Site] = true
+		}
+		w.wg.Add(1)
+		go w.execute(ctx, job)
+	}
+	return nil
+}
+
+func (w *Worker) execute(ctx context.Context, job *Job) {
+	id, site := job.ID, job.Site
+	defer w.wg.Done()
+	defer w.Wake()
+	defer func() {
+		w.mu.Lock()
+		delete(w.sites, site)
+		w.mu.Unlock()
+	}()
+	// The job is finished by the time the claim goes
+	defer os.Remove(claimPath(id))
+
+	log, err := os.OpenFile(job.LogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		job.Finish(Failed, err)
+		job.Save()
+		return
+	}
+	defer log.Close()
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	watching := make(chan struct{})
+	defer func() {
+		cancel()
+		<-watching
+	}()
+	go func() {
+		defer close(watching)
+		ticker := time.NewTicker(w.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-jobCtx.Done():
+				return
+			case <-ticker.C:
+				if CancelRequested(id) {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	runErr := w.run(jobCtx, job, log)
+
+	// Pick up the steps and error the job recorded while it ran
+	if saved, err := Load(id); err == nil {
+		job = saved
+	}
+	switch {
+	case CancelRequested(id):
+		job.Finish(Canceled, nil)
+	case runErr != nil && ctx.Err() != nil:
+		job.Finish(Failed, errors.New("interrupted: the worker stopped while the job was running"))
+	case runErr != nil:
+		job.Finish(Failed, runErr)
+	default:
+		job.Finish(Succeeded, nil)
+	}
+	job.Save()
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrite(t *testing.T) {
+	up := NewGauge("ploy_site_up", "Whether the site passes its health check")
+	up.Add(1, "site", "shop.com")
+	up.Add(Bool(false), "site", `odd"name\`, "kind", "files")
+
+	latency := NewGauge("ploy_site_health_latency_seconds", "Health check latency\nin seconds")
+	latency.Add(0.125)
+	latency.Add(math.NaN(), "site", "blog.com")
+
+	empty := NewGauge("ploy_unused", "Never set")
+
+	var out strings.Builder
+	assert.NoError(t, Write(&out, []*Metric{up, empty, latency}))
+	assert.Equal(t, `# HELP ploy_site_up Whether the site passes its health check
+# TYPE ploy_site_up gauge
+ploy_site_up{site="shop.com"} 1
+ploy_site_up{kind="files",site="odd\"name\\"} 0
+# HELP ploy_site_health_latency_seconds Health check latency\nin seconds
+# TYPE ploy_site_health_latency_seconds gauge
+ploy_site_health_latency_seconds 0.125
+ploy_site_health_latency_seconds{site="blog.com"} NaN
+`, out.String())
+}
+
+func TestFormatValue(t *testing.T) {
+	assert.Equal(t, "1.5e-07", formatValue(1.5e-7))
+	assert.Equal(t, "1700000001", formatValue(1700000001))
+	assert.Equal(t, "+Inf", formatValue(math.Inf(1)))
+	assert.Equal(t, "-3", formatValue(-3))
+}
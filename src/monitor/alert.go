@@ -0,0 +1,195 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Channels are the destinations alerts are sent to
+type Channels struct {
+	Webhooks []string `yaml:"webhooks,omitempty"`
+	Slack    []string `yaml:"slack,omitempty"`
+	Email    *SMTP    `yaml:"email,omitempty"`
+}
+
+// SMTP holds the settings for email alerts. Username and password are optional.
+type SMTP struct {
+	Host     string   `yaml:"host"`
+	Port     int      `yaml:"port"`
+	Username string   `yaml:"username,omitempty"`
+	Password string   `yaml:"password,omitempty"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// Notifier delivers an event to one alert channel
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, event Event) error
+}
+
+// Notifiers returns a notifier for every configured channel
+func (c Channels) Notifiers() []Notifier {
+	var notifiers []Notifier
+	for _, url := range c.Webhooks {
+		notifiers = append(notifiers, &Webhook{URL: url})
+	}
+	for _, url := range c.Slack {
+		notifiers = append(notifiers, &Slack{URL: url})
+	}
+	if c.Email != nil {
+		notifiers = append(notifiers, &Email{SMTP: *c.Email})
+	}
+	return notifiers
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Webhook posts the event as JSON
+type Webhook struct {
+	URL string
+}
+
+func (w *Webhook) Name() string { return "webhook " + w.URL }
+
+func (w *Webhook) Notify(ctx context.Context, event Event) error {
+	payload := struct {
+		Event
+		Message string `json:"message"`
+	}{event, event.Message()}
+	return postJSON(ctx, w.URL, payload)
+}
+
+// Slack posts the event to a Slack compatible incoming webhook
+type Slack struct {
+	URL string
+}
+
+func (s *Slack) Name() string { return "slack" }
+
+func (s *Slack) Notify(ctx context.Context, event Event) error {
+	return postJSON(ctx, s.URL, map[string]string{"text": event.Message()})
+}
+
+func postJSON(ctx context.Context, url string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	return nil
+}
+
+// Email sends the event over SMTP
+type Email struct {
+	SMTP
+}
+
+func (e *Email) Name() string { return "email " + strings.Join(e.To, ",") }
+
+func (e *Email) Notify(ctx context.Context, event Event) error {
+	if e.Host == "" || e.From == "" || len(e.To) == 0 {
+		return fmt.Errorf("email alerts need host, from and to")
+	}
+	port := e.Port
+	if port == 0 {
+		port = 25
+	}
+	addr := net.JoinHostPort(e.Host, strconv.Itoa(port))
+
+	var auth smtp.Auth
+	if e.Username != "" {
+		auth = smtp.PlainAuth("", e.Username, e.Password, e.Host)
+	}
+
+	subject := event.Message()
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", e.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&body, "Date: %s\r\n", event.At.Format(time.RFC1123Z))
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&body, "%s\r\n\r\nTarget: %s\r\nState: %s -> %s\r\nAt: %s\r\n",
+		subject, event.Target, event.From, event.To, event.At.Format(time.RFC3339))
+
+	return sendMail(ctx, addr, e.Host, auth, e.From, e.To, []byte(body.String()))
+}
+
+// sendMail is smtp.SendMail bounded by ctx: the connection is dialed with the
+// context and every read and write after that fails once its deadline passes
+func sendMail(ctx context.Context, addr, host string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	// A cancelled context interrupts a conversation that is still going on
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
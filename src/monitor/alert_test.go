@@ -0,0 +1,137 @@
+package monitor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testEvent = Event{Target: "shop.com", From: StateUp, To: StateDown, At: time.Now(), Detail: "unexpected status 502"}
+
+func TestWebhookAndSlack(t *testing.T) {
+	var received []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		received = append(received, payload)
+	}))
+	defer server.Close()
+
+	channels := Channels{Webhooks: []string{server.URL}, Slack: []string{server.URL}}
+	for _, n := range channels.Notifiers() {
+		assert.NoError(t, n.Notify(context.Background(), testEvent))
+	}
+
+	assert.Len(t, received, 2)
+	assert.Equal(t, "shop.com", received[0]["target"])
+	assert.Equal(t, "down", received[0]["to"])
+	assert.Equal(t, "[ploy] shop.com is DOWN: unexpected status 502", received[0]["message"])
+	assert.Equal(t, "[ploy] shop.com is DOWN: unexpected status 502", received[1]["text"])
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	assert.Error(t, (&Webhook{URL: failing.URL}).Notify(context.Background(), testEvent))
+}
+
+// smtpStandIn accepts a single message and returns its DATA section
+func smtpStandIn(t *testing.T) (string, int, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	messages := make(chan string, 1)
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP stand-in")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case cmd == "DATA":
+				reply("354 end with .")
+				var data strings.Builder
+				for {
+					l, _ := r.ReadString('\n')
+					if l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				messages <- data.String()
+				reply("250 OK")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return host, p, messages
+}
+
+func TestEmail(t *testing.T) {
+	host, port, messages := smtpStandIn(t)
+
+	email := &Email{SMTP{Host: host, Port: port, From: "ploy@example.com", To: []string{"ops@example.com"}}}
+	assert.NoError(t, email.Notify(context.Background(), testEvent))
+
+	select {
+	case message := <-messages:
+		assert.Contains(t, message, "Subject: [ploy] shop.com is DOWN: unexpected status 502")
+		assert.Contains(t, message, "To: ops@example.com")
+		assert.Contains(t, message, "State: up -> down")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+
+	assert.Error(t, (&Email{SMTP{Host: host}}).Notify(context.Background(), testEvent))
+}
+
+func TestEmailStopsAtDeadline(t *testing.T) {
+	// A server that accepts the connection but never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	email := &Email{SMTP{Host: host, Port: p, From: "ploy@example.com", To: []string{"ops@example.com"}}}
+	assert.Error(t, email.Notify(ctx, testEvent))
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
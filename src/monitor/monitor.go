@@ -0,0 +1,295 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"gopkg.in/yaml.v2"
+)
+
+// State is the last confirmed state of a monitored target
+type State string
+
+const (
+	StateUnknown State = "unknown"
+	StateUp      State = "up"
+	StateDown    State = "down"
+)
+
+// Config is read from ~/.ploy/monitor.yaml
+type Config struct {
+	Interval          string        `yaml:"interval"`
+	FailureThreshold  int           `yaml:"failure_threshold"`
+	RecoveryThreshold int           `yaml:"recovery_threshold"`
+	Channels          Channels      `yaml:"channels"`
+	Maintenance       []Maintenance `yaml:"maintenance,omitempty"`
+}
+
+// Maintenance silences alerts for a target, or for everything when Target is
+// empty, between Start and End
+type Maintenance struct {
+	Target string    `yaml:"target,omitempty"`
+	Start  time.Time `yaml:"start"`
+	End    time.Time `yaml:"end"`
+}
+
+// DefaultConfig returns the configuration used when monitor.yaml does not exist
+func DefaultConfig() Config {
+	return Config{Interval: "30s", FailureThreshold: 3, RecoveryThreshold: 2}
+}
+
+// Dir holds the monitor's state and event log
+func Dir() string {
+	return filepath.Join(common.ServicesDir, "monitor")
+}
+
+// ConfigPath returns the location of the monitor configuration
+func ConfigPath() string {
+	return filepath.Join(common.ServicesDir, "monitor.yaml")
+}
+
+// LoadConfig reads the monitor configuration, falling back to the defaults for
+// anything not set
+func LoadConfig() (Config, error) {
+	config := DefaultConfig()
+
+	data, err := os.ReadFile(ConfigPath())
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid monitor configuration: %v", err)
+	}
+
+	defaults := DefaultConfig()
+	if config.Interval == "" {
+		config.Interval = defaults.Interval
+	}
+	if config.FailureThreshold < 1 {
+		config.FailureThreshold = defaults.FailureThreshold
+	}
+	if config.RecoveryThreshold < 1 {
+		config.RecoveryThreshold = defaults.RecoveryThreshold
+	}
+	if _, err := time.ParseDuration(config.Interval); err != nil {
+		return config, fmt.Errorf("invalid monitor interval %q", config.Interval)
+	}
+	return config, nil
+}
+
+// SaveConfig writes the monitor configuration. It may hold SMTP credentials, so
+// it is only readable by the owner.
+func SaveConfig(config Config) error {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := runner.MkdirAll(filepath.Dir(ConfigPath()), 0755); err != nil {
+		return err
+	}
+	return runner.WriteFile(ConfigPath(), data, 0600)
+}
+
+// InMaintenance reports whether alerts for a target are silenced at the given time
+func (c Config) InMaintenance(target string, now time.Time) bool {
+	for _, m := range c.Maintenance {
+		if (m.Target == "" || m.Target == target) && !now.Before(m.Start) && now.Before(m.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// PruneMaintenance drops windows that ended before now
+func (c *Config) PruneMaintenance(now time.Time) {
+	windows := c.Maintenance[:0]
+	for _, m := range c.Maintenance {
+		if now.Before(m.End) {
+			windows = append(windows, m)
+		}
+	}
+	c.Maintenance = windows
+}
+
+// Event is a confirmed state transition of a target
+type Event struct {
+	Target     string    `json:"target"`
+	From       State     `json:"from"`
+	To         State     `json:"to"`
+	At         time.Time `json:"at"`
+	Detail     string    `json:"detail,omitempty"`
+	Downtime   string    `json:"downtime,omitempty"`
+	Suppressed bool      `json:"suppressed,omitempty"`
+}
+
+// Message is the human readable text sent to alert channels
+func (e Event) Message() string {
+	switch e.To {
+	case StateDown:
+		if e.Detail != "" {
+			return fmt.Sprintf("[ploy] %s is DOWN: %s", e.Target, e.Detail)
+		}
+		return fmt.Sprintf("[ploy] %s is DOWN", e.Target)
+	case StateUp:
+		if e.Downtime != "" {
+			return fmt.Sprintf("[ploy] %s is back UP after %s", e.Target, e.Downtime)
+		}
+		return fmt.Sprintf("[ploy] %s is UP", e.Target)
+	}
+	return fmt.Sprintf("[ploy] %s is %s", e.Target, e.To)
+}
+
+// TargetState is what the tracker knows about one target
+type TargetState struct {
+	State       State     `json:"state"`
+	Since       time.Time `json:"since"`
+	Failures    int       `json:"failures"`
+	Successes   int       `json:"successes"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastChecked time.Time `json:"last_checked"`
+}
+
+// Tracker turns individual check results into state transitions. A target only
+// changes state after FailureThreshold consecutive failures or RecoveryThreshold
+// consecutive successes, so a single flapping check does not cause an alert.
+type Tracker struct {
+	FailureThreshold  int                     `json:"-"`
+	RecoveryThreshold int                     `json:"-"`
+	Targets           map[string]*TargetState `json:"targets"`
+}
+
+// NewTracker returns an empty tracker using the thresholds from config
+func NewTracker(config Config) *Tracker {
+	return &Tracker{
+		FailureThreshold:  config.FailureThreshold,
+		RecoveryThreshold: config.RecoveryThreshold,
+		Targets:           make(map[string]*TargetState),
+	}
+}
+
+// Observe records a check result and returns the transition it confirmed, if any.
+// The first successful check of a new target marks it up without an event.
+func (t *Tracker) Observe(target string, healthy bool, detail string, now time.Time) *Event {
+	s, ok := t.Targets[target]
+	if !ok {
+		s = &TargetState{State: StateUnknown, Since: now}
+		t.Targets[target] = s
+	}
+	s.LastChecked = now
+
+	if healthy {
+		s.Successes++
+		s.Failures = 0
+		s.LastError = ""
+		if s.State == StateUnknown {
+			s.State, s.Since = StateUp, now
+			return nil
+		}
+		if s.State == StateDown && s.Successes >= t.RecoveryThreshold {
+			event := &Event{Target: target, From: StateDown, To: StateUp, At: now, Downtime: now.Sub(s.Since).Round(time.Second).String()}
+			s.State, s.Since = StateUp, now
+			return event
+		}
+		return nil
+	}
+
+	s.Failures++
+	s.Successes = 0
+	s.LastError = detail
+	if s.State != StateDown && s.Failures >= t.FailureThreshold {
+		event := &Event{Target: target, From: s.State, To: StateDown, At: now, Detail: detail}
+		s.State, s.Since = StateDown, now
+		return event
+	}
+	return nil
+}
+
+// Forget drops targets that are no longer monitored
+func (t *Tracker) Forget(keep []string) {
+	wanted := make(map[string]bool, len(keep))
+	for _, name := range keep {
+		wanted[name] = true
+	}
+	for name := range t.Targets {
+		if !wanted[name] {
+			delete(t.Targets, name)
+		}
+	}
+}
+
+// Names returns the tracked targets in alphabetical order
+func (t *Tracker) Names() []string {
+	names := make([]string, 0, len(t.Targets))
+	for name := range t.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func statePath() string {
+	return filepath.Join(Dir(), "state.json")
+}
+
+func eventsPath() string {
+	return filepath.Join(Dir(), "events.log")
+}
+
+// LoadTracker restores the tracker saved by a previous run
+func LoadTracker(config Config) (*Tracker, error) {
+	tracker := NewTracker(config)
+
+	data, err := os.ReadFile(statePath())
+	if os.IsNotExist(err) {
+		return tracker, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, tracker); err != nil {
+		return nil, fmt.Errorf("invalid monitor state: %v", err)
+	}
+	if tracker.Targets == nil {
+		tracker.Targets = make(map[string]*TargetState)
+	}
+	return tracker, nil
+}
+
+// Save stores the tracker so state survives restarts of the monitor
+func (t *Tracker) Save() error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(Dir(), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(statePath(), data, 0644)
+}
+
+// RecordEvent appends a transition to the event log
+func RecordEvent(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(Dir(), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(eventsPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
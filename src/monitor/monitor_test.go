@@ -0,0 +1,121 @@
+package monitor
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupMonitorTest(t *testing.T) {
+	oldServicesDir := common.ServicesDir
+	common.SetServicesDir(t.TempDir())
+	t.Cleanup(func() { common.SetServicesDir(oldServicesDir) })
+}
+
+func TestTrackerSuppressesFlapping(t *testing.T) {
+	tracker := NewTracker(DefaultConfig())
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	tick := func() time.Time {
+		now = now.Add(30 * time.Second)
+		return now
+	}
+
+	// First success marks the target up without an alert
+	assert.Nil(t, tracker.Observe("shop.com", true, "", tick()))
+	assert.Equal(t, StateUp, tracker.Targets["shop.com"].State)
+
+	// Two failures followed by a success do not alert
+	assert.Nil(t, tracker.Observe("shop.com", false, "502", tick()))
+	assert.Nil(t, tracker.Observe("shop.com", false, "502", tick()))
+	assert.Nil(t, tracker.Observe("shop.com", true, "", tick()))
+	assert.Equal(t, StateUp, tracker.Targets["shop.com"].State)
+
+	// Three consecutive failures do
+	tracker.Observe("shop.com", false, "502", tick())
+	tracker.Observe("shop.com", false, "502", tick())
+	event := tracker.Observe("shop.com", false, "unexpected status 502", tick())
+	if assert.NotNil(t, event) {
+		assert.Equal(t, StateUp, event.From)
+		assert.Equal(t, StateDown, event.To)
+		assert.Equal(t, "[ploy] shop.com is DOWN: unexpected status 502", event.Message())
+	}
+	assert.Nil(t, tracker.Observe("shop.com", false, "502", tick()))
+
+	// Recovery needs two consecutive successes
+	assert.Nil(t, tracker.Observe("shop.com", true, "", tick()))
+	assert.Nil(t, tracker.Observe("shop.com", false, "502", tick()))
+	assert.Nil(t, tracker.Observe("shop.com", true, "", tick()))
+	event = tracker.Observe("shop.com", true, "", tick())
+	if assert.NotNil(t, event) {
+		assert.Equal(t, StateUp, event.To)
+		assert.Equal(t, "2m30s", event.Downtime)
+		assert.Equal(t, "[ploy] shop.com is back UP after 2m30s", event.Message())
+	}
+}
+
+func TestTrackerInitiallyDown(t *testing.T) {
+	tracker := NewTracker(Config{FailureThreshold: 1, RecoveryThreshold: 1})
+	event := tracker.Observe("service:mysql", false, "not running", time.Now())
+	if assert.NotNil(t, event) {
+		assert.Equal(t, StateUnknown, event.From)
+		assert.Equal(t, StateDown, event.To)
+	}
+
+	tracker.Forget([]string{"shop.com"})
+	assert.Empty(t, tracker.Names())
+}
+
+func TestMaintenance(t *testing.T) {
+	start := time.Date(2026, 10, 1, 22, 0, 0, 0, time.UTC)
+	config := Config{Maintenance: []Maintenance{
+		{Target: "shop.com", Start: start, End: start.Add(time.Hour)},
+		{Start: start.Add(24 * time.Hour), End: start.Add(25 * time.Hour)},
+	}}
+
+	assert.True(t, config.InMaintenance("shop.com", start.Add(30*time.Minute)))
+	assert.False(t, config.InMaintenance("blog.com", start.Add(30*time.Minute)))
+	assert.False(t, config.InMaintenance("shop.com", start.Add(time.Hour)))
+	assert.True(t, config.InMaintenance("blog.com", start.Add(24*time.Hour)))
+
+	config.PruneMaintenance(start.Add(2 * time.Hour))
+	assert.Len(t, config.Maintenance, 1)
+}
+
+func TestConfigAndStatePersistence(t *testing.T) {
+	setupMonitorTest(t)
+
+	config, err := LoadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultConfig(), config)
+
+	config.FailureThreshold = 5
+	config.Channels.Slack = []string{"https://hooks.example.com/abc"}
+	assert.NoError(t, SaveConfig(config))
+
+	loaded, err := LoadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, loaded.FailureThreshold)
+	assert.Equal(t, 2, loaded.RecoveryThreshold)
+	assert.Len(t, loaded.Channels.Notifiers(), 1)
+
+	assert.NoError(t, os.WriteFile(ConfigPath(), []byte("interval: often\n"), 0600))
+	_, err = LoadConfig()
+	assert.Error(t, err)
+
+	tracker := NewTracker(loaded)
+	tracker.Observe("shop.com", true, "", time.Now())
+	assert.NoError(t, tracker.Save())
+	assert.NoError(t, RecordEvent(Event{Target: "shop.com", From: StateUp, To: StateDown, At: time.Now()}))
+
+	restored, err := LoadTracker(loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"shop.com"}, restored.Names())
+	assert.Equal(t, 5, restored.FailureThreshold)
+
+	events, err := os.ReadFile(eventsPath())
+	assert.NoError(t, err)
+	assert.Contains(t, string(events), `"to":"down"`)
+}
@@ -0,0 +1,237 @@
+package nginx
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"text/template"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"gopkg.in/yaml.v2"
+)
+
+// TemplateVersion is bumped whenever the vhost template changes in a way existing
+// sites should pick up through `ploy nginx regenerate`
+const TemplateVersion = 3
+
+//go:embed templates/vhost.conf.tmpl
+var vhostTemplate string
+
+var tmpl = template.Must(template.New("vhost").Parse(vhostTemplate))
+
+var headerPattern = regexp.MustCompile(`(?m)^# Managed by ploy \(vhost template v(\d+)\)`)
+
+var upstreamNamePattern = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// Sizes and times as nginx accepts them in the directives the options set
+var (
+	sizePattern = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+	timePattern = regexp.MustCompile(`^[0-9]+(ms|s|m|h|d|w|M|y)?$`)
+)
+
+// Load balancing methods for sites with more than one replica
+const (
+	BalanceLeastConn  = "least_conn"
+	BalanceIPHash     = "ip_hash"
+	BalanceRoundRobin = "round_robin"
+)
+
+// Options are the tunable parts of a site's vhost
+type Options struct {
+	ClientMaxBodySize   string `yaml:"client_max_body_size"`
+	ProxyConnectTimeout string `yaml:"proxy_connect_timeout"`
+	ProxyTimeout        string `yaml:"proxy_timeout"`
+	Gzip                bool   `yaml:"gzip"`
+	Brotli              bool   `yaml:"brotli"`
+	SecurityHeaders     bool   `yaml:"security_headers"`
+	StaticCache         string `yaml:"static_cache"`
+	HTTP2               bool   `yaml:"http2"`
+	LoadBalancing       string `yaml:"load_balancing"`
+	MaxFails            int    `yaml:"max_fails"`
+	FailTimeout         string `yaml:"fail_timeout"`
+}
+
+// Validate checks the options that nginx would otherwise only reject on reload
+func (o Options) Validate() error {
+	switch o.LoadBalancing {
+	case BalanceLeastConn, BalanceIPHash, BalanceRoundRobin:
+	default:
+		return fmt.Errorf("unknown load balancing method %q (use %s, %s or %s)",
+			o.LoadBalancing, BalanceLeastConn, BalanceIPHash, BalanceRoundRobin)
+	}
+	if o.MaxFails < 0 {
+		return fmt.Errorf("max_fails must not be negative")
+	}
+	if !sizePattern.MatchString(o.ClientMaxBodySize) {
+		return fmt.Errorf("invalid client_max_body_size %q (use a size such as 64m)", o.ClientMaxBodySize)
+	}
+	times := map[string]string{
+		"proxy_connect_timeout": o.ProxyConnectTimeout,
+		"proxy_timeout":         o.ProxyTimeout,
+		"fail_timeout":          o.FailTimeout,
+	}
+	for name, value := range times {
+		if !timePattern.MatchString(value) {
+			return fmt.Errorf("invalid %s %q (use a time such as 30s)", name, value)
+		}
+	}
+	switch o.StaticCache {
+	case "", "off", "max", "epoch":
+	default:
+		if !timePattern.MatchString(o.StaticCache) {
+			return fmt.Errorf("invalid static_cache %q (use a time such as 30d, or off)", o.StaticCache)
+		}
+	}
+	return nil
+}
+
+// DefaultOptions returns the options used for sites without overrides
+func DefaultOptions() Options {
+	return Options{
+		ClientMaxBodySize:   "64m",
+		ProxyConnectTimeout: "60s",
+		ProxyTimeout:        "300s",
+		Gzip:                true,
+		Brotli:              false,
+		SecurityHeaders:     true,
+		StaticCache:         "30d",
+		HTTP2:               true,
+		LoadBalancing:       BalanceLeastConn,
+		MaxFails:            3,
+		FailTimeout:         "30s",
+	}
+}
+
+// TLS holds the certificate paths for a vhost served over HTTPS
+type TLS struct {
+	CertPath string
+	KeyPath  string
+}
+
+// Upstream is the pool of replica endpoints (host:port) a site is balanced across
+type Upstream struct {
+	Name    string
+	Servers []string
+}
+
+// UpstreamName returns the nginx upstream block name for a domain
+func UpstreamName(domain string) string {
+	return "ploy_" + upstreamNamePattern.ReplaceAllString(domain, "_")
+}
+
+// Vhost is everything needed to render a site's nginx configuration
+type Vhost struct {
+	Domain string
+	// Aliases are further domains served by the same vhost
+	Aliases     []string
+	Upstream    Upstream
+	AcmeWebroot string
+	CustomDir   string
+	TLS         *TLS
+	Options     Options
+}
+
+// SecurityHeaders returns the add_header arguments of the security headers the
+// vhost sends, none when they are turned off
+func (v Vhost) SecurityHeaders() []string {
+	if !v.Options.SecurityHeaders {
+		return nil
+	}
+	headers := []string{
+		`X-Frame-Options "SAMEORIGIN"`,
+		`X-Content-Type-Options "nosniff"`,
+		`Referrer-Policy "strict-origin-when-cross-origin"`,
+		`X-XSS-Protection "1; mode=block"`,
+	}
+	if v.TLS != nil {
+		headers = append(headers, `Strict-Transport-Security "max-age=31536000"`)
+	}
+	return headers
+}
+
+// Render renders the vhost template for a site
+func Render(v Vhost) (string, error) {
+	if len(v.Upstream.Servers) == 0 {
+		return "", fmt.Errorf("no upstream servers for %s", v.Domain)
+	}
+	if err := v.Options.Validate(); err != nil {
+		return "", err
+	}
+	if v.Upstream.Name == "" {
+		v.Upstream.Name = UpstreamName(v.Domain)
+	}
+
+	var buf bytes.Buffer
+	data := struct {
+		Vhost
+		Header string
+	}{v, fmt.Sprintf("Managed by ploy (vhost template v%d)", TemplateVersion)}
+
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render nginx vhost for %s: %v", v.Domain, err)
+	}
+	return buf.String(), nil
+}
+
+// ManagedVersion returns the template version a vhost was rendered with. ok is
+// false when the file was not written from the template.
+func ManagedVersion(content string) (version int, ok bool) {
+	m := headerPattern.FindStringSubmatch(content)
+	if m == nil {
+		return 0, false
+	}
+	version, _ = strconv.Atoi(m[1])
+	return version, true
+}
+
+// plannedOptions holds the options saved during a dry run, so that the vhost
+// rendered afterwards uses them
+var plannedOptions = map[string]Options{}
+
+func optionsPath(domain string) string {
+	return filepath.Join(common.NginxDir, "sites", domain+".yml")
+}
+
+// LoadOptions returns the vhost options for a domain, with stored overrides
+// applied on top of the defaults
+func LoadOptions(domain string) (Options, error) {
+	if options, ok := plannedOptions[domain]; ok && runner.DryRun {
+		return options, nil
+	}
+	options := DefaultOptions()
+
+	data, err := os.ReadFile(optionsPath(domain))
+	if os.IsNotExist(err) {
+		return options, nil
+	}
+	if err != nil {
+		return options, err
+	}
+
+	if err := yaml.Unmarshal(data, &options); err != nil {
+		return options, fmt.Errorf("invalid nginx options for %s: %v", domain, err)
+	}
+	return options, nil
+}
+
+// SaveOptions stores the vhost options for a domain
+func SaveOptions(domain string, options Options) error {
+	data, err := yaml.Marshal(options)
+	if err != nil {
+		return err
+	}
+
+	if runner.DryRun {
+		plannedOptions[domain] = options
+	}
+	path := optionsPath(domain)
+	if err := runner.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return runner.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,171 @@
+package nginx
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func testVhost() Vhost {
+	return Vhost{
+		Domain:      "example.com",
+		Upstream:    Upstream{Servers: []string{"127.0.0.1:20001"}},
+		AcmeWebroot: "/srv/acme",
+		CustomDir:   "/etc/nginx/ploy/example.com/custom.d",
+		Options:     DefaultOptions(),
+	}
+}
+
+func TestRenderHTTP(t *testing.T) {
+	content, err := Render(testVhost())
+	assert.NoError(t, err)
+
+	assert.Contains(t, content, "server_name example.com;")
+	assert.Contains(t, content, "listen 80;")
+	assert.NotContains(t, content, "listen 443")
+	assert.Contains(t, content, "root /srv/acme;")
+	assert.Contains(t, content, "proxy_pass http://ploy_example_com;")
+	assert.Contains(t, content, "server 127.0.0.1:20001 max_fails=3 fail_timeout=30s;")
+	assert.Contains(t, content, "client_max_body_size 64m;")
+	assert.Contains(t, content, "gzip on;")
+	assert.NotContains(t, content, "brotli on;")
+	assert.Contains(t, content, "X-Content-Type-Options")
+	assert.NotContains(t, content, "Strict-Transport-Security")
+	assert.Contains(t, content, "expires 30d;")
+	assert.Contains(t, content, "include /etc/nginx/ploy/example.com/custom.d/*.conf;")
+}
+
+func TestRenderTLS(t *testing.T) {
+	vhost := testVhost()
+	vhost.TLS = &TLS{CertPath: "/certs/fullchain.pem", KeyPath: "/certs/privkey.pem"}
+
+	content, err := Render(vhost)
+	assert.NoError(t, err)
+	assert.Contains(t, content, "listen 443 ssl http2;")
+	assert.Contains(t, content, "ssl_certificate /certs/fullchain.pem;")
+	assert.Contains(t, content, "return 301 https://$host$request_uri;")
+	assert.Contains(t, content, "Strict-Transport-Security")
+
+	// The static asset location sets its own headers and must repeat these
+	static := content[strings.Index(content, "location ~*"):]
+	static = static[:strings.Index(static, "}")]
+	assert.Contains(t, static, "\t\tadd_header Cache-Control \"public\";\n")
+	assert.Contains(t, static, "\t\tadd_header X-Frame-Options \"SAMEORIGIN\" always;\n")
+	assert.Contains(t, static, "\t\tadd_header Strict-Transport-Security \"max-age=31536000\" always;\n")
+	assert.Equal(t, 2, strings.Count(content, "X-Content-Type-Options"))
+
+	vhost.Options.HTTP2 = false
+	content, err = Render(vhost)
+	assert.NoError(t, err)
+	assert.Contains(t, content, "listen 443 ssl;")
+}
+
+func TestRenderOptions(t *testing.T) {
+	vhost := testVhost()
+	vhost.Options.ClientMaxBodySize = "512m"
+	vhost.Options.Gzip = false
+	vhost.Options.Brotli = true
+	vhost.Options.SecurityHeaders = false
+	vhost.Options.StaticCache = ""
+
+	content, err := Render(vhost)
+	assert.NoError(t, err)
+	assert.Contains(t, content, "client_max_body_size 512m;")
+	assert.NotContains(t, content, "gzip on;")
+	assert.Contains(t, content, "brotli on;")
+	assert.NotContains(t, content, "X-Frame-Options")
+	assert.NotContains(t, content, "expires")
+}
+
+func TestRenderUpstream(t *testing.T) {
+	vhost := testVhost()
+	vhost.Upstream.Servers = []string{"127.0.0.1:20001", "127.0.0.1:20002", "127.0.0.1:20003"}
+
+	content, err := Render(vhost)
+	assert.NoError(t, err)
+	assert.Contains(t, content, "upstream ploy_example_com {\n\tleast_conn;\n")
+	for _, server := range vhost.Upstream.Servers {
+		assert.Contains(t, content, "server "+server+" max_fails=3 fail_timeout=30s;")
+	}
+	assert.Contains(t, content, "proxy_next_upstream error timeout")
+
+	vhost.Options.LoadBalancing = BalanceIPHash
+	vhost.Options.MaxFails = 1
+	content, err = Render(vhost)
+	assert.NoError(t, err)
+	assert.Contains(t, content, "\tip_hash;\n")
+	assert.Contains(t, content, "server 127.0.0.1:20002 max_fails=1 fail_timeout=30s;")
+
+	vhost.Options.LoadBalancing = BalanceRoundRobin
+	content, err = Render(vhost)
+	assert.NoError(t, err)
+	assert.NotContains(t, content, "least_conn")
+	assert.NotContains(t, content, "ip_hash")
+
+	vhost.Options.LoadBalancing = "random"
+	_, err = Render(vhost)
+	assert.Error(t, err)
+
+	vhost.Options.LoadBalancing = BalanceLeastConn
+	vhost.Upstream.Servers = nil
+	_, err = Render(vhost)
+	assert.Error(t, err)
+}
+
+func TestUpstreamName(t *testing.T) {
+	assert.Equal(t, "ploy_shop_example_com", UpstreamName("shop.example.com"))
+	assert.Equal(t, "ploy_my_site_io", UpstreamName("my-site.io"))
+}
+
+func TestManagedVersion(t *testing.T) {
+	content, err := Render(testVhost())
+	assert.NoError(t, err)
+
+	version, ok := ManagedVersion(content)
+	assert.True(t, ok)
+	assert.Equal(t, TemplateVersion, version)
+
+	_, ok = ManagedVersion("server {\n\tlisten 80;\n}")
+	assert.False(t, ok)
+}
+
+func TestLoadSaveOptions(t *testing.T) {
+	oldNginxDir := common.NginxDir
+	common.SetNginxDir(t.TempDir())
+	defer common.SetNginxDir(oldNginxDir)
+
+	options, err := LoadOptions("example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultOptions(), options)
+
+	options.ClientMaxBodySize = "1g"
+	options.Brotli = true
+	assert.NoError(t, SaveOptions("example.com", options))
+
+	loaded, err := LoadOptions("example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, options, loaded)
+}
+
+func TestOptionsValidate(t *testing.T) {
+	assert.NoError(t, DefaultOptions().Validate())
+
+	options := DefaultOptions()
+	options.StaticCache = "off"
+	assert.NoError(t, options.Validate())
+
+	// Values end up in nginx directives, so nothing but a size or a time is accepted
+	options = DefaultOptions()
+	options.ClientMaxBodySize = "64m; include /etc/shadow"
+	assert.ErrorContains(t, options.Validate(), "client_max_body_size")
+
+	options = DefaultOptions()
+	options.ProxyTimeout = "300s;\n}"
+	assert.ErrorContains(t, options.Validate(), "proxy_timeout")
+
+	options = DefaultOptions()
+	options.StaticCache = "30d; root /"
+	assert.ErrorContains(t, options.Validate(), "static_cache")
+}
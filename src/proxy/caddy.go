@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/ploycloud/ploy-server-cli/src/nginx"
+)
+
+// CaddyContainer is the name of the Caddy container ploy runs
+const CaddyContainer = "ploy-caddy"
+
+// Caddy describes the containerised Caddy instance. Caddy runs on the host network,
+// proxies to the loopback ports of each site and obtains certificates itself.
+type Caddy struct {
+	Dir      string
+	CertsDir string
+	Email    string
+}
+
+// SitesDir holds one Caddyfile snippet per site
+func (c Caddy) SitesDir() string {
+	return filepath.Join(c.Dir, "sites")
+}
+
+// ComposePath is the compose file that runs Caddy
+func (c Caddy) ComposePath() string {
+	return filepath.Join(c.Dir, "docker-compose.yml")
+}
+
+// ConfigPath is the main Caddyfile
+func (c Caddy) ConfigPath() string {
+	return filepath.Join(c.Dir, "Caddyfile")
+}
+
+// SitePath is the Caddyfile snippet for a domain
+func (c Caddy) SitePath(domain string) string {
+	return filepath.Join(c.SitesDir(), domain+".caddy")
+}
+
+// CaddySite is everything needed to render a site block
+type CaddySite struct {
+	Domain  string
+	Aliases []string
+	Servers []string
+	TLS     *nginx.TLS
+	Options nginx.Options
+}
+
+var caddyComposeTemplate = template.Must(template.New("caddy-compose").Parse(`# Managed by ploy
+services:
+  caddy:
+    image: caddy:2
+    container_name: {{ .Container }}
+    restart: always
+    network_mode: host
+    command: caddy run --config {{ .ConfigPath }} --adapter caddyfile
+    volumes:
+      - {{ .ConfigPath }}:{{ .ConfigPath }}:ro
+      - {{ .SitesDir }}:{{ .SitesDir }}:ro
+      - {{ .Dir }}/data:/data
+      - {{ .CertsDir }}:{{ .CertsDir }}:ro
+`))
+
+var caddyfileTemplate = template.Must(template.New("caddyfile").Parse(`# Managed by ploy
+{
+{{- if .Email }}
+	email {{ .Email }}
+{{- end }}
+	admin localhost:2019
+}
+
+import {{ .SitesDir }}/*.caddy
+`))
+
+var caddySiteTemplate = template.Must(template.New("caddy-site").Parse(`# Managed by ploy
+{{ .Domain }}{{ range .Aliases }}, {{ . }}{{ end }} {
+	reverse_proxy{{ range .Servers }} {{ . }}{{ end }} {
+		lb_policy {{ .Options.LoadBalancing }}
+		fail_duration {{ .Options.FailTimeout }}
+		max_fails {{ .Options.MaxFails }}
+	}
+	request_body {
+		max_size {{ .MaxBodySize }}
+	}
+{{- if .Options.Gzip }}
+	encode gzip
+{{- end }}
+{{- if .Options.SecurityHeaders }}
+	header {
+		X-Frame-Options "SAMEORIGIN"
+		X-Content-Type-Options "nosniff"
+		Referrer-Policy "strict-origin-when-cross-origin"
+	}
+{{- end }}
+{{- if .TLS }}
+	tls {{ .TLS.CertPath }} {{ .TLS.KeyPath }}
+{{- end }}
+}
+`))
+
+// RenderCompose renders the compose file that runs Caddy
+func (c Caddy) RenderCompose() (string, error) {
+	return render(caddyComposeTemplate, struct {
+		Caddy
+		Container, ConfigPath, SitesDir string
+	}{c, CaddyContainer, c.ConfigPath(), c.SitesDir()})
+}
+
+// RenderConfig renders the main Caddyfile, which imports every site snippet
+func (c Caddy) RenderConfig() (string, error) {
+	return render(caddyfileTemplate, struct {
+		Caddy
+		SitesDir string
+	}{c, c.SitesDir()})
+}
+
+// RenderCaddySite renders the site block for a domain. Caddy obtains a certificate
+// for the domain on its own unless a custom one is given.
+func RenderCaddySite(site CaddySite) (string, error) {
+	if len(site.Servers) == 0 {
+		return "", fmt.Errorf("no upstream servers for %s", site.Domain)
+	}
+	if err := site.Options.Validate(); err != nil {
+		return "", err
+	}
+	return render(caddySiteTemplate, struct {
+		CaddySite
+		MaxBodySize string
+	}{site, caddySize(site.Options.ClientMaxBodySize)})
+}
+
+// caddySize converts an nginx size such as 64m into Caddy's notation (64MB)
+func caddySize(size string) string {
+	size = strings.TrimSpace(size)
+	if size == "" {
+		return size
+	}
+	switch strings.ToLower(size[len(size)-1:]) {
+	case "k":
+		return size[:len(size)-1] + "KB"
+	case "m":
+		return size[:len(size)-1] + "MB"
+	case "g":
+		return size[:len(size)-1] + "GB"
+	}
+	return size
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ploycloud/ploy-server-cli/src/nginx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraefikRender(t *testing.T) {
+	traefik := Traefik{Dir: "/srv/proxy/traefik", CertsDir: "/srv/certs", Email: "ops@example.com"}
+
+	compose, err := traefik.RenderCompose()
+	assert.NoError(t, err)
+	assert.Contains(t, compose, "container_name: ploy-traefik")
+	assert.Contains(t, compose, "network_mode: host")
+	assert.Contains(t, compose, "/srv/proxy/traefik/traefik.yml:/etc/traefik/traefik.yml:ro")
+	assert.Contains(t, compose, "/srv/certs:/srv/certs:ro")
+
+	config, err := traefik.RenderConfig()
+	assert.NoError(t, err)
+	assert.Contains(t, config, "exposedByDefault: false")
+	assert.Contains(t, config, "email: ops@example.com")
+	assert.Contains(t, config, "entryPoint: web")
+
+	traefik.Email = ""
+	config, err = traefik.RenderConfig()
+	assert.NoError(t, err)
+	assert.NotContains(t, config, "email:")
+}
+
+func TestTraefikCertificate(t *testing.T) {
+	content, err := RenderCertificate("/certs/fullchain.pem", "/certs/privkey.pem")
+	assert.NoError(t, err)
+	assert.Contains(t, content, "certFile: /certs/fullchain.pem")
+	assert.NoError(t, ValidateDynamic([]byte(content)))
+
+	assert.Error(t, ValidateDynamic([]byte("tls: [")))
+	assert.Error(t, ValidateDynamic([]byte("tls:\n  certificates:\n  - certFile: /a\n")))
+	assert.Error(t, ValidateDynamic([]byte("routers: {}\n")))
+}
+
+func TestValidateTraefik(t *testing.T) {
+	static, err := Traefik{Dir: "/srv/proxy/traefik"}.RenderConfig()
+	assert.NoError(t, err)
+	certificate, err := RenderCertificate("/certs/fullchain.pem", "/certs/privkey.pem")
+	assert.NoError(t, err)
+	assert.NotContains(t, certificate, "http:")
+
+	services := `http:
+  services:
+    legacy:
+      loadBalancer:
+        servers:
+        - url: http://127.0.0.1:8080
+  middlewares:
+    compress:
+      compress: {}
+`
+	routers := `http:
+  routers:
+    legacy:
+      rule: Host(` + "`legacy.shop.com`" + `)
+      entryPoints: [websecure]
+      service: legacy
+      middlewares: [compress@file, auth@docker]
+`
+	// References may point into other files
+	assert.NoError(t, ValidateTraefik([]byte(static), map[string][]byte{
+		"shop.com.yml": []byte(certificate), "services.yml": []byte(services), "routers.yml": []byte(routers),
+	}))
+
+	for _, tt := range []struct {
+		static, dynamic, err string
+	}{
+		{static, "routers: {}\n", `unknown section "routers"`},
+		{static, strings.Replace(routers, "service: legacy", "service: shop", 1), "router legacy uses service shop, which is not defined"},
+		{static, strings.Replace(routers, "[websecure]", "[https]", 1), "router legacy uses entry point https, which is not defined"},
+		{static, strings.Replace(routers, "compress@file", "gzip", 1), "router legacy uses middleware gzip, which is not defined"},
+		{static, strings.Replace(routers, "      service: legacy\n", "", 1), "router legacy has no service"},
+		{strings.Replace(static, "websecure:", "secure:", 1), "", "entry point websecure, which the site routers use, is not defined"},
+		{strings.Replace(static, "to: websecure", "to: https", 1), "", "entry point web redirects to entry point https"},
+		{strings.Replace(static, "certResolver: ploy", "certResolver: le", 1), "", "certificate resolver le, which is not defined"},
+		{strings.Replace(static, "entryPoint: web\n", "entryPoint: http\n", 1), "", "answers challenges on entry point http"},
+		{"entryPoints: [", "", "invalid Traefik static configuration"},
+	} {
+		err := ValidateTraefik([]byte(tt.static), map[string][]byte{
+			"services.yml": []byte(services), "custom.yml": []byte(tt.dynamic),
+		})
+		assert.ErrorContains(t, err, tt.err)
+	}
+}
+
+func TestCaddyRender(t *testing.T) {
+	caddy := Caddy{Dir: "/srv/proxy/caddy", CertsDir: "/srv/certs"}
+
+	config, err := caddy.RenderConfig()
+	assert.NoError(t, err)
+	assert.Contains(t, config, "import /srv/proxy/caddy/sites/*.caddy")
+	assert.NotContains(t, config, "email")
+
+	compose, err := caddy.RenderCompose()
+	assert.NoError(t, err)
+	assert.Contains(t, compose, "caddy run --config /srv/proxy/caddy/Caddyfile")
+
+	site := CaddySite{
+		Domain:  "shop.com",
+		Servers: []string{"127.0.0.1:20010", "127.0.0.1:20011"},
+		Options: nginx.DefaultOptions(),
+	}
+	content, err := RenderCaddySite(site)
+	assert.NoError(t, err)
+	assert.Contains(t, content, "shop.com {")
+	assert.Contains(t, content, "reverse_proxy 127.0.0.1:20010 127.0.0.1:20011 {")
+	assert.Contains(t, content, "lb_policy least_conn")
+	assert.Contains(t, content, "max_size 64MB")
+	assert.Contains(t, content, "encode gzip")
+	assert.NotContains(t, content, "\ttls ")
+
+	site.TLS = &nginx.TLS{CertPath: "/certs/fullchain.pem", KeyPath: "/certs/privkey.pem"}
+	content, err = RenderCaddySite(site)
+	assert.NoError(t, err)
+	assert.Contains(t, content, "tls /certs/fullchain.pem /certs/privkey.pem")
+
+	site.Servers = nil
+	_, err = RenderCaddySite(site)
+	assert.Error(t, err)
+}
+
+func TestCaddySize(t *testing.T) {
+	assert.Equal(t, "64MB", caddySize("64m"))
+	assert.Equal(t, "1GB", caddySize("1G"))
+	assert.Equal(t, "512KB", caddySize("512k"))
+	assert.Equal(t, "1000", caddySize("1000"))
+}
@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TraefikContainer is the name of the Traefik container ploy runs
+const TraefikContainer = "ploy-traefik"
+
+// Traefik describes the containerised Traefik instance. Traefik runs on the host
+// network, discovers site containers through their compose labels and picks up
+// customer certificates from the file provider directory.
+type Traefik struct {
+	Dir      string
+	CertsDir string
+	Email    string
+}
+
+// DynamicDir is watched by Traefik's file provider
+func (t Traefik) DynamicDir() string {
+	return filepath.Join(t.Dir, "dynamic")
+}
+
+// ComposePath is the compose file that runs Traefik
+func (t Traefik) ComposePath() string {
+	return filepath.Join(t.Dir, "docker-compose.yml")
+}
+
+// ConfigPath is Traefik's static configuration
+func (t Traefik) ConfigPath() string {
+	return filepath.Join(t.Dir, "traefik.yml")
+}
+
+// CertificatePath is the dynamic configuration holding a domain's custom certificate
+func (t Traefik) CertificatePath(domain string) string {
+	return filepath.Join(t.DynamicDir(), domain+".yml")
+}
+
+var traefikComposeTemplate = template.Must(template.New("traefik-compose").Parse(`# Managed by ploy
+services:
+  traefik:
+    image: traefik:v3.1
+    container_name: {{ .Container }}
+    restart: always
+    network_mode: host
+    volumes:
+      - /var/run/docker.sock:/var/run/docker.sock:ro
+      - {{ .ConfigPath }}:/etc/traefik/traefik.yml:ro
+      - {{ .DynamicDir }}:/etc/traefik/dynamic:ro
+      - {{ .Dir }}/letsencrypt:/letsencrypt
+      - {{ .CertsDir }}:{{ .CertsDir }}:ro
+`))
+
+var traefikConfigTemplate = template.Must(template.New("traefik-config").Parse(`# Managed by ploy
+entryPoints:
+  web:
+    address: ":80"
+    http:
+      redirections:
+        entryPoint:
+          to: websecure
+          scheme: https
+  websecure:
+    address: ":443"
+    http:
+      tls:
+        certResolver: ploy
+providers:
+  docker:
+    exposedByDefault: false
+  file:
+    directory: /etc/traefik/dynamic
+    watch: true
+certificatesResolvers:
+  ploy:
+    acme:
+{{- if .Email }}
+      email: {{ .Email }}
+{{- end }}
+      storage: /letsencrypt/acme.json
+      httpChallenge:
+        entryPoint: web
+`))
+
+// RenderCompose renders the compose file that runs Traefik
+func (t Traefik) RenderCompose() (string, error) {
+	return render(traefikComposeTemplate, struct {
+		Traefik
+		Container, ConfigPath, DynamicDir string
+	}{t, TraefikContainer, t.ConfigPath(), t.DynamicDir()})
+}
+
+// RenderConfig renders Traefik's static configuration. Certificates for site
+// routers are obtained by Traefik itself through the "ploy" ACME resolver.
+func (t Traefik) RenderConfig() (string, error) {
+	return render(traefikConfigTemplate, t)
+}
+
+// TraefikSiteEntryPoint is the entry point the routers in the site compose labels use
+const TraefikSiteEntryPoint = "websecure"
+
+type traefikCertificate struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+type traefikRouter struct {
+	Rule        string   `yaml:"rule"`
+	EntryPoints []string `yaml:"entryPoints"`
+	Service     string   `yaml:"service"`
+	Middlewares []string `yaml:"middlewares"`
+}
+
+type traefikDynamic struct {
+	HTTP struct {
+		Routers     map[string]traefikRouter `yaml:"routers,omitempty"`
+		Services    map[string]interface{}   `yaml:"services,omitempty"`
+		Middlewares map[string]interface{}   `yaml:"middlewares,omitempty"`
+	} `yaml:"http,omitempty"`
+	TLS struct {
+		Certificates []traefikCertificate `yaml:"certificates"`
+	} `yaml:"tls"`
+}
+
+type traefikStatic struct {
+	EntryPoints map[string]struct {
+		Address string `yaml:"address"`
+		HTTP    struct {
+			Redirections struct {
+				EntryPoint struct {
+					To string `yaml:"to"`
+				} `yaml:"entryPoint"`
+			} `yaml:"redirections"`
+			TLS struct {
+				CertResolver string `yaml:"certResolver"`
+			} `yaml:"tls"`
+		} `yaml:"http"`
+	} `yaml:"entryPoints"`
+	CertificatesResolvers map[string]struct {
+		ACME struct {
+			HTTPChallenge struct {
+				EntryPoint string `yaml:"entryPoint"`
+			} `yaml:"httpChallenge"`
+		} `yaml:"acme"`
+	} `yaml:"certificatesResolvers"`
+}
+
+// RenderCertificate renders the dynamic configuration that makes Traefik serve a
+// customer supplied certificate instead of an ACME one
+func RenderCertificate(certPath, keyPath string) (string, error) {
+	var dynamic traefikDynamic
+	dynamic.TLS.Certificates = []traefikCertificate{{CertFile: certPath, KeyFile: keyPath}}
+
+	data, err := yaml.Marshal(dynamic)
+	if err != nil {
+		return "", err
+	}
+	return "# Managed by ploy\n" + string(data), nil
+}
+
+// ValidateDynamic checks that a dynamic configuration file is well formed YAML
+// with the sections Traefik loads, and that certificates name both of their files
+func ValidateDynamic(content []byte) error {
+	_, err := parseDynamic(content)
+	return err
+}
+
+func parseDynamic(content []byte) (*traefikDynamic, error) {
+	var sections map[string]interface{}
+	if err := yaml.Unmarshal(content, &sections); err != nil {
+		return nil, fmt.Errorf("invalid Traefik configuration: %v", err)
+	}
+	for section := range sections {
+		switch section {
+		case "http", "tcp", "udp", "tls":
+		default:
+			return nil, fmt.Errorf("invalid Traefik configuration: unknown section %q", section)
+		}
+	}
+
+	var dynamic traefikDynamic
+	if err := yaml.Unmarshal(content, &dynamic); err != nil {
+		return nil, fmt.Errorf("invalid Traefik configuration: %v", err)
+	}
+	for _, c := range dynamic.TLS.Certificates {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("invalid Traefik configuration: certificate entries need certFile and keyFile")
+		}
+	}
+	return &dynamic, nil
+}
+
+// ValidateTraefik checks the static configuration and the dynamic files by name.
+// Traefik has no configuration test like `nginx -t`, so this checks what ploy can:
+// the files load, the entry points that the site routers, the HTTP redirection
+// and the ACME challenge use exist, and so do the resolvers, services and
+// middlewares that are referred to. Services and middlewares of other providers,
+// such as name@docker, are left to Traefik.
+func ValidateTraefik(static []byte, dynamic map[string][]byte) error {
+	var config traefikStatic
+	if err := yaml.Unmarshal(static, &config); err != nil {
+		return fmt.Errorf("invalid Traefik static configuration: %v", err)
+	}
+	if _, ok := config.EntryPoints[TraefikSiteEntryPoint]; !ok {
+		return fmt.Errorf("entry point %s, which the site routers use, is not defined", TraefikSiteEntryPoint)
+	}
+	for name, entryPoint := range config.EntryPoints {
+		if entryPoint.Address == "" {
+			return fmt.Errorf("entry point %s has no address", name)
+		}
+		if to := entryPoint.HTTP.Redirections.EntryPoint.To; to != "" {
+			if _, ok := config.EntryPoints[to]; !ok {
+				return fmt.Errorf("entry point %s redirects to entry point %s, which is not defined", name, to)
+			}
+		}
+		if resolver := entryPoint.HTTP.TLS.CertResolver; resolver != "" {
+			if _, ok := config.CertificatesResolvers[resolver]; !ok {
+				return fmt.Errorf("entry point %s uses certificate resolver %s, which is not defined", name, resolver)
+			}
+		}
+	}
+	for name, resolver := range config.CertificatesResolvers {
+		if challenge := resolver.ACME.HTTPChallenge.EntryPoint; challenge != "" {
+			if _, ok := config.EntryPoints[challenge]; !ok {
+				return fmt.Errorf("certificate resolver %s answers challenges on entry point %s, which is not defined", name, challenge)
+			}
+		}
+	}
+
+	// The file provider merges all files, so references may cross them
+	files := make([]string, 0, len(dynamic))
+	for file := range dynamic {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	services, middlewares := map[string]bool{}, map[string]bool{}
+	routers := map[string]traefikRouter{}
+	routerFiles := map[string]string{}
+	for _, file := range files {
+		parsed, err := parseDynamic(dynamic[file])
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		for name := range parsed.HTTP.Services {
+			services[name] = true
+		}
+		for name := range parsed.HTTP.Middlewares {
+			middlewares[name] = true
+		}
+		for name, router := range parsed.HTTP.Routers {
+			routers[name], routerFiles[name] = router, file
+		}
+	}
+
+	names := make([]string, 0, len(routers))
+	for name := range routers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		router, file := routers[name], routerFiles[name]
+		if router.Rule == "" {
+			return fmt.Errorf("%s: router %s has no rule", file, name)
+		}
+		for _, entryPoint := range router.EntryPoints {
+			if _, ok := config.EntryPoints[entryPoint]; !ok {
+				return fmt.Errorf("%s: router %s uses entry point %s, which is not defined", file, name, entryPoint)
+			}
+		}
+		if router.Service == "" {
+			return fmt.Errorf("%s: router %s has no service", file, name)
+		}
+		if !fileReference(router.Service, services) {
+			return fmt.Errorf("%s: router %s uses service %s, which is not defined", file, name, router.Service)
+		}
+		for _, middleware := range router.Middlewares {
+			if !fileReference(middleware, middlewares) {
+				return fmt.Errorf("%s: router %s uses middleware %s, which is not defined", file, name, middleware)
+			}
+		}
+	}
+	return nil
+}
+
+// fileReference reports whether a reference from a dynamic file resolves: it names
+// something defined in the files, or something of another provider
+func fileReference(name string, defined map[string]bool) bool {
+	name, provider, qualified := strings.Cut(name, "@")
+	if qualified && provider != "file" {
+		return true
+	}
+	return defined[name]
+}
+
+func render(tmpl *template.Template, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render %s: %v", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,365 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/health"
+	"github.com/ploycloud/ploy-server-cli/src/runner"
+	"gopkg.in/yaml.v2"
+)
+
+const recordFileName = "site.yml"
+
+// lockFileName is locked with flock while a command changes a site record
+const lockFileName = ".lock"
+
+// Loopback ports handed out to site web containers
+var (
+	PortRangeStart = 20000
+	PortRangeEnd   = 29999
+)
+
+// ErrNotFound is returned when no site matches a domain or hostname
+var ErrNotFound = errors.New("site not found")
+
+// planned holds the records saved (or deleted, as nil) during a dry run by site
+// name, so that later steps of the run see them
+var planned = map[string]*Site{}
+
+// Database holds the connection settings a site was created with
+type Database struct {
+	Source   string `yaml:"source"`
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	Name     string `yaml:"name"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+// CronJob is a command run on a schedule in the site's web container
+type CronJob struct {
+	Schedule string `yaml:"schedule"`
+	Command  string `yaml:"command"`
+}
+
+// BackupPolicy schedules `ploy sites backup` for a site. Keep is the number of
+// archives kept, 0 keeps all of them.
+type BackupPolicy struct {
+	Schedule string `yaml:"schedule,omitempty"`
+	Keep     int    `yaml:"keep,omitempty"`
+}
+
+// Site is the recorded configuration of a site on this server
+type Site struct {
+	Domain      string            `yaml:"domain"`
+	Aliases     []string          `yaml:"aliases,omitempty"`
+	Hostname    string            `yaml:"hostname,omitempty"`
+	SiteID      string            `yaml:"site_id,omitempty"`
+	Type        string            `yaml:"type"`
+	PHPVersion  string            `yaml:"php_version"`
+	ScalingType string            `yaml:"scaling_type"`
+	Replicas    int               `yaml:"replicas"`
+	MinReplicas int               `yaml:"min_replicas,omitempty"`
+	MaxReplicas int               `yaml:"max_replicas,omitempty"`
+	HostPort    int               `yaml:"host_port"`
+	PortCount   int               `yaml:"port_count,omitempty"`
+	ComposeFile string            `yaml:"compose_file"`
+	Database    Database          `yaml:"database"`
+	HealthCheck health.Check      `yaml:"health_check"`
+	Env         map[string]string `yaml:"env,omitempty"`
+	Cron        []CronJob         `yaml:"cron,omitempty"`
+	Backup      BackupPolicy      `yaml:"backup,omitempty"`
+	TLS         bool              `yaml:"tls,omitempty"`
+	Stopped     bool              `yaml:"stopped,omitempty"`
+	CreatedAt   time.Time         `yaml:"created_at"`
+	ScaledAt    time.Time         `yaml:"scaled_at,omitempty"`
+	BackedUpAt  time.Time         `yaml:"backed_up_at,omitempty"`
+}
+
+// Name returns the name used for the site directory: the hostname if set,
+// otherwise the domain
+func (s *Site) Name() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	return s.Domain
+}
+
+// Domains returns the domain followed by its aliases
+func (s *Site) Domains() []string {
+	return append([]string{s.Domain}, s.Aliases...)
+}
+
+// Dir returns the directory holding the site's files
+func (s *Site) Dir() string {
+	return filepath.Join(common.SitesDir, s.Name())
+}
+
+// ComposePath returns the path of the site's Docker Compose file
+func (s *Site) ComposePath() string {
+	return filepath.Join(s.Dir(), s.ComposeFile)
+}
+
+// ReplicaBounds returns the replica range the site may be scaled within. Without
+// max_replicas the upper bound is the size of the site port range; a site that
+// outgrows its reserved ports gets a larger block from ReservePorts.
+func (s *Site) ReplicaBounds() (min, max int) {
+	min = s.MinReplicas
+	if min < 1 {
+		min = 1
+	}
+	max = s.MaxReplicas
+	if max < 1 {
+		max = PortRangeEnd - PortRangeStart + 1
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+// Ports returns the block of loopback ports reserved for the site's replicas,
+// starting at HostPort
+func (s *Site) Ports() []int {
+	count := s.PortCount
+	if count < 1 {
+		count = 1
+	}
+	ports := make([]int, count)
+	for i := range ports {
+		ports[i] = s.HostPort + i
+	}
+	return ports
+}
+
+// LastPort returns the last port of the site's block
+func (s *Site) LastPort() int {
+	ports := s.Ports()
+	return ports[len(ports)-1]
+}
+
+// Endpoints returns the addresses the site's replicas are expected on when they
+// cannot be looked up from Docker: one port of the block per replica
+func (s *Site) Endpoints() []string {
+	ports := s.Ports()
+	replicas := s.Replicas
+	if replicas < 1 {
+		replicas = 1
+	}
+	if replicas < len(ports) {
+		ports = ports[:replicas]
+	}
+
+	endpoints := make([]string, len(ports))
+	for i, port := range ports {
+		endpoints[i] = fmt.Sprintf("127.0.0.1:%d", port)
+	}
+	return endpoints
+}
+
+// Save writes the site record. It contains database credentials, so it is only
+// readable by the owner.
+func Save(s *Site) error {
+	if s.Domain == "" {
+		return errors.New("site domain is required")
+	}
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = time.Now().UTC()
+	}
+
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if runner.DryRun {
+		record := *s
+		planned[s.Name()] = &record
+	}
+	if err := runner.MkdirAll(s.Dir(), 0755); err != nil {
+		return fmt.Errorf("failed to create site directory: %v", err)
+	}
+	return runner.WriteFile(filepath.Join(s.Dir(), recordFileName), data, 0600)
+}
+
+// Delete removes the site record, leaving the rest of the site directory alone
+func Delete(s *Site) error {
+	if runner.DryRun {
+		planned[s.Name()] = nil
+	}
+	err := runner.Remove(filepath.Join(s.Dir(), recordFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Lock waits for the lock of the site whose domain or hostname matches name. It
+// returns the record as saved once the lock is taken, and the function that
+// releases the lock. Commands that load a record, change it and save it again,
+// such as `ploy sites scale`, `ploy apply` and the autoscaler, hold the lock until
+// they are done so that they do not overwrite each other's changes. Dry runs
+// change nothing and take no lock.
+func Lock(name string) (*Site, func(), error) {
+	site, err := Load(name)
+	if err != nil || runner.DryRun {
+		return site, func() {}, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(site.Dir(), lockFileName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open site lock: %v", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to lock site: %v", err)
+	}
+
+	// Another command may have saved the record while this one waited
+	site, err = Load(name)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return site, func() { f.Close() }, nil
+}
+
+// List returns every recorded site sorted by domain
+func List() ([]*Site, error) {
+	entries, err := os.ReadDir(common.SitesDir)
+	if os.IsNotExist(err) {
+		return applyPlanned(nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sites []*Site
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(common.SitesDir, entry.Name(), recordFileName))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var s Site
+		if err := yaml.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("invalid site record in %s: %v", entry.Name(), err)
+		}
+		sites = append(sites, &s)
+	}
+	sites = applyPlanned(sites)
+
+	sort.Slice(sites, func(i, j int) bool { return sites[i].Domain < sites[j].Domain })
+	return sites, nil
+}
+
+// applyPlanned replaces the records on disk with those changed during a dry run
+func applyPlanned(sites []*Site) []*Site {
+	if !runner.DryRun || len(planned) == 0 {
+		return sites
+	}
+
+	var result []*Site
+	for _, s := range sites {
+		if _, ok := planned[s.Name()]; !ok {
+			result = append(result, s)
+		}
+	}
+	for _, s := range planned {
+		if s != nil {
+			record := *s
+			result = append(result, &record)
+		}
+	}
+	return result
+}
+
+// Load returns the site whose domain or hostname matches name
+func Load(name string) (*Site, error) {
+	sites, err := List()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sites {
+		if s.Domain == name || s.Hostname == name {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+}
+
+// AllocatePorts returns the first port of the lowest block of count consecutive
+// loopback ports in the site range that are neither reserved for another site
+// nor currently in use
+func AllocatePorts(count int) (int, error) {
+	if count < 1 {
+		count = 1
+	}
+
+	sites, err := List()
+	if err != nil {
+		return 0, err
+	}
+
+	used := make(map[int]bool)
+	for _, s := range sites {
+		for _, port := range s.Ports() {
+			used[port] = true
+		}
+	}
+
+	for start := PortRangeStart; start+count-1 <= PortRangeEnd; start++ {
+		free := true
+		for port := start; port < start+count; port++ {
+			if used[port] || !portFree(port) {
+				free = false
+				start = port
+				break
+			}
+		}
+		if free {
+			return start, nil
+		}
+	}
+	return 0, fmt.Errorf("no block of %d free ports left between %d and %d", count, PortRangeStart, PortRangeEnd)
+}
+
+// ReservePorts makes sure the site has a port for each of count replicas. A block
+// that is too small is replaced by a new block of count ports, which the site's
+// containers must be recreated on; moved reports whether that happened. The site
+// is not saved.
+func ReservePorts(site *Site, count int) (moved bool, err error) {
+	if count <= len(site.Ports()) {
+		return false, nil
+	}
+	port, err := AllocatePorts(count)
+	if err != nil {
+		return false, err
+	}
+	site.HostPort, site.PortCount = port, count
+	return true, nil
+}
+
+func portFree(port int) bool {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
@@ -0,0 +1,167 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupRegistryTest(t *testing.T) {
+	oldSitesDir := common.SitesDir
+	common.SitesDir = t.TempDir()
+	t.Cleanup(func() { common.SitesDir = oldSitesDir })
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	setupRegistryTest(t)
+
+	site := &Site{Domain: "example.com", Hostname: "host.example.com", Type: "wp", HostPort: 20001, ComposeFile: "docker-compose-wp-php8.3.yml"}
+	assert.NoError(t, Save(site))
+	assert.False(t, site.CreatedAt.IsZero())
+	assert.FileExists(t, filepath.Join(site.Dir(), recordFileName))
+
+	byDomain, err := Load("example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "host.example.com", byDomain.Hostname)
+	assert.Equal(t, []string{"127.0.0.1:20001"}, byDomain.Endpoints())
+
+	byHostname, err := Load("host.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com", byHostname.Domain)
+
+	_, err = Load("missing.com")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	assert.NoError(t, Delete(site))
+	_, err = Load("example.com")
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestLock(t *testing.T) {
+	setupRegistryTest(t)
+	assert.NoError(t, Save(&Site{Domain: "example.com", Replicas: 1}))
+
+	site, unlock, err := Lock("example.com")
+	assert.NoError(t, err)
+
+	// A second command waits for the lock and then sees the first one's change
+	locked := make(chan *Site)
+	go func() {
+		site, unlock, err := Lock("example.com")
+		assert.NoError(t, err)
+		unlock()
+		locked <- site
+	}()
+	select {
+	case <-locked:
+		t.Fatal("the lock was taken twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	site.Replicas = 3
+	assert.NoError(t, Save(site))
+	unlock()
+	select {
+	case other := <-locked:
+		assert.Equal(t, 3, other.Replicas)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lock was not released")
+	}
+
+	_, _, err = Lock("missing.com")
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestList(t *testing.T) {
+	setupRegistryTest(t)
+
+	sites, err := List()
+	assert.NoError(t, err)
+	assert.Empty(t, sites)
+
+	assert.NoError(t, Save(&Site{Domain: "b.com", HostPort: 20001}))
+	assert.NoError(t, Save(&Site{Domain: "a.com", HostPort: 20000}))
+
+	sites, err = List()
+	assert.NoError(t, err)
+	assert.Len(t, sites, 2)
+	assert.Equal(t, "a.com", sites[0].Domain)
+	assert.Equal(t, "b.com", sites[1].Domain)
+}
+
+func TestEndpoints(t *testing.T) {
+	site := &Site{Domain: "example.com", HostPort: 20010, PortCount: 4, Replicas: 2}
+	assert.Equal(t, []int{20010, 20011, 20012, 20013}, site.Ports())
+	assert.Equal(t, 20013, site.LastPort())
+	assert.Equal(t, []string{"127.0.0.1:20010", "127.0.0.1:20011"}, site.Endpoints())
+
+	site.Replicas = 6
+	assert.Len(t, site.Endpoints(), 4)
+}
+
+func TestReplicaBounds(t *testing.T) {
+	site := &Site{Domain: "example.com", HostPort: 20010, PortCount: 5, MinReplicas: 2, MaxReplicas: 4}
+	min, max := site.ReplicaBounds()
+	assert.Equal(t, 2, min)
+	assert.Equal(t, 4, max)
+
+	// Records without bounds are not limited by their port block
+	site = &Site{Domain: "example.com", HostPort: 20010, PortCount: 3}
+	min, max = site.ReplicaBounds()
+	assert.Equal(t, 1, min)
+	assert.Equal(t, PortRangeEnd-PortRangeStart+1, max)
+}
+
+func TestAllocatePorts(t *testing.T) {
+	setupRegistryTest(t)
+
+	// Pick a free port for the range and keep the third one busy
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	start := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	busy, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", start+2))
+	if err != nil {
+		t.Skipf("port %d unavailable: %v", start+2, err)
+	}
+	defer busy.Close()
+
+	oldStart, oldEnd := PortRangeStart, PortRangeEnd
+	PortRangeStart, PortRangeEnd = start, start+5
+	defer func() { PortRangeStart, PortRangeEnd = oldStart, oldEnd }()
+
+	assert.NoError(t, Save(&Site{Domain: "a.com", HostPort: start}))
+
+	port, err := AllocatePorts(1)
+	assert.NoError(t, err)
+	assert.Equal(t, start+1, port)
+
+	// A block of two skips the busy port
+	port, err = AllocatePorts(2)
+	assert.NoError(t, err)
+	assert.Equal(t, start+3, port)
+
+	// a.com outgrows its port and moves to the next free block
+	site, err := Load("a.com")
+	assert.NoError(t, err)
+	moved, err := ReservePorts(site, 1)
+	assert.NoError(t, err)
+	assert.False(t, moved)
+	moved, err = ReservePorts(site, 2)
+	assert.NoError(t, err)
+	assert.True(t, moved)
+	assert.Equal(t, []int{start + 3, start + 4}, site.Ports())
+
+	assert.NoError(t, Save(&Site{Domain: "b.com", HostPort: start + 3, PortCount: 3}))
+	_, err = AllocatePorts(2)
+	assert.Error(t, err)
+	_, err = ReservePorts(site, 3)
+	assert.Error(t, err)
+}
@@ -0,0 +1,85 @@
+package runner
+
+import (
+	"os"
+)
+
+// WriteFile writes a file, or prints its path, mode and content in dry-run mode
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	if DryRun {
+		PlanFile(path, perm, data)
+		return nil
+	}
+	return os.WriteFile(path, data, perm)
+}
+
+// PlanFile prints a file that would be written
+func PlanFile(path string, perm os.FileMode, data []byte) {
+	Plan("write %s (%04o, %d bytes)", path, perm.Perm(), len(data))
+	printContent(data)
+}
+
+// MkdirAll creates a directory and its parents
+func MkdirAll(path string, perm os.FileMode) error {
+	if DryRun {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			return nil
+		}
+		Plan("mkdir -p %s (%04o)", path, perm.Perm())
+		return nil
+	}
+	return os.MkdirAll(path, perm)
+}
+
+// Remove removes a file or an empty directory
+func Remove(path string) error {
+	if DryRun {
+		if _, err := os.Lstat(path); err != nil {
+			return err
+		}
+		Plan("rm %s", path)
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// RemoveAll removes a path and everything below it
+func RemoveAll(path string) error {
+	if DryRun {
+		if _, err := os.Lstat(path); err == nil {
+			Plan("rm -rf %s", path)
+		}
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
+// Rename moves a file
+func Rename(oldpath, newpath string) error {
+	if DryRun {
+		Plan("mv %s %s", oldpath, newpath)
+		return nil
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+// Chmod changes the mode of a file
+func Chmod(path string, mode os.FileMode) error {
+	if DryRun {
+		Plan("chmod %04o %s", mode.Perm(), path)
+		return nil
+	}
+	return os.Chmod(path, mode)
+}
+
+// Symlink points newname at oldname, replacing what newname was
+func Symlink(oldname, newname string) error {
+	if DryRun {
+		Plan("ln -sfn %s %s", oldname, newname)
+		return nil
+	}
+	if err := os.Remove(newname); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(oldname, newname)
+}
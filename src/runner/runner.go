@@ -0,0 +1,398 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DryRun makes commands and file changes print what they would do instead of
+// doing it. Read-only queries still run, so plans reflect the current state.
+var DryRun bool
+
+// Out receives the dry-run plan
+var Out io.Writer = os.Stdout
+
+// Debug traces every command, its exit status and duration to Trace
+var (
+	Debug bool
+	Trace io.Writer = os.Stderr
+)
+
+// Deadlines for commands. Interactive commands have none.
+var (
+	// Timeout bounds commands that change the system, such as `docker compose up`
+	Timeout = 10 * time.Minute
+	// QueryTimeout bounds commands that only read state
+	QueryTimeout = time.Minute
+	// KillGrace is how long a command may take to exit after SIGTERM before it is killed
+	KillGrace = 10 * time.Second
+)
+
+// ErrInterrupted is returned when ploy received SIGINT or SIGTERM while a command ran
+var ErrInterrupted = errors.New("interrupted")
+
+// stderrTail is how much of the end of stderr is kept for errors
+const stderrTail = 2048
+
+// Error is returned when a command fails to start, exits non-zero, times out or
+// is interrupted
+type Error struct {
+	// Cmdline is the command as it could be typed into a shell
+	Cmdline string
+	// Program is the name of the program that failed, the one sudo ran for commands
+	// run with sudo
+	Program string
+	// ExitCode is the exit status, or -1 when the command did not exit by itself
+	ExitCode int
+	// Stderr is the end of what the command wrote to standard error
+	Stderr string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("`%s` failed: %v", e.Cmdline, e.Err)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Plan prints a planned side effect
+func Plan(format string, args ...interface{}) {
+	fmt.Fprintf(Out, "[dry-run] "+format+"\n", args...)
+}
+
+// Run runs a command that changes the system
+func Run(cmd *exec.Cmd) error {
+	if DryRun {
+		planCommand(cmd)
+		return nil
+	}
+	return run(cmd, Timeout, false)
+}
+
+// RunWithin runs a command that changes the system with its own deadline instead
+// of Timeout, for long jobs such as database dumps
+func RunWithin(cmd *exec.Cmd, timeout time.Duration) error {
+	if DryRun {
+		planCommand(cmd)
+		return nil
+	}
+	return run(cmd, timeout, false)
+}
+
+// Output runs a command that changes the system and returns its standard output
+func Output(cmd *exec.Cmd) ([]byte, error) {
+	if DryRun {
+		planCommand(cmd)
+		return nil, nil
+	}
+	return output(cmd, Timeout)
+}
+
+// CombinedOutput runs a command that changes the system and returns its
+// standard output and standard error
+func CombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	if DryRun {
+		planCommand(cmd)
+		return nil, nil
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := run(cmd, Timeout, false)
+	return out.Bytes(), err
+}
+
+// Query runs a command that only reads state, such as `docker ps`, and returns
+// its standard output. It runs in dry-run mode too.
+func Query(cmd *exec.Cmd) ([]byte, error) {
+	return output(cmd, QueryTimeout)
+}
+
+// Interactive runs a command attached to the terminal, such as `docker compose
+// exec`, without a deadline. On Ctrl-C ploy waits for the command to exit, which
+// receives the interrupt from the terminal itself.
+func Interactive(cmd *exec.Cmd) error {
+	if DryRun {
+		planCommand(cmd)
+		return nil
+	}
+	return run(cmd, 0, true)
+}
+
+func output(cmd *exec.Cmd, timeout time.Duration) ([]byte, error) {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := run(cmd, timeout, false)
+	return out.Bytes(), err
+}
+
+// run starts the command and waits for it until it exits, the deadline passes or
+// ploy is interrupted. Non-interactive commands run in their own process group,
+// so that children such as the containers of `docker compose up` are stopped too.
+func run(cmd *exec.Cmd, timeout time.Duration, interactive bool) error {
+	tail := &tailWriter{}
+	if cmd.Stderr == nil {
+		cmd.Stderr = tail
+	} else if cmd.Stderr != cmd.Stdout {
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, tail)
+	}
+	if !interactive && cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	start := time.Now()
+	trace("exec: %s", CommandLine(cmd))
+	if err := cmd.Start(); err != nil {
+		trace("failed to start after %s: %s", time.Since(start).Round(time.Millisecond), CommandLine(cmd))
+		return newError(cmd, err, tail, cmd.Stderr)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s: %w", timeout, context.DeadlineExceeded)
+		} else {
+			err = ErrInterrupted
+		}
+		terminate(cmd, interactive, done)
+	}
+
+	if err == nil {
+		trace("exit 0 after %s: %s", time.Since(start).Round(time.Millisecond), CommandLine(cmd))
+		return nil
+	}
+	runErr := newError(cmd, err, tail, cmd.Stderr)
+	trace("exit %d after %s: %s", runErr.ExitCode, time.Since(start).Round(time.Millisecond), CommandLine(cmd))
+	return runErr
+}
+
+// terminate stops a command that outlived its deadline or was interrupted, and
+// kills it when it does not exit within KillGrace
+func terminate(cmd *exec.Cmd, interactive bool, done <-chan error) {
+	signalCommand(cmd, interactive, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(KillGrace):
+		signalCommand(cmd, interactive, syscall.SIGKILL)
+		<-done
+	}
+}
+
+func signalCommand(cmd *exec.Cmd, interactive bool, sig syscall.Signal) {
+	if interactive {
+		cmd.Process.Signal(sig)
+		return
+	}
+	syscall.Kill(-cmd.Process.Pid, sig)
+}
+
+func newError(cmd *exec.Cmd, err error, tail *tailWriter, stderr io.Writer) *Error {
+	runErr := &Error{Cmdline: CommandLine(cmd), Program: Program(cmd), ExitCode: -1, Err: err}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.Exited() {
+		runErr.ExitCode = exitErr.ExitCode()
+	}
+	// Combined output is returned to the caller as a whole
+	if buf, ok := stderr.(*bytes.Buffer); ok && cmd.Stdout == stderr {
+		runErr.Stderr = lastBytes(buf.String())
+	} else {
+		runErr.Stderr = lastBytes(tail.String())
+	}
+	return runErr
+}
+
+func trace(format string, args ...interface{}) {
+	if Debug {
+		fmt.Fprintf(Trace, "[debug] "+format+"\n", args...)
+	}
+}
+
+// tailWriter keeps the end of what is written to it
+type tailWriter struct {
+	buf []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > 2*stderrTail {
+		w.buf = []byte(cutToLine(string(w.buf)))
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) String() string {
+	return string(w.buf)
+}
+
+// lastBytes returns the trimmed end of s
+func lastBytes(s string) string {
+	return strings.TrimSpace(cutToLine(s))
+}
+
+// cutToLine returns at most stderrTail bytes from the end of s, starting at a
+// line where possible
+func cutToLine(s string) string {
+	if len(s) <= stderrTail {
+		return s
+	}
+	s = s[len(s)-stderrTail:]
+	if i := strings.IndexByte(s, '\n'); i >= 0 && i < len(s)-1 {
+		s = s[i+1:]
+	}
+	return s
+}
+
+// envAssignment matches a KEY=value argument
+var envAssignment = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// CommandLine returns the command as it could be typed into a shell. The values
+// of environment variables set with -e or --env, such as passwords handed to a
+// container, are redacted, since the line ends up in errors, traces and plans.
+func CommandLine(cmd *exec.Cmd) string {
+	args := cmd.Args
+	if len(args) == 0 {
+		args = []string{cmd.Path}
+	}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if i > 0 && (args[i-1] == "-e" || args[i-1] == "--env") {
+			arg = redact(arg)
+		} else if value, ok := strings.CutPrefix(arg, "--env="); ok {
+			arg = "--env=" + redact(value)
+		}
+		quoted[i] = quote(arg)
+	}
+	line := strings.Join(quoted, " ")
+	if cmd.Dir != "" {
+		line = "cd " + quote(cmd.Dir) + " && " + line
+	}
+	return line
+}
+
+// sudoValueOptions are the short options of sudo that take a value
+const sudoValueOptions = "CDghprRtTUu"
+
+// Program returns the base name of the program a command runs. For sudo it is
+// the program sudo runs, after sudo's own options.
+func Program(cmd *exec.Cmd) string {
+	args := cmd.Args
+	if len(args) == 0 {
+		args = []string{cmd.Path}
+	}
+	if filepath.Base(args[0]) != "sudo" {
+		return filepath.Base(args[0])
+	}
+
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			i++
+		case strings.HasPrefix(arg, "--"):
+			// Long options take their value after =, or as the next argument
+			if !strings.Contains(arg, "=") && longOptionTakesValue(arg) {
+				i++
+			}
+			continue
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			// Short options can be grouped; one that takes a value ends the group,
+			// with the value either attached or as the next argument
+			for j := 1; j < len(arg); j++ {
+				if strings.IndexByte(sudoValueOptions, arg[j]) >= 0 {
+					if j == len(arg)-1 {
+						i++
+					}
+					break
+				}
+			}
+			continue
+		}
+		if i < len(args) {
+			return filepath.Base(args[i])
+		}
+		break
+	}
+	return "sudo"
+}
+
+// longOptionTakesValue reports whether a long sudo option takes a value
+func longOptionTakesValue(option string) bool {
+	switch option {
+	case "--close-from", "--chdir", "--group", "--host", "--prompt", "--chroot",
+		"--role", "--type", "--command-timeout", "--other-user", "--user":
+		return true
+	}
+	return false
+}
+
+// redact hides the value of a KEY=value argument
+func redact(arg string) string {
+	if loc := envAssignment.FindStringIndex(arg); loc != nil && loc[1] < len(arg) {
+		return arg[:loc[1]] + "***"
+	}
+	return arg
+}
+
+func quote(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	if strings.IndexFunc(arg, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,@%+", r))
+	}) < 0 {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+func planCommand(cmd *exec.Cmd) {
+	Plan("run: %s", CommandLine(cmd))
+	// Show what would be piped in, when it is known up front
+	switch stdin := cmd.Stdin.(type) {
+	case *strings.Reader:
+		data, _ := io.ReadAll(stdin)
+		printContent(data)
+	case *bytes.Reader:
+		data, _ := io.ReadAll(stdin)
+		printContent(data)
+	case *bytes.Buffer:
+		printContent(stdin.Bytes())
+	}
+}
+
+func printContent(data []byte) {
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		fmt.Fprintf(Out, "    | %s\n", line)
+	}
+}
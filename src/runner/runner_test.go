@@ -0,0 +1,251 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupDryRun(t *testing.T) *bytes.Buffer {
+	var plan bytes.Buffer
+	DryRun = true
+	Out = &plan
+	t.Cleanup(func() {
+		DryRun = false
+		Out = os.Stdout
+	})
+	return &plan
+}
+
+func TestCommandLine(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "mkdir -p /etc/nginx && echo 'done'")
+	assert.Equal(t, `sh -c 'mkdir -p /etc/nginx && echo '\''done'\'''`, CommandLine(cmd))
+
+	cmd = exec.Command("docker-compose", "-f", "/opt/sites/shop.com/docker-compose.yml", "up", "-d", "")
+	cmd.Dir = "/opt/sites"
+	assert.Equal(t, "cd /opt/sites && docker-compose -f /opt/sites/shop.com/docker-compose.yml up -d ''", CommandLine(cmd))
+
+	// Values passed to containers are redacted, names and queries are not
+	cmd = exec.Command("docker", "run", "-e", "MYSQL_PWD=secret", "--env", "TOKEN=abc", "--env=KEY=x y", "-e", "DEBUG",
+		"mysql", "mysql", "-e", "SELECT 1 WHERE a = 1")
+	assert.Equal(t, "docker run -e 'MYSQL_PWD=***' --env 'TOKEN=***' '--env=KEY=***' -e DEBUG mysql mysql -e 'SELECT 1 WHERE a = 1'",
+		CommandLine(cmd))
+
+	plan := setupDryRun(t)
+	assert.NoError(t, Run(exec.Command("docker", "exec", "-e", "MYSQL_PWD=secret", "mysql", "true")))
+	assert.NotContains(t, plan.String(), "secret")
+}
+
+func TestDryRunCommands(t *testing.T) {
+	plan := setupDryRun(t)
+	marker := filepath.Join(t.TempDir(), "ran")
+
+	assert.NoError(t, Run(exec.Command("touch", marker)))
+	output, err := CombinedOutput(exec.Command("touch", marker))
+	assert.NoError(t, err)
+	assert.Empty(t, output)
+	assert.NoFileExists(t, marker)
+
+	cmd := exec.Command("tee", "/etc/systemd/system/ploy-agent.service")
+	cmd.Stdin = strings.NewReader("[Unit]\nDescription=ploy agent\n")
+	assert.NoError(t, Run(cmd))
+
+	assert.Equal(t, "[dry-run] run: touch "+marker+"\n"+
+		"[dry-run] run: touch "+marker+"\n"+
+		"[dry-run] run: tee /etc/systemd/system/ploy-agent.service\n"+
+		"    | [Unit]\n"+
+		"    | Description=ploy agent\n", plan.String())
+
+	// Queries still run
+	output, err = Query(exec.Command("echo", "Up 2 hours"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Up 2 hours\n", string(output))
+}
+
+func TestDryRunFiles(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.conf")
+	assert.NoError(t, os.WriteFile(existing, []byte("keep"), 0644))
+
+	plan := setupDryRun(t)
+	path := filepath.Join(dir, "sites", "shop.com.conf")
+	assert.NoError(t, MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, MkdirAll(dir, 0755))
+	assert.NoError(t, WriteFile(path, []byte("server {\n}\n"), 0644))
+	assert.NoError(t, Remove(existing))
+	assert.True(t, os.IsNotExist(Remove(path)))
+	assert.NoError(t, RemoveAll(dir))
+
+	assert.Equal(t, "[dry-run] mkdir -p "+filepath.Dir(path)+" (0755)\n"+
+		"[dry-run] write "+path+" (0644, 11 bytes)\n"+
+		"    | server {\n"+
+		"    | }\n"+
+		"[dry-run] rm "+existing+"\n"+
+		"[dry-run] rm -rf "+dir+"\n", plan.String())
+
+	assert.NoDirExists(t, filepath.Dir(path))
+	assert.FileExists(t, existing)
+}
+
+func TestFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sites", "shop.com.conf")
+	assert.NoError(t, MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, WriteFile(path, []byte("server {}"), 0600))
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// A link is replaced like ln -sfn does
+	link := filepath.Join(filepath.Dir(path), "enabled.conf")
+	assert.NoError(t, Symlink(filepath.Join(filepath.Dir(path), "old.conf"), link))
+	assert.NoError(t, Symlink(path, link))
+	target, err := os.Readlink(link)
+	assert.NoError(t, err)
+	assert.Equal(t, path, target)
+
+	assert.NoError(t, Remove(path))
+	assert.NoFileExists(t, path)
+}
+
+func TestProgram(t *testing.T) {
+	for cmdline, program := range map[string]string{
+		"docker compose up -d":                        "docker",
+		"/usr/bin/docker ps":                          "docker",
+		"dockerd-rootless-setuptool.sh install":       "dockerd-rootless-setuptool.sh",
+		"sudo -n docker ps":                           "docker",
+		"sudo -u www-data -- /usr/bin/docker ps":      "docker",
+		"sudo -nu root docker ps":                     "docker",
+		"sudo -uroot docker ps":                       "docker",
+		"sudo --user=root --non-interactive nginx -t": "nginx",
+		"sudo --user root nginx -t":                   "nginx",
+		"sudo -n":                                     "sudo",
+	} {
+		args := strings.Fields(cmdline)
+		assert.Equal(t, program, Program(exec.Command(args[0], args[1:]...)), cmdline)
+	}
+}
+
+func TestRunError(t *testing.T) {
+	err := Run(exec.Command("sh", "-c", "echo starting; echo 'no such service: wordpress' >&2; exit 3"))
+	var runErr *Error
+	if assert.ErrorAs(t, err, &runErr) {
+		assert.Equal(t, 3, runErr.ExitCode)
+		assert.Equal(t, "sh", runErr.Program)
+		assert.Equal(t, "no such service: wordpress", runErr.Stderr)
+		assert.Equal(t, "`sh -c 'echo starting; echo '\\''no such service: wordpress'\\'' >&2; exit 3'` failed: "+
+			"exit status 3: no such service: wordpress", err.Error())
+	}
+
+	err = Run(exec.Command("sh", "-c", "exit 1", "-e", "PASSWORD=secret"))
+	assert.NotContains(t, err.Error(), "secret")
+
+	// Stderr still reaches the caller's writer
+	var stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", "echo oops >&2; exit 1")
+	cmd.Stderr = &stderr
+	err = Run(cmd)
+	assert.ErrorAs(t, err, &runErr)
+	assert.Equal(t, "oops\n", stderr.String())
+	assert.Equal(t, "oops", runErr.Stderr)
+
+	output, err := CombinedOutput(exec.Command("sh", "-c", "echo 'nginx: [emerg] unknown directive' >&2; exit 1"))
+	assert.Equal(t, "nginx: [emerg] unknown directive\n", string(output))
+	assert.ErrorAs(t, err, &runErr)
+
+	_, err = Query(exec.Command(filepath.Join(t.TempDir(), "missing")))
+	if assert.ErrorAs(t, err, &runErr) {
+		assert.Equal(t, -1, runErr.ExitCode)
+	}
+}
+
+func TestStderrTail(t *testing.T) {
+	err := Run(exec.Command("sh", "-c", "for i in $(seq 1 1000); do echo \"line $i\" >&2; done; exit 1"))
+	var runErr *Error
+	if assert.ErrorAs(t, err, &runErr) {
+		assert.LessOrEqual(t, len(runErr.Stderr), stderrTail)
+		assert.True(t, strings.HasPrefix(runErr.Stderr, "line "))
+		assert.True(t, strings.HasSuffix(runErr.Stderr, "line 1000"))
+	}
+}
+
+func TestTimeoutStopsProcessGroup(t *testing.T) {
+	oldTimeout := Timeout
+	Timeout = 200 * time.Millisecond
+	defer func() { Timeout = oldTimeout }()
+
+	// The shell starts a child and ignores SIGTERM, like a wedged docker compose
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	start := time.Now()
+	oldKillGrace := KillGrace
+	KillGrace = 200 * time.Millisecond
+	defer func() { KillGrace = oldKillGrace }()
+	err := Run(exec.Command("sh", "-c", "trap '' TERM; sleep 30 & echo $! > "+pidFile+"; wait"))
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, err.Error(), "timed out after 200ms")
+
+	data, readErr := os.ReadFile(pidFile)
+	if assert.NoError(t, readErr) {
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		assert.Eventually(t, func() bool {
+			return syscall.Kill(pid, 0) != nil
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+}
+
+// signalWriter sends SIGINT to the test process once a command is traced as started
+type signalWriter struct {
+	bytes.Buffer
+}
+
+func (w *signalWriter) Write(p []byte) (int, error) {
+	if strings.HasPrefix(string(p), "[debug] exec:") {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			syscall.Kill(os.Getpid(), syscall.SIGINT)
+		}()
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestInterruptStopsCommand(t *testing.T) {
+	trace := &signalWriter{}
+	Debug = true
+	Trace = trace
+	defer func() {
+		Debug = false
+		Trace = os.Stderr
+	}()
+
+	start := time.Now()
+	err := Run(exec.Command("sleep", "30"))
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.ErrorIs(t, err, ErrInterrupted)
+	assert.Contains(t, trace.String(), "[debug] exec: sleep 30\n")
+	assert.Contains(t, trace.String(), "[debug] exit -1 after ")
+}
+
+func TestDebugTrace(t *testing.T) {
+	var trace bytes.Buffer
+	Debug = true
+	Trace = &trace
+	defer func() {
+		Debug = false
+		Trace = os.Stderr
+	}()
+
+	output, err := Query(exec.Command("echo", "Up 2 hours"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Up 2 hours\n", string(output))
+	assert.Regexp(t, `^\[debug\] exec: echo 'Up 2 hours'\n\[debug\] exit 0 after \d+(\.\d+)?m?s: echo 'Up 2 hours'\n$`, trace.String())
+}
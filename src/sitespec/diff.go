@@ -0,0 +1,112 @@
+package sitespec
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+)
+
+// hidden stands in for secret values in a plan
+const hidden = "(hidden)"
+
+// Change is a difference between the recorded and the desired state of a site
+type Change struct {
+	Field string
+	From  string
+	To    string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s → %s", c.Field, c.From, c.To)
+}
+
+// Diff returns the differences between two records of a site, in a fixed order.
+// Database passwords and environment values are not shown.
+func Diff(current, desired *registry.Site) []Change {
+	var changes []Change
+	add := func(field, from, to string) {
+		if from != to {
+			changes = append(changes, Change{Field: field, From: orNone(from), To: orNone(to)})
+		}
+	}
+
+	add("aliases", strings.Join(current.Aliases, ", "), strings.Join(desired.Aliases, ", "))
+	add("site_id", current.SiteID, desired.SiteID)
+	add("type", current.Type, desired.Type)
+	add("php_version", current.PHPVersion, desired.PHPVersion)
+
+	add("database.source", current.Database.Source, desired.Database.Source)
+	if !(desired.Database.Source == "internal" && desired.Database.Host == "") {
+		add("database.host", current.Database.Host, desired.Database.Host)
+		add("database.port", current.Database.Port, desired.Database.Port)
+		add("database.name", current.Database.Name, desired.Database.Name)
+		add("database.user", current.Database.User, desired.Database.User)
+		if current.Database.Password != desired.Database.Password {
+			changes = append(changes, Change{Field: "database.password", From: hidden, To: hidden})
+		}
+	}
+
+	add("scaling.type", current.ScalingType, desired.ScalingType)
+	add("scaling.replicas", strconv.Itoa(current.Replicas), strconv.Itoa(desired.Replicas))
+	add("scaling.min_replicas", strconv.Itoa(current.MinReplicas), strconv.Itoa(desired.MinReplicas))
+	add("scaling.max_replicas", strconv.Itoa(current.MaxReplicas), strconv.Itoa(desired.MaxReplicas))
+
+	names := map[string]bool{}
+	for name := range current.Env {
+		names[name] = true
+	}
+	for name := range desired.Env {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		from, hadValue := current.Env[name]
+		to, hasValue := desired.Env[name]
+		if hadValue && hasValue && from == to {
+			continue
+		}
+		change := Change{Field: "env." + name, From: hidden, To: hidden}
+		if !hadValue {
+			change.From = "(unset)"
+		}
+		if !hasValue {
+			change.To = "(unset)"
+		}
+		changes = append(changes, change)
+	}
+
+	add("cron", cronJobs(current.Cron), cronJobs(desired.Cron))
+	add("backups.schedule", current.Backup.Schedule, desired.Backup.Schedule)
+	add("backups.keep", strconv.Itoa(current.Backup.Keep), strconv.Itoa(desired.Backup.Keep))
+	add("tls", strconv.FormatBool(current.TLS), strconv.FormatBool(desired.TLS))
+
+	// Records of older versions leave the health check empty, which means the defaults
+	check := current.HealthCheck.WithDefaults()
+	add("health_check.path", check.Path, desired.HealthCheck.Path)
+	add("health_check.expected_status", strconv.Itoa(check.ExpectedStatus),
+		strconv.Itoa(desired.HealthCheck.ExpectedStatus))
+	add("health_check.timeout", check.Timeout, desired.HealthCheck.Timeout)
+	return changes
+}
+
+func cronJobs(jobs []registry.CronJob) string {
+	lines := make([]string, len(jobs))
+	for i, job := range jobs {
+		lines[i] = fmt.Sprintf("%q %s", job.Schedule, job.Command)
+	}
+	return strings.Join(lines, "; ")
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "(none)"
+	}
+	return value
+}
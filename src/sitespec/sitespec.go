@@ -0,0 +1,309 @@
+package sitespec
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/ploycloud/ploy-server-cli/src/health"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"gopkg.in/yaml.v2"
+)
+
+// Defaults for fields a spec leaves out, the same as those of `ploy sites new`
+const (
+	DefaultType       = "wp"
+	DefaultPHPVersion = "8.3"
+)
+
+var (
+	domainPattern     = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)+$`)
+	phpVersionPattern = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+	envNamePattern    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	cronFieldPattern  = regexp.MustCompile(`^[0-9A-Za-z*/,-]+$`)
+	variablePattern   = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// cronMacros are the schedules cron accepts instead of five fields
+var cronMacros = map[string]bool{
+	"@reboot": true, "@yearly": true, "@annually": true, "@monthly": true,
+	"@weekly": true, "@daily": true, "@midnight": true, "@hourly": true,
+}
+
+// Scaling is how many web containers a site runs
+type Scaling struct {
+	Type string `yaml:"type"`
+	// Replicas is the number of replicas of a static site, and the minimum of a
+	// dynamic one
+	Replicas    int `yaml:"replicas"`
+	MaxReplicas int `yaml:"max_replicas"`
+}
+
+// Spec is a site as described in a site.yaml file. The first domain is the site's
+// domain, the others are served as aliases.
+type Spec struct {
+	Domains     []string              `yaml:"domains"`
+	Hostname    string                `yaml:"hostname"`
+	SiteID      string                `yaml:"site_id"`
+	Type        string                `yaml:"type"`
+	PHPVersion  string                `yaml:"php_version"`
+	Database    registry.Database     `yaml:"database"`
+	Scaling     Scaling               `yaml:"scaling"`
+	Env         map[string]string     `yaml:"env"`
+	Cron        []registry.CronJob    `yaml:"cron"`
+	Backups     registry.BackupPolicy `yaml:"backups"`
+	TLS         bool                  `yaml:"tls"`
+	HealthCheck health.Check          `yaml:"health_check"`
+}
+
+// Domain returns the site's domain
+func (s *Spec) Domain() string {
+	if len(s.Domains) == 0 {
+		return ""
+	}
+	return s.Domains[0]
+}
+
+// Load reads and validates a site.yaml file, see Parse
+func Load(path string) (*Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses and validates a site spec. Unknown fields are rejected. ${NAME} in
+// the database settings and env values is replaced by the environment variable
+// NAME, so secrets can stay out of the file.
+func Parse(data []byte) (*Spec, error) {
+	var spec Spec
+	if err := yaml.UnmarshalStrict(data, &spec); err != nil {
+		return nil, fmt.Errorf("invalid site spec: %v", err)
+	}
+
+	for _, field := range []*string{&spec.Database.Host, &spec.Database.Port, &spec.Database.Name,
+		&spec.Database.User, &spec.Database.Password} {
+		value, err := expand(*field)
+		if err != nil {
+			return nil, err
+		}
+		*field = value
+	}
+	for name, value := range spec.Env {
+		value, err := expand(value)
+		if err != nil {
+			return nil, err
+		}
+		spec.Env[name] = value
+	}
+
+	spec.setDefaults()
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// expand replaces ${NAME} with the environment variable NAME, which must be set
+func expand(value string) (string, error) {
+	var err error
+	result := variablePattern.ReplaceAllStringFunc(value, func(match string) string {
+		name := variablePattern.FindStringSubmatch(match)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v
+	})
+	return result, err
+}
+
+func (s *Spec) setDefaults() {
+	for i, domain := range s.Domains {
+		s.Domains[i] = strings.ToLower(strings.TrimSpace(domain))
+	}
+	if s.Type == "" {
+		s.Type = DefaultType
+	}
+	if s.PHPVersion == "" {
+		s.PHPVersion = DefaultPHPVersion
+	}
+	if s.Database.Source == "" {
+		s.Database.Source = "internal"
+	}
+	if s.Scaling.Type == "" {
+		s.Scaling.Type = "static"
+	}
+	if s.Scaling.Replicas == 0 {
+		s.Scaling.Replicas = 1
+	}
+	s.HealthCheck = s.HealthCheck.WithDefaults()
+}
+
+// Validate checks the spec the way `ploy sites new` checks its flags, and the
+// parts only a spec has
+func (s *Spec) Validate() error {
+	if len(s.Domains) == 0 {
+		return fmt.Errorf("at least one domain is required")
+	}
+	seen := map[string]bool{}
+	for _, domain := range s.Domains {
+		if !ValidDomain(domain) {
+			return fmt.Errorf("invalid domain %q", domain)
+		}
+		if seen[domain] {
+			return fmt.Errorf("domain %s is listed twice", domain)
+		}
+		seen[domain] = true
+	}
+
+	if s.Type != "wp" {
+		return fmt.Errorf("invalid site type %q (use wp)", s.Type)
+	}
+	if !phpVersionPattern.MatchString(s.PHPVersion) {
+		return fmt.Errorf("invalid php_version %q (use a version such as 8.3)", s.PHPVersion)
+	}
+
+	switch s.Database.Source {
+	case "internal":
+		if s.Database != (registry.Database{Source: "internal"}) {
+			return fmt.Errorf("the internal database is set up by ploy, only set source")
+		}
+	case "external":
+		fields := []struct{ name, value string }{{"host", s.Database.Host}, {"port", s.Database.Port},
+			{"name", s.Database.Name}, {"user", s.Database.User}, {"password", s.Database.Password}}
+		for _, field := range fields {
+			if field.value == "" {
+				return fmt.Errorf("database %s is required for an external database", field.name)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid database source %q (use internal or external)", s.Database.Source)
+	}
+
+	switch s.Scaling.Type {
+	case "static", "dynamic":
+	default:
+		return fmt.Errorf("invalid scaling type %q (use static or dynamic)", s.Scaling.Type)
+	}
+	if s.Scaling.Replicas < 1 {
+		return fmt.Errorf("replicas must be at least 1")
+	}
+	if s.Scaling.Type == "dynamic" && s.Scaling.MaxReplicas < s.Scaling.Replicas {
+		return fmt.Errorf("max_replicas must be greater than or equal to replicas")
+	}
+	if s.Scaling.Type == "static" && s.Scaling.MaxReplicas != 0 {
+		return fmt.Errorf("max_replicas is only used by dynamic scaling")
+	}
+
+	for name, value := range s.Env {
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+		if strings.HasPrefix(name, "WORDPRESS_DB_") {
+			return fmt.Errorf("environment variable %s is set by ploy from the database settings", name)
+		}
+		if strings.ContainsAny(value, "\n\r") {
+			return fmt.Errorf("environment variable %s must be a single line", name)
+		}
+	}
+
+	for _, job := range s.Cron {
+		if err := ValidateSchedule(job.Schedule); err != nil {
+			return err
+		}
+		if strings.TrimSpace(job.Command) == "" || strings.ContainsAny(job.Command, "\n\r") {
+			return fmt.Errorf("cron job %q needs a command on a single line", job.Schedule)
+		}
+	}
+	if s.Backups.Schedule != "" {
+		if err := ValidateSchedule(s.Backups.Schedule); err != nil {
+			return fmt.Errorf("backups: %w", err)
+		}
+	}
+	if s.Backups.Keep < 0 {
+		return fmt.Errorf("backups keep must not be negative")
+	}
+
+	return s.HealthCheck.Validate()
+}
+
+// ValidDomain reports whether domain is a lowercase domain name with at least
+// two labels
+func ValidDomain(domain string) bool {
+	return domainPattern.MatchString(domain)
+}
+
+// ValidateSchedule accepts the five cron fields or a macro such as @daily
+func ValidateSchedule(schedule string) error {
+	fields := strings.Fields(schedule)
+	if len(fields) == 1 && cronMacros[fields[0]] {
+		return nil
+	}
+	if len(fields) != 5 {
+		return fmt.Errorf("invalid cron schedule %q (use five fields or a macro such as @daily)", schedule)
+	}
+	for _, field := range fields {
+		if !cronFieldPattern.MatchString(field) {
+			return fmt.Errorf("invalid cron schedule %q", schedule)
+		}
+	}
+	return nil
+}
+
+// Site returns the record current should be changed into to match the spec. It
+// keeps what a spec does not describe, such as the reserved ports, the database
+// credentials of the internal database and the replica count the autoscaler
+// chose within the spec's bounds. current is nil for a new site.
+func (s *Spec) Site(current *registry.Site) *registry.Site {
+	site := &registry.Site{}
+	if current != nil {
+		record := *current
+		site = &record
+	}
+
+	site.Domain = s.Domain()
+	site.Aliases = nil
+	if len(s.Domains) > 1 {
+		site.Aliases = append([]string(nil), s.Domains[1:]...)
+	}
+	site.Hostname = s.Hostname
+	site.SiteID = s.SiteID
+	site.Type = s.Type
+	site.PHPVersion = s.PHPVersion
+	site.ComposeFile = fmt.Sprintf("docker-compose-wp-php%s.yml", s.PHPVersion)
+
+	site.ScalingType = s.Scaling.Type
+	site.MinReplicas = s.Scaling.Replicas
+	site.MaxReplicas = s.Scaling.MaxReplicas
+	if s.Scaling.Type == "dynamic" && current != nil {
+		site.Replicas = current.Replicas
+		if site.Replicas < site.MinReplicas {
+			site.Replicas = site.MinReplicas
+		}
+		if site.Replicas > site.MaxReplicas {
+			site.Replicas = site.MaxReplicas
+		}
+	} else {
+		site.Replicas = s.Scaling.Replicas
+	}
+
+	if s.Database.Source == "external" {
+		site.Database = s.Database
+	} else if current == nil || current.Database.Source != "internal" {
+		// The credentials are looked up from the MySQL service when the site is applied
+		site.Database = registry.Database{Source: "internal"}
+	}
+
+	site.HealthCheck = s.HealthCheck
+	site.Env = nil
+	if len(s.Env) > 0 {
+		site.Env = s.Env
+	}
+	site.Cron = s.Cron
+	site.Backup = s.Backups
+	site.TLS = s.TLS
+	return site
+}
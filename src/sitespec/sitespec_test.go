@@ -0,0 +1,159 @@
+package sitespec
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ploycloud/ploy-server-cli/src/health"
+	"github.com/ploycloud/ploy-server-cli/src/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+const shopSpec = `
+domains:
+  - Shop.com
+  - www.shop.com
+php_version: "8.2"
+database:
+  source: external
+  host: db.internal
+  port: "3306"
+  name: shop
+  user: shop
+  password: ${SHOP_DB_PASSWORD}
+scaling:
+  type: dynamic
+  replicas: 2
+  max_replicas: 4
+env:
+  WP_DEBUG: "false"
+cron:
+  - schedule: "*/5 * * * *"
+    command: wp cron event run --due-now
+backups:
+  schedule: "@daily"
+  keep: 7
+tls: true
+`
+
+func TestLoad(t *testing.T) {
+	t.Setenv("SHOP_DB_PASSWORD", "s3cret")
+	path := filepath.Join(t.TempDir(), "site.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(shopSpec), 0644))
+
+	spec, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, &Spec{
+		Domains:    []string{"shop.com", "www.shop.com"},
+		Type:       "wp",
+		PHPVersion: "8.2",
+		Database: registry.Database{Source: "external", Host: "db.internal", Port: "3306", Name: "shop",
+			User: "shop", Password: "s3cret"},
+		Scaling:     Scaling{Type: "dynamic", Replicas: 2, MaxReplicas: 4},
+		Env:         map[string]string{"WP_DEBUG": "false"},
+		Cron:        []registry.CronJob{{Schedule: "*/5 * * * *", Command: "wp cron event run --due-now"}},
+		Backups:     registry.BackupPolicy{Schedule: "@daily", Keep: 7},
+		TLS:         true,
+		HealthCheck: health.DefaultCheck(),
+	}, spec)
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestParseDefaults(t *testing.T) {
+	spec, err := Parse([]byte("domains: [blog.com]\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "wp", spec.Type)
+	assert.Equal(t, "8.3", spec.PHPVersion)
+	assert.Equal(t, registry.Database{Source: "internal"}, spec.Database)
+	assert.Equal(t, Scaling{Type: "static", Replicas: 1}, spec.Scaling)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"domains: []":                                                         "at least one domain is required",
+		"domains: [localhost]":                                                `invalid domain "localhost"`,
+		"domains: [a.com, A.com]":                                             "domain a.com is listed twice",
+		"domains: [a.com]\ntype: laravel":                                     `invalid site type "laravel" (use wp)`,
+		"domains: [a.com]\nphp_version: 8":                                    `invalid php_version "8" (use a version such as 8.3)`,
+		"domains: [a.com]\nphp: 8.3":                                          "invalid site spec: yaml: unmarshal errors:\n  line 2: field php not found in type sitespec.Spec",
+		"domains: [a.com]\ndatabase: {host: x}":                               "the internal database is set up by ploy, only set source",
+		"domains: [a.com]\ndatabase: {source: external, host: x}":             "database port is required for an external database",
+		"domains: [a.com]\ndatabase: {source: external, password: '${NOPE}'}": "environment variable NOPE is not set",
+		"domains: [a.com]\nscaling: {type: dynamic, replicas: 2}":             "max_replicas must be greater than or equal to replicas",
+		"domains: [a.com]\nscaling: {max_replicas: 3}":                        "max_replicas is only used by dynamic scaling",
+		"domains: [a.com]\nenv: {WORDPRESS_DB_HOST: x}":                       "environment variable WORDPRESS_DB_HOST is set by ploy from the database settings",
+		"domains: [a.com]\nenv: {'1X': x}":                                    `invalid environment variable name "1X"`,
+		"domains: [a.com]\ncron: [{schedule: '* * *', command: ls}]":          `invalid cron schedule "* * *" (use five fields or a macro such as @daily)`,
+		"domains: [a.com]\ncron: [{schedule: '@hourly'}]":                     `cron job "@hourly" needs a command on a single line`,
+		"domains: [a.com]\nbackups: {schedule: 'every day'}":                  `backups: invalid cron schedule "every day" (use five fields or a macro such as @daily)`,
+		"domains: [a.com]\nbackups: {keep: -1}":                               "backups keep must not be negative",
+	}
+	for spec, message := range tests {
+		_, err := Parse([]byte(spec))
+		assert.EqualError(t, err, message, spec)
+	}
+}
+
+func TestSite(t *testing.T) {
+	t.Setenv("SHOP_DB_PASSWORD", "s3cret")
+	spec, err := Parse([]byte(shopSpec))
+	assert.NoError(t, err)
+
+	// A new site
+	site := spec.Site(nil)
+	assert.Equal(t, "shop.com", site.Domain)
+	assert.Equal(t, []string{"www.shop.com"}, site.Aliases)
+	assert.Equal(t, "docker-compose-wp-php8.2.yml", site.ComposeFile)
+	assert.Equal(t, 2, site.Replicas)
+	assert.Equal(t, 2, site.MinReplicas)
+	assert.Equal(t, 4, site.MaxReplicas)
+
+	// The ports and the replica count the autoscaler chose are kept
+	current := &registry.Site{Domain: "shop.com", HostPort: 20000, PortCount: 4, Replicas: 3, ScalingType: "dynamic"}
+	site = spec.Site(current)
+	assert.Equal(t, 20000, site.HostPort)
+	assert.Equal(t, 4, site.PortCount)
+	assert.Equal(t, 3, site.Replicas)
+	current.Replicas = 1
+	assert.Equal(t, 2, spec.Site(current).Replicas)
+
+	// The credentials of the internal database are kept
+	spec, err = Parse([]byte("domains: [blog.com]\n"))
+	assert.NoError(t, err)
+	internal := registry.Database{Source: "internal", Host: "mysql", Port: "3306", Name: "wp", User: "wp", Password: "x"}
+	site = spec.Site(&registry.Site{Domain: "blog.com", Database: internal})
+	assert.Equal(t, internal, site.Database)
+	assert.Nil(t, site.Aliases)
+}
+
+func TestDiff(t *testing.T) {
+	t.Setenv("SHOP_DB_PASSWORD", "s3cret")
+	spec, err := Parse([]byte(shopSpec))
+	assert.NoError(t, err)
+
+	current := spec.Site(nil)
+	assert.Empty(t, Diff(current, spec.Site(current)))
+
+	spec.Domains = []string{"shop.com"}
+	spec.PHPVersion = "8.3"
+	spec.Database.Password = "n3w"
+	spec.Env = map[string]string{"WP_DEBUG": "true", "WP_CACHE": "true"}
+	spec.Cron = nil
+	spec.Backups.Keep = 14
+	var changes []string
+	for _, change := range Diff(current, spec.Site(current)) {
+		changes = append(changes, change.String())
+	}
+	assert.Equal(t, []string{
+		"aliases: www.shop.com → (none)",
+		"php_version: 8.2 → 8.3",
+		"database.password: (hidden) → (hidden)",
+		"env.WP_CACHE: (unset) → (hidden)",
+		"env.WP_DEBUG: (hidden) → (hidden)",
+		`cron: "*/5 * * * *" wp cron event run --due-now → (none)`,
+		"backups.keep: 7 → 14",
+	}, changes)
+}
@@ -0,0 +1,233 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DockerStatsFormat is the --format passed to `docker stats` for ParseDockerStats
+const DockerStatsFormat = "{{.ID}}\t{{.Name}}\t{{.CPUPerc}}\t{{.MemUsage}}\t{{.MemPerc}}\t{{.NetIO}}\t{{.BlockIO}}"
+
+// Container is the usage of a single container as reported by `docker stats`
+type Container struct {
+	ID            string  `json:"id"`
+	Name          string  `json:"name"`
+	CPU           float64 `json:"cpu_percent"`
+	Memory        uint64  `json:"memory_bytes"`
+	MemoryLimit   uint64  `json:"memory_limit_bytes"`
+	MemoryPercent float64 `json:"memory_percent"`
+	NetRx         uint64  `json:"net_rx_bytes"`
+	NetTx         uint64  `json:"net_tx_bytes"`
+	BlockRead     uint64  `json:"block_read_bytes"`
+	BlockWrite    uint64  `json:"block_write_bytes"`
+}
+
+// Disk is the disk space used by a site. A value of -1 means it could not be
+// determined.
+type Disk struct {
+	SiteDir  int64 `json:"site_dir_bytes"`
+	Volumes  int64 `json:"volumes_bytes"`
+	Database int64 `json:"database_bytes"`
+}
+
+// Total returns the sum of the known values
+func (d Disk) Total() int64 {
+	var total int64
+	for _, v := range []int64{d.SiteDir, d.Volumes, d.Database} {
+		if v > 0 {
+			total += v
+		}
+	}
+	return total
+}
+
+// Site is the usage of all containers of a site
+type Site struct {
+	Site          string      `json:"site"`
+	Containers    []Container `json:"containers"`
+	CPU           float64     `json:"cpu_percent"`
+	Memory        uint64      `json:"memory_bytes"`
+	MemoryPercent float64     `json:"memory_percent"`
+	NetRx         uint64      `json:"net_rx_bytes"`
+	NetTx         uint64      `json:"net_tx_bytes"`
+	BlockRead     uint64      `json:"block_read_bytes"`
+	BlockWrite    uint64      `json:"block_write_bytes"`
+	Disk          *Disk       `json:"disk,omitempty"`
+}
+
+// ParseDockerStats parses `docker stats --no-stream --format DockerStatsFormat`
+func ParseDockerStats(output string) ([]Container, error) {
+	var containers []Container
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("unexpected docker stats line: %q", line)
+		}
+
+		c := Container{ID: fields[0], Name: fields[1]}
+		var err error
+		if c.CPU, err = parsePercent(fields[2]); err != nil {
+			return nil, err
+		}
+		if c.Memory, c.MemoryLimit, err = parsePair(fields[3]); err != nil {
+			return nil, err
+		}
+		if c.MemoryPercent, err = parsePercent(fields[4]); err != nil {
+			return nil, err
+		}
+		if c.NetRx, c.NetTx, err = parsePair(fields[5]); err != nil {
+			return nil, err
+		}
+		if c.BlockRead, c.BlockWrite, err = parsePair(fields[6]); err != nil {
+			return nil, err
+		}
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
+
+// Aggregate sums the usage of a site's containers
+func Aggregate(site string, containers []Container) Site {
+	s := Site{Site: site, Containers: containers}
+	if s.Containers == nil {
+		s.Containers = []Container{}
+	}
+	for _, c := range containers {
+		s.CPU += c.CPU
+		s.Memory += c.Memory
+		s.MemoryPercent += c.MemoryPercent
+		s.NetRx += c.NetRx
+		s.NetTx += c.NetTx
+		s.BlockRead += c.BlockRead
+		s.BlockWrite += c.BlockWrite
+	}
+	return s
+}
+
+// Sort keys accepted by SortBy
+const (
+	SortCPU    = "cpu"
+	SortMemory = "memory"
+	SortNet    = "net"
+	SortIO     = "io"
+	SortDisk   = "disk"
+	SortName   = "name"
+)
+
+// SortBy orders sites with the heaviest user of the given resource first
+func SortBy(sites []Site, key string) error {
+	var less func(a, b Site) bool
+	switch key {
+	case SortCPU:
+		less = func(a, b Site) bool { return a.CPU > b.CPU }
+	case SortMemory:
+		less = func(a, b Site) bool { return a.Memory > b.Memory }
+	case SortNet:
+		less = func(a, b Site) bool { return a.NetRx+a.NetTx > b.NetRx+b.NetTx }
+	case SortIO:
+		less = func(a, b Site) bool { return a.BlockRead+a.BlockWrite > b.BlockRead+b.BlockWrite }
+	case SortDisk:
+		less = func(a, b Site) bool { return diskTotal(a) > diskTotal(b) }
+	case SortName:
+		less = func(a, b Site) bool { return a.Site < b.Site }
+	default:
+		return fmt.Errorf("unknown sort key %q (use cpu, memory, net, io, disk or name)", key)
+	}
+	sort.SliceStable(sites, func(i, j int) bool { return less(sites[i], sites[j]) })
+	return nil
+}
+
+func diskTotal(s Site) int64 {
+	if s.Disk == nil {
+		return 0
+	}
+	return s.Disk.Total()
+}
+
+func parsePercent(s string) (float64, error) {
+	s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "%"))
+	if s == "" || s == "--" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	return v, nil
+}
+
+// parsePair parses the "used / total" and "in / out" columns of docker stats
+func parsePair(s string) (uint64, uint64, error) {
+	if strings.TrimSpace(s) == "--" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid docker stats value %q", s)
+	}
+	a, err := ParseSize(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	b, err := ParseSize(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return a, b, nil
+}
+
+var units = map[string]float64{
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// ParseSize parses sizes as printed by Docker, such as "648B", "1.2kB" or "512MiB"
+func ParseSize(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "--" {
+		return 0, nil
+	}
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i == -1 {
+		i = len(s)
+	}
+	value, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	unit := strings.ToLower(strings.TrimSpace(s[i:]))
+	if unit == "" {
+		unit = "b"
+	}
+	multiplier, ok := units[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit in %q", s)
+	}
+	return uint64(value * multiplier), nil
+}
+
+// FormatBytes prints a size with binary units, e.g. "1.5GiB"
+func FormatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
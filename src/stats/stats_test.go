@@ -0,0 +1,84 @@
+package stats
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]uint64{
+		"648B":   648,
+		"1.2kB":  1200,
+		"512MiB": 512 << 20,
+		"1.5GiB": 3 << 29,
+		"2GB":    2e9,
+		"0B":     0,
+		"--":     0,
+		" 10MB ": 10e6,
+	}
+	for input, expected := range cases {
+		size, err := ParseSize(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, size, input)
+	}
+
+	_, err := ParseSize("12XB")
+	assert.Error(t, err)
+	_, err = ParseSize("lots")
+	assert.Error(t, err)
+}
+
+func TestParseDockerStats(t *testing.T) {
+	output := "abc123\tshop-wordpress-1\t12.50%\t256MiB / 2GiB\t12.50%\t1.2kB / 648B\t4MB / 1MB\n" +
+		"def456\tshop-wordpress-2\t--\t-- / --\t--\t--\t--\n"
+
+	containers, err := ParseDockerStats(output)
+	assert.NoError(t, err)
+	assert.Len(t, containers, 2)
+	assert.Equal(t, Container{
+		ID: "abc123", Name: "shop-wordpress-1", CPU: 12.5,
+		Memory: 256 << 20, MemoryLimit: 2 << 30, MemoryPercent: 12.5,
+		NetRx: 1200, NetTx: 648, BlockRead: 4e6, BlockWrite: 1e6,
+	}, containers[0])
+	assert.Equal(t, Container{ID: "def456", Name: "shop-wordpress-2"}, containers[1])
+
+	_, err = ParseDockerStats("abc123\t12%\n")
+	assert.Error(t, err)
+}
+
+func TestAggregateAndSort(t *testing.T) {
+	shop := Aggregate("shop.com", []Container{
+		{CPU: 10, Memory: 100, NetRx: 5, BlockWrite: 7},
+		{CPU: 30, Memory: 50, NetTx: 5, BlockRead: 1},
+	})
+	assert.Equal(t, 40.0, shop.CPU)
+	assert.Equal(t, uint64(150), shop.Memory)
+	assert.Equal(t, uint64(5), shop.NetRx)
+	assert.Equal(t, uint64(8), shop.BlockRead+shop.BlockWrite)
+	shop.Disk = &Disk{SiteDir: 10, Volumes: -1, Database: 5}
+	assert.Equal(t, int64(15), shop.Disk.Total())
+
+	blog := Aggregate("blog.com", nil)
+	blog.Memory = 500
+	assert.Empty(t, blog.Containers)
+	assert.NotNil(t, blog.Containers)
+
+	sites := []Site{blog, shop}
+	assert.NoError(t, SortBy(sites, SortCPU))
+	assert.Equal(t, "shop.com", sites[0].Site)
+	assert.NoError(t, SortBy(sites, SortMemory))
+	assert.Equal(t, "blog.com", sites[0].Site)
+	assert.NoError(t, SortBy(sites, SortDisk))
+	assert.Equal(t, "shop.com", sites[0].Site)
+	assert.NoError(t, SortBy(sites, SortName))
+	assert.Equal(t, "blog.com", sites[0].Site)
+	assert.Error(t, SortBy(sites, "colour"))
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512B", FormatBytes(512))
+	assert.Equal(t, "1.5KiB", FormatBytes(1536))
+	assert.Equal(t, "256.0MiB", FormatBytes(256<<20))
+	assert.Equal(t, "2.0GiB", FormatBytes(2<<30))
+}
@@ -0,0 +1,243 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ploycloud/ploy-server-cli/src/common"
+	"github.com/ploycloud/ploy-server-cli/src/config"
+)
+
+// ReleaseEndpoint lists the published releases, newest first
+var ReleaseEndpoint = "https://api.github.com/repos/ploycloud/ploy-server-cli/releases"
+
+// ReleaseCacheTTL is how long a release lookup is reused before GitHub is asked again
+var ReleaseCacheTTL = time.Hour
+
+// NoticeInterval is how often the new version notice is shown at most
+const NoticeInterval = 24 * time.Hour
+
+// ReleaseCachePath returns where release lookups and the last notice are cached
+var ReleaseCachePath = func() string {
+	return filepath.Join(common.ServicesDir, "cache", "releases.json")
+}
+
+// ErrReleaseNotFound is returned for a version that was never released
+var ErrReleaseNotFound = errors.New("release not found")
+
+type GitRelease struct {
+	TagName    string `json:"tag_name"`
+	Prerelease bool   `json:"prerelease"`
+	Draft      bool   `json:"draft"`
+	Assets     []struct {
+		Name        string `json:"name"`
+		DownloadURL string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// releaseCache is a release lookup, when GitHub was last asked and when the new
+// version notice was last shown
+type releaseCache struct {
+	Endpoint   string       `json:"endpoint"`
+	FetchedAt  time.Time    `json:"fetched_at"`
+	Releases   []GitRelease `json:"releases"`
+	AskedAt    time.Time    `json:"asked_at,omitempty"`
+	NotifiedAt time.Time    `json:"notified_at,omitempty"`
+}
+
+// CheckForUpdates returns the newest release on channel and whether it is newer
+// than the running version. The release lookup is cached for ReleaseCacheTTL.
+func CheckForUpdates(channel string) (string, bool, error) {
+	release, err := LatestRelease(channel, false)
+	if nil != err {
+		return "", false, err
+	}
+
+	newer, err := CompareVersions(release.TagName, common.CurrentCliVersion)
+	if nil != err {
+		return "", false, err
+	}
+	return release.TagName, newer > 0, nil
+}
+
+// LatestRelease returns the newest release on channel: stable skips pre-releases,
+// beta includes them. With fresh set GitHub is always asked.
+func LatestRelease(channel string, fresh bool) (*GitRelease, error) {
+	if err := config.ValidateUpdateChannel(channel); nil != err {
+		return nil, err
+	}
+	releases, err := listReleases(fresh)
+	if nil != err {
+		return nil, err
+	}
+	return latestOf(releases, channel)
+}
+
+// latestOf returns the newest release on channel in releases
+func latestOf(releases []GitRelease, channel string) (*GitRelease, error) {
+	var latest *GitRelease
+	var latestVersion Version
+	for i, release := range releases {
+		version, err := ParseVersion(release.TagName)
+		if nil != err || release.Draft {
+			continue
+		}
+		if config.UpdateBeta != channel && (release.Prerelease || len(version.Prerelease) > 0) {
+			continue
+		}
+		if nil == latest || version.Compare(latestVersion) > 0 {
+			latest, latestVersion = &releases[i], version
+		}
+	}
+	if nil == latest {
+		return nil, fmt.Errorf("no %s release found", channel)
+	}
+	return latest, nil
+}
+
+// FindRelease returns the release of version, such as 1.2.3 or v1.2.3
+func FindRelease(version string) (*GitRelease, error) {
+	want, err := ParseVersion(version)
+	if nil != err {
+		return nil, err
+	}
+	releases, err := listReleases(true)
+	if nil != err {
+		return nil, err
+	}
+	for i, release := range releases {
+		if v, err := ParseVersion(release.TagName); nil == err && 0 == v.Compare(want) && !release.Draft {
+			return &releases[i], nil
+		}
+	}
+
+	// Older releases are not in the first page of the list
+	res, err := httpClient.Get(ReleaseEndpoint + "/tags/v" + want.String())
+	if nil != err {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if http.StatusNotFound == res.StatusCode {
+		return nil, fmt.Errorf("%w: %s", ErrReleaseNotFound, version)
+	}
+	if http.StatusOK != res.StatusCode {
+		return nil, fmt.Errorf("looking up release %s: %s", version, res.Status)
+	}
+	var release GitRelease
+	if err := json.NewDecoder(res.Body).Decode(&release); nil != err {
+		return nil, err
+	}
+	return &release, nil
+}
+
+// listReleases returns the releases from the cache, or from GitHub when the cache
+// is older than ReleaseCacheTTL or fresh is set
+func listReleases(fresh bool) ([]GitRelease, error) {
+	cache := loadReleaseCache()
+	if !fresh && cache.Endpoint == ReleaseEndpoint && time.Since(cache.FetchedAt) < ReleaseCacheTTL {
+		return cache.Releases, nil
+	}
+
+	if cache.Endpoint != ReleaseEndpoint {
+		cache = releaseCache{Endpoint: ReleaseEndpoint}
+	}
+	// Recorded first, so background refreshes back off while GitHub fails or hangs,
+	// also when the command exits before the lookup ends
+	cache.AskedAt = time.Now()
+	saveReleaseCache(cache)
+	releases, err := fetchReleases()
+	if nil != err {
+		return nil, err
+	}
+
+	cache.FetchedAt, cache.Releases = time.Now(), releases
+	saveReleaseCache(cache)
+	return releases, nil
+}
+
+func fetchReleases() ([]GitRelease, error) {
+	body, err := download(ReleaseEndpoint + "?per_page=50")
+	if nil != err {
+		return nil, err
+	}
+	var releases []GitRelease
+	if err := json.Unmarshal(body, &releases); nil != err {
+		return nil, fmt.Errorf("invalid release list: %w", err)
+	}
+	return releases, nil
+}
+
+// ReleaseRefreshDue reports whether GitHub was last asked for the releases more
+// than ReleaseCacheTTL ago, whether or not that lookup succeeded
+func ReleaseRefreshDue() bool {
+	cache := loadReleaseCache()
+	return cache.Endpoint != ReleaseEndpoint || time.Since(cache.AskedAt) >= ReleaseCacheTTL
+}
+
+// UpdateNotice returns a notice about a newer release on channel. It never asks
+// GitHub, only the cached release lookup is used, and returns an empty string
+// when there is no newer release or a notice was shown less than NoticeInterval ago.
+func UpdateNotice(channel string) string {
+	cache := loadReleaseCache()
+	if cache.Endpoint != ReleaseEndpoint || time.Since(cache.NotifiedAt) < NoticeInterval {
+		return ""
+	}
+	latest, err := latestOf(cache.Releases, channel)
+	if nil != err {
+		return ""
+	}
+	if newer, err := CompareVersions(latest.TagName, common.CurrentCliVersion); nil != err || newer <= 0 {
+		return ""
+	}
+
+	cache.NotifiedAt = time.Now()
+	saveReleaseCache(cache)
+	return fmt.Sprintf("A new version of ploy is available: %s (running %s). Run 'sudo ploy update' to install it.",
+		latest.TagName, common.CurrentCliVersion)
+}
+
+// loadReleaseCache returns the cache, which is empty when it is missing or unreadable
+func loadReleaseCache() releaseCache {
+	var cache releaseCache
+	if data, err := os.ReadFile(ReleaseCachePath()); nil == err {
+		json.Unmarshal(data, &cache)
+	}
+	return cache
+}
+
+// saveReleaseCache writes the cache through a rename, so a reader never sees a
+// partial file. The cache is best effort and errors are ignored.
+func saveReleaseCache(cache releaseCache) {
+	data, err := json.Marshal(cache)
+	if nil != err {
+		return
+	}
+	path := ReleaseCachePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); nil != err {
+		return
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".releases-")
+	if nil != err {
+		return
+	}
+	_, err = tmpFile.Write(data)
+	tmpFile.Close()
+	if nil != err || nil != os.Rename(tmpFile.Name(), path) {
+		os.Remove(tmpFile.Name())
+	}
+}
+
+func getAssetURL(release *GitRelease, name string) string {
+	for _, asset := range release.Assets {
+		if name == asset.Name {
+			return asset.DownloadURL
+		}
+	}
+
+	return ""
+}
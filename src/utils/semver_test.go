@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVersion(t *testing.T) {
+	v, err := ParseVersion("v1.2.3-beta.2+build.5")
+	assert.NoError(t, err)
+	assert.Equal(t, Version{Major: 1, Minor: 2, Patch: 3, Prerelease: []string{"beta", "2"}}, v)
+	assert.Equal(t, "1.2.3-beta.2", v.String())
+
+	for _, invalid := range []string{"", "1.2", "v1.2.x", "1.2.3-", "latest"} {
+		_, err := ParseVersion(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	// Each version is older than the next, following the semver precedence example
+	ordered := []string{
+		"0.5.9", "v0.10.0", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta",
+		"1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.1.0", "2.0.0",
+	}
+	for i := 0; i+1 < len(ordered); i++ {
+		c, err := CompareVersions(ordered[i], ordered[i+1])
+		assert.NoError(t, err)
+		assert.Equal(t, -1, c, "%s < %s", ordered[i], ordered[i+1])
+
+		c, _ = CompareVersions(ordered[i+1], ordered[i])
+		assert.Equal(t, 1, c, "%s > %s", ordered[i+1], ordered[i])
+	}
+
+	c, err := CompareVersions("v1.0.0", "1.0.0+build.7")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, c)
+
+	_, err = CompareVersions("1.0.0", "main")
+	assert.EqualError(t, err, `invalid version "main"`)
+}
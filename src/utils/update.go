@@ -1,153 +1,272 @@
 package utils
 
 import (
-	"encoding/json"
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
+)
+
+// UpdatePublicKey is the base64 encoded ed25519 key that signs the checksums of a
+// release. build.sh sets it from the release signing key; builds without it
+// refuse to update themselves.
+var UpdatePublicKey = ""
 
-	"github.com/ploycloud/ploy-server-cli/src/common"
+// Release assets besides the archives
+const (
+	ChecksumsAsset = "checksums.txt"
+	// SignatureAsset holds the base64 encoded ed25519 signature of ChecksumsAsset
+	SignatureAsset = "checksums.txt.sig"
 )
 
-var ReleaseEndpoint = "https://api.github.com/repos/ploycloud/ploy-server-cli/releases/latest"
+// PreviousSuffix is added to the path of the binary to keep the version an update
+// replaced, for `ploy update --rollback`
+const PreviousSuffix = ".previous"
 
-type GitRelease struct {
-	TagName string `json:"tag_name"`
-	Assets  []struct {
-		Name        string `json:"name"`
-		DownloadURL string `json:"browser_download_url"`
-	} `json:"assets"`
-}
+// maxDownloadSize caps release downloads and the binary extracted from them
+const maxDownloadSize = 256 << 20
 
-func CheckForUpdates() (string, bool, error) {
-	res, err := http.Get(ReleaseEndpoint)
+var (
+	httpClient     = &http.Client{Timeout: 5 * time.Minute}
+	executablePath = currentExecutable
+	goos, goarch   = runtime.GOOS, runtime.GOARCH
+)
 
+// SelfUpdate replaces the running binary with release, which may be older than
+// the running version. The signature of the release checksums and the checksum of
+// the archive are verified before the binary is extracted and swapped in; the
+// binary it replaces is kept for Rollback.
+func SelfUpdate(release *GitRelease) error {
+	publicKey, err := updatePublicKey()
 	if nil != err {
-		return "", false, err
+		return err
 	}
 
-	defer res.Body.Close()
+	archiveName := fmt.Sprintf("ploy-%s-%s.tar.gz", goos, goarch)
+	urls := make(map[string]string)
+	for _, name := range []string{archiveName, ChecksumsAsset, SignatureAsset} {
+		urls[name] = getAssetURL(release, name)
+		if "" == urls[name] {
+			return fmt.Errorf("release %s has no %s", release.TagName, name)
+		}
+	}
+
+	checksums, err := download(urls[ChecksumsAsset])
+	if nil != err {
+		return err
+	}
+	signature, err := download(urls[SignatureAsset])
+	if nil != err {
+		return err
+	}
+	if err := verifySignature(publicKey, checksums, signature); nil != err {
+		return err
+	}
 
-	body, err := io.ReadAll(res.Body)
+	want, err := checksumFor(checksums, archiveName)
 	if nil != err {
-		return "", false, err
+		return err
+	}
+	archive, err := download(urls[archiveName])
+	if nil != err {
+		return err
+	}
+	if got := sha256.Sum256(archive); hex.EncodeToString(got[:]) != want {
+		return fmt.Errorf("checksum mismatch for %s: got %x, want %s", archiveName, got, want)
 	}
 
-	var release GitRelease
-	if err := json.Unmarshal(body, &release); nil != err {
-		return "", false, err
+	binary, err := extractFile(archive, fmt.Sprintf("build/ploy-%s-%s", goos, goarch))
+	if nil != err {
+		return err
 	}
 
-	return release.TagName, release.TagName > common.CurrentCliVersion, nil
+	exe, err := executablePath()
+	if nil != err {
+		return err
+	}
+	return installBinary(exe, binary)
 }
 
-func SelfUpdate() (bool, error) {
-	if 0 != os.Geteuid() {
-		return false, fmt.Errorf("the update command must be run as root")
+// Rollback swaps the running binary with the one the last update replaced, so a
+// second rollback undoes the first
+func Rollback() error {
+	exe, err := executablePath()
+	if nil != err {
+		return err
+	}
+	previous := exe + PreviousSuffix
+	if _, err := os.Stat(previous); nil != err {
+		return fmt.Errorf("no previous version to roll back to: %w", err)
 	}
 
-	release, err := getLatestRelease()
+	current, err := copyToTemp(exe)
 	if nil != err {
-		return false, err
+		return err
 	}
+	if err := os.Rename(previous, exe); nil != err {
+		os.Remove(current)
+		return err
+	}
+	return os.Rename(current, previous)
+}
 
-	fmt.Printf("Release: %s\n", release.TagName)
+func updatePublicKey() (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(UpdatePublicKey)
+	if nil != err || ed25519.PublicKeySize != len(key) {
+		return nil, errors.New("this build of ploy has no release signing key and cannot verify updates, reinstall it with install.sh")
+	}
+	return ed25519.PublicKey(key), nil
+}
 
-	assetURL := getAssetURL(release)
-	if "" == assetURL {
-		return false, fmt.Errorf("no suitable binary found for this system")
+// verifySignature checks the base64 encoded ed25519 signature of the checksums
+func verifySignature(publicKey ed25519.PublicKey, checksums, signature []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if nil != err || !ed25519.Verify(publicKey, checksums, sig) {
+		return fmt.Errorf("the signature of %s is invalid", ChecksumsAsset)
 	}
+	return nil
+}
 
-	fmt.Printf("Download URL: %s\n", assetURL)
+// checksumFor returns the SHA-256 checksum of name from sha256sum output
+func checksumFor(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if 2 == len(fields) && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no checksum for %s", ChecksumsAsset, name)
+}
 
-	// Download the new binary
-	res, err := http.Get(assetURL)
+// extractFile returns the content of the regular file name in a .tar.gz archive
+func extractFile(archive []byte, name string) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
 	if nil != err {
-		return false, err
+		return nil, fmt.Errorf("reading archive: %w", err)
 	}
+	defer gz.Close()
 
-	defer res.Body.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if io.EOF == err {
+			return nil, fmt.Errorf("the archive has no %s", name)
+		}
+		if nil != err {
+			return nil, fmt.Errorf("reading archive: %w", err)
+		}
+		if tar.TypeReg != header.Typeflag || path.Clean(header.Name) != name {
+			continue
+		}
+		content, err := io.ReadAll(io.LimitReader(tr, maxDownloadSize+1))
+		if nil != err {
+			return nil, fmt.Errorf("reading %s from archive: %w", name, err)
+		}
+		if len(content) > maxDownloadSize {
+			return nil, fmt.Errorf("%s in the archive is too large", name)
+		}
+		return content, nil
+	}
+}
 
-	// Create the new binary file
-	tmpFile, err := os.CreateTemp("", "ploy-cli-update")
+// installBinary atomically replaces exe with binary, keeping exe for Rollback
+func installBinary(exe string, binary []byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(exe), ".ploy-update-")
 	if nil != err {
-		return false, err
+		return err
 	}
-
 	defer os.Remove(tmpFile.Name())
 
-	// Write the body to the file
-	_, err = io.Copy(tmpFile, res.Body)
-	if nil != err {
-		return false, err
+	if _, err := tmpFile.Write(binary); nil != err {
+		tmpFile.Close()
+		return err
 	}
-
-	// Close the file
 	if err := tmpFile.Close(); nil != err {
-		return false, err
+		return err
 	}
-
-	// Make the file executable
 	if err := os.Chmod(tmpFile.Name(), 0755); nil != err {
-		return false, err
+		return err
 	}
 
-	// Get current executable path
-	exe, err := os.Executable()
-	if err != nil {
-		return false, err
+	previous, err := copyToTemp(exe)
+	if nil != err {
+		return err
 	}
-	exe, err = filepath.EvalSymlinks(exe)
-	if err != nil {
-		return false, err
+	if err := os.Rename(previous, exe+PreviousSuffix); nil != err {
+		os.Remove(previous)
+		return err
 	}
-
-	// Rename the temporary file to the executable name
-	return os.Rename(tmpFile.Name(), exe) == nil, nil
+	return os.Rename(tmpFile.Name(), exe)
 }
 
-func getLatestRelease() (*GitRelease, error) {
-	res, err := http.Get(ReleaseEndpoint)
-
+// copyToTemp copies a file to a temporary file next to it and returns its path
+func copyToTemp(src string) (string, error) {
+	info, err := os.Stat(src)
 	if nil != err {
-		return nil, err
+		return "", err
 	}
-
-	defer res.Body.Close()
-
-	body, err := io.ReadAll(res.Body)
-
+	content, err := os.ReadFile(src)
 	if nil != err {
-		return nil, err
+		return "", err
 	}
 
-	var release GitRelease
-
-	if err := json.Unmarshal(body, &release); nil != err {
-		return nil, err
+	tmpFile, err := os.CreateTemp(filepath.Dir(src), ".ploy-copy-")
+	if nil != err {
+		return "", err
+	}
+	_, err = tmpFile.Write(content)
+	if closeErr := tmpFile.Close(); nil == err {
+		err = closeErr
+	}
+	if nil == err {
+		err = os.Chmod(tmpFile.Name(), info.Mode().Perm())
+	}
+	if nil != err {
+		os.Remove(tmpFile.Name())
+		return "", err
 	}
+	return tmpFile.Name(), nil
+}
 
-	return &release, nil
+func currentExecutable() (string, error) {
+	exe, err := os.Executable()
+	if nil != err {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
 }
 
-func getAssetURL(release *GitRelease) string {
-	arch := runtime.GOARCH
-	systemOS := runtime.GOOS
-
-	for _, asset := range release.Assets {
-		if ".tar.gz" == filepath.Ext(asset.Name) &&
-			"linux" == systemOS {
-			if "amd64" == arch && "ploy-linux-amd64.tar.gz" == asset.Name {
-				return asset.DownloadURL
-			} else if "arm64" == arch && "ploy-linux-arm64.tar.gz" == asset.Name {
-				return asset.DownloadURL
-			}
-		}
-		// TODO: Add support for other OS and architectures
+func download(url string) ([]byte, error) {
+	res, err := httpClient.Get(url)
+	if nil != err {
+		return nil, err
 	}
+	defer res.Body.Close()
 
-	return ""
+	if http.StatusOK != res.StatusCode {
+		return nil, fmt.Errorf("downloading %s: %s", url, res.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxDownloadSize+1))
+	if nil != err {
+		return nil, fmt.Errorf("downloading %s: %w", url, err)
+	}
+	if len(body) > maxDownloadSize {
+		return nil, fmt.Errorf("downloading %s: too large", url)
+	}
+	return body, nil
 }
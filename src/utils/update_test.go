@@ -1,56 +1,351 @@
 package utils
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestCheckForUpdates(t *testing.T) {
-	// Create a mock server
+// serveReleases points ReleaseEndpoint at a server that lists releases and
+// isolates the release cache, returning how often the list was requested
+func serveReleases(t *testing.T, releases string) *int {
+	requests := 0
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"tag_name": "v1.0.1"}`))
+		if r.URL.Path != "/releases" {
+			http.NotFound(w, r)
+			return
+		}
+		requests++
+		w.Write([]byte(releases))
 	}))
-	defer server.Close()
+	useReleaseServer(t, server.URL+"/releases")
+	t.Cleanup(server.Close)
+	return &requests
+}
 
-	// Set the ReleaseEndpoint to our mock server
-	oldReleaseEndpoint := ReleaseEndpoint
-	ReleaseEndpoint = server.URL
-	defer func() { ReleaseEndpoint = oldReleaseEndpoint }()
+func useReleaseServer(t *testing.T, endpoint string) {
+	cachePath := filepath.Join(t.TempDir(), "cache", "releases.json")
+	oldEndpoint, oldCachePath := ReleaseEndpoint, ReleaseCachePath
+	ReleaseEndpoint = endpoint
+	ReleaseCachePath = func() string { return cachePath }
+	t.Cleanup(func() { ReleaseEndpoint, ReleaseCachePath = oldEndpoint, oldCachePath })
+}
+
+func TestCheckForUpdates(t *testing.T) {
+	serveReleases(t, `[{"tag_name": "v1.0.1"}]`)
 
-	version, hasUpdate, err := CheckForUpdates()
+	version, hasUpdate, err := CheckForUpdates("stable")
 	assert.NoError(t, err)
 	assert.Equal(t, "v1.0.1", version)
 	assert.True(t, hasUpdate)
 }
 
-func TestGetLatestRelease(t *testing.T) {
+func TestCheckForUpdatesComparesSemver(t *testing.T) {
+	serveReleases(t, `[{"tag_name": "v0.10.0"}, {"tag_name": "v0.9.0"}]`)
+
+	// 0.10.0 is newer than 0.5.9, although it sorts before it as text
+	_, hasUpdate, err := CheckForUpdates("stable")
+	assert.NoError(t, err)
+	assert.True(t, hasUpdate)
+}
+
+func TestLatestReleaseChannels(t *testing.T) {
+	serveReleases(t, `[
+		{"tag_name": "v1.3.0-beta.1", "prerelease": true},
+		{"tag_name": "v1.2.1-rc.1"},
+		{"tag_name": "v2.0.0", "draft": true},
+		{"tag_name": "nightly"},
+		{"tag_name": "v1.2.0", "assets": [
+			{"name": "ploy-linux-amd64.tar.gz", "browser_download_url": "https://example.com/ploy-linux-amd64.tar.gz"}
+		]},
+		{"tag_name": "v1.1.0"}
+	]`)
+
+	release, err := LatestRelease("stable", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.2.0", release.TagName)
+	assert.Equal(t, "https://example.com/ploy-linux-amd64.tar.gz", getAssetURL(release, "ploy-linux-amd64.tar.gz"))
+	assert.Equal(t, "", getAssetURL(release, "ploy-linux-arm64.tar.gz"))
+
+	release, err = LatestRelease("beta", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.3.0-beta.1", release.TagName)
+
+	_, err = LatestRelease("nightly", false)
+	assert.EqualError(t, err, `unknown update channel "nightly" (use stable or beta)`)
+}
+
+func TestReleaseCache(t *testing.T) {
+	requests := serveReleases(t, `[{"tag_name": "v1.0.1"}]`)
+
+	for i := 0; i < 3; i++ {
+		_, _, err := CheckForUpdates("stable")
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, *requests)
+	assert.False(t, ReleaseRefreshDue())
+
+	// A fresh lookup bypasses the cache, and an expired cache is refreshed
+	_, err := LatestRelease("stable", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, *requests)
+
+	oldTTL := ReleaseCacheTTL
+	ReleaseCacheTTL = 0
+	defer func() { ReleaseCacheTTL = oldTTL }()
+	assert.True(t, ReleaseRefreshDue())
+	_, _, err = CheckForUpdates("stable")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, *requests)
+}
+
+func TestReleaseRefreshBacksOff(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{
-			"tag_name": "v1.0.1",
-			"assets": [
-				{
-					"name": "ploy-linux-amd64.tar.gz",
-					"browser_download_url": "https://example.com/ploy-linux-amd64.tar.gz"
-				}
-			]
-		}`))
+		http.Error(w, "rate limited", http.StatusForbidden)
+	}))
+	defer server.Close()
+	useReleaseServer(t, server.URL+"/releases")
+	assert.True(t, ReleaseRefreshDue())
+
+	// A failed lookup is not retried in the background until the TTL passed
+	_, err := LatestRelease("stable", true)
+	assert.Error(t, err)
+	assert.False(t, ReleaseRefreshDue())
+
+	oldTTL := ReleaseCacheTTL
+	ReleaseCacheTTL = 0
+	defer func() { ReleaseCacheTTL = oldTTL }()
+	assert.True(t, ReleaseRefreshDue())
+}
+
+func TestFindRelease(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/releases":
+			w.Write([]byte(`[{"tag_name": "v1.2.0"}, {"tag_name": "v1.1.0"}]`))
+		case "/releases/tags/v0.4.0":
+			w.Write([]byte(`{"tag_name": "v0.4.0"}`))
+		default:
+			http.NotFound(w, r)
+		}
 	}))
 	defer server.Close()
+	useReleaseServer(t, server.URL+"/releases")
 
-	oldReleaseEndpoint := ReleaseEndpoint
-	ReleaseEndpoint = server.URL
-	defer func() { ReleaseEndpoint = oldReleaseEndpoint }()
+	release, err := FindRelease("1.1.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", release.TagName)
 
-	release, err := getLatestRelease()
+	// Releases beyond the listed ones are looked up by tag
+	release, err = FindRelease("v0.4.0")
 	assert.NoError(t, err)
-	assert.Equal(t, "v1.0.1", release.TagName)
-	assert.Len(t, release.Assets, 1)
-	assert.Equal(t, "ploy-linux-amd64.tar.gz", release.Assets[0].Name)
+	assert.Equal(t, "v0.4.0", release.TagName)
+
+	_, err = FindRelease("0.3.0")
+	assert.ErrorIs(t, err, ErrReleaseNotFound)
+
+	_, err = FindRelease("latest")
+	assert.EqualError(t, err, `invalid version "latest"`)
+}
+
+func TestUpdateNotice(t *testing.T) {
+	requests := serveReleases(t, `[{"tag_name": "v1.0.1"}]`)
+
+	// Nothing is cached yet and the notice never asks GitHub
+	assert.Equal(t, "", UpdateNotice("stable"))
+	assert.Equal(t, 0, *requests)
+
+	_, err := LatestRelease("stable", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "A new version of ploy is available: v1.0.1 (running 0.5.9). Run 'sudo ploy update' to install it.",
+		UpdateNotice("stable"))
+
+	// Shown at most once a day, also after the cache is refreshed
+	assert.Equal(t, "", UpdateNotice("stable"))
+	_, err = LatestRelease("stable", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "", UpdateNotice("stable"))
+
+	cache := loadReleaseCache()
+	cache.NotifiedAt = time.Now().Add(-NoticeInterval)
+	saveReleaseCache(cache)
+	assert.NotEqual(t, "", UpdateNotice("stable"))
 }
 
-// Add more tests for SelfUpdate and getAssetURL functions
+// releaseServer serves a signed release the way GitHub does, with assets that
+// tests can tamper with
+type releaseServer struct {
+	*httptest.Server
+	assets map[string][]byte
+}
+
+func newTarGz(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		assert.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func setupUpdateTest(t *testing.T, tag string) (*releaseServer, *GitRelease, string) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	archive := newTarGz(t, map[string]string{"build/ploy-linux-amd64": "new binary"})
+	sum := sha256.Sum256(archive)
+	checksums := []byte(fmt.Sprintf("%x  ploy-linux-amd64.tar.gz\n%x  ploy-linux-arm64.tar.gz\n", sum, sha256.Sum256(nil)))
+	server := &releaseServer{assets: map[string][]byte{
+		"ploy-linux-amd64.tar.gz": archive,
+		ChecksumsAsset:            checksums,
+		SignatureAsset:            []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, checksums)) + "\n"),
+	}}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/releases" {
+			fmt.Fprintf(w, `[{"tag_name": %q, "assets": [`, tag)
+			first := true
+			for name := range server.assets {
+				if !first {
+					fmt.Fprint(w, ",")
+				}
+				first = false
+				fmt.Fprintf(w, `{"name": %q, "browser_download_url": "%s/download/%s"}`, name, server.URL, name)
+			}
+			fmt.Fprint(w, "]}]")
+			return
+		}
+		content, ok := server.assets[filepath.Base(r.URL.Path)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+
+	exe := filepath.Join(t.TempDir(), "ploy")
+	assert.NoError(t, os.WriteFile(exe, []byte("old binary"), 0755))
+
+	useReleaseServer(t, server.URL+"/releases")
+	oldKey, oldExecutable, oldOS, oldArch := UpdatePublicKey, executablePath, goos, goarch
+	UpdatePublicKey = base64.StdEncoding.EncodeToString(publicKey)
+	executablePath = func() (string, error) { return exe, nil }
+	goos, goarch = "linux", "amd64"
+	t.Cleanup(func() {
+		server.Close()
+		UpdatePublicKey, executablePath, goos, goarch = oldKey, oldExecutable, oldOS, oldArch
+	})
+	release, err := LatestRelease("beta", true)
+	assert.NoError(t, err)
+	return server, release, exe
+}
+
+func assertFileContent(t *testing.T, path, content string) {
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(data))
+}
+
+func TestSelfUpdateAndRollback(t *testing.T) {
+	_, release, exe := setupUpdateTest(t, "v1.0.0")
+
+	assert.NoError(t, SelfUpdate(release))
+	assertFileContent(t, exe, "new binary")
+	assertFileContent(t, exe+PreviousSuffix, "old binary")
+	info, err := os.Stat(exe)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	// Rolling back twice returns to the update
+	assert.NoError(t, Rollback())
+	assertFileContent(t, exe, "old binary")
+	assertFileContent(t, exe+PreviousSuffix, "new binary")
+	assert.NoError(t, Rollback())
+	assertFileContent(t, exe, "new binary")
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(filepath.Dir(exe))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestSelfUpdateRejectsTampering(t *testing.T) {
+	server, release, exe := setupUpdateTest(t, "v1.0.0")
+	archive := server.assets["ploy-linux-amd64.tar.gz"]
+
+	// An archive that does not match the signed checksums
+	server.assets["ploy-linux-amd64.tar.gz"] = newTarGz(t, map[string]string{"build/ploy-linux-amd64": "evil binary"})
+	err := SelfUpdate(release)
+	assert.ErrorContains(t, err, "checksum mismatch for ploy-linux-amd64.tar.gz")
+
+	// Checksums edited without a new signature
+	server.assets["ploy-linux-amd64.tar.gz"] = archive
+	server.assets[ChecksumsAsset] = append([]byte("0000  other.tar.gz\n"), server.assets[ChecksumsAsset]...)
+	err = SelfUpdate(release)
+	assert.EqualError(t, err, "the signature of checksums.txt is invalid")
+
+	// A signature by another key
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	server.assets[SignatureAsset] = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(otherKey, server.assets[ChecksumsAsset])))
+	err = SelfUpdate(release)
+	assert.EqualError(t, err, "the signature of checksums.txt is invalid")
+
+	// A release without a signature
+	delete(server.assets, SignatureAsset)
+	release, err = LatestRelease("stable", true)
+	assert.NoError(t, err)
+	err = SelfUpdate(release)
+	assert.EqualError(t, err, "release v1.0.0 has no checksums.txt.sig")
+
+	assertFileContent(t, exe, "old binary")
+	assert.NoFileExists(t, exe+PreviousSuffix)
+}
+
+func TestSelfUpdateRefusals(t *testing.T) {
+	_, release, exe := setupUpdateTest(t, "v0.5.0")
+
+	UpdatePublicKey = ""
+	err := SelfUpdate(release)
+	assert.ErrorContains(t, err, "no release signing key")
+
+	assert.ErrorContains(t, Rollback(), "no previous version to roll back to")
+	assertFileContent(t, exe, "old binary")
+}
+
+func TestSelfUpdateDowngrades(t *testing.T) {
+	_, release, exe := setupUpdateTest(t, "v0.5.0")
+
+	// An older release than the running 0.5.9 is installed as asked
+	assert.NoError(t, SelfUpdate(release))
+	assertFileContent(t, exe, "new binary")
+}
+
+func TestExtractFile(t *testing.T) {
+	archive := newTarGz(t, map[string]string{"./build/ploy-linux-arm64": "arm binary", "README.md": "docs"})
+
+	content, err := extractFile(archive, "build/ploy-linux-arm64")
+	assert.NoError(t, err)
+	assert.Equal(t, "arm binary", string(content))
+
+	_, err = extractFile(archive, "build/ploy-linux-amd64")
+	assert.EqualError(t, err, "the archive has no build/ploy-linux-amd64")
+
+	_, err = extractFile([]byte("not an archive"), "build/ploy-linux-amd64")
+	assert.ErrorContains(t, err, "reading archive")
+}